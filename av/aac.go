@@ -0,0 +1,75 @@
+package av
+
+import "errors"
+
+var ErrADTS = errors.New("av: bad adts header")
+
+// SampleRates is the MPEG-4 sampling frequency table indexed by
+// sampling_frequency_index
+var SampleRates = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// AACFrameSize is the number of PCM samples in one AAC access unit
+const AACFrameSize = 1024
+
+// ADTS is a parsed ADTS frame header
+type ADTS struct {
+	Profile    int // audio object type - 1
+	RateIndex  int
+	Channels   int
+	HeaderLen  int
+	FrameLen   int // including the header
+	SampleRate int
+}
+
+// ParseADTS parses the ADTS header at the start of b
+func ParseADTS(b []byte) (h ADTS, err error) {
+	if len(b) < 7 || b[0] != 0xff || b[1]&0xf0 != 0xf0 {
+		return h, ErrADTS
+	}
+	h.HeaderLen = 7
+	if b[1]&1 == 0 {
+		h.HeaderLen = 9 // crc present
+	}
+	h.Profile = int(b[2] >> 6)
+	h.RateIndex = int(b[2]>>2) & 0xf
+	h.Channels = int(b[2]&1)<<2 | int(b[3]>>6)
+	h.FrameLen = int(b[3]&3)<<11 | int(b[4])<<3 | int(b[5]>>5)
+	if h.RateIndex >= len(SampleRates) || h.FrameLen < h.HeaderLen {
+		return h, ErrADTS
+	}
+	h.SampleRate = SampleRates[h.RateIndex]
+	return h, nil
+}
+
+// Config returns the two byte AudioSpecificConfig equivalent to the header
+func (h ADTS) Config() []byte {
+	return AACConfig(h.Profile+1, h.RateIndex, h.Channels)
+}
+
+// AACConfig builds a two byte AudioSpecificConfig
+func AACConfig(objtype, rateindex, channels int) []byte {
+	return []byte{
+		byte(objtype<<3 | rateindex>>1),
+		byte(rateindex<<7 | channels<<3),
+	}
+}
+
+// ParseAACConfig parses an AudioSpecificConfig, returning the audio object
+// type, sample rate and channel configuration
+func ParseAACConfig(b []byte) (objtype, rate, channels int, err error) {
+	r := &bits{b: b}
+	objtype = int(r.u(5))
+	if objtype == 31 {
+		objtype = 32 + int(r.u(6))
+	}
+	if i := int(r.u(4)); i == 15 {
+		rate = int(r.u(24))
+	} else if i < len(SampleRates) {
+		rate = SampleRates[i]
+	}
+	channels = int(r.u(4))
+	if r.err != nil || rate == 0 {
+		return objtype, rate, channels, ErrConfig
+	}
+	return objtype, rate, channels, nil
+}
@@ -0,0 +1,329 @@
+// Package av defines the container-independent tracks and samples that
+// flow between the demuxers and muxers used by hlscat, and the bitstream
+// parsers needed to describe them (H.264, H.265 and AAC).
+package av
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Kind is the type of media carried by a track
+type Kind int
+
+const (
+	Video Kind = iota + 1
+	Audio
+	Text
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Video:
+		return "video"
+	case Audio:
+		return "audio"
+	case Text:
+		return "text"
+	}
+	return "unknown"
+}
+
+// Track describes one elementary stream. Config holds the codec
+// configuration record in its mp4 form: an avcC or hvcC payload for video
+// and an AudioSpecificConfig for AAC. Text tracks carry WebVTT: their
+// Config is the file header and each sample is a cue sample in its mp4
+// form (ISO/IEC 14496-30).
+type Track struct {
+	ID        int
+	Kind      Kind
+	Codec     string // h264, h265, aac, wvtt
+	Timescale int
+
+	Width, Height        int
+	SampleRate, Channels int
+
+	// Lang is the track's language, as an ISO 639-2 code or a BCP 47
+	// tag (see Lang3), Name its title, and Default whether it's the
+	// track of its kind that's played unless another is chosen
+	Lang    string
+	Name    string
+	Default bool
+
+	Config []byte
+}
+
+// Sample is one access unit. Timestamps and durations are in the track's
+// timescale. Video data is a sequence of 4-byte length-prefixed NAL units
+// and audio data is a raw (unframed) access unit.
+type Sample struct {
+	Track    int
+	DTS, PTS int64
+	Dur      int64
+	Key      bool
+	Data     []byte
+}
+
+// Demuxer produces samples from a container. Tracks returns the tracks
+// discovered so far; a track's Config is set before its first sample is
+// returned by ReadSample.
+type Demuxer interface {
+	Tracks() []*Track
+	ReadSample() (Sample, error)
+}
+
+// Muxer writes samples into a container. WriteHeader is called once before
+// any samples, and Close flushes buffered samples without closing the
+// underlying writer.
+type Muxer interface {
+	WriteHeader(t ...*Track) error
+	WriteSample(s Sample) error
+	Close() error
+}
+
+// ErrNoTracks is returned by Copy and Merge when the sources end before
+// any track could be configured
+var ErrNoTracks = errors.New("av: no usable tracks")
+
+// Preroll is the number of samples buffered from each source while
+// waiting for every track in it to become configured
+var Preroll = 1024
+
+// MaxSkew is the largest difference, in seconds, between the start times of
+// two merged sources that is treated as an intentional offset. Sources further apart
+// than this are assumed to have unrelated clocks and start together.
+var MaxSkew = int64(1)
+
+// Copy remuxes every sample from src into dst. It buffers samples until
+// each track reported by src is configured, writes the header, and then
+// streams the samples with timestamps rebased so the output starts at zero.
+func Copy(dst Muxer, src Demuxer) error {
+	return Merge(dst, nil, src)
+}
+
+// Merge is like Copy, but interleaves the samples of several sources by
+// decode time. Keep selects the tracks taken from each source, where n is
+// the index of the source in src; a nil keep takes every track. Tracks are
+// renumbered in the output.
+func Merge(dst Muxer, keep func(n int, t *Track) bool, src ...Demuxer) error {
+	if keep == nil {
+		keep = func(int, *Track) bool { return true }
+	}
+	in := make([]*input, len(src))
+	for n, d := range src {
+		in[n] = &input{Demuxer: d, seen: map[int]bool{}, ids: map[int]*Track{}}
+		if err := in[n].preroll(func(t *Track) bool { return keep(n, t) }); err != nil {
+			return err
+		}
+	}
+
+	var tracks []*Track
+	for n, in := range in {
+		for _, t := range in.Tracks() {
+			if !in.seen[t.ID] || !keep(n, t) {
+				continue
+			}
+			out := *t
+			out.ID = len(tracks) + 1
+			in.ids[t.ID] = &out
+			tracks = append(tracks, &out)
+		}
+	}
+	if len(tracks) == 0 {
+		return ErrNoTracks
+	}
+	if err := dst.WriteHeader(tracks...); err != nil {
+		return err
+	}
+
+	// sources that start close together keep their relative offset,
+	// otherwise they are aligned at zero independently
+	var first *input
+	for _, in := range in {
+		in.start()
+		if in.scale != 0 && (first == nil || in.before(first.ticks, first.scale)) {
+			first = in
+		}
+	}
+	for _, in := range in {
+		if first != nil && in.scale != 0 && (in.ticks*first.scale-first.ticks*in.scale) <= MaxSkew*in.scale*first.scale {
+			in.ticks, in.scale = first.ticks, first.scale
+		}
+	}
+
+	for {
+		var next *input
+		for _, in := range in {
+			if !in.peek() {
+				continue
+			}
+			if next == nil || in.before(next.head.DTS, int64(next.ids[next.head.Track].Timescale)) {
+				next = in
+			}
+		}
+		if next == nil {
+			break
+		}
+		t := next.ids[next.head.Track]
+		s := next.head
+		next.ok = false
+		d := Rescale(next.ticks, next.scale, int64(t.Timescale))
+		s.Track, s.DTS, s.PTS = t.ID, s.DTS-d, s.PTS-d
+		if err := dst.WriteSample(s); err != nil {
+			return err
+		}
+	}
+	for _, in := range in {
+		if in.err != io.EOF {
+			return in.err
+		}
+	}
+	return dst.Close()
+}
+
+// input is one source being merged
+type input struct {
+	Demuxer
+	pre  []Sample
+	seen map[int]bool
+	ids  map[int]*Track // source track id to output track
+	err  error
+
+	head Sample
+	ok   bool
+
+	// origin of the source: its earliest decode time
+	ticks, scale int64
+}
+
+func (in *input) preroll(keep func(t *Track) bool) error {
+	ready := func() bool {
+		n := 0
+		for _, t := range in.Tracks() {
+			if keep(t) {
+				if !in.seen[t.ID] {
+					return false
+				}
+				n++
+			}
+		}
+		return n > 0
+	}
+	for len(in.pre) < Preroll && !ready() {
+		s, err := in.ReadSample()
+		if err != nil {
+			in.err = err
+			break
+		}
+		in.seen[s.Track] = true
+		in.pre = append(in.pre, s)
+	}
+	if in.err != nil && in.err != io.EOF {
+		return in.err
+	}
+	return nil
+}
+
+func (in *input) start() {
+	for _, s := range in.pre {
+		t := in.ids[s.Track]
+		if t == nil {
+			continue
+		}
+		if ts := int64(t.Timescale); in.scale == 0 || s.DTS*in.scale < in.ticks*ts {
+			in.ticks, in.scale = s.DTS, ts
+		}
+	}
+}
+
+// before returns true if the input's current time, its head sample or its
+// origin, is earlier than ticks/scale
+func (in *input) before(ticks, scale int64) bool {
+	t, ts := in.ticks, in.scale
+	if in.ok {
+		t, ts = in.head.DTS, int64(in.ids[in.head.Track].Timescale)
+	}
+	return t*scale < ticks*ts
+}
+
+// peek loads the next sample belonging to an output track into head
+func (in *input) peek() bool {
+	for !in.ok {
+		if len(in.pre) > 0 {
+			in.head, in.pre = in.pre[0], in.pre[1:]
+		} else if in.err != nil {
+			return false
+		} else if in.head, in.err = in.ReadSample(); in.err != nil {
+			return false
+		}
+		in.ok = in.ids[in.head.Track] != nil
+	}
+	return true
+}
+
+// Rescale converts t from timescale 'from' to timescale 'to'
+func Rescale(t, from, to int64) int64 {
+	if from == to || from == 0 {
+		return t
+	}
+	return t * to / from
+}
+
+// Params returns the video parameter sets in the track's Config in
+// decoding order, or nil if it is not a video track
+func (t *Track) Params() (nal [][]byte) {
+	switch t.Codec {
+	case "h264":
+		sps, pps, _ := AVCParams(t.Config)
+		return append(sps, pps...)
+	case "h265":
+		vps, sps, pps, _ := HEVCParams(t.Config)
+		return append(append(vps, sps...), pps...)
+	}
+	return nil
+}
+
+// Codecs returns the track's codec in the form used by the CODECS
+// attribute of hls and the codecs attribute of dash (RFC 6381), or
+// the empty string if the Config can't describe it
+func (t *Track) Codecs() string {
+	c := t.Config
+	switch t.Codec {
+	case "h264":
+		if len(c) < 4 {
+			return ""
+		}
+		return fmt.Sprintf("avc1.%02x%02x%02x", c[1], c[2], c[3])
+	case "h265":
+		if len(c) < 13 {
+			return ""
+		}
+		space := []string{"", "A", "B", "C"}[c[1]>>6]
+		tier := "L"
+		if c[1]&0x20 != 0 {
+			tier = "H"
+		}
+		flags, compat := binary.BigEndian.Uint32(c[2:6]), uint32(0)
+		for i := 0; i < 32; i++ {
+			compat = compat<<1 | flags>>i&1 // written in reverse
+		}
+		s := fmt.Sprintf("hvc1.%s%d.%X.%s%d", space, c[1]&0x1f, compat, tier, c[12])
+		con := c[6:12]
+		for len(con) > 0 && con[len(con)-1] == 0 {
+			con = con[:len(con)-1]
+		}
+		for _, b := range con {
+			s += fmt.Sprintf(".%X", b)
+		}
+		return s
+	case "aac":
+		obj, _, _, err := ParseAACConfig(c)
+		if err != nil {
+			return "mp4a.40.2"
+		}
+		return fmt.Sprintf("mp4a.40.%d", obj)
+	}
+	return ""
+}
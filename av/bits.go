@@ -0,0 +1,79 @@
+package av
+
+import "errors"
+
+var ErrShort = errors.New("av: bitstream too short")
+
+// bits reads a big-endian bitstream, including the exp-golomb codes used
+// by the H.264 and H.265 parameter sets. Reading past the end sets err
+// and returns zeroes.
+type bits struct {
+	b   []byte
+	n   int // bit offset
+	err error
+}
+
+func (r *bits) u(n int) (v uint32) {
+	for ; n > 0; n-- {
+		if r.n >= len(r.b)*8 {
+			r.err = ErrShort
+			return 0
+		}
+		v = v<<1 | uint32(r.b[r.n/8]>>(7-r.n%8))&1
+		r.n++
+	}
+	return v
+}
+
+func (r *bits) flag() bool {
+	return r.u(1) == 1
+}
+
+func (r *bits) skip(n int) {
+	for ; n > 32; n -= 32 {
+		r.u(32)
+	}
+	r.u(n)
+}
+
+// ue reads an unsigned exp-golomb code
+func (r *bits) ue() uint32 {
+	zeros := 0
+	for r.u(1) == 0 {
+		if r.err != nil || zeros > 31 {
+			r.err = ErrShort
+			return 0
+		}
+		zeros++
+	}
+	return 1<<zeros - 1 + r.u(zeros)
+}
+
+// se reads a signed exp-golomb code
+func (r *bits) se() int32 {
+	v := r.ue()
+	if v&1 == 1 {
+		return int32(v/2 + 1)
+	}
+	return -int32(v / 2)
+}
+
+// unescape removes emulation prevention bytes (00 00 03) from a NAL unit,
+// returning its raw byte sequence payload
+func unescape(nal []byte) []byte {
+	out := make([]byte, 0, len(nal))
+	zeros := 0
+	for _, c := range nal {
+		if zeros >= 2 && c == 3 {
+			zeros = 0
+			continue
+		}
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, c)
+	}
+	return out
+}
@@ -0,0 +1,302 @@
+package av
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// H.264 NAL unit types used by the muxers
+const (
+	H264Slice = 1
+	H264IDR   = 5
+	H264SEI   = 6
+	H264SPS   = 7
+	H264PPS   = 8
+	H264AUD   = 9
+)
+
+var ErrConfig = errors.New("av: bad decoder configuration")
+
+// SPS is the subset of a sequence parameter set needed to describe a
+// video track. Profile and Level are the raw profile_idc and level_idc.
+type SPS struct {
+	Profile, Compat, Level int
+	Tier                   int
+	Chroma                 int
+	BitDepth               int
+	BitDepthChroma         int
+	Width, Height          int
+	FPS                    float64
+
+	// H.265 only: the general profile_tier_level bytes and layer info
+	// copied into the hvcC record
+	ptl            []byte
+	sublayers      int
+	temporalnested bool
+}
+
+// SplitAnnexB splits an Annex B byte stream into NAL units, removing
+// the 3 or 4 byte start codes
+func SplitAnnexB(b []byte) (nal [][]byte) {
+	start := -1
+	for i := 0; i+2 < len(b); {
+		if b[i] != 0 || b[i+1] != 0 || b[i+2] != 1 {
+			i++
+			continue
+		}
+		if start >= 0 {
+			end := i
+			for end > start && b[end-1] == 0 {
+				end-- // trailing_zero_8bits and the 4-byte start code prefix
+			}
+			nal = append(nal, b[start:end])
+		}
+		i += 3
+		start = i
+	}
+	if start >= 0 && start < len(b) {
+		nal = append(nal, b[start:])
+	}
+	return nal
+}
+
+// JoinAVCC length-prefixes each NAL unit with a 4-byte size
+func JoinAVCC(nal ...[]byte) []byte {
+	n := 0
+	for _, v := range nal {
+		n += 4 + len(v)
+	}
+	out := make([]byte, 0, n)
+	for _, v := range nal {
+		out = binary.BigEndian.AppendUint32(out, uint32(len(v)))
+		out = append(out, v...)
+	}
+	return out
+}
+
+// SplitAVCC splits a buffer of 4-byte length-prefixed NAL units
+func SplitAVCC(b []byte) (nal [][]byte) {
+	for len(b) >= 4 {
+		n := int(binary.BigEndian.Uint32(b))
+		b = b[4:]
+		if n > len(b) {
+			n = len(b)
+		}
+		nal = append(nal, b[:n])
+		b = b[n:]
+	}
+	return nal
+}
+
+// JoinAnnexB joins NAL units with 4-byte start codes
+func JoinAnnexB(nal ...[]byte) []byte {
+	var out []byte
+	for _, v := range nal {
+		out = append(out, 0, 0, 0, 1)
+		out = append(out, v...)
+	}
+	return out
+}
+
+// ParseSPS parses an H.264 sequence parameter set NAL unit, including
+// its one byte header
+func ParseSPS(nal []byte) (s SPS, err error) {
+	if len(nal) < 4 {
+		return s, ErrShort
+	}
+	r := &bits{b: unescape(nal[1:])}
+	s.Profile = int(r.u(8))
+	s.Compat = int(r.u(8))
+	s.Level = int(r.u(8))
+	r.ue() // seq_parameter_set_id
+	s.Chroma, s.BitDepth, s.BitDepthChroma = 1, 8, 8
+	separate := false
+	switch s.Profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		s.Chroma = int(r.ue())
+		if s.Chroma == 3 {
+			separate = r.flag()
+		}
+		s.BitDepth = 8 + int(r.ue())
+		s.BitDepthChroma = 8 + int(r.ue())
+		r.flag() // qpprime_y_zero_transform_bypass_flag
+		if r.flag() {
+			n := 8
+			if s.Chroma == 3 {
+				n = 12
+			}
+			for i := 0; i < n; i++ {
+				if !r.flag() {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := int32(8), int32(8)
+				for j := 0; j < size; j++ {
+					if next != 0 {
+						next = (last + r.se() + 256) % 256
+					}
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+	r.ue() // log2_max_frame_num_minus4
+	switch r.ue() {
+	case 0:
+		r.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.flag()
+		r.se()
+		r.se()
+		for n := r.ue(); n > 0 && r.err == nil; n-- {
+			r.se()
+		}
+	}
+	r.ue()   // max_num_ref_frames
+	r.flag() // gaps_in_frame_num_value_allowed_flag
+	w := int(r.ue()) + 1
+	h := int(r.ue()) + 1
+	frameonly := r.flag()
+	if !frameonly {
+		r.flag() // mb_adaptive_frame_field_flag
+	}
+	r.flag() // direct_8x8_inference_flag
+	s.Width, s.Height = w*16, h*16
+	if !frameonly {
+		s.Height *= 2
+	}
+	if r.flag() {
+		cx, cy := 1, 1
+		if s.Chroma != 0 && !separate {
+			if s.Chroma != 3 {
+				cx = 2
+			}
+			if s.Chroma == 1 {
+				cy = 2
+			}
+		}
+		if !frameonly {
+			cy *= 2
+		}
+		l, rt, t, b := int(r.ue()), int(r.ue()), int(r.ue()), int(r.ue())
+		s.Width -= cx * (l + rt)
+		s.Height -= cy * (t + b)
+	}
+	if r.flag() {
+		s.FPS = vuiFPS(r, true)
+	}
+	if r.err != nil && s.Width == 0 {
+		return s, r.err
+	}
+	return s, nil
+}
+
+// vuiFPS reads the start of the VUI up to the timing info and returns the
+// frame rate, or zero if there is no timing info. The H.264 time_scale
+// counts fields, so half is true for it.
+func vuiFPS(r *bits, half bool) float64 {
+	if r.flag() { // aspect_ratio_info_present_flag
+		if r.u(8) == 255 {
+			r.skip(32)
+		}
+	}
+	if r.flag() { // overscan_info_present_flag
+		r.flag()
+	}
+	if r.flag() { // video_signal_type_present_flag
+		r.skip(4)
+		if r.flag() {
+			r.skip(24)
+		}
+	}
+	if r.flag() { // chroma_loc_info_present_flag
+		r.ue()
+		r.ue()
+	}
+	if !half {
+		r.skip(3) // neutral_chroma, field_seq, frame_field_info_present
+		if r.flag() {
+			r.ue() // default display window
+			r.ue()
+			r.ue()
+			r.ue()
+		}
+	}
+	if !r.flag() {
+		return 0
+	}
+	tick, scale := r.u(32), r.u(32)
+	if r.err != nil || tick == 0 {
+		return 0
+	}
+	if half {
+		return float64(scale) / float64(2*tick)
+	}
+	return float64(scale) / float64(tick)
+}
+
+// AVCConfig builds an AVCDecoderConfigurationRecord (avcC) from the
+// given parameter sets
+func AVCConfig(sps, pps [][]byte) ([]byte, error) {
+	if len(sps) == 0 || len(pps) == 0 || len(sps[0]) < 4 {
+		return nil, ErrConfig
+	}
+	s, err := ParseSPS(sps[0])
+	if err != nil {
+		return nil, err
+	}
+	b := []byte{1, sps[0][1], sps[0][2], sps[0][3], 0xff, 0xe0 | byte(len(sps))}
+	for _, v := range sps {
+		b = binary.BigEndian.AppendUint16(b, uint16(len(v)))
+		b = append(b, v...)
+	}
+	b = append(b, byte(len(pps)))
+	for _, v := range pps {
+		b = binary.BigEndian.AppendUint16(b, uint16(len(v)))
+		b = append(b, v...)
+	}
+	switch s.Profile {
+	case 100, 110, 122, 144:
+		b = append(b, 0xfc|byte(s.Chroma), 0xf8|byte(s.BitDepth-8), 0xf8|byte(s.BitDepthChroma-8), 0)
+	}
+	return b, nil
+}
+
+// AVCParams returns the parameter sets in an avcC record
+func AVCParams(config []byte) (sps, pps [][]byte, err error) {
+	if len(config) < 7 {
+		return nil, nil, ErrConfig
+	}
+	b := config[5:]
+	read := func(n int) (set [][]byte) {
+		for ; n > 0; n-- {
+			if len(b) < 2 {
+				err = ErrConfig
+				return set
+			}
+			m := int(b[0])<<8 | int(b[1])
+			if 2+m > len(b) {
+				err = ErrConfig
+				return set
+			}
+			set = append(set, b[2:2+m])
+			b = b[2+m:]
+		}
+		return set
+	}
+	n := int(b[0] & 0x1f)
+	b = b[1:]
+	sps = read(n)
+	if len(b) < 1 {
+		return sps, nil, ErrConfig
+	}
+	n = int(b[0])
+	b = b[1:]
+	pps = read(n)
+	return sps, pps, err
+}
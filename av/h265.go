@@ -0,0 +1,242 @@
+package av
+
+import "encoding/binary"
+
+// H.265 NAL unit types used by the muxers
+const (
+	HEVCBLA  = 16 // first random access point type
+	HEVCCRA  = 21 // last random access point type
+	HEVCVPS  = 32
+	HEVCSPS  = 33
+	HEVCPPS  = 34
+	HEVCAUD  = 35
+	HEVCSEI  = 39
+	HEVCSEI2 = 40
+)
+
+// HEVCType returns the nal_unit_type of an H.265 NAL unit
+func HEVCType(nal []byte) int {
+	if len(nal) == 0 {
+		return -1
+	}
+	return int(nal[0]>>1) & 0x3f
+}
+
+// ParseHEVCSPS parses an H.265 sequence parameter set NAL unit, including
+// its two byte header
+func ParseHEVCSPS(nal []byte) (s SPS, err error) {
+	if len(nal) < 16 {
+		return s, ErrShort
+	}
+	rbsp := unescape(nal[2:])
+	r := &bits{b: rbsp}
+	r.u(4) // sps_video_parameter_set_id
+	s.sublayers = int(r.u(3)) + 1
+	s.temporalnested = r.flag()
+	s.ptl = append([]byte{}, rbsp[1:13]...)
+	r.u(2)
+	s.Tier = int(r.u(1))
+	s.Profile = int(r.u(5))
+	s.Compat = int(r.u(32))
+	r.skip(48)
+	s.Level = int(r.u(8))
+	sub := make([][2]bool, s.sublayers-1)
+	for i := range sub {
+		sub[i] = [2]bool{r.flag(), r.flag()}
+	}
+	if len(sub) > 0 {
+		for i := len(sub); i < 8; i++ {
+			r.u(2)
+		}
+	}
+	for _, v := range sub {
+		if v[0] {
+			r.skip(88)
+		}
+		if v[1] {
+			r.u(8)
+		}
+	}
+	r.ue() // sps_seq_parameter_set_id
+	s.Chroma = int(r.ue())
+	separate := false
+	if s.Chroma == 3 {
+		separate = r.flag()
+	}
+	s.Width, s.Height = int(r.ue()), int(r.ue())
+	if r.flag() {
+		cx, cy := 1, 1
+		if !separate && s.Chroma == 1 {
+			cx, cy = 2, 2
+		} else if !separate && s.Chroma == 2 {
+			cx = 2
+		}
+		l, rt, t, b := int(r.ue()), int(r.ue()), int(r.ue()), int(r.ue())
+		s.Width -= cx * (l + rt)
+		s.Height -= cy * (t + b)
+	}
+	s.BitDepth = 8 + int(r.ue())
+	s.BitDepthChroma = 8 + int(r.ue())
+	if r.err != nil {
+		return s, r.err
+	}
+
+	// everything below is only needed to reach the VUI timing info
+	// so errors are not fatal
+	pocbits := int(r.ue()) + 4
+	i := s.sublayers - 1
+	if r.flag() {
+		i = 0
+	}
+	for ; i < s.sublayers; i++ {
+		r.ue()
+		r.ue()
+		r.ue()
+	}
+	for i := 0; i < 6; i++ {
+		r.ue() // coding block, transform block and hierarchy sizes
+	}
+	if r.flag() && r.flag() {
+		hevcScalingList(r)
+	}
+	r.flag() // amp_enabled_flag
+	r.flag() // sample_adaptive_offset_enabled_flag
+	if r.flag() {
+		r.skip(8)
+		r.ue()
+		r.ue()
+		r.flag()
+	}
+	hevcRefPicSets(r, int(r.ue()))
+	if r.flag() {
+		for n := r.ue(); n > 0 && r.err == nil; n-- {
+			r.skip(pocbits)
+			r.flag()
+		}
+	}
+	r.flag() // sps_temporal_mvp_enabled_flag
+	r.flag() // strong_intra_smoothing_enabled_flag
+	if r.flag() {
+		s.FPS = vuiFPS(r, false)
+	}
+	return s, nil
+}
+
+func hevcScalingList(r *bits) {
+	for size := 0; size < 4; size++ {
+		step := 1
+		if size == 3 {
+			step = 3
+		}
+		for m := 0; m < 6; m += step {
+			if !r.flag() {
+				r.ue()
+				continue
+			}
+			n := 1 << (4 + size<<1)
+			if n > 64 {
+				n = 64
+			}
+			if size > 1 {
+				r.se()
+			}
+			for i := 0; i < n && r.err == nil; i++ {
+				r.se()
+			}
+		}
+	}
+}
+
+func hevcRefPicSets(r *bits, n int) {
+	deltas := make([]int, n)
+	for idx := 0; idx < n && r.err == nil; idx++ {
+		if idx != 0 && r.flag() {
+			ref := idx - 1
+			if idx == n {
+				ref = idx - int(r.ue()) - 1
+			}
+			r.flag() // delta_rps_sign
+			r.ue()   // abs_delta_rps_minus1
+			count := 0
+			for j := 0; j <= deltas[ref]; j++ {
+				used := r.flag()
+				if used || r.flag() {
+					count++
+				}
+			}
+			deltas[idx] = count
+			continue
+		}
+		neg, pos := int(r.ue()), int(r.ue())
+		if neg+pos > 32 {
+			r.err = ErrShort
+			return
+		}
+		for j := 0; j < neg+pos; j++ {
+			r.ue()
+			r.flag()
+		}
+		deltas[idx] = neg + pos
+	}
+}
+
+// HEVCConfig builds an HEVCDecoderConfigurationRecord (hvcC) from the
+// given parameter sets
+func HEVCConfig(vps, sps, pps [][]byte) ([]byte, error) {
+	if len(vps) == 0 || len(sps) == 0 || len(pps) == 0 {
+		return nil, ErrConfig
+	}
+	s, err := ParseHEVCSPS(sps[0])
+	if err != nil {
+		return nil, err
+	}
+	b := append([]byte{1}, s.ptl...)
+	b = append(b, 0xf0, 0x00, 0xfc, 0xfc|byte(s.Chroma), 0xf8|byte(s.BitDepth-8), 0xf8|byte(s.BitDepthChroma-8), 0, 0)
+	flags := byte(s.sublayers)<<3 | 3
+	if s.temporalnested {
+		flags |= 1 << 2
+	}
+	b = append(b, flags, 3)
+	for i, set := range [][][]byte{vps, sps, pps} {
+		b = append(b, 0x80|byte(HEVCVPS+i))
+		b = binary.BigEndian.AppendUint16(b, uint16(len(set)))
+		for _, v := range set {
+			b = binary.BigEndian.AppendUint16(b, uint16(len(v)))
+			b = append(b, v...)
+		}
+	}
+	return b, nil
+}
+
+// HEVCParams returns the parameter sets in an hvcC record
+func HEVCParams(config []byte) (vps, sps, pps [][]byte, err error) {
+	if len(config) < 23 {
+		return nil, nil, nil, ErrConfig
+	}
+	b := config[23:]
+	for n := int(config[22]); n > 0; n-- {
+		if len(b) < 3 {
+			return vps, sps, pps, ErrConfig
+		}
+		typ := int(b[0] & 0x3f)
+		m := int(b[1])<<8 | int(b[2])
+		b = b[3:]
+		for ; m > 0; m-- {
+			if len(b) < 2 || 2+(int(b[0])<<8|int(b[1])) > len(b) {
+				return vps, sps, pps, ErrConfig
+			}
+			size := int(b[0])<<8 | int(b[1])
+			nal := b[2 : 2+size]
+			b = b[2+size:]
+			switch typ {
+			case HEVCVPS:
+				vps = append(vps, nal)
+			case HEVCSPS:
+				sps = append(sps, nal)
+			case HEVCPPS:
+				pps = append(pps, nal)
+			}
+		}
+	}
+	return vps, sps, pps, nil
+}
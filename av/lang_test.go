@@ -0,0 +1,32 @@
+package av
+
+import "testing"
+
+func TestLang3(t *testing.T) {
+	for _, tc := range []struct{ tag, want string }{
+		{"en", "eng"},
+		{"en-US", "eng"},
+		{"pt_BR", "por"},
+		{"lb", "ltz"},
+		{"mt", "mlt"},
+		{"af", "afr"},
+		{"be", "bel"},
+		{"bs", "bos"},
+		{"la", "lat"},
+		{"az", "aze"},
+		{"am", "amh"},
+		{"iw", "heb"},
+		{"fre", "fra"},
+		{"GER", "deu"},
+		{"spa", "spa"},
+		{"yue", "yue"},
+		{"x", "und"},
+		{"", "und"},
+		{"tlh-x-qo", "tlh"},
+		{"zz", "und"},
+	} {
+		if got := Lang3(tc.tag); got != tc.want {
+			t.Errorf("Lang3(%q) = %q, want %q", tc.tag, got, tc.want)
+		}
+	}
+}
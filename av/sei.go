@@ -0,0 +1,71 @@
+package av
+
+// SEI payload type of registered user data (ITU-T T.35), which carries
+// the closed captions of ATSC A/53
+const seiUserData = 4
+
+// CCData returns the closed caption data in the SEI of a video sample of
+// the given codec: the cc_data of each ATSC A/53 (GA94) message, as
+// triplets of a cc_valid and cc_type byte and a pair of caption bytes.
+func CCData(codec string, sample []byte) (cc []byte) {
+	for _, nal := range SplitAVCC(sample) {
+		var rbsp []byte
+		switch {
+		case codec == "h264" && len(nal) > 1 && nal[0]&0x1f == H264SEI:
+			rbsp = unescape(nal[1:])
+		case codec == "h265" && len(nal) > 2 && HEVCType(nal) == HEVCSEI:
+			rbsp = unescape(nal[2:])
+		default:
+			continue
+		}
+		for len(rbsp) > 2 {
+			typ, size := 0, 0
+			for len(rbsp) > 0 && rbsp[0] == 0xff {
+				typ += 255
+				rbsp = rbsp[1:]
+			}
+			if len(rbsp) == 0 {
+				break
+			}
+			typ += int(rbsp[0])
+			rbsp = rbsp[1:]
+			for len(rbsp) > 0 && rbsp[0] == 0xff {
+				size += 255
+				rbsp = rbsp[1:]
+			}
+			if len(rbsp) == 0 {
+				break
+			}
+			size += int(rbsp[0])
+			rbsp = rbsp[1:]
+			if size > len(rbsp) {
+				break
+			}
+			if typ == seiUserData {
+				cc = append(cc, a53(rbsp[:size])...)
+			}
+			rbsp = rbsp[size:]
+		}
+	}
+	return cc
+}
+
+// a53 returns the cc_data triplets in a registered user data message
+// with the GA94 identifier
+func a53(p []byte) (cc []byte) {
+	// country code (united states), provider code (atsc), user identifier
+	// and user_data_type_code (cc_data)
+	if len(p) < 10 || p[0] != 0xb5 || p[1] != 0 || p[2] != 0x31 || string(p[3:7]) != "GA94" || p[7] != 3 {
+		return nil
+	}
+	if p[8]&0x40 == 0 {
+		return nil // process_cc_data_flag
+	}
+	n := int(p[8] & 0x1f)
+	p = p[10:] // and em_data
+	for i := 0; i < n && len(p) >= 3; i++ {
+		cc = append(cc, p[:3]...)
+		p = p[3:]
+	}
+	return cc
+}
@@ -0,0 +1,49 @@
+package av
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// avcc prefixes each nal unit with its length
+func avcc(nal ...[]byte) (b []byte) {
+	for _, n := range nal {
+		b = binary.BigEndian.AppendUint32(b, uint32(len(n)))
+		b = append(b, n...)
+	}
+	return b
+}
+
+// ga94 returns a registered user data sei message with the cc_data
+// triplets, without emulation prevention
+func ga94(cc ...byte) []byte {
+	p := []byte{0xb5, 0, 0x31, 'G', 'A', '9', '4', 3, 0x40 | byte(len(cc)/3), 0xff}
+	p = append(append(p, cc...), 0xff)
+	return append([]byte{seiUserData, byte(len(p))}, p...)
+}
+
+func TestCCData(t *testing.T) {
+	cc := []byte{0xfc, 0x94, 0x20, 0xfc, 0x00, 0x00, 0x03, 0x11, 0x22}
+	// the second and third triplets need emulation prevention
+	escaped := bytes.Replace(ga94(cc...), []byte{0, 0, 3}, []byte{0, 0, 3, 3}, 1)
+	unregistered := append([]byte{5, 17}, make([]byte, 17)...)
+	other := []byte{4, 9, 0xb5, 0, 0x31, 'D', 'T', 'G', '1', 0x41, 0xff}
+	for _, tc := range []struct {
+		name   string
+		codec  string
+		sample []byte
+		want   []byte
+	}{
+		{"h264", "h264", avcc([]byte{0x09, 0xf0}, append(append([]byte{0x06}, escaped...), 0x80), []byte{0x65, 0x88}), cc},
+		{"h265", "h265", avcc([]byte{0x46, 0x01, 0x50}, append(append([]byte{0x4e, 0x01}, escaped...), 0x80)), cc},
+		{"several messages", "h264", avcc(append(append(append([]byte{0x06}, unregistered...), ga94(cc[:3]...)...), 0x80)), cc[:3]},
+		{"other user data", "h264", avcc(append(append([]byte{0x06}, other...), 0x80)), nil},
+		{"h264 sei as h265", "h265", avcc(append(append([]byte{0x06}, ga94(cc[:3]...)...), 0x80)), nil},
+		{"truncated", "h264", avcc(append([]byte{0x06}, ga94(cc...)[:8]...)), nil},
+	} {
+		if got := CCData(tc.codec, tc.sample); !bytes.Equal(got, tc.want) {
+			t.Errorf("%s: cc_data %x, want %x", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+// Package cc decodes CEA-608 and CEA-708 closed captions, as carried in
+// the cc_data of ATSC A/53 (see av.CCData), into cues
+package cc
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/as/hlscat/vtt"
+)
+
+var ErrChannel = errors.New("cc: bad caption channel")
+
+// Decoder decodes the captions of one channel into cues. A cue is the
+// text on the screen between two changes to it. Times are in
+// milliseconds.
+type Decoder struct {
+	dec      decoder
+	shown    string // the text on the screen
+	since    int64  // and since when
+	painting bool   // whether text is being painted on the screen
+	paint    int64  // and since when
+	cues     []vtt.Cue
+}
+
+// decoder is the decoder of a caption standard
+type decoder interface {
+	// decode decodes a pair of caption bytes of cc_type typ, calling
+	// commit whenever the screen might have changed
+	decode(typ, b1, b2 byte, commit func())
+
+	// screen returns the text on the screen
+	screen() string
+
+	// painted reports whether text was written straight to the screen
+	// since the last commit, as in roll-up or paint-on captions
+	painted() bool
+}
+
+// NewDecoder returns a decoder for the caption channel, which is CC1 to
+// CC4 for CEA-608 or SERVICE1 to SERVICE63 for CEA-708
+func NewDecoder(channel string) (*Decoder, error) {
+	ch := strings.ToUpper(channel)
+	if n, ok := number(ch, "CC"); ok && n >= 1 && n <= 4 {
+		return &Decoder{dec: new608(n)}, nil
+	}
+	if n, ok := number(ch, "SERVICE"); ok && n >= 1 && n <= 63 {
+		return &Decoder{dec: new708(n)}, nil
+	}
+	return nil, ErrChannel
+}
+
+func number(s, prefix string) (int, bool) {
+	v, ok := strings.CutPrefix(s, prefix)
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.Atoi(v)
+	return n, err == nil
+}
+
+// Decode decodes cc_data triplets presented at time t
+func (d *Decoder) Decode(t int64, cc []byte) {
+	for ; len(cc) >= 3; cc = cc[3:] {
+		if cc[0]&4 == 0 {
+			continue // cc_valid
+		}
+		d.dec.decode(cc[0]&3, cc[1], cc[2], func() { d.commit(t) })
+		if !d.painting && d.dec.painted() {
+			d.painting, d.paint = true, t
+		}
+	}
+}
+
+// Flush ends the cue on the screen at time t, along with any text
+// painted on it since the last change. Text that's replaced at the time
+// it's shown is dropped.
+func (d *Decoder) Flush(t int64) {
+	if d.painting {
+		d.commit(t)
+	}
+	if d.shown != "" && t > d.since {
+		d.cues = append(d.cues, vtt.Cue{Start: d.since, End: t, Text: d.shown})
+	}
+	d.shown, d.since = "", t
+}
+
+// Cues returns the cues that ended since it was last called
+func (d *Decoder) Cues() []vtt.Cue {
+	c := d.cues
+	d.cues = nil
+	return c
+}
+
+// commit starts a new cue at time t if the screen changed. Text painted
+// on the screen is shown from when it was painted.
+func (d *Decoder) commit(t int64) {
+	if d.painting && d.dec.painted() {
+		t = max(d.paint, d.since)
+	}
+	d.painting = false
+	if s := d.dec.screen(); s != d.shown {
+		d.Flush(t)
+		d.shown = s
+	}
+}
+
+// grid is a screen of character cells
+type grid [][]rune
+
+func newGrid(rows, cols int) grid {
+	g := make(grid, rows)
+	for i := range g {
+		g[i] = make([]rune, cols)
+	}
+	return g
+}
+
+func (g grid) clear() {
+	for _, row := range g {
+		clear(row)
+	}
+}
+
+// text returns the rows of g that aren't blank
+func (g grid) text() string {
+	var lines []string
+	for _, row := range g {
+		line := strings.TrimSpace(strings.Map(func(r rune) rune {
+			if r == 0 {
+				return ' '
+			}
+			return r
+		}, string(row)))
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
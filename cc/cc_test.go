@@ -0,0 +1,259 @@
+package cc
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/as/hlscat/vtt"
+)
+
+// step is cc_data presented at time t
+type step struct {
+	t  int64
+	cc []byte
+}
+
+// f1 and f2 return cc_data triplets of the first and second field for
+// byte pairs
+func f1(pair ...byte) []byte { return triplets(0, pair) }
+func f2(pair ...byte) []byte { return triplets(1, pair) }
+
+func triplets(typ byte, pair []byte) (cc []byte) {
+	for i := 0; i+1 < len(pair); i += 2 {
+		cc = append(cc, 0xfc|typ, pair[i], pair[i+1])
+	}
+	return cc
+}
+
+// text returns the byte pairs of the characters in s
+func text(s string) []byte {
+	if len(s)%2 == 1 {
+		s += "\x00"
+	}
+	return []byte(s)
+}
+
+// twice returns a control code sent twice, as it usually is
+func twice(b1, b2 byte) []byte { return []byte{b1, b2, b1, b2} }
+
+func cat(b ...[]byte) (c []byte) {
+	for _, b := range b {
+		c = append(c, b...)
+	}
+	return c
+}
+
+func cues(c []vtt.Cue) string {
+	var s []string
+	for _, c := range c {
+		s = append(s, fmt.Sprintf("%d-%d %q", c.Start, c.End, c.Text))
+	}
+	return strings.Join(s, "; ")
+}
+
+func run(t *testing.T, channel string, steps []step, end int64) string {
+	t.Helper()
+	d, err := NewDecoder(channel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range steps {
+		d.Decode(s.t, s.cc)
+	}
+	d.Flush(end)
+	return cues(d.Cues())
+}
+
+// the second bytes of the miscellaneous control codes, which follow
+// 0x14 in CC1, 0x1c in CC2, 0x15 in CC3 and 0x1d in CC4
+const (
+	rcl = 0x20 // resume caption loading
+	ru2 = 0x25 // roll-up, two rows
+	rdc = 0x29 // resume direct captioning
+	edm = 0x2c // erase displayed memory
+	cr  = 0x2d // carriage return
+	enm = 0x2e // erase non-displayed memory
+	eoc = 0x2f // end of caption
+)
+
+func Test608(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		steps []step
+		want  string
+	}{
+		{
+			name: "pop-on",
+			steps: []step{
+				{0, f1(cat(twice(0x14, rcl), twice(0x14, enm), twice(0x14, 0x50), text("Hello"))...)},
+				{100, f1(cat(twice(0x14, 0x70), text("world"))...)}, // the row below
+				{1000, f1(twice(0x14, eoc)...)},
+				{1500, f1(cat(twice(0x14, rcl), text("Next"))...)},
+				{3000, f1(twice(0x14, eoc)...)},
+				{4000, f1(twice(0x14, edm)...)},
+			},
+			want: `1000-3000 "Hello\nworld"; 3000-4000 "Next"`,
+		},
+		{
+			name: "roll-up",
+			steps: []step{
+				{0, f1(cat(twice(0x14, ru2), text("one"))...)},
+				{1000, f1(cat(twice(0x14, cr), text("two"))...)},
+				{2000, f1(cat(twice(0x14, cr), text("three"))...)},
+				{3000, f1(twice(0x14, cr)...)},
+			},
+			want: `0-1000 "one"; 1000-2000 "one\ntwo"; 2000-3000 "two\nthree"; 3000-5000 "three"`,
+		},
+		{
+			name: "paint-on",
+			steps: []step{
+				{0, f1(cat(twice(0x14, rdc), twice(0x14, 0x70), text("He"))...)},
+				{500, f1(cat(twice(0x14, 0x70), text("Hey"))...)},
+				{2000, f1(twice(0x14, edm)...)},
+			},
+			want: `0-500 "He"; 500-2000 "Hey"`,
+		},
+		{
+			name: "backspace and special characters",
+			steps: []step{
+				{0, f1(cat(twice(0x14, rcl), text("a-"), twice(0x14, 0x21), twice(0x11, 0x37), text("b"))...)},
+				{1000, f1(twice(0x14, eoc)...)},
+			},
+			want: `1000-5000 "a♪b"`,
+		},
+		{
+			name: "extended data services",
+			steps: []step{
+				{0, f1(cat(twice(0x14, rcl), text("ok"), []byte{0x01, 0x03}, text("xds"), []byte{0x0f, 0x1d})...)},
+				{1000, f1(cat([]byte{0x14, rcl}, text(" and"), twice(0x14, eoc))...)},
+			},
+			want: `1000-5000 "ok and"`,
+		},
+	} {
+		if got := run(t, "CC1", tc.steps, 5000); got != tc.want {
+			t.Errorf("%s:\n%s\nwant:\n%s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func Test608Channels(t *testing.T) {
+	// a pop-on caption on each channel, interleaved
+	steps := []step{
+		{0, cat(
+			f1(cat(twice(0x14, rcl), text("CC1"), twice(0x1c, rcl), text("CC2"))...),
+			f2(cat(twice(0x15, rcl), text("CC3"), twice(0x1d, rcl), text("CC4"))...),
+		)},
+		{1000, cat(f1(twice(0x14, eoc)...), f2(twice(0x15, eoc)...))},
+		{2000, cat(f1(twice(0x1c, eoc)...), f2(twice(0x1d, eoc)...))},
+		// the same control code on another channel isn't a repeat
+		{3000, f1(0x14, edm, 0x1c, edm, 0x14, edm)},
+		{3500, f2(cat(twice(0x15, edm), twice(0x1d, edm))...)},
+	}
+	for _, tc := range []struct{ channel, want string }{
+		{"CC1", `1000-3000 "CC1"`},
+		{"cc2", `2000-3000 "CC2"`},
+		{"CC3", `1000-3500 "CC3"`},
+		{"CC4", `2000-3500 "CC4"`},
+	} {
+		if got := run(t, tc.channel, steps, 5000); got != tc.want {
+			t.Errorf("%s: %s, want %s", tc.channel, got, tc.want)
+		}
+	}
+}
+
+func Test608Doubled(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		cc   []byte
+		want string
+	}{
+		// a repeated carriage return only rolls once
+		{"doubled", cat(twice(0x14, cr), text("b")), `1000-2000 "a\nb"`},
+		// but one sent again after other data runs again
+		{"again", cat(twice(0x14, cr), text("b"), []byte{0x14, cr}, text("c")), `1000-2000 "b\nc"`},
+		{"separate pairs", cat([]byte{0x14, cr}, []byte{0, 0}, []byte{0x14, cr}, text("b")), `1000-2000 "a\nb"`},
+	} {
+		steps := []step{
+			{0, f1(cat(twice(0x14, ru2), text("a"))...)},
+			{1000, f1(tc.cc...)},
+			{2000, f1(twice(0x14, edm)...)},
+		}
+		// past the cue of "a" alone
+		got := run(t, "CC1", steps, 5000)
+		if i := strings.Index(got, "; "); i >= 0 {
+			got = got[i+2:]
+		}
+		if got != tc.want {
+			t.Errorf("%s: %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestNewDecoder(t *testing.T) {
+	for _, ch := range []string{"CC0", "CC5", "SERVICE0", "SERVICE64", "T1", ""} {
+		if _, err := NewDecoder(ch); err != ErrChannel {
+			t.Errorf("%q: %v, want ErrChannel", ch, err)
+		}
+	}
+}
+
+// dtvcc returns the cc_data of a caption channel packet holding the
+// service blocks
+func dtvcc(blocks ...[]byte) []byte {
+	p := []byte{0}
+	for _, b := range blocks {
+		p = append(p, b...)
+	}
+	if len(p)%2 == 1 {
+		p = append(p, 0)
+	}
+	p[0] = byte(len(p) / 2)
+	cc := []byte{0xff, p[0], p[1]}
+	for i := 2; i < len(p); i += 2 {
+		cc = append(cc, 0xfe, p[i], p[i+1])
+	}
+	return cc
+}
+
+// block returns a service block
+func block(service int, data ...byte) []byte {
+	if service >= 7 {
+		return append([]byte{7<<5 | byte(len(data)), byte(service)}, data...)
+	}
+	return append([]byte{byte(service)<<5 | byte(len(data))}, data...)
+}
+
+// define defines window n, visible or not, with the rows and columns
+func define(n int, visible bool, rows, cols int) []byte {
+	v := byte(0)
+	if visible {
+		v = 0x20
+	}
+	return []byte{0x98 + byte(n), v, 0, 0, byte(rows - 1), byte(cols - 1), 0}
+}
+
+func Test708(t *testing.T) {
+	const etx, cr = 0x03, 0x0d
+	steps := []step{
+		{0, dtvcc(
+			block(1, cat(define(0, true, 2, 32), []byte("main"), []byte{etx})...),
+			block(2, cat(define(1, true, 2, 32), []byte("Hi"), []byte{cr}, []byte("there"), []byte{etx})...),
+		)},
+		{1000, dtvcc(block(2, 0x10, 0x25))}, // an ellipsis
+		{1500, dtvcc(block(2, 0x88, 0x02))}, // clear the window
+		{2000, dtvcc(block(2, define(0, false, 1, 32)...), block(9, cat(define(0, true, 1, 32), []byte("nine"))...))},
+		{2500, dtvcc(block(2, cat([]byte("hidden"), []byte{etx})...))},
+		{3000, dtvcc(block(2, 0x89, 0x01))}, // display it
+		{4000, dtvcc(block(2, 0x8f))},       // reset
+	}
+	for _, tc := range []struct{ channel, want string }{
+		{"SERVICE1", `0-5000 "main"`},
+		{"SERVICE2", `0-1000 "Hi\nthere"; 1000-1500 "Hi\nthere…"; 3000-4000 "hidden"`},
+		{"SERVICE9", `2000-5000 "nine"`},
+	} {
+		if got := run(t, tc.channel, steps, 5000); got != tc.want {
+			t.Errorf("%s: %s, want %s", tc.channel, got, tc.want)
+		}
+	}
+}
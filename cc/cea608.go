@@ -0,0 +1,231 @@
+package cc
+
+// caption modes of CEA-608
+const (
+	popOn = iota
+	paintOn
+	rollUp
+)
+
+// cea608 decodes one channel of CEA-608 captions. Each field carries
+// two data channels: CC1 and CC2 in the first, CC3 and CC4 in the
+// second, and the channel of the characters is that of the last
+// control code.
+type cea608 struct {
+	field   byte    // cc_type of the field
+	channel int     // data channel in the field
+	active  int     // and the channel of the last control code
+	last    [2]byte // the last control code, which is sent twice
+	xds     bool    // in extended data services
+
+	mode     int
+	rows     int  // of the roll-up
+	dirty    bool // whether the screen was written since the last commit
+	display  grid
+	hidden   grid // where pop-on captions are loaded
+	row, col int
+}
+
+func new608(n int) *cea608 {
+	return &cea608{
+		field:   byte((n - 1) / 2),
+		channel: (n - 1) % 2,
+		display: newGrid(15, 32),
+		hidden:  newGrid(15, 32),
+		row:     14,
+		rows:    2,
+	}
+}
+
+func (c *cea608) screen() string {
+	return c.display.text()
+}
+
+func (c *cea608) painted() bool {
+	return c.dirty
+}
+
+func (c *cea608) decode(typ, b1, b2 byte, commit func()) {
+	if typ != c.field {
+		return
+	}
+	b1, b2 = b1&0x7f, b2&0x7f // parity
+	switch {
+	case b1 == 0 && b2 == 0:
+		return // padding
+	case b1 >= 0x10 && b1 <= 0x1f:
+		c.xds = false
+		if [2]byte{b1, b2} == c.last {
+			c.last = [2]byte{}
+			return
+		}
+		c.last = [2]byte{b1, b2}
+		if c.active = int(b1>>3) & 1; c.active != c.channel {
+			return
+		}
+		if c.dirty {
+			commit()
+		}
+		c.control(b1&^0x08, b2)
+		c.dirty = false
+		commit()
+		return
+	case b1 < 0x10:
+		// extended data services, up to their end code
+		c.last = [2]byte{}
+		c.xds = b1 != 0x0f
+		return
+	}
+	c.last = [2]byte{}
+	if c.xds || c.active != c.channel {
+		return
+	}
+	c.put(char608(b1))
+	if b2 >= 0x20 {
+		c.put(char608(b2))
+	}
+}
+
+// control runs a control code of the first data channel
+func (c *cea608) control(b1, b2 byte) {
+	switch {
+	case (b1 == 0x14 || b1 == 0x15) && b2 >= 0x20 && b2 <= 0x2f:
+		c.command(b2)
+	case b1 == 0x17 && b2 >= 0x21 && b2 <= 0x23:
+		c.col = min(c.col+int(b2-0x20), 31) // tab offset
+	case b1 == 0x11 && b2 >= 0x30 && b2 <= 0x3f:
+		c.put(special[b2-0x30])
+	case b1 == 0x11 && b2 >= 0x20 && b2 <= 0x2f:
+		c.put(' ') // a mid-row code takes a cell
+	case (b1 == 0x12 || b1 == 0x13) && b2 >= 0x20 && b2 <= 0x3f:
+		// an extended character replaces the one before it
+		c.col = max(c.col-1, 0)
+		c.put(extended[b1-0x12][b2-0x20])
+	case b2 >= 0x40:
+		c.preamble(b1, b2)
+	}
+}
+
+// command runs a miscellaneous control code
+func (c *cea608) command(b2 byte) {
+	switch b2 {
+	case 0x20: // resume caption loading
+		c.mode = popOn
+	case 0x21: // backspace
+		if c.col > 0 {
+			c.col--
+			c.memory()[c.row][c.col] = 0
+		}
+	case 0x24: // delete to end of row
+		clear(c.memory()[c.row][c.col:])
+	case 0x25, 0x26, 0x27: // roll-up captions
+		if c.mode != rollUp {
+			c.display.clear()
+			c.hidden.clear()
+			c.row = 14
+		}
+		c.mode, c.rows, c.col = rollUp, int(b2-0x23), 0
+	case 0x29: // resume direct captioning
+		c.mode = paintOn
+	case 0x2c: // erase displayed memory
+		c.display.clear()
+	case 0x2d: // carriage return
+		if c.mode == rollUp {
+			c.roll()
+		}
+	case 0x2e: // erase non-displayed memory
+		c.hidden.clear()
+	case 0x2f: // end of caption
+		c.display, c.hidden = c.hidden, c.display
+	}
+}
+
+// roll moves the rows of the roll-up up by one
+func (c *cea608) roll() {
+	for i := max(c.row-c.rows+1, 0); i < c.row; i++ {
+		copy(c.display[i], c.display[i+1])
+	}
+	clear(c.display[c.row])
+	for i := 0; i <= c.row-c.rows; i++ {
+		clear(c.display[i])
+	}
+	c.col = 0
+}
+
+// rows of the preamble address codes of the first data channel, for
+// the second byte below and above 0x60
+var pacRows = [8][2]int{{11, 11}, {1, 2}, {3, 4}, {12, 13}, {14, 15}, {5, 6}, {7, 8}, {9, 10}}
+
+// preamble runs a preamble address code, which moves the cursor to a
+// row and an indent. A roll-up moves along with its base row.
+func (c *cea608) preamble(b1, b2 byte) {
+	row := pacRows[b1&7][b2>>5&1] - 1
+	if c.mode == rollUp && row != c.row {
+		rows := newGrid(c.rows, 32)
+		for i := range rows {
+			if j := c.row - c.rows + 1 + i; j >= 0 {
+				copy(rows[i], c.display[j])
+			}
+		}
+		c.display.clear()
+		for i := range rows {
+			if j := row - c.rows + 1 + i; j >= 0 {
+				copy(c.display[j], rows[i])
+			}
+		}
+	}
+	c.row, c.col = row, 0
+	if b2&0x10 != 0 {
+		c.col = int(b2&0x0e) << 1
+	}
+}
+
+// memory returns the memory being written in the current mode
+func (c *cea608) memory() grid {
+	if c.mode == popOn {
+		return c.hidden
+	}
+	c.dirty = true
+	return c.display
+}
+
+func (c *cea608) put(r rune) {
+	c.memory()[c.row][min(c.col, 31)] = r
+	c.col = min(c.col+1, 32)
+}
+
+// char608 returns the character of a standard character code, which
+// is ascii apart from a few
+func char608(b byte) rune {
+	switch b {
+	case 0x2a:
+		return 'á'
+	case 0x5c:
+		return 'é'
+	case 0x5e:
+		return 'í'
+	case 0x5f:
+		return 'ó'
+	case 0x60:
+		return 'ú'
+	case 0x7b:
+		return 'ç'
+	case 0x7c:
+		return '÷'
+	case 0x7d:
+		return 'Ñ'
+	case 0x7e:
+		return 'ñ'
+	case 0x7f:
+		return '█'
+	}
+	return rune(b)
+}
+
+var (
+	special  = []rune("®°½¿™¢£♪à èâêîôû")
+	extended = [2][]rune{
+		[]rune("ÁÉÓÚÜü‘¡*'—©℠•“”ÀÂÇÈÊËëÎÏïÔÙùÛ«»"),
+		[]rune("ÃãÍÌìÒòÕõ{}\\^_|~ÄäÖöß¥¤¦ÅåØø┌┐└┘"),
+	}
+)
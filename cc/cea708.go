@@ -0,0 +1,323 @@
+package cc
+
+// cea708 decodes one service of CEA-708 captions. The caption channel
+// packets (DTVCC) are collected from the cc_data, and the service blocks
+// of the service are run against a set of eight windows. The screen is
+// the text of the visible windows, in priority order.
+type cea708 struct {
+	service int
+	packet  []byte // being collected
+
+	dirty   bool // whether a visible window was written since the last commit
+	changed bool // or was shown, hidden, cleared or scrolled
+	win     [8]window
+	cur     int // the current window
+	commit  func()
+}
+
+// window is a caption window
+type window struct {
+	defined, visible bool
+	priority         int
+	text             grid
+	row, col         int
+}
+
+func new708(n int) *cea708 {
+	return &cea708{service: n}
+}
+
+func (c *cea708) screen() string {
+	var s string
+	for p := 0; p < 8; p++ {
+		for i := range c.win {
+			w := &c.win[i]
+			if !w.defined || !w.visible || w.priority != p {
+				continue
+			}
+			if t := w.text.text(); t != "" {
+				if s != "" {
+					s += "\n"
+				}
+				s += t
+			}
+		}
+	}
+	return s
+}
+
+func (c *cea708) painted() bool {
+	return c.dirty
+}
+
+func (c *cea708) decode(typ, b1, b2 byte, commit func()) {
+	switch typ {
+	case 3: // packet start
+		c.run(commit)
+		c.packet = append(c.packet[:0], b1, b2)
+	case 2:
+		if len(c.packet) == 0 {
+			return // the start was missed
+		}
+		c.packet = append(c.packet, b1, b2)
+	default:
+		return
+	}
+	if size := packetSize(c.packet[0]); len(c.packet) >= size {
+		c.packet = c.packet[:size]
+		c.run(commit)
+	}
+}
+
+// packetSize returns the size of a packet with the header h
+func packetSize(h byte) int {
+	if n := int(h & 0x3f); n != 0 {
+		return n * 2
+	}
+	return 128
+}
+
+// run runs the service blocks of the packet collected
+func (c *cea708) run(commit func()) {
+	if len(c.packet) == 0 {
+		return
+	}
+	p := c.packet[1:]
+	c.packet = c.packet[:0]
+	c.commit = commit
+	for len(p) > 0 {
+		service, size := int(p[0]>>5), int(p[0]&0x1f)
+		p = p[1:]
+		if service == 0 {
+			break // null block
+		}
+		if service == 7 && len(p) > 0 {
+			service = int(p[0] & 0x3f) // extended service number
+			p = p[1:]
+		}
+		size = min(size, len(p))
+		if service == c.service {
+			c.block(p[:size])
+		}
+		p = p[size:]
+	}
+	if c.changed {
+		c.dirty, c.changed = false, false
+		commit()
+	}
+}
+
+// params is the number of parameter bytes of the commands of the C1
+// code set, from 0x80
+var params = [32]int{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 1, 1, 0, 0, 2, 3, 2, 0, 0, 0, 0, 4, 6, 6, 6, 6, 6, 6, 6, 6}
+
+// block runs a service block
+func (c *cea708) block(p []byte) {
+	for len(p) > 0 {
+		b := p[0]
+		p = p[1:]
+		switch {
+		case b == 0x10: // EXT1: the extended code sets
+			if len(p) == 0 {
+				return
+			}
+			p = c.extended(p)
+		case b < 0x10:
+			c.c0(b)
+		case b == 0x18: // P16: a 16 bit character
+			if len(p) < 2 {
+				return
+			}
+			c.put(rune(p[0])<<8 | rune(p[1]))
+			p = p[2:]
+		case b < 0x18:
+			p = p[min(1, len(p)):]
+		case b < 0x20:
+			p = p[min(2, len(p)):]
+		case b == 0x7f:
+			c.put('♪')
+		case b < 0x80:
+			c.put(rune(b))
+		case b < 0xa0:
+			n := params[b-0x80]
+			if n > len(p) {
+				return
+			}
+			c.c1(b, p[:n])
+			p = p[n:]
+		default:
+			c.put(rune(b)) // latin-1
+		}
+	}
+}
+
+// extended runs the character or command after an EXT1 code and
+// returns the rest of p
+func (c *cea708) extended(p []byte) []byte {
+	b := p[0]
+	p = p[1:]
+	switch {
+	case b < 0x08:
+	case b < 0x10:
+		p = p[min(1, len(p)):]
+	case b < 0x18:
+		p = p[min(2, len(p)):]
+	case b < 0x20:
+		p = p[min(3, len(p)):]
+	case b < 0x80:
+		if r, ok := g2[b]; ok {
+			c.put(r)
+		}
+	case b < 0x88:
+		p = p[min(4, len(p)):]
+	case b < 0x90:
+		p = p[min(5, len(p)):]
+	case b < 0xa0:
+		// variable length commands, which end the block
+		return nil
+	case b == 0xa0:
+		c.put('㏄') // the cc icon
+	}
+	return p
+}
+
+// g2 are the characters of the G2 code set
+var g2 = map[byte]rune{
+	0x20: ' ', 0x21: ' ', 0x25: '…', 0x2a: 'Š', 0x2c: 'Œ',
+	0x30: '█', 0x31: '‘', 0x32: '’', 0x33: '“', 0x34: '”', 0x35: '•',
+	0x39: '™', 0x3a: 'š', 0x3c: 'œ', 0x3d: '℠', 0x3f: 'Ÿ',
+	0x76: '⅛', 0x77: '⅜', 0x78: '⅝', 0x79: '⅞', 0x7a: '│',
+	0x7b: '┐', 0x7c: '└', 0x7d: '─', 0x7e: '┘', 0x7f: '┌',
+}
+
+// c0 runs a command of the C0 code set
+func (c *cea708) c0(b byte) {
+	w := &c.win[c.cur]
+	if !w.defined {
+		return
+	}
+	switch b {
+	case 0x03: // end of text
+		c.flush()
+	case 0x08: // backspace
+		if w.col > 0 {
+			w.col--
+			w.text[w.row][w.col] = 0
+			c.wrote(w)
+		}
+	case 0x0c: // form feed
+		c.flush()
+		w.text.clear()
+		w.row, w.col = 0, 0
+		c.change(w)
+	case 0x0d: // carriage return
+		c.flush()
+		w.col = 0
+		if w.row++; w.row == len(w.text) {
+			w.row--
+			copy(w.text, w.text[1:])
+			w.text[w.row] = make([]rune, len(w.text[w.row]))
+			c.change(w)
+		}
+	case 0x0e: // horizontal carriage return
+		c.flush()
+		clear(w.text[w.row])
+		w.col = 0
+		c.change(w)
+	}
+}
+
+// c1 runs a command of the C1 code set with its parameters
+func (c *cea708) c1(b byte, p []byte) {
+	switch {
+	case b <= 0x87: // set current window
+		c.cur = int(b - 0x80)
+		return
+	case b == 0x8f: // reset
+		c.flush()
+		c.win = [8]window{}
+		c.changed = true
+		return
+	case b == 0x92: // set pen location
+		if w := &c.win[c.cur]; w.defined {
+			w.row, w.col = min(int(p[0]&0x0f), len(w.text)-1), min(int(p[1]&0x3f), len(w.text[0])-1)
+		}
+		return
+	case b >= 0x98: // define window
+		c.define(int(b-0x98), p)
+		return
+	case b < 0x88 || b > 0x8c:
+		return
+	}
+	// the window commands, with a bitmap of windows
+	c.flush()
+	for i := range c.win {
+		w := &c.win[i]
+		if p[0]&(1<<i) == 0 || !w.defined {
+			continue
+		}
+		switch b {
+		case 0x88: // clear windows
+			w.text.clear()
+		case 0x89: // display windows
+			w.visible = true
+		case 0x8a: // hide windows
+			w.visible = false
+		case 0x8b: // toggle windows
+			w.visible = !w.visible
+		case 0x8c: // delete windows
+			*w = window{}
+		}
+	}
+	c.changed = true
+}
+
+// define defines or updates window n, and makes it current
+func (c *cea708) define(n int, p []byte) {
+	c.flush()
+	w := &c.win[n]
+	rows, cols := int(p[3]&0x0f)+1, int(p[4]&0x3f)+1
+	if !w.defined || len(w.text) != rows || len(w.text[0]) != cols {
+		text := newGrid(rows, cols)
+		for i := range text {
+			if i < len(w.text) {
+				copy(text[i], w.text[i])
+			}
+		}
+		w.text = text
+		w.row, w.col = min(w.row, rows-1), min(w.col, cols-1)
+	}
+	w.defined, w.visible, w.priority = true, p[0]&0x20 != 0, int(p[0]&7)
+	c.cur = n
+	c.changed = true
+}
+
+func (c *cea708) put(r rune) {
+	w := &c.win[c.cur]
+	if !w.defined {
+		return
+	}
+	w.text[w.row][min(w.col, len(w.text[w.row])-1)] = r
+	w.col = min(w.col+1, len(w.text[w.row]))
+	c.wrote(w)
+}
+
+// wrote notes text written to window w. The text is shown at the next
+// command that changes the screen.
+func (c *cea708) wrote(w *window) {
+	c.dirty = c.dirty || w.visible
+}
+
+// change notes a change to window w that's shown right away
+func (c *cea708) change(w *window) {
+	c.changed = c.changed || w.visible
+}
+
+// flush commits the text written before a command that changes the
+// screen
+func (c *cea708) flush() {
+	if c.dirty {
+		c.commit()
+		c.dirty = false
+	}
+}
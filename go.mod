@@ -2,7 +2,6 @@ module github.com/as/hlscat
 
 go 1.22.4
 
-require (
-	github.com/as/hls v0.5.1 // indirect
-	github.com/as/scte v0.0.2 // indirect
-)
+require github.com/as/hls v0.5.1
+
+require github.com/as/scte v0.0.2
@@ -12,22 +12,22 @@ vlc segment.ts
 package main
 
 import (
-	"bufio"
 	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/as/hls"
+	"github.com/as/hlscat/repack"
 )
 
-const Blocksize = 16
-
 var (
 	verbose  = flag.Bool("v", false, "verbose output")
 	noads    = flag.Bool("noads", false, "trim away all ad breaks")
@@ -40,6 +40,20 @@ var (
 	nodec    = flag.Bool("nodec", false, "never decrypt anything")
 	nofilter = flag.Bool("nofilter", false, "never fix ts segments")
 	cbcbuf   = flag.Int("cbcbuf", 4096+16, "cbc buffer size")
+	remuxer  = flag.String("mux", "ffmpeg", "remuxer to use: ffmpeg or native (in-process)")
+	format   = flag.String("format", "mp4", "output container for the native remuxer: mp4 or ts")
+	follow   = flag.Bool("f", false, "follow live and event playlists until they end")
+	outdir   = flag.String("o", "", "write an hls package (segments and playlists) to this directory instead of stdout")
+	allr     = flag.Bool("renditions", false, "keep every audio rendition of the variant and every subtitle rendition as tracks (native)")
+	dash     = flag.Bool("dash", false, "with -o, write an mpeg-dash package (manifest.mpd and fmp4 segments) instead of hls")
+	subs     = flag.String("subs", "", "also write the subtitles of a master playlist to this .vtt or .srt file (a media playlist is read as the subtitles)")
+	ccfile   = flag.String("cc", "", "also write the closed captions in the video to this .vtt or .srt file (native)")
+	ccchan   = flag.String("ccchannel", "CC1", "caption channel for -cc: CC1 to CC4 (cea-608) or SERVICE1 to SERVICE63 (cea-708)")
+
+	retries    = flag.Int("retry", 3, "retry attempts for each failed download")
+	backoff    = flag.Duration("backoff", 500*time.Millisecond, "delay before the first retry, doubled for each one after")
+	timeout    = flag.Duration("timeout", time.Minute, "deadline for each http request (0 is none)")
+	segtimeout = flag.Duration("segtimeout", 0, "deadline for each download, including its retries (0 is none)")
 
 	recurse    = flag.Bool("r", false, "recurse into media manifests if target is a master")
 	ls         = flag.Bool("ls", false, "list segments found in manifests")
@@ -47,26 +61,31 @@ var (
 	abs        = flag.Bool("abs", false, "force absolute paths when listing")
 	print      = flag.Bool("print", false, "print the manifest to stderr after applying all transformations")
 	selectexpr = flag.String("t", "", "select time range expression (s+e) or (s-e)")
+	policy     = flag.String("select", "", "variant selection policy, such as codec=hvc1,height<=1080,max (see repack.ParsePolicy)")
+	langs      = flag.String("lang", "", "preferred audio languages, most preferred first (en,es-419)")
+	layouts    = flag.String("channels", "", "preferred audio channel layouts, most preferred first (16/JOC,6,2)")
+	describes  = flag.Bool("describes", false, "prefer audio that describes the video, which is otherwise left out")
 
 	blackout      = flag.Bool("blackout", false, "blackout any ad content (not working)")
 	blackoutdebug = flag.Bool("blackoutdebug", false, "blackoutdebug")
 
-	base string
+	keyfile   = flag.String("keyfile", "", "json or csv file of key uris and key ids to hex keys")
+	keycmd    = flag.String("keycmd", "", "command that prints the key for the key uri given as its last argument")
+	keyheader = headerflag{}
 
-	proto = Info{}
-)
+	enckey    = flag.String("enckey", "", "encrypt the output with aes-128 using this hex key")
+	enciv     = flag.String("enciv", "sequence", "iv for -enckey: sequence (the media sequence number), random, or hex")
+	enckeyuri = flag.String("enckeyuri", "", "key uri written to -o playlists for -enckey (default: the key is written to the package as key.bin)")
 
-var sem = make(chan bool, *maxhttp)
+	proto = repack.Info{}
+	keys  = keyflag{}
 
-func init() {
-	for i := 0; i < cap(sem); i++ {
-		sem <- true
-	}
-}
+	rp *repack.Repackager
+)
 
 func init() {
 	var nothing bool
-	flag.BoolVar(&nothing, "z", false, "z flags serve as a prototype for media manifests without a master; they describe codec settings")
+	flag.BoolVar(&nothing, "z", false, "z flags describe the codec settings of blackout content; without any, they're probed from the first segment")
 	flag.IntVar(&proto.Video.Height, "z.h", 540, "video width")
 	flag.IntVar(&proto.Video.Width, "z.w", 960, "video height")
 	flag.Float64Var(&proto.Video.FPS, "z.fps", 25, "frame rate")
@@ -77,271 +96,402 @@ func init() {
 	flag.IntVar(&proto.Audio.Bitrate, "z.abps", 192000, "audio bitrate")
 	flag.IntVar(&proto.Audio.Samplerate, "z.arate", 48000, "audio sample rate")
 	flag.IntVar(&proto.Audio.Channels, "z.channels", 2, "audio channel count")
+	flag.Var(keys, "key", "content key for cenc and cbcs fmp4, as KID:KEY in hex (repeatable)")
+	flag.Var(keyheader, "keyheader", "http header for key requests, as Name: value (repeatable)")
 }
 
-func main() {
-	http.DefaultClient.Transport = &http.Transport{
-		ReadBufferSize:      8192,
-		DisableCompression:  true,
-		DisableKeepAlives:   false,
-		MaxIdleConnsPerHost: 25,
-		ForceAttemptHTTP2:   true,
+// headerflag collects the -keyheader flags
+type headerflag http.Header
+
+func (h headerflag) String() string { return "" }
+
+func (h headerflag) Set(v string) error {
+	name, value, ok := strings.Cut(v, ":")
+	if !ok {
+		return fmt.Errorf("want Name: value")
 	}
-	flag.Parse()
+	http.Header(h).Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	return nil
+}
+
+// keyflag collects the -key flags by key id
+type keyflag map[string][]byte
 
-	if *cbcbuf%16 != 0 {
-		*cbcbuf = 4096 + 16 // clearly the user is unwell
+func (k keyflag) String() string { return "" }
+
+func (k keyflag) Set(v string) error {
+	kid, key, ok := strings.Cut(v, ":")
+	if !ok {
+		return fmt.Errorf("want KID:KEY")
+	}
+	kid = repack.KeyID(kid)
+	id, err := hex.DecodeString(kid)
+	if err != nil || len(id) != 16 {
+		return fmt.Errorf("bad key id %q", kid)
 	}
+	data, err := hex.DecodeString(key)
+	if err != nil || len(data) != 16 {
+		return fmt.Errorf("bad key %q", key)
+	}
+	k[kid] = data
+	return nil
+}
+
+func main() {
+	flag.Parse()
 	if *ls2 {
 		*ls = true
 	}
+	opt := repack.Options{
+		Conns:     *maxhttp,
+		BufSize:   *maxbuf,
+		CBCBuf:    *cbcbuf,
+		NoDecrypt: *nodec,
+		NoInit:    *noinit,
+		NoFilter:  *nofilter,
+		Keys:      keys,
+		Skip:      *skip,
+		Count:     *count,
+		Follow:    *follow,
+		Native:    *remuxer == "native" || *outdir != "" || *allr || *ccfile != "",
+		Format:    *format,
+		Proto:     proto,
+
+		ProbeBlackout: !zflags(),
+
+		KeepRenditions: *allr,
+
+		Retries:        *retries,
+		Backoff:        *backoff,
+		Timeout:        *timeout,
+		SegmentTimeout: *segtimeout,
+
+		Client: &http.Client{Transport: &http.Transport{
+			ReadBufferSize:      8192,
+			DisableCompression:  true,
+			DisableKeepAlives:   false,
+			MaxIdleConnsPerHost: 25,
+			ForceAttemptHTTP2:   true,
+		}},
+		Log:     os.Stderr,
+		Verbose: *verbose,
+		Debug:   *debug,
+	}
+	if err := keyprovider(&opt); err != nil {
+		fatal(err)
+	}
+	if err := encryption(&opt); err != nil {
+		fatal(err)
+	}
+	if *noads {
+		opt.Ads = repack.AdSkip
+	} else if *blackout {
+		opt.Ads = repack.AdBlackout
+	}
+	if *selectexpr != "" {
+		opt.Start, opt.End = parseSelectExpr(*selectexpr)
+	}
+	if *langs != "" || *layouts != "" || *describes {
+		opt.Audio = &repack.AudioPolicy{Langs: split(*langs), Channels: split(*layouts), Describes: *describes}
+	}
+	if *policy != "" {
+		p, err := repack.ParsePolicy(*policy)
+		if err != nil {
+			fatal(err)
+		}
+		opt.Policy = p
+	}
+	if *blackoutdebug {
+		data, err := repack.Blackout(&proto, 0)
+		if err != nil {
+			fatal(err)
+		}
+		os.Stdout.Write(data)
+		os.Exit(0)
+	}
+	rp = repack.New(opt)
+
 	a := flag.Args()
-	var src io.Reader
-	if len(a) > 0 {
-		if strings.HasPrefix(a[0], "http") {
-			src = strings.NewReader(string(download(a[0])))
-			if n := strings.LastIndex(a[0], "/"); n > 0 {
-				base = a[0][:n] + "/"
-				println("base path is", base)
-			}
-		} else {
-			d, _ := ioutil.ReadFile(a[0])
-			src = strings.NewReader(string(d))
+	if len(a) > 0 && (a[0] == "inspect" || a[0] == "probe") {
+		run := inspect
+		if a[0] == "probe" {
+			run = probe
 		}
-	} else {
-		src = os.Stdin
+		if err := run(a[1:]); err != nil {
+			fatal(err)
+		}
+		os.Exit(0)
 	}
+	if err := stream(a); err != nil {
+		fatal(err)
+	}
+	summary()
+}
 
-	tags, multi, err := hls.Decode(src)
+// stream writes the playlist in a[0], or on standard input, to standard
+// output or the -o directory, or lists it, along with the -subs and -cc
+// files
+func stream(a []string) (err error) {
+	if *ccfile != "" && !*ls {
+		fd, err := os.Create(*ccfile)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if cerr := fd.Close(); err == nil {
+				err = cerr
+			}
+		}()
+		rp.Captions = &repack.Captions{W: fd, Format: subformat(*ccfile), Channel: *ccchan}
+	}
+	var (
+		m  *hls.Master
+		mm *hls.Media
+	)
+	if len(a) > 0 {
+		m, mm, err = rp.Load(a[0])
+	} else {
+		m, mm, err = rp.Decode(os.Stdin, "")
+	}
 	if err != nil {
-		panic(err)
+		return err
 	}
-	if !multi {
-		m := &hls.Media{URL: a[0]}
-		err = m.DecodeTag(tags...)
+	if *subs != "" && !*ls {
+		if mm != nil {
+			return sidecar(mm, nil)
+		}
+		ms, err := rp.SelectSubtitles(m)
 		if err != nil {
-			panic(err)
+			return err
 		}
-		if len(a) == 1 {
-			io.Copy(os.Stdout, media(m))
-			os.Exit(0)
-		} else {
-			s0 := media(m)
-			m := &hls.Media{URL: a[1]}
-			err = m.Decode(strings.NewReader(string(download(a[1]))))
-			if err != nil {
-				panic(err)
-			}
-			s1 := media(m)
-			println("video", a[0], "audio", a[1])
-			io.Copy(os.Stdout, filterMerge(s0, s1))
-			os.Exit(0)
+		mv, _, err := rp.Select(m)
+		if err != nil {
+			return err
 		}
+		sidecarc = make(chan error, 1)
+		go func() { sidecarc <- sidecar(ms, mv) }()
 	}
-	m := &hls.Master{URL: a[0]}
-	err = m.DecodeTag(tags...)
-	if err != nil {
-		panic(err)
+	if *outdir != "" && !*ls {
+		if err := writeout(m, mm, a); err != nil {
+			return err
+		}
+		return waitsidecar()
 	}
-	if *ls {
-		master(m)
-		os.Exit(0)
+	if mm != nil {
+		if len(a) < 2 {
+			return copyout(media(mm))
+		}
+		ma, err := rp.Playlist(a[1])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "video %s audio %s\n", a[0], a[1])
+		return copyout(rp.Encrypt(rp.Merge(mm, ma), 0))
 	}
-	mv, ma := selectBest(m)
-	fmt.Fprintf(os.Stderr, "hls video: %s\n", mv.Path(m.Path("")))
-	fmt.Fprintf(os.Stderr, "hls audio: %s\n", ma.Path(m.Path("")))
-	if mv != ma {
-		fmt.Fprintf(os.Stderr, "hls multi-file a/v\n")
-		io.Copy(os.Stdout, filterMerge(media(mv), media(ma)))
-	} else {
-		fmt.Fprintf(os.Stderr, "hls single-file a/v\n")
-		io.Copy(os.Stdout, media(mv))
+	if *ls {
+		return master(m)
 	}
-}
-
-func mediaPlaylist(uri string) *hls.Media {
-	println(uri)
-	m := &hls.Media{URL: uri}
-	err := m.Decode(strings.NewReader(string(download(uri))))
+	out, err := rp.Master(m)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	return m
+	return copyout(rp.Encrypt(out, 0))
 }
 
-func master(m *hls.Master) {
-	listmaster(m, os.Stdout)
-	if *print {
-		m.Encode(os.Stdout)
+// keyprovider sets up the key sources given by the -keyfile, -keycmd
+// and -keyheader flags
+func keyprovider(opt *repack.Options) error {
+	var chain repack.Keychain
+	if *keyfile != "" {
+		f, err := repack.LoadKeyFile(*keyfile)
+		if err != nil {
+			return err
+		}
+		chain = append(chain, f)
+		for kid, key := range f.KeyIDs() {
+			if _, ok := keys[kid]; !ok {
+				keys[kid] = key
+			}
+		}
 	}
+	if a := strings.Fields(*keycmd); len(a) > 0 {
+		chain = append(chain, repack.KeyCommand{Path: a[0], Args: a[1:]})
+	}
+	if len(keyheader) > 0 {
+		chain = append(chain, repack.HTTPKeys{Client: opt.Client, Header: http.Header(keyheader)})
+	}
+	if len(chain) > 0 {
+		opt.KeyProvider = chain
+	}
+	return nil
 }
 
-type Pathy interface {
-	Path(string) string
-}
-
-func media(m *hls.Media) io.ReadCloser {
-	fmt.Fprintf(os.Stderr, "media playlist duration=%s\n", hls.Runtime(m.File...))
-
-	if *noads {
-		m.File = filterAD(m.File...)
+// encryption sets up the output encryption given by -enckey and -enciv
+func encryption(opt *repack.Options) error {
+	if *enckey == "" {
+		return nil
+	}
+	key, err := hex.DecodeString(strings.TrimPrefix(*enckey, "0x"))
+	if err != nil || len(key) != repack.Blocksize {
+		return fmt.Errorf("bad -enckey %q", *enckey)
 	}
-	if *skip > 0 {
-		if *skip > len(m.File) {
-			m.File = m.File[:0]
-		} else {
-			m.File = m.File[*skip:]
+	e := &repack.Encryption{Key: key, URI: *enckeyuri}
+	switch *enciv {
+	case "sequence":
+	case "random":
+		e.IV = make([]byte, repack.Blocksize)
+		if _, err := rand.Read(e.IV); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "hlscat: encrypting with iv 0x%x\n", e.IV)
+	default:
+		e.IV, err = hex.DecodeString(strings.TrimPrefix(*enciv, "0x"))
+		if err != nil || len(e.IV) != repack.Blocksize {
+			return fmt.Errorf("bad -enciv %q", *enciv)
 		}
 	}
-	if *count > 0 {
-		if *count < len(m.File) {
-			m.File = m.File[:*count]
+	opt.Encryption = e
+	return nil
+}
+
+// writeout writes the hls or dash package for the master or media
+// playlist to the -o directory. A second argument is the audio for a
+// media playlist.
+func writeout(m *hls.Master, mm *hls.Media, a []string) error {
+	if mm == nil {
+		if *dash {
+			return rp.WriteDASH(*outdir, m)
 		}
+		return rp.WriteMaster(*outdir, m)
 	}
-	if *selectexpr != "" {
-		ts, te := parseSelectExpr(*selectexpr)
-		p, q := selectrange(ts, te, m)
-		if *debug > 5 {
-			fmt.Fprintf(os.Stderr, "select range t(%d,%d) -> s(%d,%d)\n", ts.Unix(), te.Unix(), p, q)
+	var audio *hls.Media
+	if len(a) > 1 {
+		var err error
+		if audio, err = rp.Playlist(a[1]); err != nil {
+			return err
 		}
-		m.File = m.File[p:q]
 	}
+	if *dash {
+		return rp.WriteDASHMedia(*outdir, mm, audio)
+	}
+	_, err := rp.WriteMedia(*outdir, mm, audio)
+	return err
+}
 
-	dst := &bytes.Buffer{}
-	if *ls {
-		if *abs {
-			list(m, dst)
-		} else {
-			stat(m, dst)
-		}
-	} else {
-		return cat(&proto, m)
+// sidecarc is the result of writing the -subs file alongside the stream
+var sidecarc chan error
+
+// sidecar writes the subtitles in m to the -subs file, as SubRip if
+// its name ends in .srt and otherwise as WebVTT, timed from the start
+// of the video in v, if it's not nil
+func sidecar(m, v *hls.Media) error {
+	fd, err := os.Create(*subs)
+	if err != nil {
+		return err
 	}
-	if *print {
-		m.Encode(os.Stderr)
+	rc := rp.Subtitles(m, v, subformat(*subs))
+	_, err = io.Copy(fd, rc)
+	rc.Close()
+	if err != nil {
+		fd.Close()
+		return err
 	}
-	return io.NopCloser(dst)
+	return fd.Close()
 }
 
-func cat(info *Info, m *hls.Media) (rc io.ReadCloser) {
-	var blackstream []byte
-	var err error
-	if *blackout {
-		blackstream, err = makeBlackout(info, m.Target)
-		if err != nil {
-			panic(err)
-		}
-		if *blackoutdebug {
-			os.Stdout.Write(blackstream)
-			os.Exit(0)
+// split splits a comma separated flag
+func split(s string) (a []string) {
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			a = append(a, v)
 		}
 	}
-	outc := make(chan io.ReadCloser, *maxhttp)
-	go func() {
-		defer close(outc)
-		keyfile := ""
-		key, iv := "", ""
-		init := ""
-		masterurl := m.Path("")
-		for i := range m.File {
-			f := &m.File[i]
-			if f.Key.Method == "NONE" {
-				keyfile, key, iv = "", "", ""
-			}
-			if k := f.Key.URI; k != "" && k != keyfile {
-				// download the key but only if its unique
-				keyfile = k
-				key = string(download(f.Key.Path(masterurl)))
-			}
-			iv = f.Key.IV
-			blackout := *blackout && (f.IsAD() || (i+1)%2 == 0)
-			if newinit := f.Map.Path(masterurl); newinit != "" && newinit != init && !*noinit && !blackout {
-				fmt.Fprintf(os.Stderr, "streaming init segment: %s\n", newinit)
-				if key == "" {
-					outc <- stream(newinit)
-				} else {
-					outc <- decrypt(key, iv, stream(newinit))
-				}
-				init = newinit
-			}
-			if blackout {
-				init = ""
-				outc <- filterFrag(io.NopCloser(bytes.NewReader(blackstream)), f.Duration(0))
-			} else if key != "" {
-				if *debug > 1 {
-					fmt.Fprintf(os.Stderr, "keyfil=%q key=%x iv=%q iv=%x\n", f.Key.Path(masterurl), key, iv, unhex(iv))
-				}
-				outc <- decrypt(key, iv, stream(f.Path(masterurl)))
-			} else {
-				outc <- stream(f.Path(masterurl))
-			}
-		}
-	}()
-
-	pr, pw := io.Pipe()
-	go func() {
-		defer pw.Close()
-		for out := range outc {
-			_, err := io.Copy(pw, out)
-			if err != nil {
-				//			panic(err)
-			}
-			out.Close()
-		}
-	}()
-	return filterFrag(pr, 0)
+	return a
 }
 
-func location(u string) string {
-	if !strings.HasPrefix(u, "http") {
-		u = base + u
+// subformat returns the subtitle format for a file name: srt if it
+// ends in .srt, and otherwise vtt
+func subformat(name string) string {
+	if strings.HasSuffix(strings.ToLower(name), ".srt") {
+		return "srt"
 	}
-	return u
+	return "vtt"
 }
 
-func printlocation(u string) string {
-	if *abs {
-		return location(u)
+// waitsidecar waits for the -subs file, if it's being written
+func waitsidecar() error {
+	if sidecarc == nil {
+		return nil
 	}
-	return u
+	return <-sidecarc
 }
 
-func download(u string) []byte {
-	resp, err := http.Get(location(u))
+// copyout copies the stream to stdout, and waits for the -subs file
+func copyout(rc io.ReadCloser) error {
+	_, err := io.Copy(os.Stdout, rc)
+	rc.Close()
 	if err != nil {
-		panic(err)
+		return err
 	}
-	data, err := io.ReadAll(resp.Body)
-	if err != nil {
-		panic(err)
+	return waitsidecar()
+}
+
+func fatal(err error) {
+	summary()
+	fmt.Fprintf(os.Stderr, "hlscat: %v\n", err)
+	os.Exit(1)
+}
+
+// summary prints the http statistics if anything was retried
+func summary() {
+	if rp == nil {
+		return
+	}
+	if s := rp.Stats(); *verbose || s.Retries > 0 || s.Failed > 0 {
+		fmt.Fprintf(os.Stderr, "hlscat: %s\n", s)
 	}
-	return data
 }
 
-func stream(u string) io.ReadCloser {
-	<-sem
-	u = location(u)
-	if *debug > 0 {
-		println("start stream", u)
+func master(m *hls.Master) error {
+	if err := listmaster(m, os.Stdout); err != nil {
+		return err
 	}
-	resp, err := http.Get(u)
-	if err != nil {
-		panic(err)
-	}
-	pr, pw := io.Pipe()
-	go func() {
-		bw := bufio.NewWriterSize(pw, *maxbuf)
-		io.Copy(bw, resp.Body)
-		sem <- true
-		if *debug > 0 {
-			println("fin stream", u)
-		}
-		resp.Body.Close()
-		bw.Flush()
-		pw.Close()
-	}()
-	br := bufio.NewReaderSize(pr, *maxbuf)
-	return io.NopCloser(br)
+	if *print {
+		m.Encode(os.Stdout)
+	}
+	return nil
+}
+
+type Pathy interface {
+	Path(string) string
+}
+
+// media lists the segments in m if listing was requested, otherwise
+// it returns the repackaged stream
+func media(m *hls.Media) io.ReadCloser {
+	if !*ls {
+		return rp.Encrypt(rp.Media(m), 0)
+	}
+	fmt.Fprintf(os.Stderr, "media playlist duration=%s\n", hls.Runtime(m.File...))
+	rp.Trim(m)
+	dst := &bytes.Buffer{}
+	if *abs {
+		list(m, dst)
+	} else {
+		stat(m, dst)
+	}
+	if *print {
+		m.Encode(os.Stderr)
+	}
+	return io.NopCloser(dst)
+}
+
+// printlocation returns u, or with -abs, its location relative to m
+func printlocation(m *hls.Media, u string) string {
+	if *abs {
+		return rp.Location(repack.Resolve(m.URL, u))
+	}
+	return u
 }
 
 func js(v any) string {
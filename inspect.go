@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/as/hls"
+	"github.com/as/hlscat/repack"
+)
+
+// inspect runs the inspect subcommand, which describes the variants,
+// I-frame streams and renditions of a master playlist
+//
+//	hlscat inspect [-json] [url]
+func inspect(args []string) error {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	asjson := fs.Bool("json", false, "print json instead of a table")
+	fs.Parse(args)
+	var (
+		m   *hls.Master
+		err error
+	)
+	if a := fs.Args(); len(a) > 0 {
+		m, _, err = rp.Load(a[0])
+	} else {
+		m, _, err = rp.Decode(os.Stdin, "")
+	}
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		return errors.New("inspect: not a master playlist")
+	}
+	in := repack.Inspect(m)
+	if *asjson {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		return enc.Encode(in)
+	}
+	return printinspection(in, os.Stdout)
+}
+
+func printinspection(in *repack.Inspection, dst io.Writer) error {
+	w := tabwriter.NewWriter(dst, 0, 8, 2, ' ', 0)
+	variants := func(title string, list []repack.Variant) {
+		if len(list) == 0 {
+			return
+		}
+		fmt.Fprintf(w, "%s\tBANDWIDTH\tAVERAGE\tRESOLUTION\tFPS\tRANGE\tCODECS\tAUDIO\tVIDEO\tSUBTITLES\tCC\tURL\n", title)
+		for i, v := range list {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", i,
+				num(v.Bandwidth), num(v.AverageBandwidth), resolution(v.Info.Video),
+				fps(v.Info.Video.FPS), blank(v.Range), codecs(v.Codecs),
+				blank(v.Audio), blank(v.Video), blank(v.Subtitles), blank(v.Captions), v.URL)
+		}
+		fmt.Fprintln(w)
+	}
+	variants("VARIANT", in.Variants)
+	variants("IFRAME", in.IFrames)
+	if len(in.Renditions) > 0 {
+		fmt.Fprintf(w, "TYPE\tGROUP\tNAME\tLANGUAGE\tCHANNELS\tFLAGS\tCODECS\tURI\n")
+		for _, r := range in.Renditions {
+			var flags []string
+			if r.Default {
+				flags = append(flags, "default")
+			}
+			if r.Autoselect {
+				flags = append(flags, "autoselect")
+			}
+			flags = append(flags, r.Characteristics...)
+			uri := r.URI
+			if r.Instream != "" {
+				uri = r.Instream
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.Type, r.Group, r.Name,
+				blank(r.Lang), blank(r.Channels), blank(strings.Join(flags, ",")), codecs(r.Codecs), blank(uri))
+		}
+		fmt.Fprintln(w)
+	}
+	for _, g := range in.Dangling {
+		fmt.Fprintf(w, "dangling: %s group %q has no renditions (variants %s)\n", g.Type, g.ID, ints(g.Variants))
+	}
+	for _, g := range in.Unused {
+		fmt.Fprintf(w, "unused: %s group %q is not referred to by any variant\n", g.Type, g.ID)
+	}
+	return w.Flush()
+}
+
+// codecs returns the readable names of the codecs, or - if there are
+// none
+func codecs(list []repack.Codec) string {
+	var s []string
+	for _, c := range list {
+		s = append(s, c.Name)
+	}
+	return blank(strings.Join(s, ", "))
+}
+
+func resolution(v repack.Video) string {
+	if v.Width == 0 && v.Height == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%dx%d", v.Width, v.Height)
+}
+
+func fps(f float64) string {
+	if f == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%g", f)
+}
+
+func num(n int) string {
+	if n == 0 {
+		return "-"
+	}
+	return fmt.Sprint(n)
+}
+
+func ints(a []int) string {
+	s := make([]string, len(a))
+	for i, n := range a {
+		s[i] = fmt.Sprint(n)
+	}
+	return strings.Join(s, ",")
+}
+
+// blank returns s, or - if it's empty
+func blank(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
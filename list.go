@@ -3,44 +3,52 @@ package main
 import (
 	"fmt"
 	"io"
-	"strings"
 	"time"
 
 	"github.com/as/hls"
+	"github.com/as/hlscat/repack"
 )
 
 func list(m *hls.Media, dst io.Writer) (err error) {
-	init := ""
+	init := hls.Map{}
 	for i := range m.File {
 		f := &m.File[i]
-		if newinit := f.Map.URI; newinit != "" && newinit != init && !*noinit {
-			fmt.Fprintf(dst, "%s\n", printlocation(f.Map.URI))
+		if newinit := f.Map; newinit.URI != "" && newinit != init && !*noinit {
+			fmt.Fprintf(dst, "%s%s\n", printlocation(m, f.Map.URI), printrange(repack.MapRange(&f.Map)))
 			init = newinit
 		}
-		fmt.Fprintf(dst, "%s\n", printlocation(f.Inf.URL))
+		fmt.Fprintf(dst, "%s%s\n", printlocation(m, f.Inf.URL), printrange(repack.FileRange(f)))
 	}
 	return nil
 }
 
 func stat(m *hls.Media, dst io.Writer) (err error) {
-	init := ""
+	init := hls.Map{}
 	t := time.Duration(0)
 	for i := range m.File {
 		f := &m.File[i]
-		if newinit := f.Map.URI; newinit != "" && newinit != init && !*noinit {
-			fmt.Fprintf(dst, "%s\n", printlocation(f.Map.URI))
+		if newinit := f.Map; newinit.URI != "" && newinit != init && !*noinit {
+			fmt.Fprintf(dst, "%s%s\n", printlocation(m, f.Map.URI), printrange(repack.MapRange(&f.Map)))
 			init = newinit
 		}
 		d := f.Duration(0)
 		t += d
-		fmt.Fprintf(dst, "%s	d=%f	t=%f\n", printlocation(f.Inf.URL), d.Seconds(), t.Seconds())
+		fmt.Fprintf(dst, "%s	d=%f	t=%f%s\n", printlocation(m, f.Inf.URL), d.Seconds(), t.Seconds(), printrange(repack.FileRange(f)))
 	}
 	return nil
 }
 
+// printrange returns the tab separated byte range for a listing, if any
+func printrange(b repack.ByteRange) string {
+	if b.Length == 0 {
+		return ""
+	}
+	return "\t" + b.String()
+}
+
 func listmaster(m *hls.Master, dst io.Writer) (err error) {
 	link := m.Path("")
-	dolist := func(f Pathy) {
+	dolist := func(f Pathy) error {
 		link := f.Path(link)
 		if *abs {
 			fmt.Fprintf(dst, "%s\n", link)
@@ -48,24 +56,30 @@ func listmaster(m *hls.Master, dst io.Writer) (err error) {
 			fmt.Fprintf(dst, "%s\n", f.Path(""))
 		}
 		if *recurse {
-			m := &hls.Media{URL: link}
-			err := m.Decode(strings.NewReader(string(download(link))))
+			mm, err := rp.Playlist(link)
 			if err != nil {
-				panic(err)
+				return err
 			}
-			io.Copy(dst, media(m))
+			io.Copy(dst, media(mm))
 			fmt.Fprintln(dst)
 			fmt.Fprintln(dst)
 		}
+		return nil
 	}
 	for i := range m.Media {
-		dolist(&m.Media[i])
+		if err := dolist(&m.Media[i]); err != nil {
+			return err
+		}
 	}
 	for i := range m.Stream {
-		dolist(&m.Stream[i])
+		if err := dolist(&m.Stream[i]); err != nil {
+			return err
+		}
 	}
 	for i := range m.IFrame {
-		dolist(&m.IFrame[i])
+		if err := dolist(&m.IFrame[i]); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -0,0 +1,126 @@
+// Package mp4 reads and writes fragmented ISO base media files
+package mp4
+
+import "encoding/binary"
+
+// buf builds nested boxes in memory. Box sizes are patched in
+// when each box is ended.
+type buf struct {
+	b     []byte
+	stack []int
+}
+
+func (w *buf) box(typ string) {
+	w.stack = append(w.stack, len(w.b))
+	w.u32(0)
+	w.b = append(w.b, typ[:4]...)
+}
+
+func (w *buf) full(typ string, version byte, flags uint32) {
+	w.box(typ)
+	w.u32(uint32(version)<<24 | flags&0xffffff)
+}
+
+func (w *buf) end() {
+	n := len(w.stack) - 1
+	at := w.stack[n]
+	w.stack = w.stack[:n]
+	binary.BigEndian.PutUint32(w.b[at:], uint32(len(w.b)-at))
+}
+
+func (w *buf) u8(v byte)    { w.b = append(w.b, v) }
+func (w *buf) u16(v uint16) { w.b = binary.BigEndian.AppendUint16(w.b, v) }
+func (w *buf) u32(v uint32) { w.b = binary.BigEndian.AppendUint32(w.b, v) }
+func (w *buf) u64(v uint64) { w.b = binary.BigEndian.AppendUint64(w.b, v) }
+func (w *buf) bytes(p []byte) {
+	w.b = append(w.b, p...)
+}
+func (w *buf) zero(n int) {
+	for ; n > 0; n-- {
+		w.b = append(w.b, 0)
+	}
+}
+
+// matrix writes the unity transformation matrix used by mvhd and tkhd
+func (w *buf) matrix() {
+	for _, v := range []uint32{0x10000, 0, 0, 0, 0x10000, 0, 0, 0, 0x40000000} {
+		w.u32(v)
+	}
+}
+
+// descriptor writes an mpeg-4 descriptor header with a fixed 4 byte size
+// field. The caller writes n bytes of body.
+func (w *buf) descriptor(tag byte, n int) {
+	w.u8(tag)
+	w.u8(0x80 | byte(n>>21&0x7f))
+	w.u8(0x80 | byte(n>>14&0x7f))
+	w.u8(0x80 | byte(n>>7&0x7f))
+	w.u8(byte(n & 0x7f))
+}
+
+// boxes calls fn with the type and body of each box in b
+func boxes(b []byte, fn func(typ string, body []byte)) {
+	each(b, func(box, body []byte) {
+		fn(string(box[4:8]), body)
+	})
+}
+
+// each calls fn with each whole box in b and its body. Both alias b, so
+// the box can be changed in place.
+func each(b []byte, fn func(box, body []byte)) {
+	for len(b) >= 8 {
+		n, h := uint64(binary.BigEndian.Uint32(b)), uint64(8)
+		if n == 1 {
+			if len(b) < 16 {
+				return
+			}
+			n, h = binary.BigEndian.Uint64(b[8:]), 16
+		} else if n == 0 {
+			n = uint64(len(b))
+		}
+		if n < h || n > uint64(len(b)) {
+			return
+		}
+		fn(b[:n], b[h:n])
+		b = b[n:]
+	}
+}
+
+// find returns the body of the first box found by descending
+// through the given path of box types, or nil
+func find(b []byte, path ...string) []byte {
+	for _, typ := range path {
+		var next []byte
+		boxes(b, func(t string, body []byte) {
+			if next == nil && t == typ {
+				next = body
+			}
+		})
+		if next == nil {
+			return nil
+		}
+		b = next
+	}
+	return b
+}
+
+func u16(b []byte, at int) int {
+	if at+2 > len(b) {
+		return 0
+	}
+	return int(binary.BigEndian.Uint16(b[at:]))
+}
+
+func u32(b []byte, at int) uint32 {
+	if at+4 > len(b) {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b[at:])
+}
+
+func u64(b []byte, at int) uint64 {
+	if at+8 > len(b) {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b[at:])
+}
@@ -0,0 +1,583 @@
+package mp4
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	ErrNoKey = errors.New("mp4: no key for key id")
+	ErrCENC  = errors.New("mp4: bad sample encryption")
+)
+
+// Decrypt copies the fragmented mp4 in src to dst and decrypts the samples
+// of the tracks protected with common encryption (the cenc, cens, cbc1 and
+// cbcs schemes). Key returns the content key for a key id, or nil if it
+// isn't known.
+//
+// The layout of the stream doesn't change. The encrypted sample entries
+// are renamed to their original formats, and the boxes that describe the
+// encryption (sinf, pssh, senc, saiz, saio and the seig sample groups)
+// become free boxes, so the output describes clear tracks.
+func Decrypt(dst io.Writer, src io.Reader, key func(kid []byte) []byte) error {
+	return NewDecrypter().Decrypt(dst, src, key)
+}
+
+// Decrypter decrypts a fragmented mp4 stream that arrives in pieces, like
+// the segments of a playlist, each of which may have its own keys
+type Decrypter struct {
+	key     func(kid []byte) []byte
+	track   map[uint32]*protection // by track_ID in the current init
+	defsize map[uint32]uint32      // default sample sizes from trex
+	block   map[string]cipher.Block
+	pos     int64 // stream offset of the next box
+}
+
+// NewDecrypter returns a Decrypter for a new stream
+func NewDecrypter() *Decrypter {
+	return &Decrypter{
+		track:   map[uint32]*protection{},
+		defsize: map[uint32]uint32{},
+	}
+}
+
+// Decrypt is like the Decrypt function for the next piece of the stream,
+// which must hold whole boxes. The init segment seen in an earlier piece
+// still applies, but the keys are looked up again.
+func (d *Decrypter) Decrypt(dst io.Writer, src io.Reader, key func(kid []byte) []byte) error {
+	d.key = key
+	d.block = map[string]cipher.Block{}
+	r := bufio.NewReaderSize(src, 64*1024)
+	w := bufio.NewWriterSize(dst, 64*1024)
+	var (
+		moof    []byte
+		moofpos int64
+	)
+	for {
+		box, hlen, err := readbox(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		start := d.pos
+		d.pos += int64(len(box))
+		switch string(box[4:8]) {
+		case "moov":
+			d.moov(box[hlen:])
+		case "moof":
+			if moof != nil {
+				if _, err = w.Write(moof); err != nil {
+					return err
+				}
+			}
+			moof, moofpos = box, start
+			continue
+		case "mdat":
+			if moof != nil {
+				if err = d.fragment(moof, moofpos, box[hlen:], start+int64(hlen)); err != nil {
+					return err
+				}
+			}
+		}
+		if moof != nil {
+			if _, err = w.Write(moof); err != nil {
+				return err
+			}
+			moof = nil
+		}
+		if _, err = w.Write(box); err != nil {
+			return err
+		}
+	}
+	if moof != nil {
+		if _, err := w.Write(moof); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// readbox reads the next top level box and returns all of it and the
+// length of its header
+func readbox(r *bufio.Reader) (box []byte, hlen int, err error) {
+	var h [16]byte
+	if _, err = io.ReadFull(r, h[:8]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return nil, 0, err
+	}
+	n, hlen := uint64(binary.BigEndian.Uint32(h[:])), 8
+	switch n {
+	case 0:
+		rest, err := io.ReadAll(r)
+		return append(h[:8:8], rest...), hlen, err
+	case 1:
+		if _, err = io.ReadFull(r, h[8:]); err != nil {
+			return nil, 0, err
+		}
+		n, hlen = binary.BigEndian.Uint64(h[8:]), 16
+	}
+	if n < uint64(hlen) || n > 1<<32 {
+		return nil, 0, ErrBox
+	}
+	box = make([]byte, n)
+	copy(box, h[:hlen])
+	if _, err = io.ReadFull(r, box[hlen:]); err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return box, hlen, err
+}
+
+// protection is the encryption of a track
+type protection struct {
+	scheme string       // cenc, cens, cbc1 or cbcs
+	enc    encryption   // the defaults from tenc
+	seig   []encryption // the seig sample group descriptions in stbl
+}
+
+// encryption is the encryption of a sample, described by a tenc box or
+// a seig sample group entry
+type encryption struct {
+	protected   bool
+	ivsize      int
+	kid         []byte
+	iv          []byte // the constant iv, if ivsize is zero
+	crypt, skip int    // the pattern, in 16 byte blocks
+}
+
+// subsample is a clear range followed by a protected one
+type subsample struct {
+	clear, protected int
+}
+
+// parseEncryption parses the layout shared by tenc (after its full box
+// header) and the seig entries. Tenc version 0 has no pattern, and its
+// pattern byte is reserved and zero.
+func parseEncryption(b []byte) (e encryption) {
+	if len(b) < 20 {
+		return e
+	}
+	e.crypt, e.skip = int(b[1]>>4), int(b[1]&0xf)
+	e.protected = b[2] != 0
+	e.ivsize = int(b[3])
+	e.kid = b[4:20]
+	if e.protected && e.ivsize == 0 && len(b) > 20 {
+		if n := int(b[20]); 21+n <= len(b) {
+			e.iv = b[21 : 21+n]
+		}
+	}
+	return e
+}
+
+func (d *Decrypter) moov(b []byte) {
+	d.track = map[uint32]*protection{}
+	boxes(find(b, "mvex"), func(typ string, body []byte) {
+		if typ == "trex" {
+			d.defsize[u32(body, 4)] = u32(body, 16)
+		}
+	})
+	each(b, func(box, body []byte) {
+		switch string(box[4:8]) {
+		case "pssh":
+			copy(box[4:8], "free")
+		case "trak":
+			d.trak(body)
+		}
+	})
+}
+
+// trak finds the protected sample entries of a track and renames them
+// to their original formats
+func (d *Decrypter) trak(b []byte) {
+	tkhd := find(b, "tkhd")
+	id := u32(tkhd, 12)
+	if len(tkhd) > 0 && tkhd[0] == 1 {
+		id = u32(tkhd, 20)
+	}
+	stbl := find(b, "mdia", "minf", "stbl")
+	stsd := find(stbl, "stsd")
+	if len(stsd) < 8 {
+		return
+	}
+	each(stsd[8:], func(entry, body []byte) {
+		n := 0 // the size of the sample entry before its child boxes
+		switch string(entry[4:8]) {
+		case "encv":
+			n = 78
+		case "enca":
+			n = 28
+			switch u16(body, 8) {
+			case 1:
+				n += 16
+			case 2:
+				n += 36
+			}
+		}
+		if n == 0 || n > len(body) {
+			return
+		}
+		each(body[n:], func(box, sinf []byte) {
+			if string(box[4:8]) != "sinf" {
+				return
+			}
+			frma, tenc := find(sinf, "frma"), find(sinf, "schi", "tenc")
+			if len(frma) < 4 || len(tenc) < 24 {
+				return
+			}
+			p := &protection{scheme: "cenc", enc: parseEncryption(tenc[4:])}
+			if schm := find(sinf, "schm"); len(schm) >= 8 {
+				p.scheme = string(schm[4:8])
+			}
+			p.seig = seig(stbl)
+			d.track[id] = p
+			copy(entry[4:8], frma[:4])
+			copy(box[4:8], "free")
+		})
+	})
+}
+
+// seig returns the seig sample group descriptions in the sgpd boxes of b
+func seig(b []byte) (e []encryption) {
+	boxes(b, func(typ string, sgpd []byte) {
+		if typ != "sgpd" || len(sgpd) < 12 || string(sgpd[4:8]) != "seig" {
+			return
+		}
+		version, at := sgpd[0], 8
+		size := 0
+		if version == 1 {
+			size = int(u32(sgpd, at))
+			at += 4
+		}
+		if version >= 2 {
+			at += 4 // default_sample_description_index
+		}
+		n := int(u32(sgpd, at))
+		at += 4
+		for i := 0; i < n && at < len(sgpd); i++ {
+			sz := size
+			if version == 1 && size == 0 {
+				sz = int(u32(sgpd, at))
+				at += 4
+			}
+			if sz == 0 {
+				sz = 20 // version 0 has no lengths, assume no constant iv
+				if at+20 < len(sgpd) && sgpd[at+2] != 0 && sgpd[at+3] == 0 {
+					sz = 21 + int(sgpd[at+20])
+				}
+			}
+			if at+sz > len(sgpd) {
+				break
+			}
+			e = append(e, parseEncryption(sgpd[at:at+sz]))
+			at += sz
+		}
+	})
+	return e
+}
+
+// fragment decrypts the samples of a moof in its mdat. Moofpos is the
+// stream offset of the moof box and mdatpos the offset of the mdat body.
+func (d *Decrypter) fragment(moof []byte, moofpos int64, mdat []byte, mdatpos int64) (err error) {
+	// data returns the n bytes at stream offset pos, in either box
+	data := func(pos, n int64) []byte {
+		if off := pos - mdatpos; off >= 0 && off+n <= int64(len(mdat)) {
+			return mdat[off : off+n]
+		}
+		if off := pos - moofpos; off >= 0 && off+n <= int64(len(moof)) {
+			return moof[off : off+n]
+		}
+		return nil
+	}
+	each(moof[8:], func(box, traf []byte) {
+		switch string(box[4:8]) {
+		case "pssh":
+			copy(box[4:8], "free")
+		case "traf":
+			if err == nil {
+				err = d.traf(traf, moofpos, data)
+			}
+		}
+	})
+	return err
+}
+
+func (d *Decrypter) traf(traf []byte, moofpos int64, data func(pos, n int64) []byte) error {
+	tfhd := find(traf, "tfhd")
+	id := u32(tfhd, 4)
+	p := d.track[id]
+	if p == nil {
+		return nil
+	}
+
+	// the samples, as stream offsets and sizes
+	flags := u32(tfhd, 0) & 0xffffff
+	size := d.defsize[id]
+	at := 8
+	if flags&0x1 != 0 {
+		at += 8 // base_data_offset: only meaningful in the original file
+	}
+	if flags&0x2 != 0 {
+		at += 4
+	}
+	if flags&0x8 != 0 {
+		at += 4
+	}
+	if flags&0x10 != 0 {
+		size = u32(tfhd, at)
+	}
+	var pos, sizes []int64
+	next := moofpos
+	boxes(traf, func(typ string, trun []byte) {
+		if typ != "trun" || len(trun) < 8 {
+			return
+		}
+		flags := u32(trun, 0) & 0xffffff
+		n := int(u32(trun, 4))
+		at := 8
+		if flags&0x1 != 0 {
+			next = moofpos + int64(int32(u32(trun, at)))
+			at += 4
+		}
+		if flags&0x4 != 0 {
+			at += 4
+		}
+		for i := 0; i < n && at <= len(trun); i++ {
+			sz := size
+			if flags&0x100 != 0 {
+				at += 4
+			}
+			if flags&0x200 != 0 {
+				sz = u32(trun, at)
+				at += 4
+			}
+			if flags&0x400 != 0 {
+				at += 4
+			}
+			if flags&0x800 != 0 {
+				at += 4
+			}
+			pos, sizes = append(pos, next), append(sizes, int64(sz))
+			next += int64(sz)
+		}
+	})
+
+	// the encryption of each sample, from the seig sample group
+	enc := make([]encryption, len(pos))
+	for i := range enc {
+		enc[i] = p.enc
+	}
+	local := seig(traf)
+	i := 0
+	boxes(traf, func(typ string, sbgp []byte) {
+		if typ != "sbgp" || len(sbgp) < 12 || string(sbgp[4:8]) != "seig" {
+			return
+		}
+		at := 8
+		if sbgp[0] == 1 {
+			at += 4
+		}
+		n := int(u32(sbgp, at))
+		at += 4
+		for ; n > 0 && at+8 <= len(sbgp); n-- {
+			count, index := int(u32(sbgp, at)), int(u32(sbgp, at+4))
+			at += 8
+			for ; count > 0 && i < len(enc); count-- {
+				switch {
+				case index > 0x10000 && index-0x10001 < len(local):
+					enc[i] = local[index-0x10001]
+				case index > 0 && index <= len(p.seig):
+					enc[i] = p.seig[index-1]
+				}
+				i++
+			}
+		}
+	})
+
+	// the iv and subsamples of each sample, from senc or saiz and saio
+	iv := make([][]byte, len(pos))
+	sub := make([][]subsample, len(pos))
+	if senc := find(traf, "senc"); len(senc) >= 8 {
+		subs := u32(senc, 0)&0x2 != 0
+		b := senc[8:]
+		for i := 0; i < len(pos) && i < int(u32(senc, 4)); i++ {
+			var n int
+			if iv[i], sub[i], n = auxinfo(b, enc[i].ivsize, subs); n < 0 {
+				return ErrCENC
+			}
+			b = b[n:]
+		}
+	} else if saiz, saio := find(traf, "saiz"), find(traf, "saio"); len(saiz) >= 9 && len(saio) >= 12 {
+		at := 4
+		if u32(saiz, 0)&1 != 0 {
+			at += 8
+		}
+		def, n := int(saiz[at]), int(u32(saiz, at+1))
+		at += 5
+		oat := 4
+		if u32(saio, 0)&1 != 0 {
+			oat += 8
+		}
+		off := int64(u32(saio, oat+4))
+		if saio[0] == 1 {
+			off = int64(u64(saio, oat+4))
+		}
+		next := moofpos + off
+		for i := 0; i < len(pos) && i < n; i++ {
+			sz := def
+			if def == 0 {
+				if at >= len(saiz) {
+					return ErrCENC
+				}
+				sz = int(saiz[at])
+				at++
+			}
+			b := data(next, int64(sz))
+			if b == nil {
+				return ErrCENC
+			}
+			var m int
+			if iv[i], sub[i], m = auxinfo(b, enc[i].ivsize, sz > enc[i].ivsize); m < 0 {
+				return ErrCENC
+			}
+			next += int64(sz)
+		}
+	}
+
+	for i := range pos {
+		if !enc[i].protected {
+			continue
+		}
+		b := data(pos[i], sizes[i])
+		if b == nil {
+			return ErrCENC
+		}
+		if err := d.sample(p.scheme, enc[i], b, iv[i], sub[i]); err != nil {
+			return err
+		}
+	}
+
+	each(traf, func(box, body []byte) {
+		switch string(box[4:8]) {
+		case "senc", "saiz", "saio":
+			copy(box[4:8], "free")
+		case "sbgp", "sgpd":
+			if len(body) >= 8 && string(body[4:8]) == "seig" {
+				copy(box[4:8], "free")
+			}
+		}
+	})
+	return nil
+}
+
+// auxinfo parses the sample auxiliary information of one sample: its iv,
+// followed by its subsamples if subs is set. It returns the length of the
+// information, or -1 if it's truncated.
+func auxinfo(b []byte, ivsize int, subs bool) (iv []byte, sub []subsample, n int) {
+	if ivsize > len(b) {
+		return nil, nil, -1
+	}
+	iv, n = b[:ivsize], ivsize
+	if !subs {
+		return iv, nil, n
+	}
+	if n+2 > len(b) {
+		return nil, nil, -1
+	}
+	count := u16(b, n)
+	n += 2
+	if n+6*count > len(b) {
+		return nil, nil, -1
+	}
+	for i := 0; i < count; i++ {
+		sub = append(sub, subsample{u16(b, n), int(u32(b, n+2))})
+		n += 6
+	}
+	return iv, sub, n
+}
+
+// sample decrypts one sample in place
+func (d *Decrypter) sample(scheme string, e encryption, data, iv []byte, sub []subsample) error {
+	block, err := d.cipher(e.kid)
+	if err != nil {
+		return err
+	}
+	if len(iv) == 0 {
+		iv = e.iv
+	}
+	ivb := make([]byte, aes.BlockSize)
+	copy(ivb, iv) // an 8 byte iv is the upper half of the counter
+	if len(sub) == 0 {
+		sub = []subsample{{0, len(data)}}
+	}
+	ctr := scheme == "cenc" || scheme == "cens"
+	var (
+		stream cipher.Stream
+		cbc    cipher.BlockMode
+	)
+	if ctr {
+		stream = cipher.NewCTR(block, ivb)
+	} else {
+		cbc = cipher.NewCBCDecrypter(block, ivb)
+	}
+	decrypt := func(b []byte) {
+		if ctr {
+			stream.XORKeyStream(b, b)
+			return
+		}
+		b = b[:len(b)/aes.BlockSize*aes.BlockSize]
+		cbc.CryptBlocks(b, b)
+	}
+	for _, s := range sub {
+		if s.clear+s.protected > len(data) {
+			return ErrCENC
+		}
+		data = data[s.clear:]
+		if scheme == "cbcs" {
+			// the chain starts over with every subsample
+			cbc = cipher.NewCBCDecrypter(block, ivb)
+		}
+		pattern(data[:s.protected], e.crypt, e.skip, decrypt)
+		data = data[s.protected:]
+	}
+	return nil
+}
+
+// pattern calls fn with the encrypted parts of a protected range: crypt
+// blocks out of every crypt+skip, or all of it if there's no pattern. A
+// partial block at the end of a pattern is clear.
+func pattern(p []byte, crypt, skip int, fn func([]byte)) {
+	if crypt == 0 {
+		fn(p)
+		return
+	}
+	for len(p) >= aes.BlockSize {
+		n := min(crypt*aes.BlockSize, len(p)/aes.BlockSize*aes.BlockSize)
+		fn(p[:n])
+		p = p[n:]
+		p = p[min(skip*aes.BlockSize, len(p)):]
+	}
+}
+
+func (d *Decrypter) cipher(kid []byte) (cipher.Block, error) {
+	if b := d.block[string(kid)]; b != nil {
+		return b, nil
+	}
+	key := d.key(kid)
+	if key == nil {
+		return nil, fmt.Errorf("%w %x", ErrNoKey, kid)
+	}
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	d.block[string(kid)] = b
+	return b, nil
+}
@@ -0,0 +1,424 @@
+package mp4
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/as/hlscat/av"
+)
+
+var ErrBox = errors.New("mp4: bad box")
+
+// MaxJump is the largest gap between two consecutive fragments of the same
+// track that is not treated as a discontinuity
+var MaxJump = 2 * time.Second
+
+// Reader is an av.Demuxer for fragmented mp4: an init segment followed by
+// any number of moof/mdat pairs. Init segments may repeat, as they do when
+// hls segments are concatenated, and the tracks of a new init continue the
+// existing tracks with the same codec.
+type Reader struct {
+	r      *bufio.Reader
+	pos    int64 // stream offset of the next box
+	tracks []*av.Track
+	trak   map[uint32]*trak // by track_ID in the current init
+	out    []av.Sample
+	offset time.Duration // added to every timestamp
+
+	moof    []byte
+	moofpos int64
+}
+
+// trak is a track in the current init segment
+type trak struct {
+	track  *av.Track
+	config []byte
+	inject bool // config differs from track's and goes in-band
+
+	timescale int64
+	defdur    uint32
+	defsize   uint32
+	defflags  uint32
+
+	started bool
+	next    int64 // decode time after the last sample, in timescale units
+}
+
+// NewReader returns a Reader that demuxes the fragmented mp4 in r
+func NewReader(r io.Reader) *Reader {
+	return &Reader{
+		r:    bufio.NewReaderSize(r, 64*1024),
+		trak: map[uint32]*trak{},
+	}
+}
+
+// Tracks returns the tracks declared by the init segments read so far
+func (d *Reader) Tracks() []*av.Track {
+	return d.tracks
+}
+
+// ReadSample returns the next sample in the stream
+func (d *Reader) ReadSample() (s av.Sample, err error) {
+	for len(d.out) == 0 {
+		typ, body, pos, err := d.box()
+		if err != nil {
+			return s, err
+		}
+		switch typ {
+		case "moov":
+			d.moov(body)
+		case "moof":
+			d.moof, d.moofpos = body, pos
+		case "mdat":
+			if d.moof != nil {
+				d.fragment(d.moof, d.moofpos, body, pos)
+				d.moof = nil
+			}
+		}
+	}
+	s, d.out = d.out[0], d.out[1:]
+	return s, nil
+}
+
+// box reads the next top level box and returns its type, its body, and the
+// stream offset of the body
+func (d *Reader) box() (typ string, body []byte, pos int64, err error) {
+	var h [16]byte
+	if _, err = io.ReadFull(d.r, h[:8]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return
+	}
+	n, hlen := uint64(binary.BigEndian.Uint32(h[:])), uint64(8)
+	typ = string(h[4:8])
+	switch n {
+	case 0:
+		body, err = io.ReadAll(d.r)
+		d.pos += 8
+		pos = d.pos
+		d.pos += int64(len(body))
+		return typ, body, pos, err
+	case 1:
+		if _, err = io.ReadFull(d.r, h[8:]); err != nil {
+			return
+		}
+		n, hlen = binary.BigEndian.Uint64(h[8:]), 16
+	}
+	if n < hlen || n-hlen > 1<<32 {
+		return typ, nil, 0, ErrBox
+	}
+	body = make([]byte, n-hlen)
+	if _, err = io.ReadFull(d.r, body); err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	pos = d.pos + int64(hlen)
+	d.pos += int64(n)
+	return typ, body, pos, err
+}
+
+func (d *Reader) moov(b []byte) {
+	trex := map[uint32][]byte{}
+	boxes(find(b, "mvex"), func(typ string, body []byte) {
+		if typ == "trex" {
+			trex[u32(body, 4)] = body
+		}
+	})
+	old := d.trak
+	d.trak = map[uint32]*trak{}
+	used := map[*av.Track]bool{}
+	boxes(b, func(typ string, body []byte) {
+		if typ != "trak" {
+			return
+		}
+		t, id := parsetrak(body)
+		if t == nil {
+			return
+		}
+		if x := trex[id]; x != nil {
+			t.defdur, t.defsize, t.defflags = u32(x, 12), u32(x, 16), u32(x, 20)
+		}
+		var track *av.Track
+		for _, v := range d.tracks {
+			if v.Codec == t.track.Codec && !used[v] {
+				track = v
+				break
+			}
+		}
+		if track == nil {
+			t.track.ID = len(d.tracks) + 1
+			d.tracks = append(d.tracks, t.track)
+		} else {
+			t.inject = !bytes.Equal(track.Config, t.config)
+			t.track = track
+			for _, o := range old {
+				if o.track == track {
+					t.started, t.next = o.started, av.Rescale(o.next, o.timescale, t.timescale)
+				}
+			}
+		}
+		used[t.track] = true
+		d.trak[id] = t
+	})
+}
+
+// parsetrak returns the track described by a trak box and its track_ID,
+// or nil if the codec isn't supported
+func parsetrak(b []byte) (*trak, uint32) {
+	tkhd := find(b, "tkhd")
+	id := u32(tkhd, 12)
+	if len(tkhd) > 0 && tkhd[0] == 1 {
+		id = u32(tkhd, 20)
+	}
+	mdhd := find(b, "mdia", "mdhd")
+	timescale, lang := u32(mdhd, 12), u16(mdhd, 20)
+	if len(mdhd) > 0 && mdhd[0] == 1 {
+		timescale, lang = u32(mdhd, 20), u16(mdhd, 32)
+	}
+	stsd := find(b, "mdia", "minf", "stbl", "stsd")
+	if len(stsd) < 8 || timescale == 0 {
+		return nil, 0
+	}
+	t := &av.Track{Timescale: int(timescale), Lang: unpacklang(lang)}
+	boxes(stsd[8:], func(typ string, body []byte) {
+		if t.Codec != "" {
+			return
+		}
+		switch typ {
+		case "avc1", "avc3", "hvc1", "hev1":
+			if len(body) < 78 {
+				return
+			}
+			t.Kind, t.Codec = av.Video, "h264"
+			cfg := "avcC"
+			if typ[0] == 'h' {
+				t.Codec, cfg = "h265", "hvcC"
+			}
+			t.Width, t.Height = u16(body, 24), u16(body, 26)
+			t.Config = find(body[78:], cfg)
+		case "mp4a":
+			if len(body) < 28 {
+				return
+			}
+			n := 28
+			switch u16(body, 8) {
+			case 1:
+				n += 16
+			case 2:
+				n += 36
+			}
+			if n > len(body) {
+				return
+			}
+			t.Kind, t.Codec = av.Audio, "aac"
+			t.Channels, t.SampleRate = u16(body, 16), int(u32(body, 24)>>16)
+			t.Config = esds(find(body[n:], "esds"))
+			if _, rate, ch, err := av.ParseAACConfig(t.Config); err == nil {
+				t.SampleRate = rate
+				if ch != 0 {
+					t.Channels = ch
+				}
+			}
+		}
+	})
+	if t.Codec == "" || t.Config == nil {
+		return nil, 0
+	}
+	t.Config = append([]byte{}, t.Config...)
+	return &trak{track: t, config: t.Config, timescale: int64(timescale)}, id
+}
+
+// esds returns the DecoderSpecificInfo in an esds box
+func esds(b []byte) []byte {
+	if len(b) < 4 {
+		return nil
+	}
+	b = b[4:]
+	for len(b) > 0 {
+		tag := b[0]
+		n, i := 0, 1
+		for ; i < len(b) && i <= 4; i++ {
+			n = n<<7 | int(b[i]&0x7f)
+			if b[i]&0x80 == 0 {
+				i++
+				break
+			}
+		}
+		b = b[i:]
+		if n > len(b) {
+			return nil
+		}
+		switch tag {
+		case 3: // ES_Descriptor
+			if len(b) < 3 {
+				return nil
+			}
+			flags, skip := b[2], 3
+			if flags&0x80 != 0 {
+				skip += 2
+			}
+			if flags&0x40 != 0 && len(b) > skip {
+				skip += 1 + int(b[skip])
+			}
+			if flags&0x20 != 0 {
+				skip += 2
+			}
+			if skip > n {
+				return nil
+			}
+			b = b[skip:n]
+		case 4: // DecoderConfigDescriptor
+			if n < 13 {
+				return nil
+			}
+			b = b[13:n]
+		case 5: // DecoderSpecificInfo
+			return b[:n]
+		default:
+			b = b[n:]
+		}
+	}
+	return nil
+}
+
+func unpacklang(v int) string {
+	if v == 0 || v == 0x7fff {
+		return ""
+	}
+	l := []byte{byte(v>>10&0x1f) + 0x60, byte(v>>5&0x1f) + 0x60, byte(v&0x1f) + 0x60}
+	if string(l) == "und" {
+		return ""
+	}
+	return string(l)
+}
+
+// fragment converts a moof and its mdat into samples. Moofpos and mdatpos
+// are the stream offsets of their bodies.
+func (d *Reader) fragment(moof []byte, moofpos int64, mdat []byte, mdatpos int64) {
+	start := moofpos - 8 // data offsets are relative to the moof header
+	var out []av.Sample
+	boxes(moof, func(typ string, traf []byte) {
+		if typ != "traf" {
+			return
+		}
+		tfhd := find(traf, "tfhd")
+		t := d.trak[u32(tfhd, 4)]
+		if t == nil {
+			return
+		}
+		flags := u32(tfhd, 0) & 0xffffff
+		dur, size, sflags := t.defdur, t.defsize, t.defflags
+		at := 8
+		if flags&0x1 != 0 {
+			at += 8 // base_data_offset: only meaningful in the original file
+		}
+		if flags&0x2 != 0 {
+			at += 4
+		}
+		if flags&0x8 != 0 {
+			dur = u32(tfhd, at)
+			at += 4
+		}
+		if flags&0x10 != 0 {
+			size = u32(tfhd, at)
+			at += 4
+		}
+		if flags&0x20 != 0 {
+			sflags = u32(tfhd, at)
+		}
+		dts := t.next
+		if tfdt := find(traf, "tfdt"); tfdt != nil {
+			dts = int64(u32(tfdt, 4))
+			if tfdt[0] == 1 {
+				dts = int64(u64(tfdt, 4))
+			}
+		}
+		dts = d.continuous(t, dts)
+		inject := t.inject
+
+		data := start
+		boxes(traf, func(typ string, trun []byte) {
+			if typ != "trun" || len(trun) < 8 {
+				return
+			}
+			version, flags := trun[0], u32(trun, 0)&0xffffff
+			n := int(u32(trun, 4))
+			at := 8
+			if flags&0x1 != 0 {
+				data = start + int64(int32(u32(trun, at)))
+				at += 4
+			}
+			first, firstset := uint32(0), flags&0x4 != 0
+			if firstset {
+				first = u32(trun, at)
+				at += 4
+			}
+			for i := 0; i < n && at <= len(trun); i++ {
+				s := av.Sample{Track: t.track.ID, DTS: dts, Dur: int64(dur)}
+				sz, fl, cto := size, sflags, int64(0)
+				if flags&0x100 != 0 {
+					s.Dur = int64(u32(trun, at))
+					at += 4
+				}
+				if flags&0x200 != 0 {
+					sz = u32(trun, at)
+					at += 4
+				}
+				if flags&0x400 != 0 {
+					fl = u32(trun, at)
+					at += 4
+				} else if i == 0 && firstset {
+					fl = first
+				}
+				if flags&0x800 != 0 {
+					cto = int64(u32(trun, at))
+					if version == 1 {
+						cto = int64(int32(u32(trun, at)))
+					}
+					at += 4
+				}
+				s.PTS = dts + cto
+				s.Key = fl&0x10000 == 0
+				if off := data - mdatpos; off >= 0 && off+int64(sz) <= int64(len(mdat)) {
+					s.Data = mdat[off : off+int64(sz)]
+					if inject && s.Key && t.track.Kind == av.Video {
+						s.Data = append(av.JoinAVCC((&av.Track{Codec: t.track.Codec, Config: t.config}).Params()...), s.Data...)
+					}
+					out = append(out, s)
+				}
+				data += int64(sz)
+				dts += s.Dur
+			}
+		})
+		t.next = dts
+	})
+	// interleave the tracks of the fragment
+	sort.SliceStable(out, func(i, j int) bool {
+		ti, tj := d.tracks[out[i].Track-1], d.tracks[out[j].Track-1]
+		return out[i].DTS*int64(tj.Timescale) < out[j].DTS*int64(ti.Timescale)
+	})
+	d.out = append(d.out, out...)
+}
+
+// continuous applies the reader's clock offset to the fragment's decode
+// time and adjusts the offset when the track jumps, keeping every track
+// in the reader in sync
+func (d *Reader) continuous(t *trak, dts int64) int64 {
+	ts := t.timescale
+	dts += av.Rescale(int64(d.offset), int64(time.Second), ts)
+	if t.started {
+		jump := av.Rescale(int64(MaxJump), int64(time.Second), ts)
+		if delta := dts - t.next; delta < -jump || delta > jump {
+			fix := t.next - dts
+			d.offset += time.Duration(av.Rescale(fix, ts, int64(time.Second)))
+			dts += fix
+		}
+	}
+	t.started = true
+	return dts
+}
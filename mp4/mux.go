@@ -0,0 +1,410 @@
+package mp4
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/as/hlscat/av"
+)
+
+var ErrCodec = errors.New("mp4: unsupported codec")
+
+// Sample flags for trun entries
+const (
+	flagSync    = 0x02000000 // sample_depends_on=2
+	flagNonSync = 0x01010000 // sample_depends_on=1, sample_is_non_sync_sample=1
+)
+
+// Writer is an av.Muxer that writes a fragmented mp4 with an empty moov,
+// equivalent to ffmpeg's -movflags empty_moov+default_base_moof
+type Writer struct {
+	// FragDur is the minimum duration of a fragment. If there is a video
+	// track, fragments are cut on its keyframes once they are at least
+	// this long.
+	FragDur time.Duration
+
+	w      io.Writer
+	tracks []*track
+	byid   map[int]*track
+	lead   *track
+	seq    uint32
+}
+
+type track struct {
+	*av.Track
+	pending []av.Sample
+	dur     int64 // the most recent sample duration
+}
+
+// NewWriter returns a Writer that writes to w
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{
+		FragDur: 10 * time.Second,
+		w:       w,
+		byid:    map[int]*track{},
+	}
+}
+
+// WriteHeader writes the ftyp and moov boxes for the given tracks
+func (w *Writer) WriteHeader(tracks ...*av.Track) error {
+	b := &buf{}
+	b.box("ftyp")
+	b.bytes([]byte("iso5"))
+	b.u32(512)
+	b.bytes([]byte("iso5iso6mp41"))
+	b.end()
+
+	b.box("moov")
+	b.full("mvhd", 0, 0)
+	b.zero(8)
+	b.u32(1000)
+	b.u32(0)
+	b.u32(0x10000)
+	b.u16(0x100)
+	b.zero(10)
+	b.matrix()
+	b.zero(24)
+	b.u32(uint32(len(tracks) + 1))
+	b.end()
+	for _, t := range tracks {
+		if err := trakbox(b, t, enabled(t, tracks), group(t, tracks)); err != nil {
+			return err
+		}
+		tr := &track{Track: t}
+		w.tracks = append(w.tracks, tr)
+		w.byid[t.ID] = tr
+		if w.lead == nil || (t.Kind == av.Video && w.lead.Kind != av.Video) {
+			w.lead = tr
+		}
+	}
+	b.box("mvex")
+	for _, t := range tracks {
+		b.full("trex", 0, 0)
+		b.u32(uint32(t.ID))
+		b.u32(1)
+		b.zero(12)
+		b.end()
+	}
+	b.end()
+	b.end()
+	_, err := w.w.Write(b.b)
+	return err
+}
+
+// enabled reports whether t is played by default: tracks are, unless
+// another track of their kind is the default. Text tracks are only
+// enabled as the default.
+func enabled(t *av.Track, tracks []*av.Track) bool {
+	if t.Default || t.Kind == av.Video {
+		return true
+	}
+	for _, v := range tracks {
+		if v.Kind == t.Kind && v.Default {
+			return false
+		}
+	}
+	return t.Kind != av.Text
+}
+
+// group returns the alternate group of t, which is shared by the
+// tracks of its kind when there's more than one of them
+func group(t *av.Track, tracks []*av.Track) uint16 {
+	n := 0
+	for _, v := range tracks {
+		if v.Kind == t.Kind {
+			n++
+		}
+	}
+	if n < 2 {
+		return 0
+	}
+	return uint16(t.Kind)
+}
+
+func trakbox(b *buf, t *av.Track, enabled bool, group uint16) error {
+	handler, name := "vide", "VideoHandler"
+	switch t.Kind {
+	case av.Audio:
+		handler, name = "soun", "SoundHandler"
+	case av.Text:
+		handler, name = "text", "TextHandler"
+	}
+	if t.Name != "" {
+		name = t.Name
+	}
+	flags := uint32(3) // enabled, in movie
+	if !enabled {
+		flags = 2
+	}
+	b.box("trak")
+	b.full("tkhd", 0, flags)
+	b.zero(8)
+	b.u32(uint32(t.ID))
+	b.zero(4 + 4 + 8)
+	b.u16(0)     // layer
+	b.u16(group) // alternate group
+	if t.Kind == av.Audio {
+		b.u16(0x100)
+	} else {
+		b.u16(0)
+	}
+	b.u16(0)
+	b.matrix()
+	b.u32(uint32(t.Width) << 16)
+	b.u32(uint32(t.Height) << 16)
+	b.end()
+
+	b.box("mdia")
+	b.full("mdhd", 0, 0)
+	b.zero(8)
+	b.u32(uint32(t.Timescale))
+	b.u32(0)
+	b.u16(language(t.Lang))
+	b.u16(0)
+	b.end()
+	b.full("hdlr", 0, 0)
+	b.u32(0)
+	b.bytes([]byte(handler))
+	b.zero(12)
+	b.bytes([]byte(name))
+	b.u8(0)
+	b.end()
+
+	b.box("minf")
+	switch t.Kind {
+	case av.Audio:
+		b.full("smhd", 0, 0)
+		b.u32(0)
+	case av.Text:
+		b.full("nmhd", 0, 0)
+	default:
+		b.full("vmhd", 0, 1)
+		b.zero(8)
+	}
+	b.end()
+	b.box("dinf")
+	b.full("dref", 0, 0)
+	b.u32(1)
+	b.full("url ", 0, 1)
+	b.end()
+	b.end()
+	b.end()
+
+	b.box("stbl")
+	b.full("stsd", 0, 0)
+	b.u32(1)
+	if err := sampleEntry(b, t); err != nil {
+		return err
+	}
+	b.end()
+	for _, typ := range []string{"stts", "stsc", "stco"} {
+		b.full(typ, 0, 0)
+		b.u32(0)
+		b.end()
+	}
+	b.full("stsz", 0, 0)
+	b.u32(0)
+	b.u32(0)
+	b.end()
+	b.end() // stbl
+	b.end() // minf
+	b.end() // mdia
+	b.end() // trak
+	return nil
+}
+
+func sampleEntry(b *buf, t *av.Track) error {
+	switch t.Codec {
+	case "h264", "h265":
+		typ, cfg := "avc1", "avcC"
+		if t.Codec == "h265" {
+			typ, cfg = "hvc1", "hvcC"
+		}
+		b.box(typ)
+		b.zero(6)
+		b.u16(1) // data_reference_index
+		b.zero(16)
+		b.u16(uint16(t.Width))
+		b.u16(uint16(t.Height))
+		b.u32(0x480000)
+		b.u32(0x480000)
+		b.u32(0)
+		b.u16(1) // frame_count
+		b.zero(32)
+		b.u16(0x18)
+		b.u16(0xffff)
+		b.box(cfg)
+		b.bytes(t.Config)
+		b.end()
+		b.end()
+	case "aac":
+		b.box("mp4a")
+		b.zero(6)
+		b.u16(1)
+		b.zero(8)
+		b.u16(uint16(t.Channels))
+		b.u16(16)
+		b.u32(0)
+		// the rate is 16.16 fixed point; like ffmpeg, rates that don't fit
+		// are left to the AudioSpecificConfig and the media timescale
+		if t.SampleRate <= 0xffff {
+			b.u32(uint32(t.SampleRate) << 16)
+		} else {
+			b.u32(0)
+		}
+		b.full("esds", 0, 0)
+		dcd := 13 + 5 + len(t.Config)
+		b.descriptor(3, 3+5+dcd+5+1)
+		b.u16(uint16(t.ID))
+		b.u8(0)
+		b.descriptor(4, dcd)
+		b.u8(0x40) // mpeg-4 audio
+		b.u8(0x15) // audio stream
+		b.zero(3 + 4 + 4)
+		b.descriptor(5, len(t.Config))
+		b.bytes(t.Config)
+		b.descriptor(6, 1)
+		b.u8(2)
+		b.end()
+		b.end()
+	case "wvtt":
+		b.box("wvtt")
+		b.zero(6)
+		b.u16(1)
+		b.box("vttC")
+		b.bytes(t.Config)
+		b.end()
+		b.end()
+	default:
+		return ErrCodec
+	}
+	return nil
+}
+
+// language packs a language into the mdhd format
+func language(lang string) uint16 {
+	lang = av.Lang3(lang)
+	return uint16(lang[0]-0x60)<<10 | uint16(lang[1]-0x60)<<5 | uint16(lang[2]-0x60)
+}
+
+// WriteSample buffers a sample and writes a fragment when the lead track
+// reaches a cut point
+func (w *Writer) WriteSample(s av.Sample) error {
+	t := w.byid[s.Track]
+	if t == nil {
+		return nil
+	}
+	if t == w.lead && len(t.pending) > 0 && (s.Key || t.Kind != av.Video) {
+		first := t.pending[0].DTS
+		if time.Duration(s.DTS-first)*time.Second/time.Duration(t.Timescale) >= w.FragDur {
+			t.settle(s.DTS)
+			if err := w.flush(); err != nil {
+				return err
+			}
+		}
+	}
+	t.settle(s.DTS)
+	t.pending = append(t.pending, s)
+	return nil
+}
+
+// settle sets the duration of the last pending sample now that the
+// decode time of the sample after it is known
+func (t *track) settle(next int64) {
+	if len(t.pending) == 0 {
+		return
+	}
+	prev := &t.pending[len(t.pending)-1]
+	if d := next - prev.DTS; d > 0 {
+		prev.Dur = d
+	}
+	if prev.Dur > 0 {
+		t.dur = prev.Dur
+	}
+}
+
+// Close writes any buffered samples as a final fragment
+func (w *Writer) Close() error {
+	return w.flush()
+}
+
+// Cut writes the buffered samples as a fragment, so the stream can be
+// split before the next sample
+func (w *Writer) Cut() error {
+	return w.flush()
+}
+
+func (w *Writer) flush() error {
+	n := 0
+	for _, t := range w.tracks {
+		n += len(t.pending)
+	}
+	if n == 0 {
+		return nil
+	}
+	b := &buf{}
+	var at []int
+	var data [][]av.Sample
+	w.seq++
+	b.box("moof")
+	b.full("mfhd", 0, 0)
+	b.u32(w.seq)
+	b.end()
+	for _, t := range w.tracks {
+		if len(t.pending) == 0 {
+			continue
+		}
+		last := &t.pending[len(t.pending)-1]
+		if last.Dur <= 0 {
+			last.Dur = t.dur
+		}
+		base := t.pending[0].DTS
+		if base < 0 {
+			base = 0
+		}
+		b.box("traf")
+		b.full("tfhd", 0, 0x020000)
+		b.u32(uint32(t.ID))
+		b.end()
+		b.full("tfdt", 1, 0)
+		b.u64(uint64(base))
+		b.end()
+		b.full("trun", 1, 0xf01)
+		b.u32(uint32(len(t.pending)))
+		at = append(at, len(b.b))
+		b.u32(0)
+		for _, s := range t.pending {
+			b.u32(uint32(s.Dur))
+			b.u32(uint32(len(s.Data)))
+			if s.Key {
+				b.u32(flagSync)
+			} else {
+				b.u32(flagNonSync)
+			}
+			b.u32(uint32(s.PTS - s.DTS))
+		}
+		b.end()
+		b.end()
+		data = append(data, t.pending)
+		t.pending = nil
+	}
+	b.end()
+	offset := len(b.b) + 8
+	for i, samples := range data {
+		binary.BigEndian.PutUint32(b.b[at[i]:], uint32(offset))
+		for _, s := range samples {
+			offset += len(s.Data)
+		}
+	}
+	b.box("mdat")
+	for _, samples := range data {
+		for _, s := range samples {
+			b.bytes(s.Data)
+		}
+	}
+	b.end()
+	_, err := w.w.Write(b.b)
+	return err
+}
@@ -0,0 +1,52 @@
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/as/hlscat/av"
+)
+
+func TestSampleRate(t *testing.T) {
+	for _, tc := range []struct {
+		rate, index int
+		field       uint32 // samplerate of the mp4a sample entry
+	}{
+		{44100, 4, 44100 << 16},
+		{48000, 3, 48000 << 16},
+		{96000, 0, 0},
+	} {
+		var out bytes.Buffer
+		w := NewWriter(&out)
+		a := &av.Track{ID: 1, Kind: av.Audio, Codec: "aac", Timescale: tc.rate, SampleRate: tc.rate, Channels: 2, Config: av.AACConfig(2, tc.index, 2)}
+		if err := w.WriteHeader(a); err != nil {
+			t.Fatal(err)
+		}
+		for i := int64(0); i < 4; i++ {
+			if err := w.WriteSample(av.Sample{Track: 1, DTS: i * av.AACFrameSize, PTS: i * av.AACFrameSize, Key: true, Data: []byte{0x21, byte(i)}}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		i := bytes.Index(out.Bytes(), []byte("mp4a"))
+		if i < 0 {
+			t.Fatalf("%d: no mp4a box", tc.rate)
+		}
+		if field := binary.BigEndian.Uint32(out.Bytes()[i+4+24:]); field != tc.field {
+			t.Errorf("%d: samplerate field %#x, want %#x", tc.rate, field, tc.field)
+		}
+		d := NewReader(bytes.NewReader(out.Bytes()))
+		n := 0
+		for ; ; n++ {
+			if _, err := d.ReadSample(); err != nil {
+				break
+			}
+		}
+		if tr := d.Tracks(); len(tr) != 1 || tr[0].SampleRate != tc.rate || n != 4 {
+			t.Errorf("%d: read back %d samples of %+v", tc.rate, n, tr)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"strings"
+
+	"github.com/as/hls"
+)
+
+// probe runs the probe subcommand, which prints the settings of the
+// video and audio of a playlist as json. Of a master playlist, the
+// variant and audio rendition that would be repackaged are probed.
+//
+//	hlscat probe [url]
+func probe(args []string) error {
+	fs := flag.NewFlagSet("probe", flag.ExitOnError)
+	fs.Parse(args)
+	var (
+		m   *hls.Master
+		mm  *hls.Media
+		err error
+	)
+	if a := fs.Args(); len(a) > 0 {
+		m, mm, err = rp.Load(a[0])
+	} else {
+		m, mm, err = rp.Decode(os.Stdin, "")
+	}
+	if err != nil {
+		return err
+	}
+	var audio *hls.Media
+	if m != nil {
+		if mm, audio, err = rp.Select(m); err != nil {
+			return err
+		}
+	}
+	info, err := rp.Probe(mm)
+	if err != nil {
+		return err
+	}
+	if audio != nil && audio != mm {
+		// the audio isn't muxed into the variant
+		ai, err := rp.Probe(audio)
+		if err != nil {
+			return err
+		}
+		info.Audio = ai.Audio
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "\t")
+	return enc.Encode(info)
+}
+
+// zflags reports whether any of the -z flags were given
+func zflags() (set bool) {
+	flag.Visit(func(f *flag.Flag) {
+		if strings.HasPrefix(f.Name, "z.") {
+			set = true
+		}
+	})
+	return set
+}
@@ -0,0 +1,335 @@
+package repack
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/as/hls"
+	"github.com/as/scte"
+)
+
+// levels of ad spans: a break holds advertisements, which hold
+// placement opportunities. The end of a span ends the ones in it.
+const (
+	levelBreak = iota
+	levelAd
+	levelPlacement
+	levels
+)
+
+// kinds of ad signals
+const (
+	adOut  = iota + 1 // a span starts with the segment
+	adCont            // the segment is in a span, which may have started before it
+	adIn              // a span ended before the segment
+)
+
+// signal is an ad signal carried by the tags of a segment
+type signal struct {
+	kind, level int
+	dur         time.Duration // left in the span, if known
+	by          string        // the tag and command, for the log
+}
+
+// adspan is an ad span in progress
+type adspan struct {
+	at   int           // the segment it started at
+	left time.Duration // of its duration, if known
+	by   string
+}
+
+// adbreak tracks the ad spans of a playlist from segment to segment. A
+// segment is an ad if it's in any span. Spans start and end with
+// EXT-X-CUE-OUT and EXT-X-CUE-IN, EXT-X-CUE, EXT-X-SCTE35, EXT-X-DATERANGE,
+// or the SCTE-35 splice_insert and time_signal commands in any of them or
+// in EXT-OATCLS-SCTE35 and EXT-X-SPLICEPOINT-SCTE35. A span with a known
+// duration also ends after it, counted from the last signal of the span
+// that gave one. Spans that start at the same segment are taken as the
+// same break signalled twice, and end together.
+type adbreak struct {
+	open [levels]*adspan
+	n    int // segments seen
+	logf func(string, ...any)
+}
+
+// adbreak returns a tracker for the ad spans of a playlist that logs
+// them
+func (r *Repackager) adbreak() *adbreak {
+	return &adbreak{logf: r.logf}
+}
+
+func (b *adbreak) log(format string, v ...any) {
+	if b.logf != nil {
+		b.logf(format, v...)
+	}
+}
+
+// ad reports whether f is an ad. It must be called for the segments of
+// a playlist in order.
+func (b *adbreak) ad(f *hls.File) bool {
+	b.n++
+	for _, s := range b.signals(f) {
+		switch s.kind {
+		case adOut, adCont:
+			switch o := b.open[s.level]; {
+			case o == nil:
+				b.open[s.level] = &adspan{at: b.n, left: s.dur, by: s.by}
+				b.log("ad break: %s at %s\n", s.by, f.Inf.URL)
+			case s.dur > 0 && s.dur != o.left:
+				// a repeated signal moves the end of the span
+				o.left = s.dur
+				b.log("ad break: %s has %s left at %s\n", s.by, s.dur, f.Inf.URL)
+			}
+		case adIn:
+			b.end(s.level, s.by)
+		}
+	}
+	ad, d := false, f.Duration(0)
+	for l, s := range b.open {
+		if s == nil {
+			continue
+		}
+		ad = true
+		if s.left > 0 {
+			if s.left -= d; s.left < d/2 {
+				b.end(l, "its duration")
+			}
+		}
+	}
+	return ad
+}
+
+// end ends the span at the level, the spans in it, and those that
+// started with it. The end of a break that wasn't signalled ends the
+// outermost span there is.
+func (b *adbreak) end(level int, by string) {
+	if level == levelBreak {
+		for level < levels-1 && b.open[level] == nil {
+			level++
+		}
+	}
+	s := b.open[level]
+	if s == nil {
+		return
+	}
+	for l, o := range b.open {
+		if o != nil && (l >= level || o.at == s.at) {
+			b.open[l] = nil
+		}
+	}
+	b.log("ad break: %s ended by %s\n", s.by, by)
+}
+
+// signals returns the ad signals in the tags of f
+func (b *adbreak) signals(f *hls.File) (s []signal) {
+	a := f.AD
+	if a == nil {
+		return nil
+	}
+	if c := a.CueOut; c.IsAD() {
+		s = append(s, signal{kind: adOut, dur: c.Duration, by: "EXT-X-CUE-OUT"})
+	}
+	if c := a.CueCont; c.IsAD() {
+		s = append(s, signal{kind: adCont, dur: remaining(c.Duration, c.Elapsed), by: "EXT-X-CUE-OUT-CONT"})
+	}
+	if a.CueIn.IsAD() {
+		s = append(s, signal{kind: adIn, by: "EXT-X-CUE-IN"})
+	}
+	if c := a.CueAdobe; c.Type != "" {
+		switch t := strings.ToLower(c.Type); {
+		case strings.HasSuffix(t, "out"):
+			s = append(s, signal{kind: adOut, dur: c.Duration, by: "EXT-X-CUE " + c.Type})
+		case strings.HasSuffix(t, "in"):
+			s = append(s, signal{kind: adIn, by: "EXT-X-CUE " + c.Type})
+		}
+	}
+	if c := a.SCTE35; c.IsAD() || c.Cue != "" {
+		switch {
+		case strings.EqualFold(c.CueOut, "CONT"):
+			s = append(s, signal{kind: adCont, dur: remaining(c.Duration, c.Elapsed), by: "EXT-X-SCTE35 CUE-OUT=CONT"})
+		case c.CueOut != "":
+			s = append(s, signal{kind: adOut, dur: c.Duration, by: "EXT-X-SCTE35 CUE-OUT"})
+		case c.CueIn != "":
+			s = append(s, signal{kind: adIn, by: "EXT-X-SCTE35 CUE-IN"})
+		default:
+			s = append(s, b.scte35("EXT-X-SCTE35", c.Cue)...)
+		}
+	}
+	if d := a.DateRange; d.IsAD() || d.Cmd != "" {
+		dur := d.Duration
+		if dur == 0 {
+			dur = d.Planned
+		}
+		if d.CueOut != "" {
+			out := b.scte35("EXT-X-DATERANGE SCTE35-OUT", d.CueOut)
+			if len(out) == 0 {
+				out = []signal{{kind: adOut, by: "EXT-X-DATERANGE SCTE35-OUT"}}
+			}
+			for i := range out {
+				if out[i].kind == adOut && out[i].dur == 0 {
+					out[i].dur = dur
+				}
+			}
+			s = append(s, out...)
+		}
+		if d.CueIn != "" {
+			in := b.scte35("EXT-X-DATERANGE SCTE35-IN", d.CueIn)
+			if len(in) == 0 {
+				in = []signal{{kind: adIn, by: "EXT-X-DATERANGE SCTE35-IN"}}
+			}
+			s = append(s, in...)
+		}
+		if d.Cmd != "" {
+			s = append(s, b.scte35("EXT-X-DATERANGE SCTE35-CMD", d.Cmd)...)
+		}
+	}
+	s = append(s, b.scte35("EXT-OATCLS-SCTE35", a.SCTE35OatclsSplice)...)
+	s = append(s, b.scte35("EXT-X-SPLICEPOINT-SCTE35", a.SCTE35Splice)...)
+	return s
+}
+
+// scte35 returns the ad signals of a SCTE-35 splice_info_section in
+// base64 or hex, carried by the tag
+func (b *adbreak) scte35(tag, v string) (s []signal) {
+	if v = strings.Trim(strings.TrimSpace(v), `"`); v == "" {
+		return nil
+	}
+	p, segs, err := parseSCTE35(v)
+	if err != nil {
+		b.log("ad break: %s: bad scte-35: %v\n", tag, err)
+		return nil
+	}
+	if si, ok := p.Cmd.(scte.SpliceInsert); ok && !si.Cancel {
+		sig := signal{kind: adIn, by: tag + " splice_insert"}
+		if si.OutOfNetwork {
+			sig.kind = adOut
+			if si.HasDuration {
+				sig.dur = pts(int64(si.BreakDur))
+			}
+		}
+		s = append(s, sig)
+	}
+	for _, seg := range segs {
+		sig, ok := segmentation[seg.typ]
+		if !ok {
+			continue
+		}
+		sig.by = tag + " " + sig.by
+		if seg.dur > 0 && sig.kind == adOut {
+			sig.dur = pts(seg.dur)
+		}
+		s = append(s, sig)
+	}
+	return s
+}
+
+// segmentation are the ad signals of the segmentation types of the
+// segmentation descriptor
+var segmentation = map[byte]signal{
+	0x22: {kind: adOut, level: levelBreak, by: "break start"},
+	0x23: {kind: adIn, level: levelBreak, by: "break end"},
+	0x30: {kind: adOut, level: levelAd, by: "provider advertisement start"},
+	0x31: {kind: adIn, level: levelAd, by: "provider advertisement end"},
+	0x32: {kind: adOut, level: levelAd, by: "distributor advertisement start"},
+	0x33: {kind: adIn, level: levelAd, by: "distributor advertisement end"},
+	0x34: {kind: adOut, level: levelPlacement, by: "provider placement opportunity start"},
+	0x35: {kind: adIn, level: levelPlacement, by: "provider placement opportunity end"},
+	0x36: {kind: adOut, level: levelPlacement, by: "distributor placement opportunity start"},
+	0x37: {kind: adIn, level: levelPlacement, by: "distributor placement opportunity end"},
+}
+
+// segdesc is a segmentation descriptor that isn't cancelled
+type segdesc struct {
+	typ byte
+	dur int64 // in 90kHz ticks, if known
+}
+
+// parseSCTE35 decodes a splice_info_section in base64, or in hex with or
+// without a 0x prefix, and its segmentation descriptors. The scte
+// package misreads the descriptors with sub-segments or component
+// offsets, so it's only given the splice command.
+func parseSCTE35(v string) (p scte.Packet, segs []segdesc, err error) {
+	var data []byte
+	if h := strings.TrimPrefix(strings.TrimPrefix(v, "0x"), "0X"); len(h)%2 == 0 {
+		data, err = hex.DecodeString(h)
+	}
+	if data == nil || err != nil {
+		if data, err = base64.StdEncoding.DecodeString(v); err != nil {
+			return p, nil, err
+		}
+	}
+	if len(data) < 14 || data[0] != 0xfc {
+		return p, nil, fmt.Errorf("table id is not 0xfc")
+	}
+	if n := int(data[11]&0x0f)<<8 | int(data[12]); n != 0xfff && 14+n+2 <= len(data) {
+		loop := data[14+n+2:]
+		loop = loop[:min(int(data[14+n])<<8|int(data[14+n+1]), len(loop))]
+		segs = segdescs(loop)
+		cmd := append(data[:14+n:14+n], 0, 0, 0, 0, 0, 0) // no descriptors, and a crc
+		p, err = scte.Parse(cmd)
+		return p, segs, err
+	}
+	// the length of a legacy command isn't known
+	if p, err = scte.Parse(data); err != nil {
+		return p, nil, err
+	}
+	for _, d := range p.Desc {
+		if seg, ok := d.(scte.DescSegment); ok && !seg.Cancel {
+			segs = append(segs, segdesc{typ: seg.SegType, dur: int64(seg.Duration)})
+		}
+	}
+	return p, segs, nil
+}
+
+// segdescs decodes the segmentation descriptors in a descriptor loop
+// (SCTE 35 10.3.3)
+func segdescs(loop []byte) (segs []segdesc) {
+	for len(loop) >= 2 {
+		tag, n := loop[0], int(loop[1])
+		if 2+n > len(loop) {
+			break
+		}
+		b := loop[2 : 2+n]
+		loop = loop[2+n:]
+		if tag != 2 || len(b) < 10 || string(b[:4]) != "CUEI" || b[8]&0x80 != 0 {
+			continue // not one, or cancelled
+		}
+		flags := b[9]
+		b = b[10:]
+		if flags&0x80 == 0 && len(b) > 0 {
+			// component tags and pts offsets
+			b = b[min(1+6*int(b[0]), len(b)):]
+		}
+		var seg segdesc
+		if flags&0x40 != 0 {
+			if len(b) < 5 {
+				continue
+			}
+			seg.dur = int64(b[0])<<32 | int64(b[1])<<24 | int64(b[2])<<16 | int64(b[3])<<8 | int64(b[4])
+			b = b[5:]
+		}
+		if len(b) < 2 || len(b) < 2+int(b[1])+1 {
+			continue
+		}
+		seg.typ = b[2+int(b[1])] // after the upid
+		segs = append(segs, seg)
+	}
+	return segs
+}
+
+// pts returns the duration of ticks of the 90kHz clock
+func pts(ticks int64) time.Duration {
+	return time.Duration(ticks) * time.Second / 90000
+}
+
+// remaining returns what's left of a span's duration after elapsed,
+// or zero if it's not known
+func remaining(dur, elapsed time.Duration) time.Duration {
+	if dur > elapsed {
+		return dur - elapsed
+	}
+	return 0
+}
@@ -0,0 +1,314 @@
+package repack
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// splice_info_sections, built to the spec, in base64
+const (
+	insertOut30  = "/DAlAAAAAAAAAP/wFAUAAAABf+/+AA27oP4AKTLgAAEAAAAAH+cIDA=="
+	insertIn     = "/DAgAAAAAAAAAP/wDwUAAAABf0/+AA27oAABAAAAAKuBK6g="
+	insertCancel = "/DAWAAAAAAAAAP/wBQUAAAAB/wAAteiDlg=="
+	breakStart60 = "/DAwAAAAAAAAAP/wBQb+AA27oAAaAhhDVUVJAAAAAn/fAABSZcAPBGFkMDEiAQHCwnyx"
+	breakEnd     = "/DArAAAAAAAAAP/wBQb+AA27oAAVAhNDVUVJAAAAAn+fDwRhZDAxIwEBm4c9Zg=="
+	adStart30    = "/DAyAAAAAAAAAP/wBQb+AA27oAAcAhpDVUVJAAAAA3/fAAApMuAPBGFkMDEwAQEBAcr19nY="
+	adEnd        = "/DArAAAAAAAAAP/wBQb+AA27oAAVAhNDVUVJAAAAA3+fDwRhZDAxMQEBgkpPHg=="
+	placement15  = "/DAyAAAAAAAAAP/wBQb+AA27oAAcAhpDVUVJAAAABH/fAAAUmXAPBGFkMDE0AQEBASXGoK4="
+	placementEnd = "/DArAAAAAAAAAP/wBQb+AA27oAAVAhNDVUVJAAAABH+fDwRhZDAxNQEBkuhUEA=="
+	components20 = "/DA3AAAAAAAAAP/wBQb+AA27oAAhAh9DVUVJAAAABX9fARH+AAAAAAAAG3dADwRhZDAxNgEBENh2Kw==" // distributor placement opportunity, by component
+	breakAndAd   = "/DBMAAAAAAAAAP/wBQb+AA27oAA2AhhDVUVJAAAAAn/fAABSZcAPBGFkMDEiAQECGkNVRUkAAAADf98AACky4A8EYWQwMTABAQEBVOpobg=="
+)
+
+// and in hex
+const (
+	insertOut30Hex = "0xfc302500000000000000fff01405000000017feffe000dbba0fe002932e00001000000001fe7080c"
+	insertOutHex   = "0xfc302000000000000000fff00f05000000017fcffe000dbba00001000000005db38e71" // without a duration
+	insertInHex    = "0xfc302000000000000000fff00f05000000017f4ffe000dbba0000100000000ab812ba8"
+)
+
+func TestSCTE35(t *testing.T) {
+	for _, tc := range []struct {
+		name, v string
+		want    string // kind/level/duration of each signal
+	}{
+		{"splice_insert out", insertOut30, "out/0/30s"},
+		{"splice_insert out in hex", insertOut30Hex, "out/0/30s"},
+		{"upper case hex", strings.ToUpper(insertOut30Hex[2:]), "out/0/30s"},
+		{"quoted", `"` + insertOut30 + `"`, "out/0/30s"},
+		{"splice_insert out, 212.5s", "/DAlAAAAAAAAAP/wFAUAAAABf+/+LRQrAP4BI9MIAAEBAQAAfxV6SQ==", "out/0/3m32.5s"},
+		{"splice_insert in", insertIn, "in/0/0s"},
+		{"splice_insert in in hex", insertInHex, "in/0/0s"},
+		{"cancelled splice_insert", insertCancel, ""},
+		{"break start", breakStart60, "out/0/1m0s"},
+		{"break end", breakEnd, "in/0/0s"},
+		{"provider ad start", adStart30, "out/1/30s"},
+		{"provider ad end", adEnd, "in/1/0s"},
+		{"placement opportunity start", placement15, "out/2/15s"},
+		{"placement opportunity end", placementEnd, "in/2/0s"},
+		{"component segmentation", components20, "out/2/20s"},
+		{"two descriptors", breakAndAd, "out/0/1m0s out/1/30s"},
+		{"not scte-35", "0x" + strings.Repeat("00", 20), ""},
+		{"garbage", "not a cue!", ""},
+		{"empty", `""`, ""},
+	} {
+		var got []string
+		for _, s := range (&adbreak{}).scte35("TAG", tc.v) {
+			kind := map[int]string{adOut: "out", adCont: "cont", adIn: "in"}[s.kind]
+			got = append(got, fmt.Sprintf("%s/%d/%s", kind, s.level, s.dur))
+		}
+		if strings.Join(got, " ") != tc.want {
+			t.Errorf("%s: %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestAdBreak(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		playlist string
+		ads      string // of each segment
+	}{
+		{
+			name: "duration",
+			playlist: `#EXTM3U
+#EXT-X-TARGETDURATION:6
+#EXTINF:6,
+c1.ts
+#EXT-X-CUE-OUT:12
+#EXTINF:6,
+a1.ts
+#EXTINF:6,
+a2.ts
+#EXTINF:6,
+c2.ts
+#EXT-X-ENDLIST
+`,
+			ads: "-aa-",
+		},
+		{
+			name: "cue-in",
+			playlist: `#EXTM3U
+#EXT-X-TARGETDURATION:6
+#EXT-X-CUE-OUT
+#EXTINF:6,
+a1.ts
+#EXTINF:6,
+a2.ts
+#EXT-X-CUE-IN
+#EXTINF:6,
+c1.ts
+#EXT-X-ENDLIST
+`,
+			ads: "aa-",
+		},
+		{
+			name: "repeated cue-out",
+			playlist: `#EXTM3U
+#EXT-X-TARGETDURATION:6
+#EXT-X-CUE-OUT:12
+#EXTINF:6,
+a1.ts
+#EXT-X-CUE-OUT:12
+#EXTINF:6,
+a2.ts
+#EXTINF:6,
+a3.ts
+#EXTINF:6,
+c1.ts
+#EXT-X-ENDLIST
+`,
+			ads: "aaa-",
+		},
+		{
+			name: "splice_insert with a break duration",
+			playlist: `#EXTM3U
+#EXT-X-TARGETDURATION:6
+#EXTINF:6,
+c1.ts
+#EXT-OATCLS-SCTE35:` + insertOut30 + `
+#EXTINF:6,
+a1.ts
+#EXTINF:6,
+a2.ts
+#EXTINF:6,
+a3.ts
+#EXTINF:6,
+a4.ts
+#EXTINF:6,
+a5.ts
+#EXTINF:6,
+c2.ts
+#EXT-X-ENDLIST
+`,
+			ads: "-aaaaa-",
+		},
+		{
+			name: "splice_insert out and in",
+			playlist: `#EXTM3U
+#EXT-X-TARGETDURATION:6
+#EXT-X-SPLICEPOINT-SCTE35:` + insertOut30Hex + `
+#EXTINF:6,
+a1.ts
+#EXTINF:6,
+a2.ts
+#EXT-X-SPLICEPOINT-SCTE35:` + insertInHex + `
+#EXTINF:6,
+c1.ts
+#EXTINF:6,
+c2.ts
+#EXT-X-ENDLIST
+`,
+			ads: "aa--",
+		},
+		{
+			name: "time_signal break",
+			playlist: `#EXTM3U
+#EXT-X-TARGETDURATION:6
+#EXT-X-SCTE35:CUE="` + breakStart60 + `"
+#EXTINF:6,
+a1.ts
+#EXTINF:6,
+a2.ts
+#EXT-X-SCTE35:CUE="` + breakEnd + `"
+#EXTINF:6,
+c1.ts
+#EXT-X-ENDLIST
+`,
+			ads: "aa-",
+		},
+		{
+			name: "an ad ends inside its break",
+			playlist: `#EXTM3U
+#EXT-X-TARGETDURATION:6
+#EXT-OATCLS-SCTE35:` + breakStart60 + `
+#EXTINF:6,
+a1.ts
+#EXT-OATCLS-SCTE35:` + adStart30 + `
+#EXTINF:6,
+a2.ts
+#EXT-OATCLS-SCTE35:` + adEnd + `
+#EXTINF:6,
+a3.ts
+#EXT-OATCLS-SCTE35:` + placement15 + `
+#EXTINF:6,
+a4.ts
+#EXT-OATCLS-SCTE35:` + placementEnd + `
+#EXTINF:6,
+a5.ts
+#EXT-OATCLS-SCTE35:` + breakEnd + `
+#EXTINF:6,
+c1.ts
+#EXT-X-ENDLIST
+`,
+			ads: "aaaaa-",
+		},
+		{
+			name: "the end of a break ends the spans in it",
+			playlist: `#EXTM3U
+#EXT-X-TARGETDURATION:6
+#EXT-OATCLS-SCTE35:` + breakStart60 + `
+#EXTINF:6,
+a1.ts
+#EXT-OATCLS-SCTE35:` + adStart30 + `
+#EXTINF:6,
+a2.ts
+#EXT-OATCLS-SCTE35:` + placement15 + `
+#EXTINF:6,
+a3.ts
+#EXT-OATCLS-SCTE35:` + breakEnd + `
+#EXTINF:6,
+c1.ts
+#EXTINF:6,
+c2.ts
+#EXT-X-ENDLIST
+`,
+			ads: "aaa--",
+		},
+		{
+			name: "the end of a break that wasn't signalled",
+			playlist: `#EXTM3U
+#EXT-X-TARGETDURATION:6
+#EXT-OATCLS-SCTE35:` + adStart30 + `
+#EXTINF:6,
+a1.ts
+#EXT-OATCLS-SCTE35:` + placement15 + `
+#EXTINF:6,
+a2.ts
+#EXT-OATCLS-SCTE35:` + breakEnd + `
+#EXTINF:6,
+c1.ts
+#EXTINF:6,
+c2.ts
+#EXT-X-ENDLIST
+`,
+			ads: "aa--",
+		},
+		{
+			name: "spans that start together end together",
+			playlist: `#EXTM3U
+#EXT-X-TARGETDURATION:6
+#EXT-OATCLS-SCTE35:` + breakAndAd + `
+#EXTINF:6,
+a1.ts
+#EXTINF:6,
+a2.ts
+#EXT-OATCLS-SCTE35:` + adEnd + `
+#EXTINF:6,
+c1.ts
+#EXT-X-ENDLIST
+`,
+			ads: "aa-",
+		},
+		{
+			name: "daterange out and in",
+			playlist: `#EXTM3U
+#EXT-X-TARGETDURATION:6
+#EXT-X-PROGRAM-DATE-TIME:2024-01-01T00:00:00Z
+#EXTINF:6,
+c1.ts
+#EXT-X-DATERANGE:ID="b1",START-DATE="2024-01-01T00:00:06Z",PLANNED-DURATION=60,SCTE35-OUT=` + insertOut30Hex + `
+#EXTINF:6,
+a1.ts
+#EXTINF:6,
+a2.ts
+#EXT-X-DATERANGE:ID="b1",START-DATE="2024-01-01T00:00:06Z",SCTE35-IN=` + insertInHex + `
+#EXTINF:6,
+c2.ts
+#EXT-X-ENDLIST
+`,
+			ads: "-aa-",
+		},
+		{
+			name: "daterange out with a planned duration",
+			playlist: `#EXTM3U
+#EXT-X-TARGETDURATION:6
+#EXT-X-PROGRAM-DATE-TIME:2024-01-01T00:00:00Z
+#EXT-X-DATERANGE:ID="b2",START-DATE="2024-01-01T00:00:00Z",PLANNED-DURATION=12,SCTE35-OUT=` + insertOutHex + `
+#EXTINF:6,
+a1.ts
+#EXTINF:6,
+a2.ts
+#EXTINF:6,
+c1.ts
+#EXT-X-ENDLIST
+`,
+			ads: "aa-",
+		},
+	} {
+		m, _ := decodePlaylist(t, tc.playlist)
+		var ads strings.Builder
+		b := &adbreak{}
+		for i := range m.File {
+			if b.ad(&m.File[i]) {
+				ads.WriteByte('a')
+			} else {
+				ads.WriteByte('-')
+			}
+		}
+		if ads.String() != tc.ads {
+			t.Errorf("%s: ads %q, want %q", tc.name, ads.String(), tc.ads)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package repack
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/as/hls"
+	"github.com/as/hlscat/av"
+)
+
+// describesVideo is the characteristic of audio that describes the video
+const describesVideo = "public.accessibility.describes-video"
+
+// AudioPolicy chooses the audio rendition of a variant, among those in
+// its AUDIO group and the ones that no variant refers to. Renditions
+// that describe the video are left out unless Describes is set, or
+// nothing else is left. Of the rest, the first language in Langs is
+// preferred, then the first layout in Channels, then the variant's own
+// group, then the DEFAULT and AUTOSELECT ones.
+type AudioPolicy struct {
+	Langs     []string // LANGUAGE tags, most preferred first
+	Channels  []string // CHANNELS, such as 2, 6 or 16/JOC, most preferred first
+	Describes bool     // prefer audio that describes the video
+}
+
+// candidate is an audio rendition, or the audio muxed into the variant
+// if info is nil
+type candidate struct {
+	info *hls.MediaInfo
+	alt  bool // outside the variant's group
+	rank []int
+	why  []string
+}
+
+// audio returns the audio rendition chosen for the variant si of m, or
+// nil for the audio muxed into the variant
+func (r *Repackager) audio(m *hls.Master, si *hls.StreamInfo) *hls.MediaInfo {
+	p := r.Audio
+	if p == nil {
+		p = &AudioPolicy{}
+	}
+	var list []*candidate
+	if si.Audio == "" {
+		list = append(list, &candidate{})
+	}
+	for i := range m.Media {
+		mi := &m.Media[i]
+		if mi.Type != "AUDIO" {
+			continue
+		}
+		if in := mi.Group == si.Audio && si.Audio != ""; in || !referenced(m, mi.Group) {
+			list = append(list, &candidate{info: mi, alt: !in})
+		}
+	}
+	keep := list[:0:0]
+	for _, c := range list {
+		if p.Describes || !describes(c.info) {
+			keep = append(keep, c)
+		}
+	}
+	if len(keep) == 0 {
+		keep = list // only descriptive audio
+	}
+	var best *candidate
+	for _, c := range keep {
+		p.rank(c)
+		if best == nil || slices.Compare(c.rank, best.rank) < 0 {
+			best = c
+		}
+	}
+	if r.Audio != nil {
+		for _, c := range list {
+			reason := "rejected: describes the video"
+			switch {
+			case c == best:
+				reason = "chosen by " + strings.Join(c.why, ", ")
+			case c.rank != nil:
+				reason = "ranked below by " + strings.Join(c.why, ", ")
+			}
+			r.logf("select: audio %s: %s\n", describeAudio(c.info), reason)
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	return best.info
+}
+
+// rank ranks the candidate by the policy. Lower ranks are better.
+func (p *AudioPolicy) rank(c *candidate) {
+	mi := c.info
+	if mi == nil {
+		mi = &hls.MediaInfo{Default: true}
+	}
+	lang := 2 * len(p.Langs)
+	for i, l := range p.Langs {
+		if strings.EqualFold(mi.Lang, l) {
+			lang = 2 * i
+			break
+		}
+		if sameLang(mi.Lang, l) {
+			lang = 2*i + 1
+			break
+		}
+	}
+	if lang < 2*len(p.Langs) {
+		c.why = append(c.why, "language "+mi.Lang)
+	}
+	ch := len(p.Channels)
+	for i, v := range p.Channels {
+		if channels(mi.Channels, v) {
+			ch = i
+			c.why = append(c.why, "channels "+mi.Channels)
+			break
+		}
+	}
+	desc := 1
+	if describes(c.info) == p.Describes {
+		desc = 0
+	}
+	if desc == 0 && p.Describes {
+		c.why = append([]string{"describes the video"}, c.why...)
+	}
+	c.rank = []int{desc, lang, ch, btoi(c.alt), btoi(!mi.Default), btoi(!mi.Autoselect)}
+	if mi.Default {
+		c.why = append(c.why, "DEFAULT")
+	} else if mi.Autoselect {
+		c.why = append(c.why, "AUTOSELECT")
+	}
+	if len(c.why) == 0 {
+		c.why = append(c.why, "order")
+	}
+}
+
+func btoi(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// sameLang reports whether two language tags name the same language,
+// like en and en-GB, or fr and fra. Languages that Lang3 doesn't know
+// only match by their primary subtags.
+func sameLang(a, b string) bool {
+	primary := func(tag string) string {
+		tag, _, _ = strings.Cut(strings.ToLower(tag), "-")
+		tag, _, _ = strings.Cut(tag, "_")
+		return tag
+	}
+	if a == "" || b == "" {
+		return false
+	}
+	if primary(a) == primary(b) {
+		return true
+	}
+	l := av.Lang3(a)
+	return l != "und" && l == av.Lang3(b)
+}
+
+// channels reports whether the CHANNELS attribute v is the layout
+// want. A layout without parameters, such as 6, matches any 6 channel
+// layout.
+func channels(v, want string) bool {
+	if strings.EqualFold(v, want) {
+		return true
+	}
+	n, _, _ := strings.Cut(v, "/")
+	return !strings.Contains(want, "/") && n == want
+}
+
+// describes reports whether the rendition describes the video
+func describes(mi *hls.MediaInfo) bool {
+	if mi == nil {
+		return false
+	}
+	for _, c := range mi.Character {
+		for _, c := range strings.Split(c, ",") {
+			if strings.TrimSpace(c) == describesVideo {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// referenced reports whether a variant in m refers to the audio group
+func referenced(m *hls.Master, group string) bool {
+	for _, si := range m.Stream {
+		if si.Audio == group {
+			return true
+		}
+	}
+	return false
+}
+
+func describeAudio(mi *hls.MediaInfo) string {
+	if mi == nil {
+		return "of the variant"
+	}
+	s := fmt.Sprintf("%s %q", mi.Group, mi.Name)
+	if mi.Lang != "" {
+		s += " language=" + mi.Lang
+	}
+	if mi.Channels != "" {
+		s += " channels=" + mi.Channels
+	}
+	if c := strings.Join(mi.Character, ","); c != "" {
+		s += " characteristics=" + c
+	}
+	if mi.URI == "" {
+		s += " (in the variant)"
+	}
+	return s
+}
@@ -0,0 +1,53 @@
+package repack
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/as/hls"
+)
+
+// decodeMaster decodes a master playlist
+func decodeMaster(t *testing.T, s string) *hls.Master {
+	t.Helper()
+	m, _, err := New(Options{}).Decode(strings.NewReader(s), "http://example.com/master.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m == nil {
+		t.Fatal("not a master playlist")
+	}
+	return m
+}
+
+func TestAudioLang(t *testing.T) {
+	m := decodeMaster(t, `#EXTM3U
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="a",NAME="English",LANGUAGE="en",DEFAULT=YES,AUTOSELECT=YES,URI="en.m3u8"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="a",NAME="Malti",LANGUAGE="mt",URI="mt.m3u8"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="a",NAME="British",LANGUAGE="en-GB",URI="gb.m3u8"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="a",NAME="Klingon",LANGUAGE="tlh-x-qo",URI="tlh.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=1000000,AUDIO="a"
+v.m3u8
+`)
+	for _, tc := range []struct {
+		langs []string
+		want  string
+	}{
+		{nil, "English"},
+		{[]string{"mt"}, "Malti"},
+		{[]string{"en-GB"}, "British"},
+		{[]string{"en-US"}, "English"},
+		{[]string{"eng"}, "English"},
+		{[]string{"lb"}, "English"},
+		{[]string{"lb", "mt"}, "Malti"},
+		{[]string{"tlh"}, "Klingon"},
+		{[]string{"xx"}, "English"},
+	} {
+		r := New(Options{})
+		r.Audio = &AudioPolicy{Langs: tc.langs}
+		mi := r.audio(m, &m.Stream[0])
+		if mi == nil || mi.Name != tc.want {
+			t.Errorf("%q: chose %+v, want %s", tc.langs, mi, tc.want)
+		}
+	}
+}
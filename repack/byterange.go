@@ -0,0 +1,116 @@
+package repack
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/as/hls"
+	"github.com/as/hls/m3u"
+)
+
+// ByteRange is a sub-range of a resource. A zero Length extends
+// to the end of the resource.
+type ByteRange struct {
+	Offset, Length int64
+}
+
+// String returns the range in the form of an http Range header value
+func (b ByteRange) String() string {
+	if b.Length == 0 {
+		if b.Offset == 0 {
+			return ""
+		}
+		return fmt.Sprintf("bytes=%d-", b.Offset)
+	}
+	return fmt.Sprintf("bytes=%d-%d", b.Offset, b.Offset+b.Length-1)
+}
+
+// FileRange returns the byte range of the segment f. The implicit
+// offsets in a playlist are resolved when it is decoded.
+func FileRange(f *hls.File) ByteRange {
+	b, _ := parseRange(f.Range.V, 0)
+	return b
+}
+
+// MapRange returns the byte range of the initialization segment m
+func MapRange(m *hls.Map) ByteRange {
+	b, _ := parseRange(m.Byterange, 0)
+	return b
+}
+
+// parseRange parses a BYTERANGE value, n[@o]. If the offset is
+// missing, the range starts at next.
+func parseRange(v string, next int64) (b ByteRange, err error) {
+	if v == "" {
+		return b, nil
+	}
+	n, o, ok := strings.Cut(v, "@")
+	if b.Length, err = strconv.ParseInt(n, 10, 64); err != nil {
+		return b, fmt.Errorf("byterange %q: %w", v, err)
+	}
+	b.Offset = next
+	if ok {
+		if b.Offset, err = strconv.ParseInt(o, 10, 64); err != nil {
+			return b, fmt.Errorf("byterange %q: %w", v, err)
+		}
+	}
+	return b, nil
+}
+
+func rangeValue(b ByteRange) string {
+	return fmt.Sprintf("%d@%d", b.Length, b.Offset)
+}
+
+// resolveRanges rewrites the byte ranges in m with explicit offsets. A
+// segment range without an offset starts where the previous sub-range
+// of the same resource ended. A map range without one starts at zero.
+func resolveRanges(m *hls.Media) error {
+	end := map[string]int64{}
+	for i := range m.File {
+		f := &m.File[i]
+		if v := f.Map.Byterange; v != "" {
+			b, err := parseRange(v, 0)
+			if err != nil {
+				return err
+			}
+			f.Map.Byterange = rangeValue(b)
+			if _, ok := end[f.Map.URI]; !ok {
+				end[f.Map.URI] = b.Offset + b.Length
+			}
+		}
+		if v := f.Range.V; v != "" {
+			b, err := parseRange(v, end[f.Inf.URL])
+			if err != nil {
+				return err
+			}
+			f.Range.V = rangeValue(b)
+			end[f.Inf.URL] = b.Offset + b.Length
+		}
+	}
+	return nil
+}
+
+// fixRange moves the tags between an EXTINF and its uri ahead of the
+// EXTINF. The hls decoder gives the uri to the last tag before it, so
+// the usual EXTINF, EXT-X-BYTERANGE, uri order would lose the uri and
+// give the range to the next segment.
+func fixRange(tags []m3u.Tag) []m3u.Tag {
+	inf := -1
+	for i := 0; i < len(tags); i++ {
+		t := &tags[i]
+		switch {
+		case t.Name == "EXTINF" && len(t.Line) == 0:
+			inf = i
+		case t.Name == "EXTINF":
+			inf = -1
+		case inf >= 0 && len(t.Line) > 0:
+			x := tags[inf]
+			x.Line, t.Line = t.Line, nil
+			copy(tags[inf:i], tags[inf+1:i+1])
+			tags[i] = x
+			inf = -1
+		}
+	}
+	return tags
+}
@@ -0,0 +1,137 @@
+package repack
+
+import (
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/as/hlscat/av"
+	"github.com/as/hlscat/cc"
+	"github.com/as/hlscat/vtt"
+)
+
+// Captions extracts the closed captions in the video (CEA-608 or
+// CEA-708 in the SEI of H.264 or H.265) as it's remuxed natively, and
+// writes them to W as WebVTT or, if Format is "srt", SubRip. Cue times
+// are those of the repackaged stream. Only the first video stream
+// remuxed is read.
+type Captions struct {
+	W       io.Writer
+	Format  string
+	Channel string // CC1 to CC4 for CEA-608, SERVICE1 to SERVICE63 for CEA-708 (default CC1)
+
+	once sync.Once
+}
+
+// reorder is the number of samples held back to put the captions in
+// presentation order
+const reorder = 32
+
+// captioner is a muxer that passes the samples on to the next one and
+// decodes the captions of the video on the way
+type captioner struct {
+	av.Muxer
+	c     *Captions
+	dec   *cc.Decoder
+	out   *vtt.Writer
+	video *av.Track
+	held  []held
+	end   int64 // the last presentation time seen
+}
+
+// held are the captions of a sample
+type held struct {
+	pts  int64
+	data []byte
+}
+
+// captions returns dst, or a muxer that also extracts the captions of
+// its video if Options.Captions is set and no other stream has
+func (r *Repackager) captions(dst av.Muxer) av.Muxer {
+	c := r.Captions
+	if c == nil {
+		return dst
+	}
+	claimed := false
+	c.once.Do(func() { claimed = true })
+	if !claimed {
+		return dst
+	}
+	return &captioner{Muxer: dst, c: c}
+}
+
+func (m *captioner) WriteHeader(tracks ...*av.Track) error {
+	for _, t := range tracks {
+		if t.Kind == av.Video && m.video == nil {
+			m.video = t
+		}
+	}
+	ch := m.c.Channel
+	if ch == "" {
+		ch = "CC1"
+	}
+	dec, err := cc.NewDecoder(ch)
+	if err != nil {
+		return err
+	}
+	m.dec = dec
+	if m.c.Format == "srt" {
+		m.out = vtt.NewSRTWriter(m.c.W)
+	} else {
+		m.out = vtt.NewWriter(m.c.W)
+	}
+	return m.Muxer.WriteHeader(tracks...)
+}
+
+func (m *captioner) WriteSample(s av.Sample) error {
+	if m.video != nil && s.Track == m.video.ID {
+		pts := av.Rescale(s.PTS, int64(m.video.Timescale), vtt.Timescale)
+		m.end = max(m.end, pts+av.Rescale(s.Dur, int64(m.video.Timescale), vtt.Timescale))
+		if data := av.CCData(m.video.Codec, s.Data); len(data) > 0 {
+			m.held = append(m.held, held{pts, data})
+			if len(m.held) > reorder {
+				if err := m.decode(1); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return m.Muxer.WriteSample(s)
+}
+
+func (m *captioner) Close() error {
+	if m.dec != nil {
+		if err := m.decode(len(m.held)); err != nil {
+			return err
+		}
+		m.dec.Flush(m.end)
+		if err := m.write(); err != nil {
+			return err
+		}
+		if err := m.out.Close(); err != nil {
+			return err
+		}
+	}
+	return m.Muxer.Close()
+}
+
+// decode decodes the captions of the first n samples held, in
+// presentation order
+func (m *captioner) decode(n int) error {
+	sort.SliceStable(m.held, func(i, j int) bool { return m.held[i].pts < m.held[j].pts })
+	for _, h := range m.held[:n] {
+		m.dec.Decode(h.pts, h.data)
+	}
+	m.held = append(m.held[:0], m.held[n:]...)
+	return m.write()
+}
+
+// write writes the cues that ended
+func (m *captioner) write() error {
+	for _, c := range m.dec.Cues() {
+		if err := m.out.WriteCue(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package repack
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/as/hlscat/av"
+)
+
+// discard is a muxer that drops everything
+type discard struct{}
+
+func (discard) WriteHeader(...*av.Track) error { return nil }
+func (discard) WriteSample(av.Sample) error    { return nil }
+func (discard) Close() error                   { return nil }
+
+// seiSample returns an h264 sample with an sei that carries cc_data for
+// the byte pairs in the first field
+func seiSample(pairs ...byte) []byte {
+	p := []byte{0xb5, 0, 0x31, 'G', 'A', '9', '4', 3, 0x40 | byte(len(pairs)/2), 0xff}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		p = append(p, 0xfc, pairs[i], pairs[i+1])
+	}
+	p = append(p, 0xff)
+	nal := append([]byte{0x06, 4, byte(len(p))}, p...)
+	nal = append(nal, 0x80)
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(nal))), nal...)
+}
+
+func TestCaptioner(t *testing.T) {
+	// a pop-on caption and then a paint-on one, by presentation time,
+	// at 25 frames per second, after enough padding to fill the reorder
+	// buffer
+	var frames [][]byte
+	for range reorder + 10 {
+		frames = append(frames, []byte{0x80, 0x80})
+	}
+	frames = append(frames, [][]byte{
+		{0x14, 0x20, 0x14, 0x20}, // resume caption loading
+		{'H', 'e'},
+		{'l', 'l'},
+		{'o', 0},
+		{0x14, 0x2f, 0x14, 0x2f}, // end of caption, at 1.88s
+		nil,
+		{0x14, 0x29, 0x14, 0x29}, // resume direct captioning, erasing nothing
+		{0x14, 0x2c, 0x14, 0x2c}, // erase displayed memory, at 2s
+		{'B', 'y'},               // at 2.04s, and shown until the end
+		{'e', 0},
+	}...)
+	const dur = 3600
+	var out strings.Builder
+	r := New(Options{})
+	r.Captions = &Captions{W: &out}
+	m := r.captions(discard{})
+	video := &av.Track{ID: 1, Kind: av.Video, Codec: "h264", Timescale: 90000}
+	if err := m.WriteHeader(video); err != nil {
+		t.Fatal(err)
+	}
+	// in decode order, with b-frames: I P B B P B B ...
+	order := []int{0}
+	for i := 1; i+2 < len(frames); i += 3 {
+		order = append(order, i+2, i, i+1)
+	}
+	for dts, pts := range order {
+		s := av.Sample{Track: 1, DTS: int64(dts) * dur, PTS: int64(pts+1) * dur, Dur: dur, Key: pts == 0}
+		if frames[pts] != nil {
+			s.Data = seiSample(frames[pts]...)
+		}
+		if err := m.WriteSample(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	const want = "WEBVTT\n\n" +
+		"00:00:01.880 --> 00:00:02.000\nHello\n\n" +
+		"00:00:02.040 --> 00:00:02.120\nBye\n\n"
+	if out.String() != want {
+		t.Errorf("captions:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
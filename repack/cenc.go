@@ -0,0 +1,56 @@
+package repack
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/as/hlscat/mp4"
+)
+
+// KeyID returns the form of a cenc key id used in Options.Keys: lower
+// case hex without dashes, as in a uuid
+func KeyID(kid string) string {
+	return strings.ToLower(strings.ReplaceAll(kid, "-", ""))
+}
+
+// piece is a segment, or an init segment, on its way to be concatenated
+// with the key its fragmented mp4 samples are encrypted with, if any
+type piece struct {
+	io.ReadCloser
+	key string
+}
+
+// cenc copies the piece to dst and decrypts the samples of a fragmented
+// mp4 stream encrypted with common encryption (cenc or cbcs). Keys are
+// looked up by key id in Options.Keys, then taken from the piece.
+// Anything that isn't mp4, like mpeg ts or webvtt, is passed through.
+// Dec carries the init segment from one piece to the next.
+func (r *Repackager) cenc(dst io.Writer, p piece, dec *mp4.Decrypter) error {
+	if r.NoDecrypt {
+		_, err := io.Copy(dst, p)
+		return err
+	}
+	key := func(kid []byte) []byte {
+		if k := r.Keys[hex.EncodeToString(kid)]; k != nil {
+			return k
+		}
+		if p.key != "" {
+			return []byte(p.key)
+		}
+		return nil
+	}
+	br := bufio.NewReaderSize(p, r.BufSize)
+	var err error
+	if h, _ := br.Peek(8); !mp4box(h) {
+		_, err = io.Copy(dst, br)
+	} else {
+		err = dec.Decrypt(dst, br, key)
+	}
+	if errors.Is(err, mp4.ErrNoKey) {
+		err = &KeyError{Err: err}
+	}
+	return err
+}
@@ -0,0 +1,130 @@
+package repack
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/as/hlscat/av"
+	"github.com/as/hlscat/mp4"
+)
+
+// cbcsInit protects the mp4a track of a clear init segment with cbcs
+// under kid, using a constant iv, as a packager would
+func cbcsInit(t *testing.T, init, kid, iv []byte) []byte {
+	t.Helper()
+	box := func(typ string, body ...[]byte) []byte {
+		b := binary.BigEndian.AppendUint32(nil, uint32(8+len(bytes.Join(body, nil))))
+		return append(append(b, typ...), bytes.Join(body, nil)...)
+	}
+	tenc := append([]byte{1, 0, 0, 0, 0, 0, 1, 0}, kid...)
+	tenc = append(append(tenc, byte(len(iv))), iv...)
+	sinf := box("sinf",
+		box("frma", []byte("mp4a")),
+		box("schm", []byte{0, 0, 0, 0}, []byte("cbcs"), []byte{0, 1, 0, 0}),
+		box("schi", box("tenc", tenc)),
+	)
+	// grow the boxes down to the sample entry and append the sinf to it
+	at := 0
+	for _, typ := range []string{"moov", "trak", "mdia", "minf", "stbl", "stsd", "mp4a"} {
+		i := bytes.Index(init[at:], []byte(typ))
+		if i < 4 {
+			t.Fatalf("no %s box", typ)
+		}
+		at += i - 4
+		size := binary.BigEndian.Uint32(init[at:])
+		binary.BigEndian.PutUint32(init[at:], size+uint32(len(sinf)))
+		if typ == "mp4a" {
+			copy(init[at+4:], "enca")
+			end := at + int(size)
+			return append(init[:end:end], append(sinf, init[end:]...)...)
+		}
+		at += 8
+	}
+	return nil
+}
+
+func TestCENCKeyRotation(t *testing.T) {
+	kid := bytes.Repeat([]byte{0x4b}, 16)
+	iv := bytes.Repeat([]byte{0x1f}, 16)
+	keys := [][]byte{testKey, otherKey}
+
+	var out bytes.Buffer
+	w := mp4.NewWriter(&out)
+	w.FragDur = 1 << 40
+	a := &av.Track{ID: 1, Kind: av.Audio, Codec: "aac", Timescale: 44100, SampleRate: 44100, Channels: 2, Config: av.AACConfig(2, 4, 2)}
+	if err := w.WriteHeader(a); err != nil {
+		t.Fatal(err)
+	}
+	init := cbcsInit(t, bytes.Clone(out.Bytes()), kid, iv)
+	var (
+		clear [][]byte
+		segs  []string
+	)
+	for n, key := range keys {
+		out.Reset()
+		var samples [][]byte
+		for i := 0; i < 4; i++ {
+			// two whole blocks and a clear partial one
+			s := bytes.Repeat([]byte{byte(n), byte(i), 0x21}, 14)
+			samples = append(samples, s)
+			dts := int64(n*4+i) * av.AACFrameSize
+			if err := w.WriteSample(av.Sample{Track: 1, DTS: dts, PTS: dts, Key: true, Data: s}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Cut(); err != nil {
+			t.Fatal(err)
+		}
+		seg := bytes.Clone(out.Bytes())
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range samples {
+			i := bytes.Index(seg, s)
+			if i < 0 {
+				t.Fatal("sample not in mdat")
+			}
+			enc := seg[i : i+len(s)/aes.BlockSize*aes.BlockSize]
+			cipher.NewCBCEncrypter(block, iv).CryptBlocks(enc, enc)
+			clear = append(clear, s)
+		}
+		segs = append(segs, string(seg))
+	}
+
+	m, _ := decodePlaylist(t, `#EXTM3U
+#EXT-X-TARGETDURATION:1
+#EXT-X-MAP:URI="init.mp4"
+#EXT-X-KEY:METHOD=SAMPLE-AES,URI="k1"
+#EXTINF:0.1,
+a.m4s
+#EXT-X-KEY:METHOD=SAMPLE-AES,URI="k2"
+#EXTINF:0.1,
+b.m4s
+#EXT-X-ENDLIST
+`)
+	r := New(Options{
+		Fetcher:     files{"init.mp4": string(init), "a.m4s": segs[0], "b.m4s": segs[1]},
+		KeyProvider: KeyFile{"k1": keys[0], "k2": keys[1]},
+	})
+	src := r.concat(nil, r.open(m))
+	defer src.Close()
+	data, err := io.ReadAll(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := mp4.NewReader(bytes.NewReader(data))
+	for i, want := range clear {
+		s, err := d.ReadSample()
+		if err != nil {
+			t.Fatalf("sample %d: %v", i, err)
+		}
+		if !bytes.Equal(s.Data, want) {
+			t.Errorf("sample %d: %x, want %x", i, s.Data, want)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package repack
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Codec is a codec of a CODECS attribute (RFC 6381)
+type Codec struct {
+	ID   string // as in the playlist, such as avc1.640028
+	Name string // readable, such as H.264 High@4.0
+	Kind string `json:",omitempty"` // video, audio or text, if known
+}
+
+// ParseCodec decodes a codec of a CODECS attribute. What it says about
+// the video or audio is added to info, if it's not nil. A codec that
+// isn't known is named by its id.
+func ParseCodec(id string, info *Info) Codec {
+	id = strings.TrimSpace(id)
+	c := Codec{ID: id, Name: id}
+	f := strings.Split(id, ".")
+	v, a := &Video{}, &Audio{}
+	switch strings.ToLower(f[0]) {
+	case "avc1", "avc3":
+		c.Kind, c.Name = "video", "H.264"
+		v.Codec = "h264"
+		if len(f) > 1 {
+			v.Profile, v.Level, c.Name = avc(f[1])
+		}
+	case "hvc1", "hev1":
+		c.Kind, c.Name = "video", "HEVC"
+		v.Codec = "h265"
+		if len(f) > 3 {
+			v.Profile, v.Level, c.Name = hevc(f[1], f[3])
+		}
+	case "av01":
+		c.Kind, c.Name = "video", "AV1"
+		v.Codec = "av1"
+		if len(f) > 2 {
+			v.Profile, v.Level, c.Name = av1(f[1:])
+		}
+	case "vp09":
+		c.Kind, c.Name = "video", "VP9"
+		v.Codec = "vp9"
+		if len(f) > 2 {
+			v.Profile, v.Level, c.Name = vp9(f[1:])
+		}
+	case "dvh1", "dvhe", "dva1", "dvav", "dav1":
+		c.Kind, c.Name = "video", "Dolby Vision"
+		v.Codec = "dolbyvision"
+		if len(f) > 2 {
+			p, _ := strconv.Atoi(f[1])
+			l, _ := strconv.Atoi(f[2])
+			v.Profile, v.Level = strconv.Itoa(p), strconv.Itoa(l)
+			c.Name = fmt.Sprintf("Dolby Vision Profile %d@%d", p, l)
+		}
+	case "mp4a":
+		c.Kind, c.Name = "audio", "AAC"
+		a.Codec = "aac"
+		if len(f) > 1 {
+			a.Codec, c.Name = mp4a(f[1:])
+		}
+	case "ac-3":
+		c.Kind, c.Name, a.Codec = "audio", "AC-3", "ac3"
+	case "ec-3":
+		c.Kind, c.Name, a.Codec = "audio", "E-AC-3", "eac3"
+	case "ac-4":
+		c.Kind, c.Name, a.Codec = "audio", "AC-4", "ac4"
+	case "opus":
+		c.Kind, c.Name, a.Codec = "audio", "Opus", "opus"
+	case "flac":
+		c.Kind, c.Name, a.Codec = "audio", "FLAC", "flac"
+	case "alac":
+		c.Kind, c.Name, a.Codec = "audio", "ALAC", "alac"
+	case "wvtt":
+		c.Kind, c.Name = "text", "WebVTT"
+	case "stpp":
+		c.Kind, c.Name = "text", "TTML"
+		if strings.HasSuffix(strings.ToLower(id), ".im1t") {
+			c.Name = "TTML (IMSC1 text)"
+		} else if strings.HasSuffix(strings.ToLower(id), ".im1i") {
+			c.Name = "TTML (IMSC1 image)"
+		}
+	}
+	if info != nil {
+		switch c.Kind {
+		case "video":
+			info.Video.Codec, info.Video.Profile, info.Video.Level = v.Codec, v.Profile, v.Level
+		case "audio":
+			info.Audio.Codec = a.Codec
+		}
+	}
+	return c
+}
+
+// avcProfiles are the names of the H.264 profiles by profile_idc, in
+// full and as ffmpeg knows them
+var avcProfiles = map[int][2]string{
+	44:  {"CAVLC 4:4:4 Intra", "high444"},
+	66:  {"Baseline", "baseline"},
+	77:  {"Main", "main"},
+	88:  {"Extended", "extended"},
+	100: {"High", "high"},
+	110: {"High 10", "high10"},
+	118: {"Multiview High", "high"},
+	122: {"High 4:2:2", "high422"},
+	128: {"Stereo High", "high"},
+	244: {"High 4:4:4 Predictive", "high444"},
+}
+
+// avc decodes the profile_idc, constraint flags and level_idc of an
+// H.264 codec, in hex
+func avc(s string) (profile, level, name string) {
+	b, err := strconv.ParseUint(s, 16, 32)
+	if err != nil || len(s) != 6 {
+		return "", "", "H.264"
+	}
+	idc, flags, lvl := int(b>>16), int(b>>8&0xff), int(b&0xff)
+	p, ok := avcProfiles[idc]
+	if !ok {
+		p = [2]string{fmt.Sprintf("Profile %d", idc), strconv.Itoa(idc)}
+	}
+	if idc == 66 && flags&0x40 != 0 {
+		p[0] = "Constrained Baseline"
+	}
+	level = fmt.Sprintf("%d.%d", lvl/10, lvl%10)
+	if lvl == 9 || lvl == 11 && flags&0x10 != 0 && idc <= 88 {
+		level = "1b"
+	}
+	return p[1], level, fmt.Sprintf("H.264 %s@%s", p[0], level)
+}
+
+// hevcProfiles are the names of the HEVC profiles by general_profile_idc,
+// in full and as ffmpeg knows them
+var hevcProfiles = map[int][2]string{
+	1: {"Main", "main"},
+	2: {"Main10", "main10"},
+	3: {"Main Still Picture", "mainstillpicture"},
+	4: {"Range Extensions", "rext"},
+	5: {"High Throughput", "ht"},
+	9: {"Screen Content", "scc"},
+}
+
+// hevc decodes the profile and the tier and level of an HEVC codec:
+// 2 and L123 are Main10 at level 4.1 of the main tier
+func hevc(ps, ls string) (profile, level, name string) {
+	idc, err := strconv.Atoi(strings.TrimLeft(ps, "ABCabc"))
+	if err != nil || len(ls) < 2 {
+		return "", "", "HEVC"
+	}
+	p, ok := hevcProfiles[idc]
+	if !ok {
+		p = [2]string{fmt.Sprintf("Profile %d", idc), strconv.Itoa(idc)}
+	}
+	lvl, err := strconv.Atoi(ls[1:])
+	if err != nil {
+		return p[1], "", "HEVC " + p[0]
+	}
+	level = fmt.Sprintf("%d.%d", lvl/30, lvl%30/3)
+	name = fmt.Sprintf("HEVC %s@%s", p[0], level)
+	if ls[0] == 'H' || ls[0] == 'h' {
+		name += " High tier"
+	}
+	return p[1], level, name
+}
+
+// av1 decodes the profile, level and tier, and bit depth of an AV1
+// codec: 0, 08M and 10 are Main at level 4.0, 10 bit
+func av1(f []string) (profile, level, name string) {
+	p, err := strconv.Atoi(f[0])
+	if err != nil || len(f[1]) < 3 {
+		return "", "", "AV1"
+	}
+	profile = [...]string{"main", "high", "professional", ""}[min(p, 3)]
+	lvl, _ := strconv.Atoi(f[1][:2])
+	level = fmt.Sprintf("%d.%d", 2+lvl>>2, lvl&3)
+	name = fmt.Sprintf("AV1 %s@%s", [...]string{"Main", "High", "Professional", "Profile " + f[0]}[min(p, 3)], level)
+	if f[1][2] == 'H' {
+		name += " High tier"
+	}
+	if len(f) > 2 {
+		if depth, err := strconv.Atoi(f[2]); err == nil {
+			name += fmt.Sprintf(" %d-bit", depth)
+		}
+	}
+	return profile, level, name
+}
+
+// vp9 decodes the profile, level and bit depth of a VP9 codec: 02, 41
+// and 10 are profile 2 at level 4.1, 10 bit
+func vp9(f []string) (profile, level, name string) {
+	p, err := strconv.Atoi(f[0])
+	lvl, err1 := strconv.Atoi(f[1])
+	if err != nil || err1 != nil {
+		return "", "", "VP9"
+	}
+	profile, level = strconv.Itoa(p), fmt.Sprintf("%d.%d", lvl/10, lvl%10)
+	name = fmt.Sprintf("VP9 Profile %d@%s", p, level)
+	if len(f) > 2 {
+		if depth, err := strconv.Atoi(f[2]); err == nil {
+			name += fmt.Sprintf(" %d-bit", depth)
+		}
+	}
+	return profile, level, name
+}
+
+// aacObjects are the names of the MPEG-4 audio object types
+var aacObjects = map[int]string{
+	1:  "AAC Main",
+	2:  "AAC-LC",
+	3:  "AAC SSR",
+	4:  "AAC LTP",
+	5:  "HE-AAC",
+	23: "AAC-LD",
+	29: "HE-AACv2",
+	39: "AAC-ELD",
+	42: "xHE-AAC",
+}
+
+// mp4a decodes the object type indication, and for MPEG-4 audio the
+// audio object type, of an mp4a codec
+func mp4a(f []string) (codec, name string) {
+	switch strings.ToLower(f[0]) {
+	case "69", "6b":
+		return "mp3", "MP3"
+	case "a5":
+		return "ac3", "AC-3"
+	case "a6":
+		return "eac3", "E-AC-3"
+	case "40":
+		if len(f) < 2 {
+			return "aac", "AAC"
+		}
+		obj, _ := strconv.Atoi(f[1])
+		switch obj {
+		case 34:
+			return "mp3", "MP3"
+		}
+		if name, ok := aacObjects[obj]; ok {
+			return "aac", name
+		}
+		return "aac", "AAC object type " + f[1]
+	}
+	return "", "mp4a." + strings.Join(f, ".")
+}
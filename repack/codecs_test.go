@@ -0,0 +1,51 @@
+package repack
+
+import "testing"
+
+func TestParseCodec(t *testing.T) {
+	for _, tc := range []struct {
+		id, name, kind        string
+		codec, profile, level string
+	}{
+		{"avc1.640028", "H.264 High@4.0", "video", "h264", "high", "4.0"},
+		{"avc1.42E01E", "H.264 Constrained Baseline@3.0", "video", "h264", "baseline", "3.0"},
+		{"avc3.42f00b", "H.264 Constrained Baseline@1b", "video", "h264", "baseline", "1b"},
+		{"avc1.6e0033", "H.264 High 10@5.1", "video", "h264", "high10", "5.1"},
+		{"avc1", "H.264", "video", "h264", "", ""},
+		{"avc1.64", "H.264", "video", "h264", "", ""},
+		{"hvc1.2.4.L123.B0", "HEVC Main10@4.1", "video", "h265", "main10", "4.1"},
+		{"hev1.1.6.H150.90", "HEVC Main@5.0 High tier", "video", "h265", "main", "5.0"},
+		{"hvc1.A4.10.L93", "HEVC Range Extensions@3.1", "video", "h265", "rext", "3.1"},
+		{"av01.0.08M.10", "AV1 Main@4.0 10-bit", "video", "av1", "main", "4.0"},
+		{"av01.1.13H.12", "AV1 High@5.1 High tier 12-bit", "video", "av1", "high", "5.1"},
+		{"av01.0.04M", "AV1 Main@3.0", "video", "av1", "main", "3.0"},
+		{"vp09.02.41.10", "VP9 Profile 2@4.1 10-bit", "video", "vp9", "2", "4.1"},
+		{"vp09.00.10.08.01.01.01.01.00", "VP9 Profile 0@1.0 8-bit", "video", "vp9", "0", "1.0"},
+		{"dvh1.05.06", "Dolby Vision Profile 5@6", "video", "dolbyvision", "5", "6"},
+		{"mp4a.40.2", "AAC-LC", "audio", "aac", "", ""},
+		{"mp4a.40.5", "HE-AAC", "audio", "aac", "", ""},
+		{"mp4a.40.29", "HE-AACv2", "audio", "aac", "", ""},
+		{"mp4a.40.34", "MP3", "audio", "mp3", "", ""},
+		{"mp4a.69", "MP3", "audio", "mp3", "", ""},
+		{"mp4a.A6", "E-AC-3", "audio", "eac3", "", ""},
+		{"mp4a.40.99", "AAC object type 99", "audio", "aac", "", ""},
+		{"ec-3", "E-AC-3", "audio", "eac3", "", ""},
+		{"Opus", "Opus", "audio", "opus", "", ""},
+		{"wvtt", "WebVTT", "text", "", "", ""},
+		{"stpp.ttml.im1t", "TTML (IMSC1 text)", "text", "", "", ""},
+		{"xyz1.2", "xyz1.2", "", "", "", ""},
+	} {
+		var info Info
+		c := ParseCodec(" "+tc.id+" ", &info)
+		if c.ID != tc.id || c.Name != tc.name || c.Kind != tc.kind {
+			t.Errorf("%s: %+v, want %q, %s", tc.id, c, tc.name, tc.kind)
+		}
+		codec, profile, level := info.Video.Codec, info.Video.Profile, info.Video.Level
+		if tc.kind == "audio" {
+			codec = info.Audio.Codec
+		}
+		if codec != tc.codec || profile != tc.profile || level != tc.level {
+			t.Errorf("%s: info %s %s %s, want %s %s %s", tc.id, codec, profile, level, tc.codec, tc.profile, tc.level)
+		}
+	}
+}
@@ -0,0 +1,420 @@
+package repack
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/as/hls"
+	"github.com/as/hlscat/av"
+)
+
+// WriteDASH repackages the variant streams of m and their audio
+// renditions into an mpeg-dash package in dir. The video of each variant
+// is a representation in the adaptation set of its codec, and each audio
+// rendition is an adaptation set of its own. Without audio renditions, the audio of
+// the best variant (see Select) is used. Each representation is written
+// to its own directory as fragmented mp4, next to the manifest.mpd that
+// refers to them.
+//
+// With Follow, the manifest is dynamic until the playlists end, and
+// it's rewritten after every segment.
+func (r *Repackager) WriteDASH(dir string, m *hls.Master) error {
+	if len(m.Stream) == 0 {
+		return ErrNoStreams
+	}
+	parent := m.Path("")
+	d := r.dash(dir)
+	separate := false
+	for i, mi := range m.Media {
+		switch {
+		case mi.URI == "":
+		case mi.Type == "AUDIO":
+			d.add(Resolve(parent, mi.URI), nil, &dashRep{
+				id:   fmt.Sprintf("audio%d", i),
+				kind: av.Audio,
+				lang: mi.Lang,
+				main: mi.Default,
+			})
+			separate = true
+		default:
+			r.logf("dropping %s rendition: %s\n", mi.Type, mi.Name)
+		}
+	}
+	b, err := r.best(m)
+	if err != nil {
+		return err
+	}
+	for i, si := range m.Stream {
+		uri := Resolve(parent, si.URL)
+		d.add(uri, nil, &dashRep{id: fmt.Sprintf("video%d", i), kind: av.Video})
+		if i == b && !separate {
+			d.add(uri, nil, &dashRep{id: "audio", kind: av.Audio, main: true})
+		}
+	}
+	return d.run()
+}
+
+// WriteDASHMedia is like WriteDASH for a single media playlist, and the
+// separate audio for it if audio is not nil
+func (r *Repackager) WriteDASHMedia(dir string, m, audio *hls.Media) error {
+	d := r.dash(dir)
+	j := d.add("", m, &dashRep{id: "video", kind: av.Video})
+	j.audio = audio
+	d.add("", m, &dashRep{id: "audio", kind: av.Audio, main: true})
+	return d.run()
+}
+
+// dash writes the representations of an mpd, and the mpd itself
+type dash struct {
+	r    *Repackager
+	dir  string
+	jobs []*dashJob
+
+	mu    sync.Mutex
+	start time.Time // availability start time of a dynamic mpd
+}
+
+// dashJob is one playlist, and the representations it's split into
+type dashJob struct {
+	uri   string
+	m     *hls.Media
+	audio *hls.Media
+	rep   map[av.Kind]*dashRep
+}
+
+// dashRep is a representation, written by its segmenter
+type dashRep struct {
+	id   string
+	kind av.Kind
+	lang string
+	main bool
+	s    *segmenter
+
+	// copied from the segmenter when it's safe to read them
+	tracks []*av.Track
+	span   []span
+}
+
+func (r *Repackager) dash(dir string) *dash {
+	return &dash{r: r, dir: dir}
+}
+
+// add adds a representation of a kind of track in the playlist at uri,
+// or in m. Playlists are only read once, and the first representation
+// of each kind is used.
+func (d *dash) add(uri string, m *hls.Media, rep *dashRep) *dashJob {
+	var j *dashJob
+	for _, v := range d.jobs {
+		if uri != "" && v.uri == uri || m != nil && v.m == m {
+			j = v
+		}
+	}
+	if j == nil {
+		j = &dashJob{uri: uri, m: m, rep: map[av.Kind]*dashRep{}}
+		d.jobs = append(d.jobs, j)
+	}
+	if j.rep[rep.kind] == nil {
+		j.rep[rep.kind] = rep
+	}
+	return j
+}
+
+// run writes every playlist concurrently, and then the final mpd
+func (d *dash) run() error {
+	if d.r.Encryption != nil {
+		return ErrEncryption
+	}
+	errc := make(chan error, len(d.jobs))
+	for _, j := range d.jobs {
+		go func(j *dashJob) {
+			errc <- d.write(j)
+		}(j)
+	}
+	var err error
+	for range d.jobs {
+		if e := <-errc; err == nil {
+			err = e
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return d.mpd(true)
+}
+
+// write writes the representations of a playlist
+func (d *dash) write(j *dashJob) (err error) {
+	m := j.m
+	if m == nil {
+		if m, err = d.r.Playlist(j.uri); err != nil {
+			return err
+		}
+	}
+	if err := resolveRanges(m); err != nil {
+		return err
+	}
+	p := d.r.open(m)
+	dst := &split{mux: map[av.Kind]av.Muxer{}}
+	for kind, rep := range j.rep {
+		s := d.r.segmenter(filepath.Join(d.dir, rep.id), "mp4", p)
+		s.seq = p.first // the segments are numbered like the playlist's
+		s.update = func() error { return d.update(rep, s) }
+		rep.s = s
+		dst.mux[kind] = s
+	}
+	return d.r.pack(dst, p, j.audio)
+}
+
+// update copies what the mpd needs from the segmenter, which is only
+// safe in its own goroutine, and rewrites a dynamic mpd
+func (d *dash) update(rep *dashRep, s *segmenter) error {
+	d.mu.Lock()
+	rep.tracks = s.tracks
+	rep.span = append(rep.span[:0], s.span...)
+	d.mu.Unlock()
+	if !d.r.Follow {
+		return nil
+	}
+	return d.mpd(false)
+}
+
+// mpd writes manifest.mpd, which is dynamic unless it's final
+func (d *dash) mpd(final bool) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	out := &mpd{
+		Profiles:      "urn:mpeg:dash:profile:isoff-live:2011",
+		Type:          "static",
+		MinBufferTime: "PT2S",
+		Period:        period{ID: "0", Start: "PT0S"},
+	}
+	var end, longest time.Duration
+	var video, audio []adaptationSet
+	for _, j := range d.jobs {
+		for _, kind := range []av.Kind{av.Video, av.Audio} {
+			rep := j.rep[kind]
+			if rep == nil || len(rep.span) == 0 {
+				continue
+			}
+			v, e, l := rep.representation()
+			end, longest = max(end, e), max(longest, l)
+			if kind == av.Video {
+				// players only switch between representations of a
+				// codec, so each one has its own adaptation set
+				i := slices.IndexFunc(video, func(set adaptationSet) bool { return set.codec == rep.codec() })
+				if i < 0 {
+					i = len(video)
+					video = append(video, adaptationSet{ContentType: "video", codec: rep.codec()})
+				}
+				video[i].Reps = append(video[i].Reps, v)
+				continue
+			}
+			set := adaptationSet{ContentType: "audio", Lang: rep.lang, Reps: []representation{v}}
+			if set.Lang == "" && len(rep.tracks) > 0 {
+				set.Lang = rep.tracks[0].Lang
+			}
+			if rep.main {
+				set.Role = &descriptor{Scheme: "urn:mpeg:dash:role:2011", Value: "main"}
+			}
+			audio = append(audio, set)
+		}
+	}
+	out.Period.Sets = append(video, audio...)
+	for i := range out.Period.Sets {
+		out.Period.Sets[i].ID = i
+	}
+	if final {
+		out.Duration = isoDuration(end)
+	} else {
+		now := time.Now().UTC()
+		if d.start.IsZero() {
+			d.start = now.Add(-end)
+		}
+		out.Type = "dynamic"
+		out.Start = d.start.Format(time.RFC3339Nano)
+		out.Publish = now.Format(time.RFC3339Nano)
+		out.Update = isoDuration(longest)
+	}
+	return writePlaylist(filepath.Join(d.dir, "manifest.mpd"), func(w io.Writer) error {
+		io.WriteString(w, xml.Header)
+		enc := xml.NewEncoder(w)
+		enc.Indent("", "  ")
+		if err := enc.Encode(out); err != nil {
+			return err
+		}
+		_, err := io.WriteString(w, "\n")
+		return err
+	})
+}
+
+// codec returns the codec of the representation's track
+func (rep *dashRep) codec() string {
+	if len(rep.tracks) == 0 {
+		return ""
+	}
+	return rep.tracks[0].Codec
+}
+
+// representation returns the representation, the end of its timeline
+// and its longest segment
+func (rep *dashRep) representation() (v representation, end, longest time.Duration) {
+	var codecs []string
+	for _, t := range rep.tracks {
+		codecs = append(codecs, t.Codecs())
+		switch t.Kind {
+		case av.Video:
+			v.Width, v.Height = t.Width, t.Height
+		case av.Audio:
+			v.SampleRate = t.SampleRate
+			v.Channels = &descriptor{
+				Scheme: "urn:mpeg:dash:23003:3:audio_channel_configuration:2011",
+				Value:  fmt.Sprint(t.Channels),
+			}
+		}
+	}
+	scale := int64(rep.s.lead.Timescale)
+	sec := func(t int64) time.Duration {
+		return time.Duration(av.Rescale(t, scale, int64(time.Second)))
+	}
+	v.ID = rep.id
+	v.MimeType = rep.kind.String() + "/mp4"
+	v.Codecs = strings.Join(codecs, ",")
+	v.Template = segmentTemplate{
+		Timescale:   int(scale),
+		Init:        rep.id + "/init.mp4",
+		Media:       rep.id + "/seg$Number$.m4s",
+		StartNumber: rep.s.seq,
+	}
+	var next int64
+	for i, sp := range rep.span {
+		if d := sec(sp.d); d > 0 {
+			v.Bandwidth = max(v.Bandwidth, int(float64(sp.size*8)/d.Seconds()))
+			longest = max(longest, d)
+		}
+		tl := v.Template.Timeline
+		if n := len(tl); n > 0 && sp.t == next && tl[n-1].D == sp.d {
+			tl[n-1].R++
+		} else {
+			s := segment{D: sp.d}
+			if i == 0 || sp.t != next {
+				t := sp.t
+				s.T = &t
+			}
+			v.Template.Timeline = append(tl, s)
+		}
+		next = sp.t + sp.d
+	}
+	return v, sec(next), longest
+}
+
+// isoDuration formats d as an xml schema duration
+func isoDuration(d time.Duration) string {
+	return fmt.Sprintf("PT%.3fS", d.Seconds())
+}
+
+// split is an av.Muxer that writes each kind of track with its own
+// muxer, and drops the kinds without one
+type split struct {
+	mux  map[av.Kind]av.Muxer
+	kind map[int]av.Kind // of each track id
+}
+
+func (s *split) WriteHeader(tracks ...*av.Track) error {
+	s.kind = map[int]av.Kind{}
+	for kind, mux := range s.mux {
+		var kt []*av.Track
+		for _, t := range tracks {
+			if t.Kind == kind {
+				kt = append(kt, t)
+				s.kind[t.ID] = kind
+			}
+		}
+		if len(kt) == 0 {
+			continue
+		}
+		if err := mux.WriteHeader(kt...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *split) WriteSample(x av.Sample) error {
+	kind, ok := s.kind[x.Track]
+	if !ok {
+		return nil
+	}
+	return s.mux[kind].WriteSample(x)
+}
+
+func (s *split) Close() error {
+	var err error
+	for _, mux := range s.mux {
+		if e := mux.Close(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// the parts of an mpd that are written
+type (
+	mpd struct {
+		XMLName       xml.Name `xml:"urn:mpeg:dash:schema:mpd:2011 MPD"`
+		Profiles      string   `xml:"profiles,attr"`
+		Type          string   `xml:"type,attr"`
+		Duration      string   `xml:"mediaPresentationDuration,attr,omitempty"`
+		Start         string   `xml:"availabilityStartTime,attr,omitempty"`
+		Publish       string   `xml:"publishTime,attr,omitempty"`
+		Update        string   `xml:"minimumUpdatePeriod,attr,omitempty"`
+		MinBufferTime string   `xml:"minBufferTime,attr"`
+		Period        period   `xml:"Period"`
+	}
+	period struct {
+		ID    string          `xml:"id,attr"`
+		Start string          `xml:"start,attr"`
+		Sets  []adaptationSet `xml:"AdaptationSet"`
+	}
+	adaptationSet struct {
+		ID          int              `xml:"id,attr"`
+		ContentType string           `xml:"contentType,attr"`
+		Lang        string           `xml:"lang,attr,omitempty"`
+		Role        *descriptor      `xml:"Role"`
+		Reps        []representation `xml:"Representation"`
+
+		codec string // of the representations, for grouping them
+	}
+	representation struct {
+		ID         string          `xml:"id,attr"`
+		MimeType   string          `xml:"mimeType,attr"`
+		Codecs     string          `xml:"codecs,attr,omitempty"`
+		Bandwidth  int             `xml:"bandwidth,attr"`
+		Width      int             `xml:"width,attr,omitempty"`
+		Height     int             `xml:"height,attr,omitempty"`
+		SampleRate int             `xml:"audioSamplingRate,attr,omitempty"`
+		Channels   *descriptor     `xml:"AudioChannelConfiguration"`
+		Template   segmentTemplate `xml:"SegmentTemplate"`
+	}
+	descriptor struct {
+		Scheme string `xml:"schemeIdUri,attr"`
+		Value  string `xml:"value,attr"`
+	}
+	segmentTemplate struct {
+		Timescale   int       `xml:"timescale,attr"`
+		Init        string    `xml:"initialization,attr"`
+		Media       string    `xml:"media,attr"`
+		StartNumber int       `xml:"startNumber,attr"`
+		Timeline    []segment `xml:"SegmentTimeline>S"`
+	}
+	segment struct {
+		T *int64 `xml:"t,attr"`
+		D int64  `xml:"d,attr"`
+		R int    `xml:"r,attr,omitempty"`
+	}
+)
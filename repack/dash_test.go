@@ -0,0 +1,66 @@
+package repack
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/as/hlscat/av"
+)
+
+func TestMPD(t *testing.T) {
+	dir := t.TempDir()
+	d := New(Options{}).dash(dir)
+	avc := []byte{1, 0x64, 0, 0x1f}
+	for i, v := range []struct {
+		codec string
+		kind  av.Kind
+	}{{"h264", av.Video}, {"h265", av.Video}, {"h264", av.Video}, {"aac", av.Audio}} {
+		track := &av.Track{ID: 1, Kind: v.kind, Codec: v.codec, Timescale: 90000, Config: avc}
+		rep := &dashRep{
+			id:     fmt.Sprintf("%s%d", v.codec, i),
+			kind:   v.kind,
+			s:      &segmenter{lead: track, seq: 40},
+			tracks: []*av.Track{track},
+			span:   []span{{0, 180000, 1000, 0}, {180000, 180000, 1000, 0}},
+		}
+		d.jobs = append(d.jobs, &dashJob{rep: map[av.Kind]*dashRep{v.kind: rep}})
+	}
+	if err := d.mpd(true); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "manifest.mpd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m mpd
+	if err := xml.Unmarshal(data, &m); err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		content string
+		reps    []string
+	}{
+		{"video", []string{"h2640", "h2642"}},
+		{"video", []string{"h2651"}},
+		{"audio", []string{"aac3"}},
+	}
+	if len(m.Period.Sets) != len(want) {
+		t.Fatalf("%d adaptation sets, want %d", len(m.Period.Sets), len(want))
+	}
+	for i, set := range m.Period.Sets {
+		var reps []string
+		for _, rep := range set.Reps {
+			reps = append(reps, rep.ID)
+			if rep.Template.StartNumber != 40 {
+				t.Errorf("%s: startNumber %d, want 40", rep.ID, rep.Template.StartNumber)
+			}
+		}
+		if set.ID != i || set.ContentType != want[i].content || strings.Join(reps, " ") != strings.Join(want[i].reps, " ") {
+			t.Errorf("set %d: %s %q, want %s %q", set.ID, set.ContentType, reps, want[i].content, want[i].reps)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package repack
+
+import (
+	"errors"
+
+	"github.com/as/hls"
+)
+
+var ErrDelta = errors.New("repack: delta update doesn't apply to the previous playlist")
+
+// ApplyDelta returns the playlist described by a delta update (a playlist
+// with EXT-X-SKIP) by restoring the skipped segments from prev, the last
+// full playlist. Skipped is the SKIPPED-SEGMENTS count. The header comes
+// from the delta update.
+func ApplyDelta(prev, delta *hls.Media, skipped int) (*hls.Media, error) {
+	at := delta.Sequence - prev.Sequence
+	if at < 0 || skipped < 0 || at+skipped > len(prev.File) {
+		return nil, ErrDelta
+	}
+	m := *delta
+	m.File = make([]hls.File, 0, skipped+len(delta.File))
+	m.File = append(m.File, prev.File[at:at+skipped]...)
+
+	// the decoder carries keys and maps forward, so the leading segments
+	// with zero values are covered by tags in the skipped part
+	var key hls.Key
+	var init hls.Map
+	if skipped > 0 {
+		key, init = m.File[skipped-1].Key, m.File[skipped-1].Map
+	}
+	for _, f := range delta.File {
+		if f.Key != (hls.Key{}) {
+			key = f.Key
+		}
+		if f.Map != (hls.Map{}) {
+			init = f.Map
+		}
+		f.Key, f.Map = key, init
+		m.File = append(m.File, f)
+	}
+	return &m, nil
+}
@@ -0,0 +1,143 @@
+package repack
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/as/hls"
+)
+
+// decodePlaylist decodes a media playlist, returning its SKIPPED-SEGMENTS count
+func decodePlaylist(t *testing.T, s string) (*hls.Media, int) {
+	t.Helper()
+	tags, _, err := hls.Decode(strings.NewReader(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := decodeMedia(tags, "http://example.com/live.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m, ParseLowLatency(tags, m.Sequence).Skip.Segments
+}
+
+const prevPlaylist = `#EXTM3U
+#EXT-X-VERSION:9
+#EXT-X-TARGETDURATION:4
+#EXT-X-SERVER-CONTROL:CAN-SKIP-UNTIL=24
+#EXT-X-MEDIA-SEQUENCE:10
+#EXT-X-MAP:URI="init.mp4"
+#EXT-X-KEY:METHOD=AES-128,URI="key1"
+#EXTINF:4,
+s10.m4s
+#EXTINF:4,
+s11.m4s
+#EXTINF:4,
+s12.m4s
+#EXTINF:4,
+s13.m4s
+#EXTINF:4,
+s14.m4s
+#EXTINF:4,
+s15.m4s
+`
+
+func TestApplyDelta(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		delta string
+		urls  []string // of the segments, or nil for ErrDelta
+		keys  []string // key uris of the segments
+		maps  []string // map uris of the segments
+	}{
+		{
+			name: "skipped prefix",
+			delta: `#EXTM3U
+#EXT-X-VERSION:9
+#EXT-X-TARGETDURATION:4
+#EXT-X-MEDIA-SEQUENCE:12
+#EXT-X-SKIP:SKIPPED-SEGMENTS=3
+#EXTINF:4,
+s15.m4s
+#EXTINF:4,
+s16.m4s
+`,
+			urls: []string{"s12.m4s", "s13.m4s", "s14.m4s", "s15.m4s", "s16.m4s"},
+			keys: []string{"key1", "key1", "key1", "key1", "key1"},
+			maps: []string{"init.mp4", "init.mp4", "init.mp4", "init.mp4", "init.mp4"},
+		},
+		{
+			name: "key and map across the skip",
+			delta: `#EXTM3U
+#EXT-X-VERSION:9
+#EXT-X-TARGETDURATION:4
+#EXT-X-MEDIA-SEQUENCE:11
+#EXT-X-SKIP:SKIPPED-SEGMENTS=4
+#EXTINF:4,
+s15.m4s
+#EXT-X-KEY:METHOD=AES-128,URI="key2"
+#EXTINF:4,
+s16.m4s
+#EXT-X-MAP:URI="init2.mp4"
+#EXTINF:4,
+s17.m4s
+`,
+			urls: []string{"s11.m4s", "s12.m4s", "s13.m4s", "s14.m4s", "s15.m4s", "s16.m4s", "s17.m4s"},
+			keys: []string{"key1", "key1", "key1", "key1", "key1", "key2", "key2"},
+			maps: []string{"init.mp4", "init.mp4", "init.mp4", "init.mp4", "init.mp4", "init.mp4", "init2.mp4"},
+		},
+		{
+			name: "sequence behind the previous playlist",
+			delta: `#EXTM3U
+#EXT-X-VERSION:9
+#EXT-X-TARGETDURATION:4
+#EXT-X-MEDIA-SEQUENCE:9
+#EXT-X-SKIP:SKIPPED-SEGMENTS=2
+#EXTINF:4,
+s11.m4s
+`,
+		},
+		{
+			name: "skip beyond the previous playlist",
+			delta: `#EXTM3U
+#EXT-X-VERSION:9
+#EXT-X-TARGETDURATION:4
+#EXT-X-MEDIA-SEQUENCE:12
+#EXT-X-SKIP:SKIPPED-SEGMENTS=8
+#EXTINF:4,
+s20.m4s
+`,
+		},
+	} {
+		prev, _ := decodePlaylist(t, prevPlaylist)
+		delta, skipped := decodePlaylist(t, tc.delta)
+		m, err := ApplyDelta(prev, delta, skipped)
+		if tc.urls == nil {
+			if err != ErrDelta {
+				t.Errorf("%s: error %v, want ErrDelta", tc.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if m.Sequence != delta.Sequence {
+			t.Errorf("%s: sequence %d, want %d", tc.name, m.Sequence, delta.Sequence)
+		}
+		var urls, keys, maps []string
+		for _, f := range m.File {
+			urls = append(urls, f.Inf.URL)
+			keys = append(keys, f.Key.URI)
+			maps = append(maps, f.Map.URI)
+		}
+		for _, c := range []struct {
+			what      string
+			got, want []string
+		}{{"segments", urls, tc.urls}, {"keys", keys, tc.keys}, {"maps", maps, tc.maps}} {
+			if strings.Join(c.got, " ") != strings.Join(c.want, " ") {
+				t.Errorf("%s: %s %q, want %q", tc.name, c.what, c.got, c.want)
+			}
+		}
+	}
+}
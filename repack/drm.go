@@ -0,0 +1,278 @@
+package repack
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/as/hls"
+)
+
+// unlock decrypts a segment encrypted with the given EXT-X-KEY method
+func (r *Repackager) unlock(method, key, iv string, src io.ReadCloser) io.ReadCloser {
+	switch method {
+	case "SAMPLE-AES":
+		return r.sampleAES(key, iv, src)
+	case "SAMPLE-AES-CTR":
+		return src // only in fragmented mp4, see cenc
+	}
+	return r.decrypt(key, iv, src)
+}
+
+// decryptInit decrypts an init segment covered by an AES-128 key. Many
+// playlists list the key before a map that isn't encrypted, so an init
+// that already starts with an mp4 box is passed through.
+func (r *Repackager) decryptInit(key, iv string, src io.ReadCloser) io.ReadCloser {
+	if key == "" {
+		return src
+	}
+	br := bufio.NewReader(src)
+	if h, _ := br.Peek(8); mp4box(h) {
+		return struct {
+			io.Reader
+			io.Closer
+		}{br, src}
+	}
+	return r.decrypt(key, iv, struct {
+		io.Reader
+		io.Closer
+	}{br, src})
+}
+
+// mp4box reports whether h is the header of a box that starts an mp4
+// file or segment
+func mp4box(h []byte) bool {
+	if len(h) < 8 {
+		return false
+	}
+	switch string(h[4:8]) {
+	case "ftyp", "styp", "moov", "moof", "sidx", "emsg", "prft", "free", "skip":
+		return true
+	}
+	return false
+}
+
+// identity reports whether the key's uri is the key itself, rather than
+// something only a drm system understands
+func identity(k *hls.Key) bool {
+	return k.Format == "" || k.Format == "identity"
+}
+
+// decrypt decrypts the contents of the reader using the key and iv
+// in aes128cbc mode. it automatically unpads the last block when
+// the reader encounters an eof condition
+func (r *Repackager) decrypt(key, iv string, src io.ReadCloser) io.ReadCloser {
+	if r.NoDecrypt || key == "" {
+		return src
+	}
+	block, ivb, err := cbcparams(key, iv)
+	if err != nil {
+		src.Close()
+		return failed(err)
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		defer src.Close()
+		br := bufio.NewReader(src)
+		// the reason we make two buffers is because we need to delay
+		// writes to the pipe by 16 bytes, since only the last block is padded
+		// and we dont know when that is in a stream
+		//
+		// the buffers are swapped and output is delayed to detect this condition
+		tmp0, tmp1 := make([]byte, r.CBCBuf), make([]byte, r.CBCBuf)
+		//tmp0, tmp1 = make([]byte, 16), make([]byte, 16)
+		lastblock := func(msg []byte) error {
+			// this is the last block, so we must unpad it
+			msg, err := unpad(msg)
+			if err != nil {
+				return err
+			}
+			_, err = pw.Write(msg)
+			return err
+		}
+		cbc := cipher.NewCBCDecrypter(block, ivb)
+		//n, err := io.ReadAtLeast(r, tmp0, Blocksize)
+		n, err := readMod16(br, tmp0)
+		for n >= 16 {
+			if n%16 != 0 {
+				err = fmt.Errorf("%w: truncated block", ErrPadding)
+				break
+			}
+			msg := tmp0[:n]
+			cbc.CryptBlocks(msg, msg)
+			if err != nil {
+				// its possible to get 16 bytes and an io.EOF
+				if err == io.EOF || err == io.ErrUnexpectedEOF {
+					err = lastblock(msg)
+				}
+				break
+			}
+
+			//n, err = io.ReadAtLeast(r, tmp1, 16)
+			n, err = readMod16(br, tmp1)
+			if err == nil {
+				if _, err = pw.Write(msg); err != nil {
+					break
+				}
+				tmp0, tmp1 = tmp1, tmp0 // swap buffers
+			} else if err == io.EOF || err == io.ErrUnexpectedEOF {
+				// but more commonly the eof is on the next write
+				err = lastblock(msg)
+				break
+			} else {
+				break
+			}
+		}
+		if err == io.EOF {
+			err = nil
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// Encryption describes the AES-128 encryption of the output
+type Encryption struct {
+	Key []byte // the 16 byte key
+	IV  []byte // the iv of every segment, or nil for their media sequence numbers
+	URI string // the key uri written to playlists
+}
+
+// iv returns the iv of the segment with media sequence number seq
+func (e *Encryption) iv(seq int) []byte {
+	if e.IV != nil {
+		return e.IV
+	}
+	iv := make([]byte, Blocksize)
+	binary.BigEndian.PutUint64(iv[8:], uint64(seq))
+	return iv
+}
+
+// Tag returns the EXT-X-KEY for the segments
+func (e *Encryption) Tag() hls.Key {
+	k := hls.Key{Method: "AES-128", URI: e.URI}
+	if e.IV != nil {
+		k.IV = fmt.Sprintf("0x%x", e.IV)
+	}
+	return k
+}
+
+// Encrypt encrypts the stream with the output encryption in
+// Options.Encryption, as the segment with media sequence number seq. The
+// last block is padded with PKCS7. Without output encryption, src is
+// returned as is.
+func (r *Repackager) Encrypt(src io.ReadCloser, seq int) io.ReadCloser {
+	e := r.Encryption
+	if e == nil {
+		return src
+	}
+	block, err := aes.NewCipher(e.Key)
+	if err != nil {
+		src.Close()
+		return failed(&KeyError{Err: err})
+	}
+	iv := e.iv(seq)
+	if len(iv) != Blocksize {
+		src.Close()
+		return failed(&KeyError{Err: fmt.Errorf("bad iv length: %d", len(iv))})
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		defer src.Close()
+		cbc := cipher.NewCBCEncrypter(block, iv)
+		buf := make([]byte, r.CBCBuf)
+		for {
+			n, err := io.ReadFull(src, buf)
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				// the last block, padded even if it's full
+				msg := pad(buf[:n])
+				cbc.CryptBlocks(msg, msg)
+				_, err = pw.Write(msg)
+				pw.CloseWithError(err)
+				return
+			}
+			if err == nil {
+				cbc.CryptBlocks(buf, buf)
+				_, err = pw.Write(buf)
+			}
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+	}()
+	return pr
+}
+
+// pad applies PKCS7 padding to m, which is the end of a message. It
+// appends in place if m has the capacity.
+func pad(m []byte) []byte {
+	n := Blocksize - len(m)%Blocksize
+	for i := 0; i < n; i++ {
+		m = append(m, byte(n))
+	}
+	return m
+}
+
+// readMod16 reads an even multiple of 16 bytes, or otherwise
+// returns an error
+func readMod16(r io.Reader, p []byte) (n int, err error) {
+	if len(p)%16 != 0 {
+		panic("readMod16: p % 16 != 0 (developer error)")
+	}
+	n, err = io.ReadAtLeast(r, p[:len(p)-16], 16)
+	if need := 16 - (n % 16); need != 0 && need != 16 {
+		m := 0
+		m, err = io.ReadFull(r, p[n:n+need])
+		n += m
+	}
+	return
+}
+
+// unpad applies the PKCS7 algorithm to unpad a plaintext CBC message 'm'
+// m should be exactly 16 bytes. As per the standard, there will always be at
+// least ONE padding byte, because a padding length of zero indicates that
+// all 16 bytes are padding.
+//
+// This function should be called in a system that applies the standard PKCS7
+// padding on the final block of the message, and it should be called AFTER
+// decryption.
+func unpad(m []byte) (q []byte, err error) {
+	if len(m) < Blocksize {
+		panic("block too small")
+	}
+	padlen := m[len(m)-1]
+	if padlen > Blocksize {
+		return nil, fmt.Errorf("%w: pad length %d > %d", ErrPadding, padlen, Blocksize)
+	}
+	if padlen == 0 {
+		// if the pad length is 0, the entire block is padded and will be thrown away
+		// some non compliant implementations zero means "no padding", which
+		// doesn't make any sense because that zero itself is one byte of padding
+		padlen = Blocksize
+	}
+
+	// check the value of the actual padding, each byte needs to be padlen
+	// this detects ciphertext tampering and acts as a CRC
+	psi := len(m) - int(padlen) // pad start index
+	for _, v := range m[psi:] {
+		if v != padlen {
+			return nil, fmt.Errorf("%w: pad value %d != %d", ErrPadding, v, padlen)
+		}
+	}
+	return m[:psi], nil
+}
+
+func unhex(a string) (h []byte, err error) {
+	h = []byte(strings.TrimPrefix(strings.TrimPrefix(a, "0x"), "0X"))
+	hexlen, err := hex.Decode(h, h)
+	if err != nil {
+		return nil, fmt.Errorf("bad iv %q: %w", a, err)
+	}
+	return h[:hexlen], nil
+}
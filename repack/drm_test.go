@@ -0,0 +1,105 @@
+package repack
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/as/hls"
+)
+
+// encrypt encrypts msg with aes-128-cbc and pkcs7 padding
+func encrypt(t *testing.T, key, iv, msg []byte) []byte {
+	t.Helper()
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := pad(append([]byte{}, msg...))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(out, out)
+	return out
+}
+
+// seqiv returns the iv derived from a media sequence number
+func seqiv(seq int) []byte {
+	iv := make([]byte, Blocksize)
+	binary.BigEndian.PutUint64(iv[8:], uint64(seq))
+	return iv
+}
+
+func TestDecryptIV(t *testing.T) {
+	explicit := []byte("an explicit iv!!")
+	r := New(Options{CBCBuf: 64})
+	for _, tc := range []struct {
+		name string
+		iv   string // the IV attribute
+		seq  int
+		enc  []byte // the iv the segment was encrypted with
+	}{
+		{"explicit", "0x" + hex.EncodeToString(explicit), 7, explicit},
+		{"sequence", "", 7, seqiv(7)},
+		{"sequence zero", "", 0, seqiv(0)},
+		{"large sequence", "", 1<<40 + 3, seqiv(1<<40 + 3)},
+	} {
+		for _, size := range []int{0, 15, 16, 17, 1000} {
+			msg := bytes.Repeat([]byte{0x47, byte(size), 0xaa}, size)[:size]
+			f := hls.File{Key: hls.Key{Method: "AES-128", URI: "key", IV: tc.iv}}
+			sequenceIV(&f, tc.seq)
+			src := io.NopCloser(bytes.NewReader(encrypt(t, testKey, tc.enc, msg)))
+			got, err := io.ReadAll(r.unlock(f.Key.Method, string(testKey), f.Key.IV, src))
+			if err != nil || !bytes.Equal(got, msg) {
+				t.Errorf("%s, %d bytes: decrypted %d bytes, %v", tc.name, size, len(got), err)
+			}
+		}
+	}
+}
+
+func TestSequenceIV(t *testing.T) {
+	const playlist = `#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXT-X-MEDIA-SEQUENCE:5
+#EXT-X-KEY:METHOD=AES-128,URI="key"
+#EXTINF:4,
+a.ts
+#EXT-X-KEY:METHOD=AES-128,URI="key",IV=0x0000000000000000000000000000abcd
+#EXTINF:4,
+b.ts
+#EXT-X-KEY:METHOD=SAMPLE-AES,URI="key"
+#EXTINF:4,
+c.ts
+#EXT-X-MAP:URI="init.mp4"
+#EXT-X-KEY:METHOD=SAMPLE-AES,URI="key",KEYFORMAT="identity"
+#EXTINF:4,
+d.m4s
+#EXT-X-KEY:METHOD=AES-128,URI="key"
+#EXTINF:4,
+e.m4s
+#EXT-X-ENDLIST
+`
+	tags, _, err := hls.Decode(strings.NewReader(playlist))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := decodeMedia(tags, "http://example.com/media.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"0x00000000000000000000000000000005",
+		"0x0000000000000000000000000000abcd",
+		"0x00000000000000000000000000000007", // sample-aes in ts
+		"",                                   // sample-aes in fmp4, ivs are in the samples
+		"0x00000000000000000000000000000009",
+	}
+	p := New(Options{}).newPlaylist(m)
+	for i, f := range p.file {
+		if f.Key.IV != want[i] {
+			t.Errorf("%s: iv %q, want %q", f.Inf.URL, f.Key.IV, want[i])
+		}
+	}
+}
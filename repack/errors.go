@@ -0,0 +1,103 @@
+package repack
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+var (
+	ErrNoStreams   = errors.New("repack: master playlist has no streams")
+	ErrNoSegments  = errors.New("repack: media playlist has no segments")
+	ErrNoSubtitles = errors.New("repack: master playlist has no subtitles")
+	ErrNoVariant   = errors.New("repack: no variant matches the selection policy")
+	ErrPolicy      = errors.New("repack: bad selection policy")
+	ErrKeySize     = errors.New("repack: key is not 16 bytes")
+	ErrPadding     = errors.New("repack: bad pkcs7 padding")
+	ErrScheme      = errors.New("repack: unsupported scheme")
+	ErrPartsLost   = errors.New("repack: parts of a live segment rolled off before they were streamed")
+
+	ErrEncryption = errors.New("repack: dash output can't be encrypted with aes-128")
+)
+
+// FetchError is returned when a playlist, key or segment can't be
+// downloaded. Status is the http status code, or zero if there was
+// no response.
+type FetchError struct {
+	URL    string
+	Status int
+	Err    error
+}
+
+func (e *FetchError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("fetch %s: %d %s", e.URL, e.Status, http.StatusText(e.Status))
+	}
+	return fmt.Sprintf("fetch %s: %v", e.URL, e.Err)
+}
+
+func (e *FetchError) Unwrap() error { return e.Err }
+
+// KeyError is returned for a decryption key or iv that can't be used
+type KeyError struct {
+	URL string
+	Err error
+}
+
+func (e *KeyError) Error() string {
+	if e.URL == "" {
+		return fmt.Sprintf("key: %v", e.Err)
+	}
+	return fmt.Sprintf("key %s: %v", e.URL, e.Err)
+}
+
+func (e *KeyError) Unwrap() error { return e.Err }
+
+// MuxError is returned when the remuxer fails on otherwise good input.
+// Cmd is ffmpeg or native.
+type MuxError struct {
+	Cmd string
+	Err error
+}
+
+func (e *MuxError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Cmd, e.Err)
+}
+
+func (e *MuxError) Unwrap() error { return e.Err }
+
+// failed returns a reader that fails with err
+func failed(err error) io.ReadCloser {
+	pr, pw := io.Pipe()
+	pw.CloseWithError(err)
+	return pr
+}
+
+// input records the first error returned by the reader so it can take
+// precedence over the error of a remuxer consuming it
+type input struct {
+	io.Reader
+	err error
+}
+
+func (r *input) Read(p []byte) (n int, err error) {
+	n, err = r.Reader.Read(p)
+	if err != nil && err != io.EOF && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// muxerr returns the first input error, or err as a MuxError
+func muxerr(cmd string, err error, in ...*input) error {
+	for _, r := range in {
+		if r.err != nil {
+			return r.err
+		}
+	}
+	if err == nil {
+		return nil
+	}
+	return &MuxError{Cmd: cmd, Err: err}
+}
@@ -0,0 +1,266 @@
+package repack
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// MaxBackoff caps the delay between retries
+const MaxBackoff = 30 * time.Second
+
+// Stats counts the download activity of a Repackager
+type Stats struct {
+	Requests int64 // requests made, including retries
+	Retries  int64 // requests that were retries
+	Resumed  int64 // retries that resumed a partial transfer with a range request
+	Failed   int64 // downloads that failed after all of their retries
+	Bytes    int64 // bytes downloaded
+}
+
+func (s Stats) String() string {
+	return fmt.Sprintf("%d requests, %d retries (%d resumed), %d failed, %d bytes",
+		s.Requests, s.Retries, s.Resumed, s.Failed, s.Bytes)
+}
+
+type stats struct {
+	requests, retries, resumed, failed, bytes atomic.Int64
+}
+
+// Stats returns the download activity so far
+func (r *Repackager) Stats() Stats {
+	return Stats{
+		Requests: r.stats.requests.Load(),
+		Retries:  r.stats.retries.Load(),
+		Resumed:  r.stats.resumed.Load(),
+		Failed:   r.stats.failed.Load(),
+		Bytes:    r.stats.bytes.Load(),
+	}
+}
+
+// Download returns the content at u
+func (r *Repackager) Download(u string) ([]byte, error) {
+	b, err := r.fetch(r.Location(u), ByteRange{})
+	if err != nil {
+		return nil, err
+	}
+	defer b.Close()
+	return io.ReadAll(b)
+}
+
+// stream returns the content at u, or the part of it in rng. The download
+// starts immediately and is buffered ahead of the reader. Closing the
+// reader abandons it.
+func (r *Repackager) stream(u string, rng ByteRange) io.ReadCloser {
+	<-r.sem
+	u = r.Location(u)
+	if r.Debug > 0 {
+		r.logf("start stream %s %s\n", u, rng)
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		defer func() { r.sem <- true }()
+		b, err := r.fetch(u, rng)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		bw := bufio.NewWriterSize(pw, r.BufSize)
+		_, err = io.Copy(bw, b)
+		b.Close()
+		if err == nil {
+			err = bw.Flush()
+		}
+		if r.Debug > 0 {
+			r.logf("fin stream %s\n", u)
+		}
+		pw.CloseWithError(err)
+	}()
+	br := bufio.NewReaderSize(pr, r.BufSize)
+	return struct {
+		io.Reader
+		io.Closer
+	}{br, pr}
+}
+
+// body is the content of a url, or a byte range of it. Failed requests
+// are retried with exponential backoff, and interrupted transfers are
+// resumed with a range request from the last byte received.
+type body struct {
+	r      *Repackager
+	url    string
+	rng    ByteRange
+	ctx    context.Context // the deadline for the whole download
+	cancel context.CancelFunc
+
+	rc    io.ReadCloser      // the content of the current request
+	done  context.CancelFunc // ends the current request
+	off   int64              // bytes received, from the start of the range
+	tries int
+	err   error // a failed read that delivered content, retried by the next
+}
+
+// fetch starts downloading rng of u, or all of it if rng is zero. Errors
+// before the first byte of content, such as an unsuccessful status, are
+// returned here.
+func (r *Repackager) fetch(u string, rng ByteRange) (*body, error) {
+	b := &body{r: r, url: u, rng: rng, ctx: context.Background(), cancel: func() {}}
+	if r.SegmentTimeout > 0 {
+		b.ctx, b.cancel = context.WithTimeout(b.ctx, r.SegmentTimeout)
+	}
+	if err := b.open(); err != nil {
+		b.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *body) Read(p []byte) (n int, err error) {
+	if err, b.err = b.err, nil; err != nil && !b.retry(err) {
+		return 0, err
+	}
+	for {
+		if b.rc == nil {
+			if err = b.open(); err != nil {
+				return 0, err
+			}
+		}
+		n, err = b.rc.Read(p)
+		b.off += int64(n)
+		b.r.stats.bytes.Add(int64(n))
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+		b.end()
+		err = &FetchError{URL: b.url, Err: err}
+		if n > 0 {
+			// deliver what arrived, the next read retries
+			b.err = err
+			return n, nil
+		}
+		if !b.retry(err) {
+			return 0, err
+		}
+	}
+}
+
+func (b *body) Close() error {
+	b.end()
+	b.cancel()
+	return nil
+}
+
+func (b *body) end() {
+	if b.rc != nil {
+		b.rc.Close()
+		b.rc = nil
+	}
+	if b.done != nil {
+		b.done()
+		b.done = nil
+	}
+}
+
+// open requests the content from the current offset, retrying
+// until it succeeds or the retries are exhausted
+func (b *body) open() error {
+	for {
+		err := b.request()
+		if err == nil {
+			return nil
+		}
+		if !b.retry(err) {
+			return err
+		}
+	}
+}
+
+func (b *body) request() error {
+	ctx, done := b.ctx, context.CancelFunc(func() {})
+	if b.r.Timeout > 0 {
+		ctx, done = context.WithTimeout(ctx, b.r.Timeout)
+	}
+	rng := ByteRange{Offset: b.rng.Offset + b.off}
+	if b.rng.Length > 0 {
+		rng.Length = b.rng.Length - b.off
+	}
+	b.r.stats.requests.Add(1)
+	rc, err := b.r.Fetcher.Fetch(ctx, b.url, rng)
+	if err != nil {
+		done()
+		if _, ok := err.(*FetchError); !ok {
+			err = &FetchError{URL: b.url, Err: err}
+		}
+		return err
+	}
+	b.rc, b.done = rc, done
+	return nil
+}
+
+// retry reports whether err is worth retrying, and if so, waits
+// for the backoff delay
+func (b *body) retry(err error) bool {
+	r := b.r
+	if b.tries >= r.Retries || !temporary(err) || b.ctx.Err() != nil {
+		r.stats.failed.Add(1)
+		return false
+	}
+	b.tries++
+	d := backoff(r.Backoff, b.tries)
+	r.stats.retries.Add(1)
+	if b.off > 0 {
+		r.stats.resumed.Add(1)
+	}
+	if r.Verbose {
+		r.logf("retry %d/%d at byte %d in %s: %v\n", b.tries, r.Retries, b.off, d, err)
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-b.ctx.Done():
+		r.stats.failed.Add(1)
+		return false
+	}
+}
+
+// backoff returns the delay before the nth retry: the base delay doubled
+// for each previous retry, capped at MaxBackoff, with half of it randomized
+func backoff(base time.Duration, n int) time.Duration {
+	d := base
+	for ; n > 1 && d < MaxBackoff; n-- {
+		d *= 2
+	}
+	if d > MaxBackoff {
+		d = MaxBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// temporary reports whether the failed request might succeed if repeated
+func temporary(err error) bool {
+	e, ok := err.(*FetchError)
+	if !ok {
+		return false
+	}
+	var pe *fs.PathError
+	switch {
+	case errors.As(e.Err, &pe):
+		return false // local files don't get better
+	case errors.Is(e.Err, ErrScheme):
+		return false
+	case e.Err != nil:
+		return true // no response, or the transfer was interrupted
+	case e.Status >= 500, e.Status == http.StatusRequestTimeout, e.Status == http.StatusTooManyRequests:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,60 @@
+package repack
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dropper serves content that drops the connection after every n bytes
+type dropper struct {
+	content string
+	n       int
+}
+
+func (d dropper) Fetch(ctx context.Context, u string, rng ByteRange) (io.ReadCloser, error) {
+	return io.NopCloser(&drop{s: d.content[rng.Offset:], n: d.n}), nil
+}
+
+type drop struct {
+	s string
+	n int
+}
+
+func (d *drop) Read(p []byte) (int, error) {
+	if d.s == "" {
+		return 0, io.EOF
+	}
+	n := copy(p[:min(len(p), d.n)], d.s)
+	if d.s = d.s[n:]; d.s == "" {
+		return n, io.EOF
+	}
+	return n, io.ErrUnexpectedEOF
+}
+
+func TestResume(t *testing.T) {
+	content := strings.Repeat("0123456789", 3)
+	for _, tc := range []struct {
+		name    string
+		retries int
+		ok      bool
+		stats   Stats
+	}{
+		{"resumed", 10, true, Stats{Requests: 4, Retries: 3, Resumed: 3, Bytes: 30}},
+		{"bounded", 2, false, Stats{Requests: 3, Retries: 2, Resumed: 2, Failed: 1, Bytes: 24}},
+	} {
+		r := New(Options{Fetcher: dropper{content, 8}, Retries: tc.retries, Backoff: time.Nanosecond})
+		b, err := r.Download("http://example.com/seg.ts")
+		if tc.ok && (err != nil || string(b) != content) {
+			t.Errorf("%s: got %q, %v, want the content", tc.name, b, err)
+		}
+		if !tc.ok && err == nil {
+			t.Errorf("%s: no error", tc.name)
+		}
+		if s := r.Stats(); s != tc.stats {
+			t.Errorf("%s: stats %v, want %v", tc.name, s, tc.stats)
+		}
+	}
+}
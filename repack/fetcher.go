@@ -0,0 +1,155 @@
+package repack
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Fetcher opens the content at a url. If rng is not zero, only that part
+// of the content is returned, and a zero rng.Length extends to the end.
+// Failures should be a *FetchError, which are retried if temporary.
+type Fetcher interface {
+	Fetch(ctx context.Context, u string, rng ByteRange) (io.ReadCloser, error)
+}
+
+// Schemes is a Fetcher that uses the Fetcher registered for the scheme
+// of the url. Plain paths have the empty scheme.
+type Schemes map[string]Fetcher
+
+func (s Schemes) Fetch(ctx context.Context, u string, rng ByteRange) (io.ReadCloser, error) {
+	scheme := ""
+	if n := strings.Index(u, "://"); n > 0 {
+		scheme = strings.ToLower(u[:n])
+	}
+	f, ok := s[scheme]
+	if !ok {
+		return nil, &FetchError{URL: u, Err: fmt.Errorf("%w %q", ErrScheme, scheme)}
+	}
+	return f.Fetch(ctx, u, rng)
+}
+
+// DefaultFetcher returns the Fetcher for http and https urls using
+// client, and for file urls and plain paths
+func DefaultFetcher(client *http.Client) Schemes {
+	h := HTTPFetcher{Client: client}
+	return Schemes{
+		"http":  h,
+		"https": h,
+		"file":  FileFetcher{},
+		"":      FileFetcher{},
+	}
+}
+
+// HTTPFetcher fetches http and https urls, using range requests for
+// byte ranges
+type HTTPFetcher struct {
+	Client *http.Client
+}
+
+func (h HTTPFetcher) Fetch(ctx context.Context, u string, rng ByteRange) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, &FetchError{URL: u, Err: err}
+	}
+	if s := rng.String(); s != "" {
+		req.Header.Set("Range", s)
+	}
+	client := h.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, &FetchError{URL: u, Err: err}
+	}
+	if resp.StatusCode/100 != 2 {
+		resp.Body.Close()
+		return nil, &FetchError{URL: u, Status: resp.StatusCode}
+	}
+	if rng.Offset > 0 && resp.StatusCode != http.StatusPartialContent {
+		// the server ignored the range, skip to where it starts
+		if _, err = io.CopyN(io.Discard, resp.Body, rng.Offset); err != nil {
+			resp.Body.Close()
+			return nil, &FetchError{URL: u, Status: resp.StatusCode, Err: err}
+		}
+	}
+	return limit(resp.Body, rng.Length), nil
+}
+
+// FileFetcher reads file urls and plain paths from the local filesystem.
+// File urls are unescaped, plain paths are opened as they are.
+type FileFetcher struct{}
+
+func (FileFetcher) Fetch(ctx context.Context, u string, rng ByteRange) (io.ReadCloser, error) {
+	name := u
+	if strings.HasPrefix(u, "file://") {
+		p, err := url.Parse(u)
+		if err != nil {
+			return nil, &FetchError{URL: u, Err: err}
+		}
+		name = p.Path
+	}
+	f, err := os.Open(filepath.FromSlash(name))
+	if err != nil {
+		return nil, &FetchError{URL: u, Err: err}
+	}
+	if rng.Offset > 0 {
+		if _, err = f.Seek(rng.Offset, io.SeekStart); err != nil {
+			f.Close()
+			return nil, &FetchError{URL: u, Err: err}
+		}
+	}
+	return limit(f, rng.Length), nil
+}
+
+// limit returns the first n bytes of rc, or all of it if n is zero
+func limit(rc io.ReadCloser, n int64) io.ReadCloser {
+	if n == 0 {
+		return rc
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(rc, n), rc}
+}
+
+// Resolve returns u relative to parent with the semantics of hls.File.Path:
+// the last element of parent is replaced by u, unless u is absolute
+func Resolve(parent, u string) string {
+	if parent == "" || u == "" || strings.Contains(u, "://") {
+		return u
+	}
+	base, err := url.Parse(parent)
+	if err != nil {
+		return u
+	}
+	ref, err := url.Parse(u)
+	if err != nil {
+		return u
+	}
+	return base.ResolveReference(ref).String()
+}
+
+// abspath returns a plain path as an absolute file url, so that paths
+// relative to it resolve against its directory, and are escaped the way
+// the file fetcher expects
+func abspath(u string) string {
+	if u == "" || strings.Contains(u, "://") {
+		return u
+	}
+	p, err := filepath.Abs(u)
+	if err != nil {
+		return u
+	}
+	p = filepath.ToSlash(p)
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	return (&url.URL{Scheme: "file", Path: p}).String()
+}
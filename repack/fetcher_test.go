@@ -0,0 +1,70 @@
+package repack
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileFetcher(t *testing.T) {
+	dir := filepath.ToSlash(t.TempDir())
+	for _, name := range []string{"a", "a#1.ts", "x", "x?y.ts", "my seg.ts"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0o644); err != nil {
+			t.Skip(err)
+		}
+	}
+	for _, tc := range []struct {
+		u, want string
+	}{
+		{dir + "/a#1.ts", "a#1.ts"},
+		{dir + "/x?y.ts", "x?y.ts"},
+		{dir + "/my seg.ts", "my seg.ts"},
+		{"file://" + dir + "/my%20seg.ts", "my seg.ts"},
+		{"file://" + dir + "/a%231.ts", "a#1.ts"},
+		{abspath(dir + "/x?y.ts"), "x?y.ts"},
+	} {
+		rc, err := FileFetcher{}.Fetch(context.Background(), tc.u, ByteRange{})
+		if err != nil {
+			t.Errorf("%s: %v", tc.u, err)
+			continue
+		}
+		data, _ := io.ReadAll(rc)
+		rc.Close()
+		if string(data) != tc.want {
+			t.Errorf("%s: read %q, want %q", tc.u, data, tc.want)
+		}
+	}
+}
+
+func TestPlaylistPlainPath(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "a #1")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	list := "#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXTINF:4,\nmy%20seg.ts\n#EXT-X-ENDLIST\n"
+	if err := os.WriteFile(filepath.Join(dir, "x?y.m3u8"), []byte(list), 0o644); err != nil {
+		t.Skip(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "my seg.ts"), []byte("segment"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	r := New(Options{})
+	m, err := r.Playlist(filepath.Join(dir, "x?y.m3u8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := r.Location(m.File[0].Path(m.URL))
+	if path.Base(u) != "my%20seg.ts" {
+		t.Errorf("segment at %s", u)
+	}
+	data, err := r.Download(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "segment" {
+		t.Errorf("segment is %q", data)
+	}
+}
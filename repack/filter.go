@@ -0,0 +1,170 @@
+package repack
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/as/hls"
+	"github.com/as/hlscat/av"
+	"github.com/as/hlscat/mp4"
+	"github.com/as/hlscat/ts"
+)
+
+func bitty() string {
+	return fmt.Sprintf("-bsf setts=pts=(2.02*12880)+N*512")
+}
+
+// filterAD returns the segments that aren't ads, as tracked by ads
+func (r *Repackager) filterAD(ads *adbreak, file ...hls.File) (new []hls.File) {
+	for _, f := range file {
+		if ads.ad(&f) {
+			r.logf("skipping ad break: %s\n", f.Inf.URL)
+			continue
+		}
+		new = append(new, f)
+	}
+	return
+}
+
+func (r *Repackager) filterFrag(src io.ReadCloser, trim time.Duration) io.ReadCloser {
+	cmdline := "ffmpeg -hide_banner -thread_queue_size 4096 -i - -c copy -f mp4 -min_frag_duration 10000000 -bsf:a aac_adtstoasc -movflags empty_moov+default_base_moof+skip_trailer -"
+	if trim != 0 {
+		cmdline += fmt.Sprintf("t %f %s -", trim.Seconds(), bitty())
+	}
+	r.logf("filterFrag %s\n", cmdline)
+	return r.ffmpeg(cmdline, src)
+}
+
+// ffmpeg runs cmdline with src on its standard input and returns its
+// standard output. The extra input, if any, is passed to ffmpeg as file
+// descriptor 3. The reader fails with the first error reading an input,
+// or a MuxError if ffmpeg itself fails.
+func (r *Repackager) ffmpeg(cmdline string, src io.ReadCloser, extra ...io.ReadCloser) io.ReadCloser {
+	s := strings.Split(cmdline, " ")
+	r.logf("%q\n", s)
+	cmd := exec.Command(s[0], s[1:]...)
+	in := []*input{{Reader: src}}
+	cmd.Stdin = in[0]
+	if r.Debug > 3 {
+		cmd.Stderr = r.Log
+	}
+	pr, pw := io.Pipe()
+	cmd.Stdout = pw
+	var copies sync.WaitGroup
+	for _, x := range extra {
+		fr, fw, err := os.Pipe()
+		if err != nil {
+			pw.CloseWithError(err)
+			return pr
+		}
+		cmd.ExtraFiles = append(cmd.ExtraFiles, fr)
+		x := &input{Reader: x}
+		in = append(in, x)
+		copies.Add(1)
+		go func() {
+			defer copies.Done()
+			io.Copy(fw, x)
+			fw.Close()
+		}()
+	}
+	go func() {
+		err := cmd.Start()
+		for _, f := range cmd.ExtraFiles {
+			f.Close() // the child has its own copy
+		}
+		if err == nil {
+			err = cmd.Wait()
+		}
+		copies.Wait()
+		src.Close()
+		for _, x := range extra {
+			x.Close()
+		}
+		pw.CloseWithError(muxerr("ffmpeg", err, in...))
+	}()
+	return pr
+}
+
+// remux converts the concatenated segments in src into a fragmented
+// mp4 using ffmpeg or the native remuxer
+func (r *Repackager) remux(src io.ReadCloser) io.ReadCloser {
+	if r.Native {
+		return r.filterNative(src)
+	}
+	return r.filterFrag(src, 0)
+}
+
+// filterNative is filterFrag without ffmpeg. It demuxes mpeg ts or
+// fragmented mp4 in-process and writes the container selected by Format
+func (r *Repackager) filterNative(src io.ReadCloser) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		in := &input{Reader: src}
+		err := av.Copy(r.captions(muxer(r.Format, pw)), r.demuxer(in))
+		src.Close()
+		pw.CloseWithError(muxerr("native", err, in))
+	}()
+	return pr
+}
+
+// mergeNative is filterMerge without ffmpeg. It takes the video from s0 and
+// the audio from s1 and interleaves them by decode time. Either input can
+// be mpeg ts or fragmented mp4.
+func (r *Repackager) mergeNative(s0, s1 io.ReadCloser) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		keep := func(n int, t *av.Track) bool {
+			return n == 0 && t.Kind == av.Video || n == 1 && t.Kind == av.Audio
+		}
+		in0, in1 := &input{Reader: s0}, &input{Reader: s1}
+		err := av.Merge(r.captions(muxer(r.Format, pw)), keep, r.demuxer(in0), r.demuxer(in1))
+		s0.Close()
+		s1.Close()
+		pw.CloseWithError(muxerr("native", err, in0, in1))
+	}()
+	return pr
+}
+
+// demuxer returns a demuxer for the container in src, which is
+// detected by looking for the transport stream sync byte
+func (r *Repackager) demuxer(src io.Reader) av.Demuxer {
+	br := bufio.NewReaderSize(src, r.BufSize)
+	if p, _ := br.Peek(1); len(p) > 0 && p[0] == ts.SyncByte {
+		return ts.NewReader(br)
+	}
+	return mp4.NewReader(br)
+}
+
+func muxer(format string, w io.Writer) av.Muxer {
+	if format == "ts" {
+		return ts.NewWriter(w)
+	}
+	return mp4.NewWriter(w)
+}
+
+func (r *Repackager) filterTS(src io.ReadCloser, trim time.Duration) io.ReadCloser {
+	if r.NoFilter {
+		return src
+	}
+	cmdline := "ffmpeg -hide_banner -thread_queue_size 4096 -dts_delta_threshold 1 -i - -c copy -fflags +shortest+genpts -muxpreload 0 -muxdelay 0 -max_interleave_delta 0 -flush_packets 0 -f mpegts -"
+	if trim != 0 {
+		cmdline += fmt.Sprintf("t %f -", trim.Seconds())
+	}
+	r.logf("filterTS %s\n", cmdline)
+	return r.ffmpeg(cmdline, src)
+}
+
+func (r *Repackager) filterMerge(s0, s1 io.ReadCloser) io.ReadCloser {
+	if r.Native {
+		return r.mergeNative(s0, s1)
+	}
+	cmdline := "ffmpeg -hide_banner -thread_queue_size 4096 -i - -thread_queue_size 4096 -i /proc/self/fd/3 -c copy -map 0:v -map 1:a -bsf:a aac_adtstoasc -f mp4 -min_frag_duration 10000000 -movflags empty_moov+default_base_moof+skip_trailer -"
+	r.logf("filterMerge %s\n", cmdline)
+	return r.ffmpeg(cmdline, s0, s1)
+}
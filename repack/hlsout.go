@@ -0,0 +1,474 @@
+package repack
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/as/hls"
+	"github.com/as/hlscat/av"
+)
+
+// WriteMedia repackages the segments in m into a vod package in dir: one
+// segment file for each segment in m, an init segment shared by all of
+// them for fragmented mp4, and the media playlist index.m3u8, which is
+// returned. Program date times and discontinuities are carried over, and
+// durations are those of the segments as cut. If audio is not nil, its
+// audio is merged into the segments, like Merge.
+//
+// The segments are remuxed natively into the container selected by
+// Format and encrypted with Options.Encryption, if it's set. Without a
+// key uri, the key is written to the package as key.bin. Clear mpeg ts
+// video also gets the i-frame playlist iframes.m3u8.
+func (r *Repackager) WriteMedia(dir string, m, audio *hls.Media) (*hls.Media, error) {
+	return r.writeMedia(dir, m, audio, nil, nil)
+}
+
+// writeMedia is WriteMedia, calling ready once the first index.m3u8 is
+// written. Closing stop stops following live playlists.
+func (r *Repackager) writeMedia(dir string, m, audio *hls.Media, ready func(), stop <-chan bool) (*hls.Media, error) {
+	r.logf("media playlist duration=%s\n", hls.Runtime(m.File...))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := resolveRanges(m); err != nil {
+		return nil, err
+	}
+	p := r.open(m)
+	p.stop = stop
+	s := r.segmenter(dir, r.Format, p)
+	s.ready = ready
+	if r.Follow {
+		// live playlists are written as they grow
+		s.update = func() error { return s.playlist(false) }
+	}
+	if err := r.pack(s, p, audio); err != nil {
+		return nil, err
+	}
+	return &s.out, s.playlist(true)
+}
+
+// pack remuxes the segments in p into dst. If audio is not nil, its
+// audio is merged with the video in p.
+func (r *Repackager) pack(dst av.Muxer, p *playlist, audio *hls.Media) error {
+	src := []io.ReadCloser{r.concat(&r.Proto, p)}
+	var keep func(n int, t *av.Track) bool
+	if audio != nil {
+		if err := resolveRanges(audio); err != nil {
+			src[0].Close()
+			return err
+		}
+		a := r.open(audio)
+		a.stop = p.stop
+		src = append(src, r.concat(&r.Proto, a))
+		keep = func(n int, t *av.Track) bool {
+			return n == 0 && t.Kind == av.Video || n == 1 && t.Kind == av.Audio
+		}
+	}
+	in := make([]*input, len(src))
+	dmx := make([]av.Demuxer, len(src))
+	for i, rc := range src {
+		in[i] = &input{Reader: rc}
+		dmx[i] = r.demuxer(in[i])
+	}
+	err := av.Merge(r.captions(dst), keep, dmx...)
+	for _, rc := range src {
+		rc.Close()
+	}
+	return muxerr("native", err, in...)
+}
+
+// WriteMaster repackages the variant streams of m and their audio and
+// video renditions with WriteMedia, and their subtitle renditions as
+// WebVTT segments timed from the start of the first variant that shows
+// them, each into its own directory in dir. The I-frame
+// streams of m refer to the i-frame playlists of the variants with their
+// resolution, which only mpeg ts without encryption has. The playlists
+// are written concurrently, so live ones are followed together, and the
+// master playlist master.m3u8 that refers to them is written once they
+// all exist. The first error stops the rest.
+func (r *Repackager) WriteMaster(dir string, m *hls.Master) error {
+	if len(m.Stream) == 0 {
+		return ErrNoStreams
+	}
+	parent := m.Path("")
+	out := *m
+	out.M3U = true
+	out.Media, out.Stream, out.IFrame = nil, nil, nil
+	out.Version = max(out.Version, version(r.Format))
+
+	// playlists that appear more than once are only written once
+	written := map[string]string{}
+	subtitles := map[string]string{} // and the first variant showing them
+	var uris []string
+	write := func(uri, name string) string {
+		uri = Resolve(parent, uri)
+		if _, ok := written[uri]; !ok {
+			written[uri] = name
+			uris = append(uris, uri)
+		}
+		return written[uri] + "/index.m3u8"
+	}
+
+	for i, mi := range m.Media {
+		switch {
+		case mi.URI == "":
+			// muxed into the variants, or closed captions
+		case mi.Type == "AUDIO" || mi.Type == "VIDEO":
+			mi.URI = write(mi.URI, fmt.Sprintf("%s%d", strings.ToLower(mi.Type), i))
+		case mi.Type == "SUBTITLES":
+			mi.URI = write(mi.URI, fmt.Sprintf("subtitles%d", i))
+			video := ""
+			if v := slices.IndexFunc(m.Stream, func(si hls.StreamInfo) bool { return si.Subtitle == mi.Group }); v >= 0 {
+				video = Resolve(parent, m.Stream[v].URL)
+			}
+			subtitles[Resolve(parent, m.Media[i].URI)] = video
+		default:
+			r.logf("dropping %s rendition: %s\n", mi.Type, mi.Name)
+			continue
+		}
+		out.Media = append(out.Media, mi)
+	}
+	for i, si := range m.Stream {
+		si.URL = write(si.URL, fmt.Sprintf("stream%d", i))
+		out.Stream = append(out.Stream, si)
+	}
+	for _, fi := range m.IFrame {
+		v := slices.IndexFunc(m.Stream, func(si hls.StreamInfo) bool { return si.Resolution == fi.Resolution })
+		if v < 0 || r.Format != "ts" || r.Encryption != nil {
+			r.logf("dropping i-frame stream: %s\n", fi.URI)
+			continue
+		}
+		fi.URI = path.Dir(out.Stream[v].URL) + "/iframes.m3u8"
+		out.IFrame = append(out.IFrame, fi)
+		out.Version = max(out.Version, 4) // EXT-X-I-FRAMES-ONLY
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	// each playlist reports an error or nil on readyc once it's written,
+	// and its final error on errc
+	readyc := make(chan error, len(uris))
+	errc := make(chan error, len(uris))
+	stop := make(chan bool) // closed on the first error to stop the rest
+	for _, uri := range uris {
+		go func(uri string) {
+			var once sync.Once
+			ready := func(err error) { once.Do(func() { readyc <- err }) }
+			mm, err := r.Playlist(uri)
+			if err == nil {
+				at := filepath.Join(dir, written[uri])
+				if video, ok := subtitles[uri]; ok {
+					var mv *hls.Media
+					if video != "" {
+						mv, err = r.Playlist(video)
+					}
+					if err == nil {
+						_, err = r.writeSubtitles(at, mm, mv, func() { ready(nil) }, stop)
+					}
+				} else {
+					_, err = r.writeMedia(at, mm, nil, func() { ready(nil) }, stop)
+				}
+			}
+			ready(err)
+			errc <- err
+		}(uri)
+	}
+	var err error
+	fail := func(e error) {
+		if e != nil && err == nil {
+			err = e
+			close(stop)
+		}
+	}
+	for n := 0; n < len(uris) && err == nil; n++ {
+		fail(<-readyc)
+	}
+	if err == nil {
+		fail(writePlaylist(filepath.Join(dir, "master.m3u8"), out.Encode))
+	}
+	// the rest stop following once one fails, so this doesn't wait for
+	// live playlists to end
+	for range uris {
+		fail(<-errc)
+	}
+	return err
+}
+
+// segmenter is an av.Muxer that writes the segments of WriteMedia. The
+// stream is cut on the first keyframe of the lead track (the video, if
+// there is one) at the end of each source segment.
+type segmenter struct {
+	r      *Repackager
+	dir    string
+	format string
+	p      *playlist
+	mux    av.Muxer
+	buf    bytes.Buffer
+	out    hls.Media
+	update func() error // called after each segment, if set
+	ready  func()       // called once the playlist is first written, if set
+
+	tracks []*av.Track
+	lead   *av.Track
+	span   []span // of each segment, in the lead track's timescale
+	n      int    // the segment being written
+	seq    int    // numbers the segment files from segment 0, if set
+	on     bool   // whether the lead track started
+	t0     int64  // decode time of its first lead sample
+	t1     int64  // and of the last one
+	key    int    // bytes of the segment up to the end of its first keyframe, in ts
+}
+
+// span is the decode time, duration and size of a segment, and the size
+// of the keyframe that starts it in ts, with the tables before it
+type span struct {
+	t, d int64
+	size int
+	key  int
+}
+
+// segmenter returns a segmenter that writes the segments of p to dir
+func (r *Repackager) segmenter(dir, format string, p *playlist) *segmenter {
+	return &segmenter{r: r, dir: dir, format: format, p: p}
+}
+
+func (s *segmenter) WriteHeader(tracks ...*av.Track) error {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+	s.tracks = tracks
+	for _, t := range tracks {
+		if s.lead == nil || t.Kind == av.Video && s.lead.Kind != av.Video {
+			s.lead = t
+		}
+	}
+	s.mux = muxer(s.format, &s.buf)
+	if err := s.mux.WriteHeader(tracks...); err != nil {
+		return err
+	}
+	if s.format == "ts" {
+		return nil // the tables start the first segment
+	}
+	defer s.buf.Reset()
+	return s.write("init.mp4", s.buf.Bytes(), false)
+}
+
+func (s *segmenter) WriteSample(x av.Sample) error {
+	first := false // whether x starts a segment
+	if x.Track == s.lead.ID && (x.Key || s.lead.Kind != av.Video) {
+		if !s.on {
+			s.on, s.t0, first = true, x.DTS, true
+		} else if s.due(x.DTS) {
+			if c, ok := s.mux.(interface{ Cut() error }); ok {
+				if err := c.Cut(); err != nil {
+					return err
+				}
+			}
+			s.t1 = x.DTS // the segment ends where the next one starts
+			if err := s.cut(); err != nil {
+				return err
+			}
+			s.t0, first = x.DTS, true
+		}
+	}
+	if x.Track == s.lead.ID {
+		s.t1 = x.DTS + x.Dur
+	}
+	if err := s.mux.WriteSample(x); err != nil {
+		return err
+	}
+	if first && s.format == "ts" {
+		s.key = s.buf.Len() // ts samples are written through
+	}
+	return nil
+}
+
+func (s *segmenter) Close() error {
+	if s.mux == nil {
+		return nil // there were no tracks
+	}
+	if err := s.mux.Close(); err != nil {
+		return err
+	}
+	if s.buf.Len() == 0 {
+		return nil
+	}
+	return s.cut()
+}
+
+// due reports whether the segment being written ends before dts
+func (s *segmenter) due(dts int64) bool {
+	f, ok := s.p.segment(s.n)
+	if !ok {
+		return false
+	}
+	d := f.Duration(0)
+	tol := min(d/8, 250*time.Millisecond) // rounded durations
+	return s.elapsed(dts) >= d-tol
+}
+
+// elapsed returns the time from the start of the segment to dts
+func (s *segmenter) elapsed(dts int64) time.Duration {
+	return time.Duration(av.Rescale(dts-s.t0, int64(s.lead.Timescale), int64(time.Second)))
+}
+
+// cut writes the buffered segment and adds it to the playlist
+func (s *segmenter) cut() error {
+	ext := ".m4s"
+	if s.format == "ts" {
+		ext = ".ts"
+	}
+	f := hls.File{Inf: hls.Inf{URL: fmt.Sprintf("seg%d%s", s.seq+s.n, ext), Duration: s.elapsed(s.t1)}}
+	if s.format != "ts" && s.n == 0 {
+		// the map is listed once, ahead of any key, so it stays clear
+		f.Map = hls.Map{URI: "init.mp4"}
+	}
+	s.span = append(s.span, span{s.t0, s.t1 - s.t0, s.buf.Len(), s.key})
+	defer s.buf.Reset()
+	return s.add(f, s.buf.Bytes())
+}
+
+// add writes segment s.n and adds it to the playlist with the
+// discontinuity and program date time of its source segment. Its
+// duration is the one it was cut with, which the source's only
+// approximates.
+func (s *segmenter) add(f hls.File, data []byte) error {
+	if src, ok := s.p.segment(s.n); ok {
+		f.Discontinuous, f.Time = src.Discontinuous, src.Time
+	}
+	if e := s.r.Encryption; e != nil {
+		f.Key = e.Tag()
+		if f.Key.URI == "" {
+			f.Key.URI = "key.bin"
+		}
+	}
+	if err := s.write(f.Inf.URL, data, s.r.Encryption != nil); err != nil {
+		return err
+	}
+	s.out.File = append(s.out.File, f)
+	s.n++
+	if s.update != nil {
+		return s.update()
+	}
+	return nil
+}
+
+// write writes a file of the package, encrypting it as segment s.n
+func (s *segmenter) write(name string, data []byte, encrypt bool) error {
+	var src io.Reader = bytes.NewReader(data)
+	if encrypt {
+		rc := s.r.Encrypt(io.NopCloser(src), s.n)
+		defer rc.Close()
+		src = rc
+	}
+	fd, err := os.Create(filepath.Join(s.dir, name))
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(fd, src); err != nil {
+		fd.Close()
+		return err
+	}
+	return fd.Close()
+}
+
+// playlist writes the media playlist of the segments, and the key if
+// it isn't hosted elsewhere. Playlists that aren't final are written
+// as event playlists.
+func (s *segmenter) playlist(final bool) error {
+	m := &s.out
+	m.M3U, m.Type, m.End = true, hls.Vod, final
+	if !final {
+		m.Type = hls.Event
+	}
+	m.Version = version(s.format)
+	m.Independent = s.lead != nil && s.lead.Kind == av.Video
+	for _, f := range m.File {
+		if d := time.Duration(math.Round(f.Duration(0).Seconds())) * time.Second; d > m.Target {
+			m.Target = d
+		}
+	}
+	if e := s.r.Encryption; e != nil && e.URI == "" {
+		if err := os.WriteFile(filepath.Join(s.dir, "key.bin"), e.Key, 0600); err != nil {
+			return err
+		}
+	}
+	if s.format == "ts" && m.Independent && s.r.Encryption == nil {
+		if err := writePlaylist(filepath.Join(s.dir, "iframes.m3u8"), s.iframes); err != nil {
+			return err
+		}
+	}
+	if err := writePlaylist(filepath.Join(s.dir, "index.m3u8"), m.Encode); err != nil {
+		return err
+	}
+	if s.ready != nil {
+		s.ready()
+		s.ready = nil
+	}
+	return nil
+}
+
+// iframes encodes the i-frame playlist of the segments. Each segment
+// starts with a keyframe, so its byte range is that keyframe and the
+// tables before it. It's written by hand, as hls has no field for
+// EXT-X-I-FRAMES-ONLY and doesn't encode byte ranges.
+func (s *segmenter) iframes(w io.Writer) error {
+	m := &s.out
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "#EXTM3U\n#EXT-X-VERSION:4\n#EXT-X-TARGETDURATION:%d\n", int(m.Target.Seconds()))
+	fmt.Fprintf(b, "#EXT-X-PLAYLIST-TYPE:%s\n#EXT-X-I-FRAMES-ONLY\n", m.Type)
+	for i, f := range m.File {
+		if f.Discontinuous {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		if !f.Time.IsZero() {
+			fmt.Fprintf(b, "#EXT-X-PROGRAM-DATE-TIME:%s\n", f.Time.Format(time.RFC3339Nano))
+		}
+		fmt.Fprintf(b, "#EXTINF:%g,\n#EXT-X-BYTERANGE:%d@0\n%s\n", f.Inf.Duration.Seconds(), s.span[i].key, f.Inf.URL)
+	}
+	if m.End {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// version returns the playlist version needed for segments in format
+func version(format string) int {
+	if format == "ts" || format == "vtt" {
+		return 3
+	}
+	return 7 // EXT-X-MAP
+}
+
+// writePlaylist writes a playlist with its encoder. It's replaced
+// atomically, so live playlists are never read half written.
+func writePlaylist(name string, encode func(io.Writer) error) error {
+	fd, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fd.Name())
+	if err = encode(fd); err != nil {
+		fd.Close()
+		return err
+	}
+	if err = fd.Chmod(0644); err != nil {
+		fd.Close()
+		return err
+	}
+	if err = fd.Close(); err != nil {
+		return err
+	}
+	return os.Rename(fd.Name(), name)
+}
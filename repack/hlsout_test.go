@@ -0,0 +1,38 @@
+package repack
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWriteMasterStops(t *testing.T) {
+	m := decodeMaster(t, `#EXTM3U
+#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="s",NAME="English",LANGUAGE="en",URI="subs.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=1000000,SUBTITLES="s"
+missing.m3u8
+`)
+	// the subtitles are live and never end
+	src := files{
+		"subs.m3u8": "#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXTINF:1,\na.vtt\n",
+		"a.vtt":     "WEBVTT\n\n00:00:00.000 --> 00:00:00.500\nhello\n",
+	}
+	r := New(Options{Fetcher: src, Follow: true})
+	dir := t.TempDir()
+	errc := make(chan error, 1)
+	go func() { errc <- r.WriteMaster(dir, m) }()
+	select {
+	case err := <-errc:
+		var fe *FetchError
+		if !errors.As(err, &fe) || fe.Status != 404 {
+			t.Errorf("err: %v, want the 404", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("still following the subtitles")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "master.m3u8")); err == nil {
+		t.Error("wrote master.m3u8")
+	}
+}
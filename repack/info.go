@@ -1,5 +1,6 @@
-package main
+package repack
 
+// Info describes the codec settings of a stream
 type Info struct {
 	Name, Container string  `json:",omitempty"`
 	Size            int     `json:",omitempty"`
@@ -9,12 +10,12 @@ type Info struct {
 	StreamOrder     string  `json:",omitempty"`
 }
 type Audio struct {
-	Codec, Lang                   string `json:",omitempty"`
-	Bitrate, Samplerate, Channels int    `json:",omitempty"`
+	Codec, Lang                              string `json:",omitempty"`
+	Bitrate, Samplerate, Channels, Timescale int    `json:",omitempty"`
 }
 type Video struct {
 	Codec, Preset, Profile, Level, Chroma, Scantype string  `json:",omitempty"`
-	Width, Height                                   int     `json:",omitempty"`
+	Width, Height, Timescale                        int     `json:",omitempty"`
 	FPS                                             float64 `json:",omitempty"`
 	Bitrate                                         Bitrate `json:",omitempty"`
 	Gop                                             Gop     `json:",omitempty"`
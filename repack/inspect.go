@@ -0,0 +1,197 @@
+package repack
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/as/hls"
+)
+
+// Inspection describes the streams of a master playlist, with their
+// codecs decoded
+type Inspection struct {
+	Variants   []Variant   `json:",omitempty"`
+	IFrames    []Variant   `json:",omitempty"`
+	Renditions []Rendition `json:",omitempty"`
+	Dangling   []Group     `json:",omitempty"` // groups referred to that have no renditions
+	Unused     []Group     `json:",omitempty"` // groups no variant refers to
+}
+
+// Variant is a variant or I-frame stream. Info holds its resolution,
+// frame rate and bandwidth, and what its codecs say.
+type Variant struct {
+	URL              string
+	Bandwidth        int     `json:",omitempty"`
+	AverageBandwidth int     `json:",omitempty"`
+	Range            string  `json:",omitempty"`
+	HDCP             string  `json:",omitempty"`
+	Codecs           []Codec `json:",omitempty"`
+	Audio            string  `json:",omitempty"`
+	Video            string  `json:",omitempty"`
+	Subtitles        string  `json:",omitempty"`
+	Captions         string  `json:",omitempty"`
+	Info             Info
+}
+
+// Rendition is an EXT-X-MEDIA rendition. Without a CODECS attribute of
+// its own, its codecs are those of the first variant that refers to its
+// group, of the same kind.
+type Rendition struct {
+	Type, Group, Name string
+	Lang              string   `json:",omitempty"`
+	Channels          string   `json:",omitempty"`
+	Characteristics   []string `json:",omitempty"`
+	Instream          string   `json:",omitempty"`
+	Default           bool     `json:",omitempty"`
+	Autoselect        bool     `json:",omitempty"`
+	URI               string   `json:",omitempty"`
+	Codecs            []Codec  `json:",omitempty"`
+	Info              Info
+}
+
+// Group is a rendition group and the variants that refer to it
+type Group struct {
+	Type, ID string
+	Variants []int `json:",omitempty"`
+}
+
+// Inspect describes the streams of m
+func Inspect(m *hls.Master) *Inspection {
+	in := &Inspection{}
+	for i := range m.Stream {
+		in.Variants = append(in.Variants, inspectVariant(&m.Stream[i], m.Stream[i].URL))
+	}
+	for i := range m.IFrame {
+		in.IFrames = append(in.IFrames, inspectVariant(&m.IFrame[i], m.IFrame[i].URI))
+	}
+	for i := range m.Media {
+		in.Renditions = append(in.Renditions, inspectRendition(&m.Media[i], in.Variants))
+	}
+	var defined, used []Group
+	for _, r := range in.Renditions {
+		defined = append(defined, Group{Type: r.Type, ID: r.Group})
+	}
+	for i, v := range in.Variants {
+		for _, g := range groups(&v) {
+			used = append(used, g)
+			if find(defined, g) >= 0 {
+				continue
+			}
+			if j := find(in.Dangling, g); j >= 0 {
+				in.Dangling[j].Variants = append(in.Dangling[j].Variants, i)
+			} else {
+				in.Dangling = append(in.Dangling, Group{Type: g.Type, ID: g.ID, Variants: []int{i}})
+			}
+		}
+	}
+	for _, r := range in.Renditions {
+		if g := (Group{Type: r.Type, ID: r.Group}); find(used, g) < 0 && find(in.Unused, g) < 0 {
+			in.Unused = append(in.Unused, g)
+		}
+	}
+	return in
+}
+
+func inspectVariant(si *hls.StreamInfo, url string) Variant {
+	v := Variant{
+		URL:              url,
+		Bandwidth:        si.Bandwidth,
+		AverageBandwidth: si.BandwidthAvg,
+		Range:            si.VideoRange,
+		HDCP:             si.HDCP,
+		Audio:            si.Audio,
+		Video:            si.Video,
+		Subtitles:        si.Subtitle,
+		Captions:         si.Caption,
+	}
+	if v.Captions == "NONE" {
+		v.Captions = ""
+	}
+	for _, c := range nonempty(si.Codecs) {
+		v.Codecs = append(v.Codecs, ParseCodec(c, &v.Info))
+	}
+	v.Info.Video.Width, v.Info.Video.Height = si.Resolution.X, si.Resolution.Y
+	v.Info.Video.FPS = si.Framerate
+	v.Info.Video.Bitrate.BPS = bandwidth(si)
+	return v
+}
+
+func inspectRendition(mi *hls.MediaInfo, variants []Variant) Rendition {
+	r := Rendition{
+		Type:            mi.Type,
+		Group:           mi.Group,
+		Name:            mi.Name,
+		Lang:            mi.Lang,
+		Channels:        mi.Channels,
+		Characteristics: nonempty(mi.Character),
+		Instream:        mi.Instream,
+		Default:         mi.Default,
+		Autoselect:      mi.Autoselect,
+		URI:             mi.URI,
+	}
+	for _, c := range nonempty(mi.Codecs) {
+		r.Codecs = append(r.Codecs, ParseCodec(c, &r.Info))
+	}
+	if len(r.Codecs) == 0 {
+		r.Codecs = inherit(r, variants, &r.Info)
+	}
+	r.Info.Audio.Lang = mi.Lang
+	r.Info.Audio.Samplerate = mi.Samplerate
+	if n, _, _ := strings.Cut(mi.Channels, "/"); n != "" {
+		r.Info.Audio.Channels, _ = strconv.Atoi(n)
+	}
+	return r
+}
+
+// nonempty returns the values of a comma separated attribute, which
+// decodes to an empty value if it's absent
+func nonempty(a []string) (v []string) {
+	for _, s := range a {
+		for _, s := range strings.Split(s, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				v = append(v, s)
+			}
+		}
+	}
+	return v
+}
+
+// kinds are the codec kinds of the rendition types
+var kinds = map[string]string{"AUDIO": "audio", "VIDEO": "video", "SUBTITLES": "text"}
+
+// inherit returns the codecs of the rendition's kind in the first
+// variant that refers to its group
+func inherit(r Rendition, variants []Variant, info *Info) (codecs []Codec) {
+	for _, v := range variants {
+		if find(groups(&v), Group{Type: r.Type, ID: r.Group}) < 0 {
+			continue
+		}
+		for _, c := range v.Codecs {
+			if c.Kind == kinds[r.Type] && c.Kind != "" {
+				codecs = append(codecs, ParseCodec(c.ID, info))
+			}
+		}
+		return codecs
+	}
+	return nil
+}
+
+// groups returns the rendition groups the variant refers to
+func groups(v *Variant) (g []Group) {
+	for _, ref := range []Group{{"AUDIO", v.Audio, nil}, {"VIDEO", v.Video, nil}, {"SUBTITLES", v.Subtitles, nil}, {"CLOSED-CAPTIONS", v.Captions, nil}} {
+		if ref.ID != "" {
+			g = append(g, ref)
+		}
+	}
+	return g
+}
+
+// find returns the index of the group of the type and id in list, or -1
+func find(list []Group, g Group) int {
+	for i := range list {
+		if list[i].Type == g.Type && list[i].ID == g.ID {
+			return i
+		}
+	}
+	return -1
+}
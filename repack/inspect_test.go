@@ -0,0 +1,57 @@
+package repack
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestInspect(t *testing.T) {
+	in := Inspect(decodeMaster(t, `#EXTM3U
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",NAME="English",LANGUAGE="en",CHANNELS="2",DEFAULT=YES,AUTOSELECT=YES,URI="en.m3u8"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="atmos",NAME="English",LANGUAGE="en",CHANNELS="16/JOC",CODECS="ec-3",URI="atmos.m3u8"
+#EXT-X-MEDIA:TYPE=CLOSED-CAPTIONS,GROUP-ID="cc",NAME="English",LANGUAGE="en",INSTREAM-ID="CC1"
+#EXT-X-STREAM-INF:BANDWIDTH=5000000,AVERAGE-BANDWIDTH=4000000,RESOLUTION=1920x1080,FRAME-RATE=29.970,CODECS="avc1.640028,mp4a.40.2",AUDIO="aac",SUBTITLES="subs",CLOSED-CAPTIONS="cc"
+hi.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=800000,RESOLUTION=640x360,CODECS="avc1.42e01e,mp4a.40.5",AUDIO="aac",SUBTITLES="subs",CLOSED-CAPTIONS=NONE
+lo.m3u8
+#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=300000,RESOLUTION=1920x1080,CODECS="avc1.640028",URI="iframe.m3u8"
+`))
+	if len(in.Variants) != 2 || len(in.IFrames) != 1 || len(in.Renditions) != 3 {
+		t.Fatalf("%d variants, %d i-frame streams and %d renditions, want 2, 1 and 3", len(in.Variants), len(in.IFrames), len(in.Renditions))
+	}
+	hi, lo := in.Variants[0], in.Variants[1]
+	if v := hi.Info.Video; v.Codec != "h264" || v.Profile != "high" || v.Level != "4.0" || v.Width != 1920 || v.Height != 1080 || v.FPS != 29.97 || v.Bitrate.BPS != 5000000 || hi.AverageBandwidth != 4000000 {
+		t.Errorf("hi video: %+v", v)
+	}
+	if hi.Info.Audio.Codec != "aac" || hi.Codecs[1].Name != "AAC-LC" {
+		t.Errorf("hi audio: %+v, %+v", hi.Info.Audio, hi.Codecs)
+	}
+	if hi.Captions != "cc" || lo.Captions != "" {
+		t.Errorf("captions %q and %q, want cc and none", hi.Captions, lo.Captions)
+	}
+	if in.IFrames[0].URL != "iframe.m3u8" || in.IFrames[0].Codecs[0].Name != "H.264 High@4.0" {
+		t.Errorf("i-frames: %+v", in.IFrames[0])
+	}
+
+	// the stereo rendition has the codec of the first variant in its
+	// group, and the atmos one its own
+	aac, atmos := in.Renditions[0], in.Renditions[1]
+	if len(aac.Codecs) != 1 || aac.Codecs[0].Name != "AAC-LC" || aac.Info.Audio.Channels != 2 || aac.Info.Audio.Lang != "en" {
+		t.Errorf("aac: %+v", aac)
+	}
+	if len(atmos.Codecs) != 1 || atmos.Codecs[0].Name != "E-AC-3" || atmos.Info.Audio.Channels != 16 {
+		t.Errorf("atmos: %+v", atmos)
+	}
+	if cc := in.Renditions[2]; cc.Instream != "CC1" || cc.Codecs != nil {
+		t.Errorf("cc: %+v", cc)
+	}
+
+	// the subtitles are referred to but never defined, and nothing
+	// refers to the atmos group
+	if want := []Group{{"SUBTITLES", "subs", []int{0, 1}}}; !reflect.DeepEqual(in.Dangling, want) {
+		t.Errorf("dangling: %+v, want %+v", in.Dangling, want)
+	}
+	if want := []Group{{"AUDIO", "atmos", nil}}; !reflect.DeepEqual(in.Unused, want) {
+		t.Errorf("unused: %+v, want %+v", in.Unused, want)
+	}
+}
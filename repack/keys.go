@@ -0,0 +1,203 @@
+package repack
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/as/hls"
+)
+
+// ErrUnknownKey is returned by a KeyProvider that has no key for an
+// EXT-X-KEY, so the next one can be asked
+var ErrUnknownKey = errors.New("repack: unknown key")
+
+// KeyProvider returns the key for an EXT-X-KEY. U is the key's uri
+// resolved against the playlist.
+//
+// Options.KeyProvider is asked first. If it returns ErrUnknownKey, keys
+// in the identity format are downloaded with the Fetcher.
+type KeyProvider interface {
+	Key(ctx context.Context, k hls.Key, u string) ([]byte, error)
+}
+
+// Keychain asks each KeyProvider in turn until one knows the key
+type Keychain []KeyProvider
+
+func (c Keychain) Key(ctx context.Context, k hls.Key, u string) ([]byte, error) {
+	for _, p := range c {
+		key, err := p.Key(ctx, k, u)
+		if !errors.Is(err, ErrUnknownKey) {
+			return key, err
+		}
+	}
+	return nil, ErrUnknownKey
+}
+
+// HTTPKeys requests keys from http and https uris with extra headers,
+// for key servers that need authorization
+type HTTPKeys struct {
+	Client *http.Client
+	Header http.Header
+}
+
+func (h HTTPKeys) Key(ctx context.Context, k hls.Key, u string) ([]byte, error) {
+	if s := strings.ToLower(u); !strings.HasPrefix(s, "http://") && !strings.HasPrefix(s, "https://") {
+		return nil, ErrUnknownKey
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, &FetchError{URL: u, Err: err}
+	}
+	for name, v := range h.Header {
+		req.Header[name] = v
+	}
+	client := h.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, &FetchError{URL: u, Err: err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return nil, &KeyError{URL: u, Err: &FetchError{URL: u, Status: resp.StatusCode}}
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, &FetchError{URL: u, Status: resp.StatusCode, Err: err}
+	}
+	return data, nil
+}
+
+// KeyFile maps key uris, as written in the playlist or resolved, and
+// cenc key ids (see KeyID) to keys
+type KeyFile map[string][]byte
+
+func (f KeyFile) Key(ctx context.Context, k hls.Key, u string) ([]byte, error) {
+	if key, ok := f[u]; ok {
+		return key, nil
+	}
+	if key, ok := f[k.URI]; ok {
+		return key, nil
+	}
+	return nil, ErrUnknownKey
+}
+
+// KeyIDs returns the keys in f that are named by a key id
+func (f KeyFile) KeyIDs() map[string][]byte {
+	ids := map[string][]byte{}
+	for name, key := range f {
+		if id, err := hex.DecodeString(KeyID(name)); err == nil && len(id) == 16 {
+			ids[KeyID(name)] = key
+		}
+	}
+	return ids
+}
+
+// LoadKeyFile reads a key file. It's either a json object of names to
+// hex keys, or csv with a name and a hex key on each line.
+func LoadKeyFile(name string) (KeyFile, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	hexkeys := map[string]string{}
+	if t := bytes.TrimSpace(data); len(t) > 0 && t[0] == '{' {
+		if err = json.Unmarshal(t, &hexkeys); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+	} else {
+		cr := csv.NewReader(bytes.NewReader(data))
+		cr.FieldsPerRecord = 2
+		cr.Comment = '#'
+		cr.TrimLeadingSpace = true
+		rows, err := cr.ReadAll()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		for _, row := range rows {
+			hexkeys[row[0]] = row[1]
+		}
+	}
+	f := KeyFile{}
+	for k, v := range hexkeys {
+		key, err := hex.DecodeString(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("%s: key %q: %w", name, k, err)
+		}
+		f[k] = key
+	}
+	return f, nil
+}
+
+// KeyCommand runs a helper to get each key. It's run with Args and the
+// resolved uri, and the attributes of the EXT-X-KEY in the environment
+// as HLS_KEY_METHOD, HLS_KEY_URI, HLS_KEY_IV, HLS_KEY_FORMAT and
+// HLS_KEY_FORMATVERSIONS. The key is read from its output, as raw bytes
+// or hex. No output means it doesn't know the key.
+type KeyCommand struct {
+	Path string
+	Args []string
+}
+
+func (c KeyCommand) Key(ctx context.Context, k hls.Key, u string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, c.Path, append(c.Args[:len(c.Args):len(c.Args)], u)...)
+	cmd.Env = append(os.Environ(),
+		"HLS_KEY_METHOD="+k.Method,
+		"HLS_KEY_URI="+k.URI,
+		"HLS_KEY_IV="+k.IV,
+		"HLS_KEY_FORMAT="+k.Format,
+		"HLS_KEY_FORMATVERSIONS="+k.Versions,
+	)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = fmt.Errorf("%s: %w: %s", c.Path, err, msg)
+		}
+		return nil, &KeyError{URL: u, Err: err}
+	}
+	if len(out) == Blocksize {
+		return out, nil
+	}
+	if t := bytes.TrimSpace(out); len(t) > 0 {
+		key, err := hex.DecodeString(string(t))
+		if err != nil {
+			return nil, &KeyError{URL: u, Err: err}
+		}
+		return key, nil
+	}
+	return nil, ErrUnknownKey
+}
+
+// key returns the key for k
+func (r *Repackager) key(k hls.Key, u string) ([]byte, error) {
+	ctx := context.Background()
+	if r.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.Timeout)
+		defer cancel()
+	}
+	if r.KeyProvider != nil {
+		key, err := r.KeyProvider.Key(ctx, k, u)
+		if !errors.Is(err, ErrUnknownKey) {
+			return key, err
+		}
+	}
+	if !identity(&k) {
+		return nil, ErrUnknownKey
+	}
+	return r.Download(u)
+}
@@ -0,0 +1,130 @@
+package repack
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/as/hls"
+)
+
+var (
+	testKey  = []byte("0123456789abcdef")
+	otherKey = []byte("fedcba9876543210")
+)
+
+// keyServer serves testKey at /key to requests with the token, and at
+// /open to any request
+func keyServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/open":
+		case r.URL.Path == "/key" && r.Header.Get("Authorization") == "Bearer token":
+		case r.URL.Path == "/key":
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(testKey)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestHTTPKeys(t *testing.T) {
+	srv := keyServer(t)
+	ctx := context.Background()
+	auth := HTTPKeys{Header: http.Header{"Authorization": {"Bearer token"}}}
+	key, err := auth.Key(ctx, hls.Key{Method: "AES-128", URI: "key"}, srv.URL+"/key")
+	if err != nil || !bytes.Equal(key, testKey) {
+		t.Fatalf("authorized: %q, %v", key, err)
+	}
+
+	_, err = HTTPKeys{}.Key(ctx, hls.Key{Method: "AES-128", URI: "key"}, srv.URL+"/key")
+	var ke *KeyError
+	var fe *FetchError
+	if !errors.As(err, &ke) || !errors.As(err, &fe) || fe.Status != http.StatusForbidden {
+		t.Fatalf("unauthorized: %v, want a KeyError for a 403", err)
+	}
+
+	if _, err = auth.Key(ctx, hls.Key{URI: "skd://key"}, "skd://key"); err != ErrUnknownKey {
+		t.Fatalf("skd uri: %v, want ErrUnknownKey", err)
+	}
+}
+
+func TestLoadKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"keys.csv":  "# uri,key\nskd://abc," + hex.EncodeToString(testKey) + "\n",
+		"keys.json": `{"skd://abc": "` + hex.EncodeToString(testKey) + `"}`,
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		f, err := LoadKeyFile(path)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		key, err := f.Key(context.Background(), hls.Key{URI: "skd://abc"}, "skd://abc")
+		if err != nil || !bytes.Equal(key, testKey) {
+			t.Fatalf("%s: %q, %v", name, key, err)
+		}
+	}
+}
+
+func TestKeychain(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("no shell")
+	}
+	srv := keyServer(t)
+	// the command knows the keys of skd uris, from their key uri
+	cmd := KeyCommand{Path: sh, Args: []string{"-c", `case "$HLS_KEY_URI" in skd://cmd) echo ` + hex.EncodeToString(otherKey) + `;; esac`, "helper"}}
+	chain := Keychain{
+		HTTPKeys{Header: http.Header{"Authorization": {"Bearer token"}}},
+		KeyFile{"skd://file": testKey},
+		cmd,
+	}
+	r := New(Options{KeyProvider: chain})
+	for _, tc := range []struct {
+		name string
+		k    hls.Key
+		u    string
+		key  []byte
+		err  error
+	}{
+		{"http", hls.Key{Method: "AES-128", URI: "key"}, srv.URL + "/key", testKey, nil},
+		{"file", hls.Key{Method: "SAMPLE-AES", URI: "skd://file", Format: "com.apple.streamingkeydelivery"}, "skd://file", testKey, nil},
+		{"command", hls.Key{Method: "SAMPLE-AES", URI: "skd://cmd", Format: "com.apple.streamingkeydelivery"}, "skd://cmd", otherKey, nil},
+		{"unknown", hls.Key{Method: "SAMPLE-AES", URI: "skd://none", Format: "com.apple.streamingkeydelivery"}, "skd://none", nil, ErrUnknownKey},
+	} {
+		key, err := r.key(tc.k, tc.u)
+		if !errors.Is(err, tc.err) || !bytes.Equal(key, tc.key) {
+			t.Errorf("%s: %q, %v, want %q, %v", tc.name, key, err, tc.key, tc.err)
+		}
+	}
+
+	// keys the providers don't know are downloaded
+	r = New(Options{KeyProvider: Keychain{KeyFile{}}})
+	if key, err := r.key(hls.Key{Method: "AES-128", URI: "open"}, srv.URL+"/open"); err != nil || !bytes.Equal(key, testKey) {
+		t.Errorf("download: %q, %v", key, err)
+	}
+
+	// a failing command is a KeyError
+	_, err = KeyCommand{Path: sh, Args: []string{"-c", "echo no >&2; exit 1", "helper"}}.Key(context.Background(), hls.Key{}, "skd://x")
+	if ke := (*KeyError)(nil); !errors.As(err, &ke) {
+		t.Errorf("failing command: %v, want a KeyError", err)
+	}
+}
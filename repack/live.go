@@ -0,0 +1,310 @@
+package repack
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/as/hls"
+)
+
+var errStopped = errors.New("repack: stopped")
+
+// playlist yields the segments of a media playlist in order. When
+// following, live and event playlists are reloaded for new segments
+// until they end.
+type playlist struct {
+	r    *Repackager
+	m    *hls.Media
+	url  string
+	done <-chan bool
+	stop <-chan bool // closed to stop following, like done
+
+	file []hls.File // segments not yet yielded
+	seq  int        // media sequence number of the next new segment
+	part int        // parts of the next new segment already queued
+	hint string     // uri of the preload hint queued ahead of its part
+	dseq int        // discontinuity sequence of the last segment yielded
+	live bool
+	ll   *LowLatency
+	ads  *adbreak // the ad spans of the segments queued
+
+	first int // media sequence number of the first segment yielded
+
+	loaded  time.Time
+	changed bool
+
+	mu      sync.Mutex
+	yielded []hls.File // segments returned by next
+}
+
+// newPlaylist returns a playlist that starts with the segments in m,
+// which must not have been trimmed yet
+func (r *Repackager) newPlaylist(m *hls.Media) *playlist {
+	p := &playlist{
+		r:       r,
+		m:       m,
+		url:     m.URL,
+		file:    make([]hls.File, len(m.File)),
+		first:   m.Sequence,
+		seq:     m.Sequence + len(m.File),
+		dseq:    m.Discontinuity,
+		live:    r.Follow && !m.End && m.Type != hls.Vod,
+		ads:     r.adbreak(),
+		loaded:  time.Now(),
+		changed: true,
+	}
+	if ll, ok := r.lowlat.Load(m); ok {
+		p.ll = ll.(*LowLatency)
+	}
+	for i, f := range m.File {
+		if f.Discontinuous {
+			p.dseq++
+		}
+		sequenceIV(&f, m.Sequence+i)
+		p.file[i] = f
+	}
+	return p
+}
+
+// sequenceIV makes the iv of f's key explicit. Without an IV attribute,
+// the iv is the media sequence number of the segment (RFC 8216 5.2). The
+// samples of fragmented mp4 carry their own ivs, so SAMPLE-AES segments
+// with an EXT-X-MAP are left alone.
+func sequenceIV(f *hls.File, seq int) {
+	if f.Key.IV != "" {
+		return
+	}
+	if f.Key.Method == "AES-128" || f.Key.Method == "SAMPLE-AES" && f.Map.URI == "" {
+		f.Key.IV = fmt.Sprintf("0x%032x", seq)
+	}
+}
+
+// next returns the next segment, waiting for it to be published
+// if the playlist is live. It returns io.EOF after the last one.
+func (p *playlist) next() (*hls.File, error) {
+	select {
+	case <-p.stop:
+		return nil, errStopped
+	default:
+	}
+	for len(p.file) == 0 {
+		if !p.live {
+			return nil, io.EOF
+		}
+		if err := p.reload(); err != nil {
+			return nil, err
+		}
+	}
+	f := &p.file[0]
+	p.file = p.file[1:]
+	p.mu.Lock()
+	p.yielded = append(p.yielded, *f)
+	p.mu.Unlock()
+	return f, nil
+}
+
+// segment returns the nth segment returned by next, if there was one
+func (p *playlist) segment(n int) (hls.File, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if n < 0 || n >= len(p.yielded) {
+		return hls.File{}, false
+	}
+	return p.yielded[n], true
+}
+
+// reload waits for the reload interval and loads the playlist again,
+// queueing the segments that weren't seen before. Low-latency playlists
+// are reloaded with blocking requests, and their parts are queued as
+// they are published.
+func (p *playlist) reload() error {
+	msn, part := -1, -1
+	if p.ll != nil && p.ll.ServerControl.CanBlockReload && p.changed {
+		msn = p.seq
+		if p.ll.usable() {
+			part = p.part
+			if p.hint != "" {
+				part++
+			}
+		}
+	} else if err := p.wait(); err != nil {
+		return err
+	}
+	// a delta update needs a playlist no older than half the skip boundary
+	skip := p.ll != nil && p.ll.ServerControl.CanSkipUntil > 0 &&
+		time.Since(p.loaded) < p.ll.ServerControl.CanSkipUntil/2
+	url := reloadURL(p.url, msn, part, skip)
+
+	p.loaded = time.Now()
+	m, ll, err := p.load(url)
+	if err == ErrDelta {
+		p.r.logf("live: %v, reloading in full\n", err)
+		url = reloadURL(p.url, msn, part, false)
+		m, ll, err = p.load(url)
+	}
+	if err != nil {
+		return err
+	}
+	p.m = m
+	p.live = !m.End
+	p.ll = lowLatency(ll)
+
+	// the discontinuity sequence of the segment before m.File[i]
+	dseq, first := m.Discontinuity, m.Sequence
+	if first > p.seq {
+		p.r.logf("live: missed segments %d to %d\n", p.seq, first-1)
+		p.seq, p.part = first, 0
+	}
+	n := len(p.file)
+	for i, f := range m.File {
+		if f.Discontinuous {
+			dseq++
+		}
+		if first+i < p.seq {
+			continue
+		}
+		sequenceIV(&f, first+i)
+		if dseq != p.dseq && !f.Discontinuous {
+			// the tagged segment rolled off before it was seen
+			f.Discontinuous = true
+		}
+		p.dseq = dseq
+		if parts := p.ll.partsof(first + i); p.part > 0 || p.hinted(parts) {
+			// some of its parts were streamed already, the rest
+			// can't be told apart from them in the full segment
+			if len(parts) < p.part {
+				return fmt.Errorf("%w: segment %d", ErrPartsLost, first+i)
+			}
+			p.parts(parts, &f)
+			p.seq, p.part = first+i+1, 0
+			continue
+		}
+		p.seq = first + i + 1
+		p.queue(f)
+	}
+	if p.live && p.ll.usable() && len(m.File) > 0 {
+		// the segment in progress
+		last := m.File[len(m.File)-1]
+		sequenceIV(&last, p.seq)
+		p.parts(p.ll.partsof(p.seq), &last)
+		if h := p.ll.hint(); h != nil && p.hint == "" {
+			p.queue(partfile(Part{URI: h.URI}, &last))
+			p.hint = h.URI
+		}
+	}
+	p.changed = len(p.file) > n
+	if p.r.Verbose {
+		p.r.logf("live: reloaded %s: sequence %d, %d new segments, end=%v\n", url, m.Sequence, len(p.file)-n, m.End)
+	}
+	return nil
+}
+
+// load downloads and decodes the playlist at url, applying it to the
+// previous playlist if it's a delta update
+func (p *playlist) load(url string) (*hls.Media, LowLatency, error) {
+	var ll LowLatency
+	data, err := p.r.Download(url)
+	if err != nil {
+		return nil, ll, err
+	}
+	tags, _, err := hls.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ll, err
+	}
+	m, err := decodeMedia(tags, p.url)
+	if err != nil && !(err == hls.ErrEmpty && !m.End) {
+		return nil, ll, err
+	}
+	ll = ParseLowLatency(tags, m.Sequence)
+	if n := ll.Skip.Segments; n > 0 {
+		if m, err = ApplyDelta(p.m, m, n); err != nil {
+			return nil, ll, err
+		}
+		if p.r.Verbose {
+			p.r.logf("live: delta update skipped %d segments\n", n)
+		}
+		// the first segment may continue a skipped one
+		if err = resolveRanges(m); err != nil {
+			return nil, ll, err
+		}
+	}
+	return m, ll, nil
+}
+
+// wait sleeps until the next reload is due
+func (p *playlist) wait() error {
+	wait := p.m.Target
+	if !p.changed {
+		wait /= 2
+		if p.ll != nil && p.ll.PartTarget > 0 {
+			wait = p.ll.PartTarget
+		}
+	}
+	if wait <= 0 {
+		wait = time.Second
+	}
+	t := time.NewTimer(time.Until(p.loaded.Add(wait)))
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-p.done:
+		return errStopped
+	case <-p.stop:
+		return errStopped
+	}
+}
+
+func (p *playlist) queue(f hls.File) {
+	if p.r.Ads == AdSkip && p.ads.ad(&f) {
+		p.r.logf("skipping ad break: %s\n", f.Inf.URL)
+		return
+	}
+	p.file = append(p.file, f)
+}
+
+// parts queues the parts that weren't queued yet, using the key and
+// initialization segment of f
+func (p *playlist) parts(parts []Part, f *hls.File) {
+	for ; p.part < len(parts); p.part++ {
+		pt := parts[p.part]
+		if pt.URI == p.hint && pt.Range == "" {
+			p.hint = "" // queued ahead as a preload hint
+			continue
+		}
+		p.queue(partfile(pt, f))
+	}
+}
+
+// hinted reports whether the preload hint is one of the parts
+func (p *playlist) hinted(parts []Part) bool {
+	for _, pt := range parts {
+		if p.hint != "" && pt.URI == p.hint && pt.Range == "" {
+			return true
+		}
+	}
+	return false
+}
+
+func (ll *LowLatency) partsof(msn int) []Part {
+	if ll == nil {
+		return nil
+	}
+	return ll.Parts[msn]
+}
+
+// partfile returns a part as a segment, using the key and
+// initialization segment of the given segment
+func partfile(pt Part, f *hls.File) hls.File {
+	return hls.File{
+		Discontinuous: pt.Discontinuous,
+		Map:           f.Map,
+		Key:           f.Key,
+		Range:         hls.Range{V: pt.Range},
+		Inf:           hls.Inf{URL: pt.URI, Duration: pt.Duration},
+	}
+}
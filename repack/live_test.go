@@ -0,0 +1,124 @@
+package repack
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// published is a version of a live playlist: seq is the media sequence
+// number of the segment in progress and parts the number of its parts
+// published so far
+type published struct {
+	seq, parts int
+	body       string
+}
+
+// script serves the versions of live.m3u8 as they are published. A
+// plain request gets the version after the one served last, and a
+// blocking reload gets the first version from the one served last that
+// has the segment and part it asks for. The queries and times of the
+// requests are recorded.
+type script struct {
+	mu       sync.Mutex
+	versions []published
+	at       int
+	queries  []string
+	times    []time.Time
+}
+
+func (s *script) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/live.m3u8" {
+		http.NotFound(w, r)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queries = append(s.queries, r.URL.RawQuery)
+	s.times = append(s.times, time.Now())
+	q := r.URL.Query()
+	if q.Has("_HLS_msn") {
+		msn, _ := strconv.Atoi(q.Get("_HLS_msn"))
+		part := -1
+		if q.Has("_HLS_part") {
+			part, _ = strconv.Atoi(q.Get("_HLS_part"))
+		}
+		for s.at < len(s.versions)-1 {
+			if v := s.versions[s.at]; msn < v.seq || msn == v.seq && part >= 0 && part < v.parts {
+				break
+			}
+			s.at++
+		}
+	} else if len(s.queries) > 1 {
+		s.at = min(s.at+1, len(s.versions)-1)
+	}
+	w.Write([]byte(s.versions[s.at].body))
+}
+
+// follow loads live.m3u8 from s and returns the names of the segments
+// its playlist yields, with "disc" before the discontinuous ones, and
+// the error that ended it
+func follow(t *testing.T, s *script) ([]string, error) {
+	t.Helper()
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	r := New(Options{Follow: true})
+	m, err := r.Playlist(srv.URL + "/live.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := r.newPlaylist(m)
+	stop := make(chan bool)
+	p.stop = stop
+	defer time.AfterFunc(5*time.Second, func() { close(stop) }).Stop()
+	var names []string
+	for {
+		f, err := p.next()
+		if err != nil {
+			return names, err
+		}
+		if f.Discontinuous {
+			names = append(names, "disc")
+		}
+		names = append(names, path.Base(f.Inf.URL))
+	}
+}
+
+func TestLiveReload(t *testing.T) {
+	const target = 400 * time.Millisecond
+	s := &script{versions: []published{
+		{body: "#EXTM3U\n#EXT-X-TARGETDURATION:0.4\n#EXTINF:0.4,\ns0.ts\n#EXTINF:0.4,\ns1.ts\n"},
+		{body: "#EXTM3U\n#EXT-X-TARGETDURATION:0.4\n#EXTINF:0.4,\ns0.ts\n#EXTINF:0.4,\ns1.ts\n"},
+		{body: "#EXTM3U\n#EXT-X-TARGETDURATION:0.4\n#EXT-X-MEDIA-SEQUENCE:1\n#EXTINF:0.4,\ns1.ts\n#EXTINF:0.4,\ns2.ts\n#EXTINF:0.4,\ns3.ts\n"},
+		// s4 was missed, and the discontinuity before it with it
+		{body: "#EXTM3U\n#EXT-X-TARGETDURATION:0.4\n#EXT-X-MEDIA-SEQUENCE:5\n#EXT-X-DISCONTINUITY-SEQUENCE:1\n#EXTINF:0.4,\ns5.ts\n#EXTINF:0.4,\ns6.ts\n#EXT-X-ENDLIST\n"},
+	}}
+	names, err := follow(t, s)
+	if err != io.EOF {
+		t.Fatalf("ended with %v, want EOF", err)
+	}
+	if got, want := strings.Join(names, " "), "s0.ts s1.ts s2.ts s3.ts disc s5.ts s6.ts"; got != want {
+		t.Errorf("segments: %s\nwant: %s", got, want)
+	}
+	if len(s.queries) != 4 {
+		t.Fatalf("%d requests, want 4", len(s.queries))
+	}
+	for i, q := range s.queries {
+		if q != "" {
+			t.Errorf("request %d: query %q, want none", i, q)
+		}
+	}
+	// a target duration after a playlist with new segments, and half of
+	// one after an unchanged one
+	for i, want := range []time.Duration{target, target / 2, target} {
+		if d := s.times[i+1].Sub(s.times[i]); d < want-20*time.Millisecond || d > want+want/2 {
+			t.Errorf("reload %d after %s, want %s", i+1, d, want)
+		}
+	}
+}
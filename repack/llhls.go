@@ -0,0 +1,195 @@
+package repack
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/as/hls"
+	"github.com/as/hls/m3u"
+)
+
+// LowLatency holds the low-latency extensions of a media playlist. The
+// hls package doesn't decode these tags, and it's a module of its own
+// that hlscat vendors unmodified, so they are taken from the raw tags of
+// the playlist rather than from fields of hls.Media.
+type LowLatency struct {
+	ServerControl ServerControl
+	PartTarget    time.Duration // EXT-X-PART-INF
+
+	// Parts are the partial segments, keyed by the media sequence
+	// number of the segment they belong to. The last key is the
+	// segment in progress, which has no EXTINF yet.
+	Parts   map[int][]Part
+	Preload []PreloadHint
+	Reports []RenditionReport
+
+	// Skip is set in a playlist delta update
+	Skip Skip
+}
+
+// Skip is EXT-X-SKIP
+type Skip struct {
+	Segments          int      // SKIPPED-SEGMENTS
+	RemovedDateRanges []string // RECENTLY-REMOVED-DATERANGES
+}
+
+// ServerControl is EXT-X-SERVER-CONTROL
+type ServerControl struct {
+	CanBlockReload    bool
+	CanSkipUntil      time.Duration
+	CanSkipDateRanges bool
+	HoldBack          time.Duration
+	PartHoldBack      time.Duration
+}
+
+// Part is EXT-X-PART
+type Part struct {
+	URI           string
+	Duration      time.Duration
+	Independent   bool
+	Gap           bool
+	Range         string // BYTERANGE, n@o with the offset resolved
+	Discontinuous bool   // the first part after an EXT-X-DISCONTINUITY
+}
+
+// PreloadHint is EXT-X-PRELOAD-HINT
+type PreloadHint struct {
+	Type   string // PART or MAP
+	URI    string
+	Start  int
+	Length int // -1 if the length is unknown
+}
+
+// RenditionReport is EXT-X-RENDITION-REPORT
+type RenditionReport struct {
+	URI      string
+	LastMSN  int
+	LastPart int
+}
+
+// ParseLowLatency decodes the low-latency tags in a media playlist whose
+// first segment has the media sequence number seq
+func ParseLowLatency(tags []m3u.Tag, seq int) (ll LowLatency) {
+	ll.Parts = map[int][]Part{}
+	disc := false
+	end := map[string]int64{} // where the last part of each uri ended
+	for _, t := range tags {
+		switch t.Name {
+		case "EXTINF":
+			seq++
+			disc = false
+		case "EXT-X-DISCONTINUITY":
+			disc = true
+		case "EXT-X-SKIP":
+			ll.Skip.Segments, _ = strconv.Atoi(t.Value("SKIPPED-SEGMENTS"))
+			if v := t.Value("RECENTLY-REMOVED-DATERANGES"); v != "" {
+				ll.Skip.RemovedDateRanges = strings.Split(v, "\t")
+			}
+			seq += ll.Skip.Segments
+		case "EXT-X-SERVER-CONTROL":
+			ll.ServerControl = ServerControl{
+				CanBlockReload:    yes(t, "CAN-BLOCK-RELOAD"),
+				CanSkipUntil:      seconds(t, "CAN-SKIP-UNTIL"),
+				CanSkipDateRanges: yes(t, "CAN-SKIP-DATERANGES"),
+				HoldBack:          seconds(t, "HOLD-BACK"),
+				PartHoldBack:      seconds(t, "PART-HOLD-BACK"),
+			}
+		case "EXT-X-PART-INF":
+			ll.PartTarget = seconds(t, "PART-TARGET")
+		case "EXT-X-PART":
+			pt := Part{
+				URI:           t.Value("URI"),
+				Duration:      seconds(t, "DURATION"),
+				Independent:   yes(t, "INDEPENDENT"),
+				Gap:           yes(t, "GAP"),
+				Discontinuous: disc && len(ll.Parts[seq]) == 0,
+			}
+			if b, err := parseRange(t.Value("BYTERANGE"), end[pt.URI]); err == nil && b.Length > 0 {
+				pt.Range = rangeValue(b)
+				end[pt.URI] = b.Offset + b.Length
+			}
+			ll.Parts[seq] = append(ll.Parts[seq], pt)
+		case "EXT-X-PRELOAD-HINT":
+			h := PreloadHint{Type: t.Value("TYPE"), URI: t.Value("URI"), Length: -1}
+			h.Start, _ = strconv.Atoi(t.Value("BYTERANGE-START"))
+			if v := t.Value("BYTERANGE-LENGTH"); v != "" {
+				h.Length, _ = strconv.Atoi(v)
+			}
+			ll.Preload = append(ll.Preload, h)
+		case "EXT-X-RENDITION-REPORT":
+			r := RenditionReport{URI: t.Value("URI")}
+			r.LastMSN, _ = strconv.Atoi(t.Value("LAST-MSN"))
+			r.LastPart, _ = strconv.Atoi(t.Value("LAST-PART"))
+			ll.Reports = append(ll.Reports, r)
+		}
+	}
+	return ll
+}
+
+// lowLatency returns ll if the playlist uses the extensions that change
+// how it's reloaded, or nil
+func lowLatency(ll LowLatency) *LowLatency {
+	if ll.PartTarget > 0 || ll.ServerControl.CanBlockReload || ll.ServerControl.CanSkipUntil > 0 {
+		return &ll
+	}
+	return nil
+}
+
+// keepLowLatency remembers the low-latency extensions in the tags of m,
+// so the first reload of a playlist that starts with m can use them
+func (r *Repackager) keepLowLatency(m *hls.Media, tags []m3u.Tag) {
+	if ll := lowLatency(ParseLowLatency(tags, m.Sequence)); ll != nil {
+		r.lowlat.Store(m, ll)
+	}
+}
+
+// usable reports whether the partial segments can be streamed
+// in place of full segments
+func (ll *LowLatency) usable() bool {
+	return ll != nil && ll.PartTarget > 0
+}
+
+// hint returns the preloaded part, if any
+func (ll *LowLatency) hint() *PreloadHint {
+	for i, h := range ll.Preload {
+		if h.Type == "PART" && h.Start == 0 && h.Length < 0 {
+			return &ll.Preload[i]
+		}
+	}
+	return nil
+}
+
+// reloadURL adds the delivery directives for a playlist reload to u. If
+// msn >= 0 the reload blocks until that segment (and part, if part >= 0)
+// is available. If skip is set, a delta update is requested.
+func reloadURL(u string, msn, part int, skip bool) string {
+	var q []string
+	if msn >= 0 {
+		q = append(q, fmt.Sprintf("_HLS_msn=%d", msn))
+		if part >= 0 {
+			q = append(q, fmt.Sprintf("_HLS_part=%d", part))
+		}
+	}
+	if skip {
+		q = append(q, "_HLS_skip=YES")
+	}
+	if len(q) == 0 {
+		return u
+	}
+	sep := "?"
+	if strings.Contains(u, "?") {
+		sep = "&"
+	}
+	return u + sep + strings.Join(q, "&")
+}
+
+func yes(t m3u.Tag, key string) bool {
+	return t.Value(key) == "YES"
+}
+
+func seconds(t m3u.Tag, key string) time.Duration {
+	f, _ := strconv.ParseFloat(t.Value(key), 64)
+	return time.Duration(f * float64(time.Second))
+}
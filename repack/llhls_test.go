@@ -0,0 +1,82 @@
+package repack
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+const llHeader = "#EXTM3U\n#EXT-X-VERSION:9\n#EXT-X-TARGETDURATION:1\n#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=0.3\n#EXT-X-PART-INF:PART-TARGET=0.1\n"
+
+// parts returns the EXT-X-PART tags of parts i to j of segment seq
+func parts(seq, i, j int) (s string) {
+	for ; i < j; i++ {
+		s += fmt.Sprintf("#EXT-X-PART:DURATION=0.1,URI=\"p%d.%d.mp4\"\n", seq, i)
+	}
+	return s
+}
+
+// hint returns the preload hint of part i of segment seq
+func hint(seq, i int) string {
+	return fmt.Sprintf("#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"p%d.%d.mp4\"\n", seq, i)
+}
+
+func TestLowLatencyReload(t *testing.T) {
+	s := &script{versions: []published{
+		{1, 2, llHeader + "#EXTINF:0.3,\ns0.mp4\n" + parts(1, 0, 2) + hint(1, 2)},
+		{1, 4, llHeader + "#EXTINF:0.3,\ns0.mp4\n" + parts(1, 0, 4) + hint(1, 4)},
+		// the hinted parts are published, and then their segment
+		{2, 1, llHeader + "#EXTINF:0.3,\ns0.mp4\n" + parts(1, 0, 5) + "#EXTINF:0.5,\ns1.mp4\n" + parts(2, 0, 1) + hint(2, 1)},
+		{3, 0, llHeader + "#EXTINF:0.3,\ns0.mp4\n#EXTINF:0.5,\ns1.mp4\n" + parts(2, 0, 3) + "#EXTINF:0.3,\ns2.mp4\n#EXT-X-ENDLIST\n"},
+	}}
+	names, err := follow(t, s)
+	if err != io.EOF {
+		t.Fatalf("ended with %v, want EOF", err)
+	}
+	// each part once, whether it was hinted or not, and none of the
+	// segments made of them
+	if got, want := strings.Join(names, " "), "s0.mp4 p1.0.mp4 p1.1.mp4 p1.2.mp4 p1.3.mp4 p1.4.mp4 p2.0.mp4 p2.1.mp4 p2.2.mp4"; got != want {
+		t.Errorf("segments: %s\nwant: %s", got, want)
+	}
+	// blocking for the part after the last one queued, hinted or not
+	want := []string{"", "_HLS_msn=1&_HLS_part=0", "_HLS_msn=1&_HLS_part=3", "_HLS_msn=1&_HLS_part=5", "_HLS_msn=2&_HLS_part=2"}
+	if got := strings.Join(s.queries, " "); got != strings.Join(want, " ") {
+		t.Errorf("queries: %s\nwant: %s", got, strings.Join(want, " "))
+	}
+}
+
+func TestPartsLost(t *testing.T) {
+	// the parts of segment 1 are dropped from the playlist once it's
+	// complete, so what's left of it can't be found
+	s := &script{versions: []published{
+		{1, 2, llHeader + "#EXTINF:0.3,\ns0.mp4\n" + parts(1, 0, 2)},
+		{2, 0, llHeader + "#EXT-X-MEDIA-SEQUENCE:1\n#EXTINF:0.3,\ns1.mp4\n"},
+	}}
+	names, err := follow(t, s)
+	if !errors.Is(err, ErrPartsLost) {
+		t.Errorf("ended with %v, want ErrPartsLost", err)
+	}
+	if got, want := strings.Join(names, " "), "s0.mp4 p1.0.mp4 p1.1.mp4"; got != want {
+		t.Errorf("segments: %s\nwant: %s", got, want)
+	}
+}
+
+func TestReloadURL(t *testing.T) {
+	for _, tc := range []struct {
+		url       string
+		msn, part int
+		skip      bool
+		want      string
+	}{
+		{"http://example.com/live.m3u8", -1, -1, false, "http://example.com/live.m3u8"},
+		{"http://example.com/live.m3u8", 5, -1, false, "http://example.com/live.m3u8?_HLS_msn=5"},
+		{"http://example.com/live.m3u8", 5, 2, true, "http://example.com/live.m3u8?_HLS_msn=5&_HLS_part=2&_HLS_skip=YES"},
+		{"http://example.com/live.m3u8?token=a", -1, 0, true, "http://example.com/live.m3u8?token=a&_HLS_skip=YES"},
+	} {
+		if got := reloadURL(tc.url, tc.msn, tc.part, tc.skip); got != tc.want {
+			t.Errorf("%s %d %d %v: %s, want %s", tc.url, tc.msn, tc.part, tc.skip, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,350 @@
+package repack
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/as/hls"
+)
+
+// Policy chooses the variant of a master playlist. It's parsed from an
+// expression of comma separated terms by ParsePolicy.
+type Policy struct {
+	terms []term
+	order string // max or min bandwidth, or the default
+}
+
+// term is a filter or preference of a policy
+type term struct {
+	key, op string
+	vals    []string // alternatives, most preferred first
+	expr    string
+}
+
+// policy keys and the operators they take
+var (
+	numeric = map[string]bool{"bandwidth": true, "width": true, "height": true, "fps": true, "hdcp": true}
+	aliases = map[string]string{"bw": "bandwidth", "framerate": "fps", "videorange": "range", "codecs": "codec"}
+	ops     = []string{"<=", ">=", "!=", "=", "<", ">", "~"}
+)
+
+// ParsePolicy parses a variant selection expression. Each term is one of
+//
+//	key=value	the variant must have the value (alternatives separated by |
+//			are allowed, and the first one the variant has is preferred)
+//	key!=value	the variant must not have the value
+//	key<value	and <=, >, >=: the variant's value must compare so
+//	key~value	the variant nearest to the value is preferred
+//	max		the highest bandwidth is preferred
+//	min		the lowest bandwidth is preferred
+//
+// The keys are bandwidth (bw, in bits per second, with an optional k or
+// m), width, height, fps, codec (avc1, hvc1, av01 and the like), range
+// (SDR, PQ or HLG) and hdcp (NONE, TYPE-0 or TYPE-1). Without max or
+// min, the highest bandwidth times resolution is preferred.
+//
+// For example, codec=hvc1,height<=1080,max is the highest bandwidth
+// hevc variant up to 1080p.
+func ParsePolicy(expr string) (*Policy, error) {
+	p := &Policy{}
+	for _, s := range strings.Split(expr, ",") {
+		s = strings.TrimSpace(s)
+		switch s {
+		case "":
+			continue
+		case "max", "min":
+			p.order = s
+			continue
+		}
+		t, err := parseTerm(s)
+		if err != nil {
+			return nil, err
+		}
+		p.terms = append(p.terms, t)
+	}
+	return p, nil
+}
+
+func parseTerm(s string) (t term, err error) {
+	i := strings.IndexAny(s, "<>=!~")
+	if i <= 0 {
+		return t, fmt.Errorf("%w: %q", ErrPolicy, s)
+	}
+	t.expr, t.key = s, strings.ToLower(strings.TrimSpace(s[:i]))
+	if k, ok := aliases[t.key]; ok {
+		t.key = k
+	}
+	for _, op := range ops {
+		if v, ok := strings.CutPrefix(s[i:], op); ok {
+			t.op = op
+			t.vals = strings.Split(v, "|")
+			break
+		}
+	}
+	switch {
+	case t.op == "":
+		return t, fmt.Errorf("%w: %q", ErrPolicy, s)
+	case !numeric[t.key] && t.key != "codec" && t.key != "range":
+		return t, fmt.Errorf("%w: unknown key in %q", ErrPolicy, s)
+	case !numeric[t.key] && t.op != "=" && t.op != "!=":
+		return t, fmt.Errorf("%w: %s can't be compared with %s", ErrPolicy, t.key, t.op)
+	case t.op != "=" && len(t.vals) > 1:
+		return t, fmt.Errorf("%w: alternatives need = in %q", ErrPolicy, s)
+	}
+	for i, v := range t.vals {
+		v = strings.TrimSpace(v)
+		if numeric[t.key] {
+			if _, err := number(t.key, v); err != nil {
+				return t, fmt.Errorf("%w: bad value in %q", ErrPolicy, s)
+			}
+		}
+		t.vals[i] = v
+	}
+	return t, nil
+}
+
+// number returns the numeric value v of the key
+func number(key, v string) (float64, error) {
+	switch key {
+	case "hdcp":
+		return hdcp(v), nil
+	case "bandwidth":
+		scale := 1.0
+		switch {
+		case strings.HasSuffix(strings.ToLower(v), "k"):
+			scale, v = 1e3, v[:len(v)-1]
+		case strings.HasSuffix(strings.ToLower(v), "m"):
+			scale, v = 1e6, v[:len(v)-1]
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		return f * scale, err
+	}
+	return strconv.ParseFloat(v, 64)
+}
+
+// hdcp ranks an HDCP-LEVEL
+func hdcp(v string) float64 {
+	switch strings.ToUpper(v) {
+	case "TYPE-0":
+		return 1
+	case "TYPE-1":
+		return 2
+	}
+	return 0
+}
+
+// value returns the value of the key for the variant. Numeric values
+// are in n.
+func value(si *hls.StreamInfo, key string) (s string, n float64) {
+	switch key {
+	case "bandwidth":
+		n = float64(bandwidth(si))
+	case "width":
+		n = float64(si.Resolution.X)
+	case "height":
+		n = float64(si.Resolution.Y)
+	case "fps":
+		n = si.Framerate
+	case "hdcp":
+		s = si.HDCP
+		if s == "" {
+			s = "NONE"
+		}
+		return s, hdcp(s)
+	case "range":
+		s = strings.ToUpper(si.VideoRange)
+		if s == "" {
+			s = "SDR"
+		}
+		return s, 0
+	case "codec":
+		return strings.Join(si.Codecs, ","), 0
+	}
+	return strconv.FormatFloat(n, 'f', -1, 64), n
+}
+
+// match returns the index of the first alternative of t the variant
+// has, or false if it's rejected by t
+func (t *term) match(si *hls.StreamInfo) (int, bool) {
+	s, n := value(si, t.key)
+	if t.op == "~" {
+		return 0, true
+	}
+	for i, v := range t.vals {
+		var eq bool
+		var cmp float64
+		switch t.key {
+		case "codec":
+			eq = hasCodec(si, v)
+		case "range":
+			eq = strings.EqualFold(s, v)
+		default:
+			x, _ := number(t.key, v)
+			eq, cmp = n == x, n-x
+		}
+		ok := false
+		switch t.op {
+		case "=":
+			ok = eq
+		case "!=":
+			ok = !eq
+		case "<":
+			ok = cmp < 0
+		case "<=":
+			ok = cmp <= 0
+		case ">":
+			ok = cmp > 0
+		case ">=":
+			ok = cmp >= 0
+		}
+		if ok {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// distance returns how far the variant is from the value of a ~ term
+func (t *term) distance(si *hls.StreamInfo) float64 {
+	_, n := value(si, t.key)
+	x, _ := number(t.key, t.vals[0])
+	return math.Abs(n - x)
+}
+
+// hasCodec reports whether the variant has a codec of the same family
+// as c: avc1 also matches avc3 and h264, hvc1 matches hev1 and h265,
+// and so on
+func hasCodec(si *hls.StreamInfo, c string) bool {
+	for _, v := range si.Codecs {
+		if family(v) == family(c) {
+			return true
+		}
+	}
+	return false
+}
+
+func family(codec string) string {
+	c, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(codec)), ".")
+	switch c {
+	case "avc1", "avc3", "avc", "h264":
+		return "avc"
+	case "hvc1", "hev1", "hevc", "h265":
+		return "hevc"
+	case "av01", "av1":
+		return "av1"
+	case "dvh1", "dvhe", "dolbyvision":
+		return "dolbyvision"
+	case "vp09", "vp9":
+		return "vp9"
+	}
+	return c
+}
+
+// rank is how a variant is ordered by a policy: by the alternatives of
+// each term it matched, then by its distance to each ~ term, then by
+// bandwidth or quality. Lower ranks are better.
+type rank []float64
+
+func (a rank) less(b rank) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
+
+// choose returns the index of the variant in m chosen by the policy,
+// and logs why each variant was chosen or rejected
+func (p *Policy) choose(m *hls.Master, logf func(string, ...any)) (int, error) {
+	best, ranks := -1, make([]rank, len(m.Stream))
+	reasons := make([]string, len(m.Stream))
+	for i := range m.Stream {
+		si := &m.Stream[i]
+		var r rank
+		var why []string
+		for _, t := range p.terms {
+			alt, ok := t.match(si)
+			if !ok {
+				s, _ := value(si, t.key)
+				reasons[i] = fmt.Sprintf("rejected: %s is %s", t.expr, s)
+				r = nil
+				break
+			}
+			if len(t.vals) > 1 {
+				r = append(r, float64(alt))
+				why = append(why, fmt.Sprintf("%s (%s)", t.expr, t.vals[alt]))
+			}
+		}
+		if reasons[i] != "" {
+			continue
+		}
+		for _, t := range p.terms {
+			if t.op == "~" {
+				r = append(r, t.distance(si))
+				why = append(why, t.expr)
+			}
+		}
+		switch p.order {
+		case "max":
+			r = append(r, -float64(bandwidth(si)))
+			why = append(why, "max bandwidth")
+		case "min":
+			r = append(r, float64(bandwidth(si)))
+			why = append(why, "min bandwidth")
+		}
+		r = append(r, -float64(quantifyV(si)))
+		why = append(why, "bandwidth × resolution")
+		ranks[i], reasons[i] = r, strings.Join(why, ", ")
+		if best < 0 || r.less(ranks[best]) {
+			best = i
+		}
+	}
+	for i := range m.Stream {
+		si := &m.Stream[i]
+		reason := reasons[i]
+		switch {
+		case i == best:
+			reason = "chosen by " + reason
+		case ranks[i] != nil:
+			reason = fmt.Sprintf("ranked below variant %d by %s", best, reason)
+		}
+		logf("select: variant %d %s: %s\n", i, describe(si), reason)
+	}
+	if best < 0 {
+		return 0, ErrNoVariant
+	}
+	return best, nil
+}
+
+// describe returns the attributes of a variant that policies select by
+func describe(si *hls.StreamInfo) string {
+	s := fmt.Sprintf("bandwidth=%d", bandwidth(si))
+	if si.Resolution.X != 0 {
+		s += fmt.Sprintf(" %dx%d", si.Resolution.X, si.Resolution.Y)
+	}
+	if si.Framerate != 0 {
+		s += fmt.Sprintf(" fps=%g", si.Framerate)
+	}
+	if len(si.Codecs) > 0 {
+		s += " codecs=" + strings.Join(si.Codecs, ",")
+	}
+	if si.VideoRange != "" {
+		s += " range=" + si.VideoRange
+	}
+	if si.HDCP != "" {
+		s += " hdcp=" + si.HDCP
+	}
+	return s
+}
+
+// bandwidth returns the peak bandwidth of the variant, or its average
+// if that's all there is
+func bandwidth(si *hls.StreamInfo) int {
+	if si.Bandwidth != 0 {
+		return si.Bandwidth
+	}
+	return si.BandwidthAvg
+}
@@ -0,0 +1,109 @@
+package repack
+
+import (
+	"errors"
+	"testing"
+)
+
+const policyMaster = `#EXTM3U
+#EXT-X-STREAM-INF:BANDWIDTH=2000000,RESOLUTION=1280x720,CODECS="avc1.64001f,mp4a.40.2",FRAME-RATE=30
+v0.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=5000000,RESOLUTION=1920x1080,CODECS="avc1.640028,mp4a.40.2",FRAME-RATE=60,HDCP-LEVEL=TYPE-0
+v1.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=4000000,RESOLUTION=1920x1080,CODECS="hvc1.2.4.L123.B0,mp4a.40.2",FRAME-RATE=30,VIDEO-RANGE=PQ,HDCP-LEVEL=TYPE-1
+v2.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=8000000,RESOLUTION=3840x2160,CODECS="hvc1.2.4.L153.B0,mp4a.40.2",FRAME-RATE=30,VIDEO-RANGE=PQ,HDCP-LEVEL=TYPE-1
+v3.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=800000,RESOLUTION=640x360,CODECS="avc1.4d401e,mp4a.40.2",FRAME-RATE=30
+v4.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=6000000,RESOLUTION=1920x1080,CODECS="hev1.1.6.L120.90,mp4a.40.2",FRAME-RATE=30,VIDEO-RANGE=SDR,HDCP-LEVEL=NONE
+v5.m3u8
+`
+
+func TestPolicy(t *testing.T) {
+	m := decodeMaster(t, policyMaster)
+	for _, tc := range []struct {
+		expr string
+		want int
+	}{
+		{"", 3},
+		{"max", 3},
+		{"min", 4},
+		{"codec=hvc1,height<=1080,max", 5},
+		{"codec=hvc1,height<=1080,min", 2},
+		{"codec=av01|hvc1|avc1", 3},
+		{"codec=avc1|hvc1,height<=1080", 1},
+		{"codecs=h264, min", 4},
+		{"codec!=hvc1,width>=1920", 1},
+		{"height~720", 0},
+		{"height~1000", 5},
+		{"height~1000,min", 2},
+		{"bw~1m", 4},
+		{"bw<=5m", 1},
+		{"bw<5000k", 2},
+		{"bandwidth>=4000000,bw<6M", 1},
+		{"fps>=50", 1},
+		{"framerate=30,height=1080", 5},
+		{"hdcp<=TYPE-0", 5},
+		{"hdcp>type-0", 3},
+		{"hdcp=TYPE-1|TYPE-0,height<=1080", 2},
+		{"hdcp=TYPE-0|TYPE-1,height<=1080", 1},
+		{"hdcp=NONE", 5},
+		{"range=PQ,min", 2},
+		{"videorange!=pq", 5},
+		{"range=HLG|SDR", 5},
+	} {
+		p, err := ParsePolicy(tc.expr)
+		if err != nil {
+			t.Errorf("%q: %v", tc.expr, err)
+			continue
+		}
+		got, err := p.choose(m, func(string, ...any) {})
+		if err != nil || got != tc.want {
+			t.Errorf("%q: chose variant %d, %v, want %d", tc.expr, got, err, tc.want)
+		}
+	}
+
+	p, _ := ParsePolicy("height>2160")
+	if _, err := p.choose(m, func(string, ...any) {}); err != ErrNoVariant {
+		t.Errorf("nothing above 2160p: %v, want ErrNoVariant", err)
+	}
+}
+
+func TestParsePolicyErrors(t *testing.T) {
+	for _, expr := range []string{
+		"height",
+		"=1080",
+		"resolution=1080",
+		"codec<hvc1",
+		"range~PQ",
+		"height<=1080|720",
+		"bw=12x",
+		"bw>k",
+		"height>abc",
+		"fps=",
+	} {
+		if _, err := ParsePolicy(expr); !errors.Is(err, ErrPolicy) {
+			t.Errorf("%q: %v, want ErrPolicy", expr, err)
+		}
+	}
+}
+
+func TestBest(t *testing.T) {
+	// without a policy, the highest bandwidth times resolution, wherever
+	// it is in the list
+	for _, tc := range []struct {
+		master string
+		want   int
+	}{
+		{policyMaster, 3},
+		{"#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=8000000,RESOLUTION=1920x1080\nhi.m3u8\n#EXT-X-STREAM-INF:BANDWIDTH=1000000,RESOLUTION=640x360\nlo.m3u8\n", 0},
+		{"#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1000000,RESOLUTION=640x360\nlo.m3u8\n#EXT-X-STREAM-INF:BANDWIDTH=8000000,RESOLUTION=1920x1080\nhi.m3u8\n#EXT-X-STREAM-INF:BANDWIDTH=2000000,RESOLUTION=1280x720\nmid.m3u8\n", 1},
+		{"#EXTM3U\n#EXT-X-STREAM-INF:AVERAGE-BANDWIDTH=3000000,RESOLUTION=1280x720\navg.m3u8\n#EXT-X-STREAM-INF:BANDWIDTH=2000000,RESOLUTION=1280x720\npeak.m3u8\n", 0},
+	} {
+		m := decodeMaster(t, tc.master)
+		if got, err := New(Options{}).best(m); err != nil || got != tc.want {
+			t.Errorf("%s: chose variant %d, %v, want %d", m.Stream[0].URL, got, err, tc.want)
+		}
+	}
+}
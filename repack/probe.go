@@ -0,0 +1,210 @@
+package repack
+
+import (
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/as/hls"
+	"github.com/as/hlscat/av"
+	"github.com/as/hlscat/ts"
+)
+
+// Probe downloads the first segment of m that isn't an ad, with its init
+// segment, and returns the settings of its video and audio: the codec,
+// profile and level, size, frame rate and chroma format of the video
+// from its parameter sets, the sample rate and channels of the audio,
+// and the timescale and bitrate of each. Streams m doesn't have are left
+// empty.
+func (r *Repackager) Probe(m *hls.Media) (*Info, error) {
+	p := r.newPlaylist(m)
+	p.live = false
+	for ads := (&adbreak{}); len(p.file) > 0 && ads.ad(&p.file[0]); {
+		p.file = p.file[1:]
+	}
+	if len(p.file) == 0 {
+		return nil, ErrNoSegments
+	}
+	p.file = p.file[:1]
+	f := &p.file[0]
+	info := &Info{Name: f.Path(m.Path("")), Dur: f.Duration(0).Seconds()}
+	r.logf("probe: %s\n", info.Name)
+
+	rc := r.concat(nil, p)
+	defer rc.Close()
+	in := &counter{Reader: rc}
+	dmx := r.demuxer(in)
+	stats := map[int]*trackstat{}
+	for {
+		s, err := dmx.ReadSample()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		st := stats[s.Track]
+		if st == nil {
+			st = &trackstat{first: s.DTS}
+			stats[s.Track] = st
+		}
+		st.n++
+		st.bytes += int64(len(s.Data))
+		st.last = s.DTS
+	}
+	info.Size = int(in.n)
+	info.Container = "mp4"
+	if _, ok := dmx.(*ts.Reader); ok {
+		info.Container = "ts"
+	}
+	var video, audio *av.Track
+	for _, t := range dmx.Tracks() {
+		switch {
+		case t.Kind == av.Video && video == nil:
+			video = t
+			probeVideo(&info.Video, t, stats[t.ID], info.Dur)
+		case t.Kind == av.Audio && audio == nil:
+			audio = t
+			probeAudio(&info.Audio, t, stats[t.ID], info.Dur)
+		}
+	}
+	if video == nil && audio == nil {
+		return nil, av.ErrNoTracks
+	}
+	return info, nil
+}
+
+// trackstat counts the samples of a track
+type trackstat struct {
+	n           int
+	bytes       int64
+	first, last int64 // decoding times
+}
+
+// rate returns the samples per second, and the bits per second, of the
+// track, or zero if it can't tell. Dur is the duration of the segment,
+// for a track with one sample.
+func (s *trackstat) rate(timescale int, dur float64) (fps float64, bps int) {
+	if s == nil || s.n == 0 {
+		return 0, 0
+	}
+	span := dur
+	if s.n > 1 && s.last > s.first && timescale > 0 {
+		fps = float64(s.n-1) * float64(timescale) / float64(s.last-s.first)
+		span = float64(s.n) / fps
+	}
+	if span > 0 {
+		bps = int(float64(s.bytes) * 8 / span)
+	}
+	return math.Round(fps*1000) / 1000, bps
+}
+
+func probeVideo(v *Video, t *av.Track, st *trackstat, dur float64) {
+	var info Info
+	if id := t.Codecs(); id != "" {
+		ParseCodec(id, &info)
+		*v = info.Video
+	}
+	if v.Codec == "" {
+		v.Codec = t.Codec
+	}
+	v.Width, v.Height, v.Timescale = t.Width, t.Height, t.Timescale
+	fps, bps := st.rate(t.Timescale, dur)
+	v.FPS, v.Bitrate.BPS = fps, bps
+	if s, err := trackSPS(t); err == nil {
+		if v.Width == 0 || v.Height == 0 {
+			v.Width, v.Height = s.Width, s.Height
+		}
+		if s.FPS > 0 {
+			v.FPS = math.Round(s.FPS*1000) / 1000
+		}
+		v.Chroma = pixfmt(s.Chroma, s.BitDepth)
+	}
+}
+
+func probeAudio(a *Audio, t *av.Track, st *trackstat, dur float64) {
+	a.Codec = t.Codec
+	if id := t.Codecs(); id != "" {
+		var info Info
+		ParseCodec(id, &info)
+		a.Codec = info.Audio.Codec
+	}
+	a.Lang, a.Samplerate, a.Channels, a.Timescale = t.Lang, t.SampleRate, t.Channels, t.Timescale
+	if t.Codec == "aac" && (a.Samplerate == 0 || a.Channels == 0) {
+		if _, rate, ch, err := av.ParseAACConfig(t.Config); err == nil {
+			a.Samplerate, a.Channels = rate, ch
+		}
+	}
+	_, a.Bitrate = st.rate(t.Timescale, dur)
+}
+
+// trackSPS parses the sequence parameter set in the config of a video
+// track
+func trackSPS(t *av.Track) (av.SPS, error) {
+	switch t.Codec {
+	case "h264":
+		sps, _, err := av.AVCParams(t.Config)
+		if err == nil && len(sps) > 0 {
+			return av.ParseSPS(sps[0])
+		}
+	case "h265":
+		_, sps, _, err := av.HEVCParams(t.Config)
+		if err == nil && len(sps) > 0 {
+			return av.ParseHEVCSPS(sps[0])
+		}
+	}
+	return av.SPS{}, av.ErrConfig
+}
+
+// pixfmt returns the ffmpeg pixel format of a chroma_format_idc and
+// bit depth
+func pixfmt(chroma, depth int) string {
+	f := [...]string{"gray", "yuv420p", "yuv422p", "yuv444p"}[chroma&3]
+	if depth > 8 {
+		f += fmt.Sprintf("%dle", depth)
+	}
+	return f
+}
+
+// probed returns the settings of the content in m for blackout: those
+// probed from its first segment, with the gaps filled from proto. It
+// returns proto if the probe fails.
+func (r *Repackager) probed(proto *Info, m *hls.Media) *Info {
+	info, err := r.Probe(m)
+	if err != nil {
+		r.logf("probe: %v: using the prototype\n", err)
+		return proto
+	}
+	if info.Video.On() {
+		if info.Video.Bitrate.BPS == 0 {
+			info.Video.Bitrate = proto.Video.Bitrate
+		}
+		if info.Video.FPS == 0 {
+			info.Video.FPS = proto.Video.FPS
+		}
+		if info.Video.Profile == "" {
+			info.Video.Profile, info.Video.Level = proto.Video.Profile, proto.Video.Level
+		}
+	}
+	if info.Audio.On() {
+		if info.Audio.Bitrate == 0 {
+			info.Audio.Bitrate = proto.Audio.Bitrate
+		}
+		if info.Audio.Samplerate == 0 || info.Audio.Channels == 0 {
+			info.Audio.Samplerate, info.Audio.Channels = proto.Audio.Samplerate, proto.Audio.Channels
+		}
+	}
+	return info
+}
+
+// counter counts the bytes read through it
+type counter struct {
+	io.Reader
+	n int64
+}
+
+func (c *counter) Read(p []byte) (n int, err error) {
+	n, err = c.Reader.Read(p)
+	c.n += int64(n)
+	return n, err
+}
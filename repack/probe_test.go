@@ -0,0 +1,128 @@
+package repack
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/as/hlscat/av"
+	"github.com/as/hlscat/mp4"
+	"github.com/as/hlscat/ts"
+)
+
+// the parameter sets of 640x368 h264 baseline at level 3.0
+var (
+	probeSPS = []byte{0x67, 0x42, 0x00, 0x1e, 0xf4, 0x05, 0x01, 0x7c, 0x80}
+	probePPS = []byte{0x68, 0xce, 0x38, 0x80}
+)
+
+// mux writes n frames of h264 at 25fps, and aac at 48kHz if audio is
+// set, to m. Head is called once the header is written, so it can be
+// split off as an init segment.
+func mux(t *testing.T, m av.Muxer, n int, audio bool, head func()) {
+	t.Helper()
+	cfg, err := av.AVCConfig([][]byte{probeSPS}, [][]byte{probePPS})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const frame = 90000 / 25
+	tracks := []*av.Track{{ID: 1, Kind: av.Video, Codec: "h264", Timescale: 90000, Width: 640, Height: 368, Config: cfg}}
+	if audio {
+		tracks = append(tracks, &av.Track{ID: 2, Kind: av.Audio, Codec: "aac", Timescale: 48000, SampleRate: 48000, Channels: 2, Config: av.AACConfig(2, 3, 2)})
+	}
+	if err := m.WriteHeader(tracks...); err != nil {
+		t.Fatal(err)
+	}
+	head()
+	a := int64(0)
+	for i := 0; i < n; i++ {
+		dts := int64(i * frame)
+		for ; audio && av.Rescale(a*av.AACFrameSize, 48000, 90000) < dts+frame; a++ {
+			s := av.Sample{Track: 2, DTS: a * av.AACFrameSize, PTS: a * av.AACFrameSize, Dur: av.AACFrameSize, Key: true, Data: bytes.Repeat([]byte{0x21}, 100)}
+			if err := m.WriteSample(s); err != nil {
+				t.Fatal(err)
+			}
+		}
+		nal := []byte{0x41, 0x9a, byte(i)}
+		if i == 0 {
+			nal = []byte{0x65, 0x88, 0x84}
+		}
+		s := av.Sample{Track: 1, DTS: dts, PTS: dts + frame, Dur: frame, Key: i == 0, Data: av.JoinAVCC(append(nal, make([]byte, 400)...))}
+		if err := m.WriteSample(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProbe(t *testing.T) {
+	var tsseg bytes.Buffer
+	mux(t, ts.NewWriter(&tsseg), 25, true, func() {})
+	var init, mp4seg bytes.Buffer
+	w := mp4.NewWriter(&mp4seg)
+	mux(t, w, 25, true, func() { init.Write(mp4seg.Bytes()); mp4seg.Reset() })
+
+	src := files{"a.ts": tsseg.String(), "init.mp4": init.String(), "a.m4s": mp4seg.String()}
+	for _, tc := range []struct {
+		playlist string
+		want     Info
+	}{
+		{
+			"#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXTINF:1,\na.ts\n#EXT-X-ENDLIST\n",
+			Info{
+				Name: "http://example.com/a.ts", Container: "ts", Size: tsseg.Len(), Dur: 1,
+				// with an access unit delimiter in each frame, and the
+				// parameter sets in the keyframe
+				Video: Video{Codec: "h264", Profile: "baseline", Level: "3.0", Chroma: "yuv420p", Width: 640, Height: 368, Timescale: 90000, FPS: 25, Bitrate: Bitrate{BPS: 81568}},
+				Audio: Audio{Codec: "aac", Bitrate: 37500, Samplerate: 48000, Channels: 2, Timescale: 48000},
+			},
+		},
+		{
+			"#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXT-X-MAP:URI=\"init.mp4\"\n#EXTINF:1,\na.m4s\n#EXT-X-ENDLIST\n",
+			Info{
+				Name: "http://example.com/a.m4s", Container: "mp4", Size: init.Len() + mp4seg.Len(), Dur: 1,
+				Video: Video{Codec: "h264", Profile: "baseline", Level: "3.0", Chroma: "yuv420p", Width: 640, Height: 368, Timescale: 90000, FPS: 25, Bitrate: Bitrate{BPS: 81400}},
+				Audio: Audio{Codec: "aac", Bitrate: 37500, Samplerate: 48000, Channels: 2, Timescale: 48000},
+			},
+		},
+	} {
+		m, _ := decodePlaylist(t, tc.playlist)
+		info, err := New(Options{Fetcher: src}).Probe(m)
+		if err != nil {
+			t.Errorf("%s: %v", tc.want.Container, err)
+			continue
+		}
+		if *info != tc.want {
+			t.Errorf("%s:\n%+v\nwant:\n%+v", tc.want.Container, *info, tc.want)
+		}
+	}
+}
+
+func TestProbed(t *testing.T) {
+	proto := &Info{
+		Video: Video{Codec: "h264", Profile: "high", Level: "4.0", FPS: 30, Bitrate: Bitrate{BPS: 5000000}},
+		Audio: Audio{Codec: "aac", Bitrate: 128000, Samplerate: 44100, Channels: 2},
+	}
+	// one frame of video only, too little to tell its frame rate or
+	// bitrate
+	var seg bytes.Buffer
+	mux(t, ts.NewWriter(&seg), 1, false, func() {})
+	src := files{"a.ts": seg.String()}
+	r := New(Options{Fetcher: src})
+
+	m, _ := decodePlaylist(t, "#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXTINF:0,\na.ts\n#EXT-X-ENDLIST\n")
+	info := r.probed(proto, m)
+	want := Video{Codec: "h264", Profile: "baseline", Level: "3.0", Chroma: "yuv420p", Width: 640, Height: 368, Timescale: 90000, FPS: 30, Bitrate: Bitrate{BPS: 5000000}}
+	if info.Video != want {
+		t.Errorf("video:\n%+v\nwant:\n%+v", info.Video, want)
+	}
+	if info.Audio != (Audio{}) {
+		t.Errorf("audio %+v, want none", info.Audio)
+	}
+
+	m, _ = decodePlaylist(t, "#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXTINF:1,\nmissing.ts\n#EXT-X-ENDLIST\n")
+	if info := r.probed(proto, m); info != proto {
+		t.Errorf("probing a missing segment: %+v, want the prototype", info)
+	}
+}
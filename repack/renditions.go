@@ -0,0 +1,129 @@
+package repack
+
+import (
+	"io"
+
+	"github.com/as/hls"
+	"github.com/as/hlscat/av"
+	"github.com/as/hlscat/vtt"
+)
+
+// rendition is a playlist merged into the output, and the tracks
+// taken from it
+type rendition struct {
+	m    *hls.Media
+	info *hls.MediaInfo // describes its tracks, if not nil
+	keep func(t *av.Track) bool
+}
+
+// Renditions returns the video of the best variant in m with every
+// audio rendition in its audio group and every subtitle rendition, each
+// as a track of its own. The tracks are tagged with the LANGUAGE, NAME
+// and DEFAULT of their renditions. Subtitles are WebVTT, placed on the
+// clock of the video by their X-TIMESTAMP-MAP, and only kept in mp4.
+// The stream is always remuxed natively.
+func (r *Repackager) Renditions(m *hls.Master) (io.ReadCloser, error) {
+	b, err := r.best(m)
+	if err != nil {
+		return nil, err
+	}
+	si := &m.Stream[b]
+	parent := m.Path("")
+	v, err := r.Playlist(si.Path(parent))
+	if err != nil {
+		return nil, err
+	}
+	r.logf("hls video: %s\n", si.Path(parent))
+	variant := &rendition{m: v, keep: func(t *av.Track) bool { return t.Kind == av.Video }}
+	list := []*rendition{variant}
+	separate := false
+	for i := range m.Media {
+		mi := &m.Media[i]
+		var kind av.Kind
+		switch {
+		case mi.Type == "AUDIO" && mi.Group == si.Audio && si.Audio != "":
+			kind = av.Audio
+		case mi.Type == "SUBTITLES":
+			kind = av.Text
+		default:
+			continue
+		}
+		if mi.URI == "" {
+			if kind == av.Audio && variant.info == nil {
+				// the variant's own audio
+				variant.info = mi
+			}
+			continue
+		}
+		a, err := r.Playlist(mi.Path(parent))
+		if err != nil {
+			return nil, err
+		}
+		r.logf("hls %s: %s %s %s\n", kind, mi.Lang, mi.Name, mi.Path(parent))
+		list = append(list, &rendition{m: a, info: mi, keep: func(t *av.Track) bool { return t.Kind == kind }})
+		separate = separate || kind == av.Audio
+	}
+	if !separate {
+		variant.keep = func(t *av.Track) bool { return t.Kind != av.Text }
+	}
+	return r.mergeRenditions(list), nil
+}
+
+// mergeRenditions merges the tracks kept from each rendition
+func (r *Repackager) mergeRenditions(list []*rendition) io.ReadCloser {
+	src := make([]io.ReadCloser, len(list))
+	for i, x := range list {
+		if err := resolveRanges(x.m); err != nil {
+			for _, rc := range src[:i] {
+				rc.Close()
+			}
+			return failed(err)
+		}
+		src[i] = r.concat(&r.Proto, r.open(x.m))
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		in := make([]*input, len(list))
+		dmx := make([]av.Demuxer, len(list))
+		for i, x := range list {
+			in[i] = &input{Reader: src[i]}
+			if x.info != nil && x.info.Type == "SUBTITLES" {
+				dmx[i] = &tagged{vtt.NewReader(in[i]), x.info}
+			} else {
+				dmx[i] = &tagged{r.demuxer(in[i]), x.info}
+			}
+		}
+		keep := func(n int, t *av.Track) bool {
+			return list[n].keep(t)
+		}
+		err := av.Merge(r.captions(muxer(r.Format, pw)), keep, dmx...)
+		for _, rc := range src {
+			rc.Close()
+		}
+		pw.CloseWithError(muxerr("native", err, in...))
+	}()
+	return pr
+}
+
+// tagged is a demuxer whose tracks are described by a rendition
+type tagged struct {
+	av.Demuxer
+	info *hls.MediaInfo
+}
+
+func (d *tagged) Tracks() []*av.Track {
+	tracks := d.Demuxer.Tracks()
+	if d.info == nil {
+		return tracks
+	}
+	for _, t := range tracks {
+		if t.Kind == av.Video {
+			continue
+		}
+		if d.info.Lang != "" {
+			t.Lang = d.info.Lang
+		}
+		t.Name, t.Default = d.info.Name, d.info.Default
+	}
+	return tracks
+}
@@ -0,0 +1,469 @@
+// Package repack downloads the segments of an HLS presentation and
+// repackages them into a single fragmented mp4 (or mpeg ts) stream
+package repack
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/as/hls"
+	"github.com/as/hls/m3u"
+	"github.com/as/hlscat/mp4"
+)
+
+const Blocksize = 16
+
+// AdPolicy decides what happens to segments that belong to an ad break
+type AdPolicy int
+
+const (
+	AdKeep     AdPolicy = iota // leave ads in the output
+	AdSkip                     // trim away all ad breaks
+	AdBlackout                 // replace ads with black frames and silence (not working)
+)
+
+// Options configures a Repackager. The zero value is usable.
+type Options struct {
+	Conns     int  // max concurrent segment downloads
+	BufSize   int  // read buffer size for each segment
+	CBCBuf    int  // aes-cbc buffer size, a multiple of 16
+	NoDecrypt bool // never decrypt anything
+	NoInit    bool // skip init segments
+	NoFilter  bool // never fix ts segments
+
+	// Keys are the content keys of fragmented mp4 encrypted with common
+	// encryption, by key id (see KeyID). Without a key for a key id, the
+	// key from the playlist is used.
+	Keys map[string][]byte
+
+	Ads AdPolicy
+
+	// Start and End select a time range of segments when either is set.
+	// A zero End means the end of the playlist.
+	Start, End time.Time
+
+	Skip  int // debugging: skip this amount of segments (after the other filters)
+	Count int // debugging: limit the number of segments processed
+
+	// Follow reloads live and event playlists for new segments
+	// until they end
+	Follow bool
+
+	Native bool   // remux in-process instead of with ffmpeg
+	Format string // output container for the native remuxer: mp4 or ts
+
+	// Policy chooses the variant of a master playlist. If nil, the
+	// one with the highest bandwidth times resolution is chosen.
+	Policy *Policy
+
+	// Audio chooses the audio rendition of the variant. If nil, the
+	// DEFAULT one that doesn't describe the video is preferred.
+	Audio *AudioPolicy
+
+	// KeepRenditions makes Master keep every audio rendition of the
+	// best variant and every subtitle rendition, see Renditions
+	KeepRenditions bool
+
+	// Captions extracts the closed captions of the video when it's set
+	Captions *Captions
+
+	// Proto describes the codec settings used for generated (blackout)
+	// content
+	Proto Info
+
+	// ProbeBlackout makes blackout content match the first segment of each
+	// playlist (see Repackager.Probe), with Proto filling in what the
+	// probe can't tell
+	ProbeBlackout bool
+
+	Retries        int           // retry attempts for each failed download
+	Backoff        time.Duration // delay before the first retry, doubled for each one after
+	Timeout        time.Duration // deadline for each http request, including its body
+	SegmentTimeout time.Duration // deadline for each download, including its retries
+
+	// Encryption encrypts the output with AES-128 when it's set
+	Encryption *Encryption
+
+	// KeyProvider gets the keys of EXT-X-KEY tags. If nil, or if it
+	// doesn't know a key, keys in the identity format are downloaded.
+	KeyProvider KeyProvider
+
+	// Fetcher opens urls and paths. If nil, http and https urls are
+	// fetched with Client, and file urls and plain paths from the
+	// local filesystem.
+	Fetcher Fetcher
+	Client  *http.Client
+	Log     io.Writer // diagnostics, discarded if nil
+	Verbose bool      // log retries
+	Debug   int       // debug level
+}
+
+// Repackager turns HLS playlists into a single media stream
+type Repackager struct {
+	Options
+	sem    chan bool
+	base   string
+	stats  stats
+	lowlat sync.Map // *hls.Media to the *LowLatency of the playlists decoded
+}
+
+// New returns a Repackager configured with opt. Unset options get
+// their defaults.
+func New(opt Options) *Repackager {
+	if opt.Conns <= 0 {
+		opt.Conns = 128
+	}
+	if opt.BufSize <= 0 {
+		opt.BufSize = 128 * 1024
+	}
+	if opt.CBCBuf <= 0 || opt.CBCBuf%16 != 0 {
+		opt.CBCBuf = 4096 + 16
+	}
+	if opt.Backoff <= 0 {
+		opt.Backoff = 500 * time.Millisecond
+	}
+	if opt.Format == "" {
+		opt.Format = "mp4"
+	}
+	if opt.Client == nil {
+		opt.Client = http.DefaultClient
+	}
+	if opt.Fetcher == nil {
+		opt.Fetcher = DefaultFetcher(opt.Client)
+	}
+	if opt.Log == nil {
+		opt.Log = io.Discard
+	}
+	r := &Repackager{Options: opt, sem: make(chan bool, opt.Conns)}
+	for i := 0; i < cap(r.sem); i++ {
+		r.sem <- true
+	}
+	return r
+}
+
+// Open downloads the master or media playlist at url and returns
+// the repackaged stream
+func (r *Repackager) Open(url string) (io.ReadCloser, error) {
+	master, media, err := r.Load(url)
+	if err != nil {
+		return nil, err
+	}
+	if media != nil {
+		return r.Media(media), nil
+	}
+	return r.Master(master)
+}
+
+// Load downloads and decodes the playlist at url
+func (r *Repackager) Load(url string) (*hls.Master, *hls.Media, error) {
+	url = abspath(url)
+	data, err := r.Download(url)
+	if err != nil {
+		return nil, nil, err
+	}
+	return r.Decode(bytes.NewReader(data), url)
+}
+
+// Decode decodes the playlist in src, which was found at url. Exactly one
+// of the master or media playlist is returned. A url with a scheme becomes
+// the base for segments with relative paths.
+func (r *Repackager) Decode(src io.Reader, url string) (*hls.Master, *hls.Media, error) {
+	if strings.Contains(url, "://") {
+		if n := strings.LastIndex(url, "/"); n > 0 {
+			r.base = url[:n] + "/"
+			r.logf("base path is %s\n", r.base)
+		}
+	}
+	tags, multi, err := hls.Decode(src)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !multi {
+		m, err := decodeMedia(tags, url)
+		if err == nil {
+			r.keepLowLatency(m, tags)
+		}
+		return nil, m, err
+	}
+	m := &hls.Master{URL: url}
+	if err := m.DecodeTag(tags...); err != nil {
+		return m, nil, err
+	}
+	renditionFlags(m, tags)
+	return m, nil, nil
+}
+
+// renditionFlags sets DEFAULT and AUTOSELECT of the renditions in m from
+// their tags. The hls package decodes both as YES for every rendition.
+func renditionFlags(m *hls.Master, tags []m3u.Tag) {
+	i := 0
+	for _, t := range tags {
+		if t.Name != "EXT-X-MEDIA" || i >= len(m.Media) {
+			continue
+		}
+		m.Media[i].Default = t.Value("DEFAULT") == "YES"
+		m.Media[i].Autoselect = t.Value("AUTOSELECT") == "YES"
+		i++
+	}
+}
+
+// Master selects the best variant in m and returns its repackaged stream,
+// merging in a separate audio rendition if there is one
+func (r *Repackager) Master(m *hls.Master) (io.ReadCloser, error) {
+	if r.KeepRenditions {
+		return r.Renditions(m)
+	}
+	mv, ma, err := r.Select(m)
+	if err != nil {
+		return nil, err
+	}
+	r.logf("hls video: %s\n", mv.Path(m.Path("")))
+	r.logf("hls audio: %s\n", ma.Path(m.Path("")))
+	if mv != ma {
+		r.logf("hls multi-file a/v\n")
+		return r.Merge(mv, ma), nil
+	}
+	r.logf("hls single-file a/v\n")
+	return r.Media(mv), nil
+}
+
+// Merge returns the video from v and the audio from a as one stream
+func (r *Repackager) Merge(v, a *hls.Media) io.ReadCloser {
+	return r.filterMerge(r.Media(v), r.Media(a))
+}
+
+// Media returns the repackaged stream for the segments in m
+func (r *Repackager) Media(m *hls.Media) io.ReadCloser {
+	r.logf("media playlist duration=%s\n", hls.Runtime(m.File...))
+	if err := resolveRanges(m); err != nil {
+		return failed(err)
+	}
+	return r.cat(&r.Proto, r.open(m))
+}
+
+// open returns the playlist of the segments in m that aren't trimmed
+func (r *Repackager) open(m *hls.Media) *playlist {
+	p := r.newPlaylist(m)
+	t := *m
+	t.File = p.file
+	r.trim(&t, p.ads)
+	if len(t.File) > 0 {
+		// the segments kept are in order, so the first one is the first
+		// of the playlist that's the same
+		first := t.File[0]
+		for i, f := range p.file {
+			if f.Inf.URL == first.Inf.URL && f.Range == first.Range {
+				p.first += i
+				break
+			}
+		}
+	}
+	p.file = t.File
+	return p
+}
+
+// Trim removes the segments from m that are excluded by the ad policy,
+// time range, and the skip and count options
+func (r *Repackager) Trim(m *hls.Media) {
+	r.trim(m, r.adbreak())
+}
+
+// trim is Trim with the ad spans tracked by ads, which carry on into
+// the segments of later reloads
+func (r *Repackager) trim(m *hls.Media, ads *adbreak) {
+	if r.Ads == AdSkip {
+		m.File = r.filterAD(ads, m.File...)
+	}
+	if r.Skip > 0 {
+		if r.Skip > len(m.File) {
+			m.File = m.File[:0]
+		} else {
+			m.File = m.File[r.Skip:]
+		}
+	}
+	if r.Count > 0 {
+		if r.Count < len(m.File) {
+			m.File = m.File[:r.Count]
+		}
+	}
+	if !r.Start.IsZero() || !r.End.IsZero() {
+		te := r.End
+		if te.IsZero() {
+			te = maxTime
+		}
+		p, q := selectrange(r.Start, te, m)
+		if r.Debug > 5 {
+			r.logf("select range t(%d,%d) -> s(%d,%d)\n", r.Start.Unix(), te.Unix(), p, q)
+		}
+		m.File = m.File[p:q]
+	}
+}
+
+// Playlist downloads and decodes the media playlist at uri
+func (r *Repackager) Playlist(uri string) (*hls.Media, error) {
+	uri = abspath(uri)
+	r.logf("%s\n", uri)
+	data, err := r.Download(uri)
+	if err != nil {
+		return nil, err
+	}
+	tags, _, err := hls.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	m, err := decodeMedia(tags, uri)
+	if err == nil {
+		r.keepLowLatency(m, tags)
+	}
+	return m, err
+}
+
+// decodeMedia decodes the tags of the media playlist found at url
+// and resolves its byte ranges
+func decodeMedia(tags []m3u.Tag, url string) (*hls.Media, error) {
+	m := &hls.Media{URL: url}
+	if err := m.DecodeTag(fixRange(tags)...); err != nil {
+		return m, err
+	}
+	return m, resolveRanges(m)
+}
+
+// cat concatenates the segments in p and remuxes them. The first error
+// from any segment fails the returned reader.
+func (r *Repackager) cat(info *Info, p *playlist) io.ReadCloser {
+	return r.remux(r.concat(info, p))
+}
+
+// concat concatenates the decrypted segments in p. With AdBlackout, ads
+// are replaced by content with the settings in info, unless it's nil.
+func (r *Repackager) concat(info *Info, p *playlist) (rc io.ReadCloser) {
+	m := p.m
+	var blackstream []byte
+	var err error
+	black := r.Ads == AdBlackout && info != nil
+	if black {
+		if r.ProbeBlackout {
+			info = r.probed(info, m)
+		}
+		blackstream, err = Blackout(info, m.Target)
+		if err != nil {
+			return failed(&MuxError{Cmd: "ffmpeg", Err: err})
+		}
+	}
+	outc := make(chan piece, r.Conns)
+	done := make(chan bool)
+	ads := r.adbreak()
+	p.done = done
+	go func() {
+		defer close(outc)
+		keyfile := ""
+		key, iv := "", ""
+		cenckey := "" // the sample key for fragmented mp4
+		send := func(rc io.ReadCloser) bool {
+			select {
+			case outc <- piece{rc, cenckey}:
+				return true
+			case <-done:
+				rc.Close()
+				return false
+			}
+		}
+		init, initrange := "", ""
+		masterurl := m.Path("")
+		for {
+			f, err := p.next()
+			if err == io.EOF || err == errStopped {
+				return
+			}
+			if err != nil {
+				send(failed(err))
+				return
+			}
+			if f.Key.Method == "NONE" {
+				keyfile, key, iv, cenckey = "", "", "", ""
+			}
+			if k := f.Key.URI; k != "" && k != keyfile && !r.NoDecrypt {
+				// get the key but only if its unique
+				keyfile = k
+				data, err := r.key(f.Key, f.Key.Path(masterurl))
+				if errors.Is(err, ErrUnknownKey) && f.Key.Method != "AES-128" {
+					// the samples may still have keys by key id
+					data, err = nil, nil
+				}
+				if err == nil && data != nil && len(data) != Blocksize {
+					err = &KeyError{URL: f.Key.Path(masterurl), Err: ErrKeySize}
+				}
+				if err != nil {
+					if ke := (*KeyError)(nil); !errors.As(err, &ke) {
+						err = &KeyError{URL: f.Key.Path(masterurl), Err: err}
+					}
+					send(failed(err))
+					return
+				}
+				key = string(data)
+				cenckey = ""
+				if f.Key.Method != "AES-128" {
+					cenckey = key
+				}
+			}
+			iv = f.Key.IV
+			blackout := black && ads.ad(f)
+			newinit := f.Map.Path(masterurl)
+			if newinit != "" && (newinit != init || f.Map.Byterange != initrange) && !r.NoInit && !blackout {
+				r.logf("streaming init segment: %s %s\n", newinit, MapRange(&f.Map))
+				initkey := key
+				if f.Key.Method != "AES-128" {
+					initkey = "" // only whole segment encryption covers the init
+				}
+				if !send(r.decryptInit(initkey, iv, r.stream(newinit, MapRange(&f.Map)))) {
+					return
+				}
+				init, initrange = newinit, f.Map.Byterange
+			}
+			var seg io.ReadCloser
+			if blackout {
+				init = ""
+				seg = r.filterFrag(io.NopCloser(bytes.NewReader(blackstream)), f.Duration(0))
+			} else {
+				if key != "" && r.Debug > 1 {
+					r.logf("keyfil=%q key=%x iv=%q\n", f.Key.Path(masterurl), key, iv)
+				}
+				seg = r.unlock(f.Key.Method, key, iv, r.stream(f.Path(masterurl), FileRange(f)))
+			}
+			if !send(seg) {
+				return
+			}
+		}
+	}()
+
+	pr, pw := io.Pipe()
+	go func() {
+		var err error
+		dec := mp4.NewDecrypter()
+		for out := range outc {
+			if err == nil {
+				if err = r.cenc(pw, out, dec); err != nil {
+					close(done)
+				}
+			}
+			out.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// Location resolves a relative segment path against the playlist's base
+func (r *Repackager) Location(u string) string {
+	return Resolve(r.base, u)
+}
+
+func (r *Repackager) logf(format string, v ...any) {
+	fmt.Fprintf(r.Log, format, v...)
+}
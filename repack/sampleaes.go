@@ -0,0 +1,450 @@
+package repack
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+	"io"
+
+	"github.com/as/hlscat/av"
+	"github.com/as/hlscat/ts"
+)
+
+// Stream types of the SAMPLE-AES elementary streams, and the clear
+// stream types they are rewritten to
+var sampleTypes = map[byte]byte{
+	0xdb: 0x1b, // h264
+	0xcf: 0x0f, // aac in adts
+	0xc1: 0x81, // ac-3
+	0xc2: 0x87, // e-ac-3
+}
+
+// sampleAES decrypts an mpeg ts segment encrypted with SAMPLE-AES. The
+// encrypted streams are reassembled into pes packets, decrypted and
+// packetized again, and the pmt is rewritten with their clear stream
+// types. Everything else, including fragmented mp4, is passed through.
+func (r *Repackager) sampleAES(key, iv string, src io.ReadCloser) io.ReadCloser {
+	if r.NoDecrypt || key == "" {
+		return src
+	}
+	block, ivb, err := cbcparams(key, iv)
+	if err != nil {
+		src.Close()
+		return failed(err)
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		defer src.Close()
+		d := &sampleDecrypter{
+			block: block,
+			iv:    ivb,
+			w:     bufio.NewWriterSize(pw, r.BufSize),
+			pmt:   map[int]bool{},
+			es:    map[int]*sampleStream{},
+		}
+		br := bufio.NewReaderSize(src, r.BufSize)
+		var err error
+		if p, _ := br.Peek(1); len(p) > 0 && p[0] != ts.SyncByte {
+			// fragmented mp4, decrypted later by cenc
+			_, err = io.Copy(d.w, br)
+		} else {
+			err = d.run(br)
+		}
+		if err == nil {
+			err = d.w.Flush()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+type sampleDecrypter struct {
+	block cipher.Block
+	iv    []byte
+	w     *bufio.Writer
+	pmt   map[int]bool
+	es    map[int]*sampleStream
+}
+
+// sampleStream is an encrypted elementary stream
+type sampleStream struct {
+	pid, typ int
+	af       []byte // adaptation field of the first packet, without stuffing
+	pes      []byte
+	cc       byte
+}
+
+func (d *sampleDecrypter) run(br *bufio.Reader) error {
+	var pkt [ts.PacketSize]byte
+	for {
+		if _, err := io.ReadFull(br, pkt[:]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return d.flushAll()
+			}
+			return err
+		}
+		if pkt[0] != ts.SyncByte {
+			return ts.ErrSync
+		}
+		if err := d.packet(pkt[:]); err != nil {
+			return err
+		}
+	}
+}
+
+func (d *sampleDecrypter) packet(p []byte) error {
+	start := p[1]&0x40 != 0
+	pid := int(p[1]&0x1f)<<8 | int(p[2])
+	afc := p[3] >> 4 & 3
+	payload := p[4:]
+	var af []byte
+	if afc&2 != 0 {
+		n := int(payload[0])
+		if 1+n > len(payload) {
+			return nil
+		}
+		af = payload[1 : 1+n]
+		payload = payload[1+n:]
+	}
+	switch {
+	case pid == 0 && start:
+		d.pat(payload)
+	case d.pmt[pid] && start:
+		d.pmtable(p, payload)
+	case d.es[pid] != nil:
+		st := d.es[pid]
+		if start {
+			if err := d.flush(st); err != nil {
+				return err
+			}
+			st.af = fields(af)
+			st.pes = []byte{}
+		}
+		if afc&1 != 0 && st.pes != nil {
+			st.pes = append(st.pes, payload...)
+		}
+		return nil
+	}
+	_, err := d.w.Write(p)
+	return err
+}
+
+func (d *sampleDecrypter) pat(p []byte) {
+	if p = psi(p); len(p) < 5 {
+		return
+	}
+	for p = p[5:]; len(p) >= 4; p = p[4:] {
+		if program := int(p[0])<<8 | int(p[1]); program != 0 {
+			d.pmt[int(p[2]&0x1f)<<8|int(p[3])] = true
+		}
+	}
+}
+
+// pmtable finds the encrypted streams in the pmt and rewrites the packet
+// with their clear stream types and without their descriptors, which
+// describe the encryption
+func (d *sampleDecrypter) pmtable(pkt, payload []byte) {
+	sec := psi(payload)
+	if len(sec) < 9 {
+		return
+	}
+	info := int(sec[7]&0x0f)<<8 | int(sec[8])
+	if 9+info > len(sec) {
+		return
+	}
+	body := append([]byte{}, sec[:9+info]...)
+	changed := false
+	for p := sec[9+info:]; len(p) >= 5; {
+		typ := p[0]
+		pid := int(p[1]&0x1f)<<8 | int(p[2])
+		n := int(p[3]&0x0f)<<8 | int(p[4])
+		if 5+n > len(p) {
+			return
+		}
+		if clear, ok := sampleTypes[typ]; ok {
+			if d.es[pid] == nil {
+				d.es[pid] = &sampleStream{pid: pid, typ: int(clear)}
+			}
+			body = append(body, clear, p[1], p[2], p[3]&0xf0, 0)
+			changed = true
+		} else {
+			body = append(body, p[:5+n]...)
+		}
+		p = p[5+n:]
+	}
+	if !changed {
+		return
+	}
+	// the table id and section length, then the body and a new crc
+	ptr := 1 + int(payload[0])
+	n := len(body) + 4
+	out := []byte{payload[ptr], payload[ptr+1]&0xf0 | byte(n>>8), byte(n)}
+	out = append(out, body...)
+	c := ts.CRC32(out)
+	out = append(out, byte(c>>24), byte(c>>16), byte(c>>8), byte(c))
+	hdr := len(pkt) - len(payload)
+	if hdr+ptr+len(out) > len(pkt) {
+		return
+	}
+	copy(pkt[hdr+ptr:], out)
+	for i := hdr + ptr + len(out); i < len(pkt); i++ {
+		pkt[i] = 0xff
+	}
+}
+
+// psi returns the body of the psi section at the start of a payload,
+// after the pointer field and the table header, and without the crc
+func psi(p []byte) []byte {
+	if len(p) < 1 || int(p[0])+4 > len(p) {
+		return nil
+	}
+	p = p[1+int(p[0]):]
+	n := int(p[1]&0x0f)<<8 | int(p[2])
+	p = p[3:]
+	if n < 4 || n > len(p) {
+		return nil
+	}
+	return p[:n-4]
+}
+
+// fields returns the adaptation field without its stuffing bytes
+func fields(af []byte) []byte {
+	if len(af) == 0 {
+		return nil
+	}
+	n := 1
+	flags := af[0]
+	if flags&0x10 != 0 {
+		n += 6 // pcr
+	}
+	if flags&0x08 != 0 {
+		n += 6 // opcr
+	}
+	if flags&0x04 != 0 {
+		n++ // splice countdown
+	}
+	if flags&0x02 != 0 && n < len(af) {
+		n += 1 + int(af[n]) // private data
+	}
+	if flags&0x01 != 0 && n < len(af) {
+		n += 1 + int(af[n]) // extension
+	}
+	if n > len(af) {
+		n = len(af)
+	}
+	return append([]byte{}, af[:n]...)
+}
+
+func (d *sampleDecrypter) flushAll() error {
+	for _, st := range d.es {
+		if err := d.flush(st); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flush decrypts the buffered pes packet and writes it out
+func (d *sampleDecrypter) flush(st *sampleStream) error {
+	pes := st.pes
+	st.pes = nil
+	if len(pes) < 9 || pes[0] != 0 || pes[1] != 0 || pes[2] != 1 {
+		return nil
+	}
+	hlen := 9 + int(pes[8])
+	if hlen > len(pes) {
+		return nil
+	}
+	if n := int(pes[4])<<8 | int(pes[5]); n != 0 && 6+n < len(pes) {
+		pes = pes[:6+n]
+	}
+	var data []byte
+	switch st.typ {
+	case 0x1b:
+		data = d.video(pes[hlen:])
+	case 0x0f:
+		data = d.adts(pes[hlen:])
+	default:
+		data = d.ac3(pes[hlen:])
+	}
+	pes = append(pes[:hlen:hlen], data...)
+	if pes[4] != 0 || pes[5] != 0 {
+		n := len(pes) - 6
+		if n > 0xffff {
+			n = 0
+		}
+		pes[4], pes[5] = byte(n>>8), byte(n)
+	}
+	return d.packetize(st, pes)
+}
+
+// packetize writes the pes packet as ts packets, giving the first one the
+// adaptation field of the packet that started it
+func (d *sampleDecrypter) packetize(st *sampleStream, pes []byte) error {
+	af := st.af
+	pusi := byte(0x40)
+	for len(pes) > 0 {
+		if af != nil || len(pes) < 184 {
+			switch {
+			case af == nil && len(pes) == 183:
+				af = []byte{}
+			case af == nil:
+				af = []byte{0}
+			}
+			for 1+len(af)+len(pes) < 184 {
+				af = append(af, 0xff)
+			}
+		}
+		pkt := []byte{ts.SyncByte, pusi | byte(st.pid>>8)&0x1f, byte(st.pid), 0x10 | st.cc}
+		if af != nil {
+			pkt[3] |= 0x20
+			pkt = append(pkt, byte(len(af)))
+			pkt = append(pkt, af...)
+		}
+		n := ts.PacketSize - len(pkt)
+		if n > len(pes) {
+			n = len(pes)
+		}
+		pkt = append(pkt, pes[:n]...)
+		if _, err := d.w.Write(pkt); err != nil {
+			return err
+		}
+		pes = pes[n:]
+		st.cc = (st.cc + 1) & 0xf
+		af, pusi = nil, 0
+	}
+	return nil
+}
+
+// video decrypts the slices in an annex b access unit. Each slice longer
+// than 48 bytes has a clear leader of 32 bytes, followed by a pattern of
+// one encrypted block and up to nine clear ones. The emulation prevention
+// bytes were inserted after encryption and are removed first.
+func (d *sampleDecrypter) video(data []byte) []byte {
+	var out []byte
+	for _, nal := range av.SplitAnnexB(data) {
+		out = append(out, 0, 0, 0, 1)
+		if len(nal) == 0 {
+			continue
+		}
+		if t := nal[0] & 0x1f; (t != av.H264IDR && t != 1) || len(nal) <= 48 {
+			out = append(out, nal...)
+			continue
+		}
+		nal = unescape(nal)
+		cbc := cipher.NewCBCDecrypter(d.block, d.iv)
+		for p := nal[32:]; len(p) > 0; {
+			if len(p) > 16 {
+				cbc.CryptBlocks(p[:16], p[:16])
+				p = p[16:]
+			}
+			p = p[min(144, len(p)):]
+		}
+		out = append(out, nal...)
+	}
+	return out
+}
+
+// unescape removes the emulation prevention bytes from a nal unit
+func unescape(nal []byte) []byte {
+	out := make([]byte, 0, len(nal))
+	for i := 0; i < len(nal); i++ {
+		if i+3 < len(nal) && nal[i] == 0 && nal[i+1] == 0 && nal[i+2] == 3 {
+			out = append(out, 0, 0)
+			i += 2
+			continue
+		}
+		out = append(out, nal[i])
+	}
+	return out
+}
+
+// adts decrypts the aac frames in data. Each frame has the header and
+// the next 16 bytes in the clear, then the whole blocks are encrypted
+// and the rest is clear.
+func (d *sampleDecrypter) adts(data []byte) []byte {
+	for p := data; len(p) > 0; {
+		h, err := av.ParseADTS(p)
+		if err != nil || h.FrameLen > len(p) {
+			break
+		}
+		d.frame(p[h.HeaderLen:h.FrameLen])
+		p = p[h.FrameLen:]
+	}
+	return data
+}
+
+// ac3 decrypts the ac-3 or e-ac-3 sync frames in data, which have their
+// first 16 bytes in the clear
+func (d *sampleDecrypter) ac3(data []byte) []byte {
+	for p := data; len(p) >= 6; {
+		n := ac3size(p)
+		if n <= 0 || n > len(p) {
+			break
+		}
+		d.frame(p[:n])
+		p = p[n:]
+	}
+	return data
+}
+
+func (d *sampleDecrypter) frame(p []byte) {
+	if len(p) < 16 {
+		return
+	}
+	p = p[16:]
+	p = p[:len(p)/16*16]
+	cipher.NewCBCDecrypter(d.block, d.iv).CryptBlocks(p, p)
+}
+
+// ac3size returns the length of the sync frame at the start of p
+func ac3size(p []byte) int {
+	if p[0] != 0x0b || p[1] != 0x77 {
+		return -1
+	}
+	if bsid := p[5] >> 3; bsid > 10 {
+		// e-ac-3
+		return (int(p[2]&7)<<8 | int(p[3]) + 1) * 2
+	}
+	fscod, frmsizecod := int(p[4]>>6), int(p[4]&0x3f)
+	if fscod > 2 || frmsizecod >= len(ac3words) {
+		return -1
+	}
+	return ac3words[frmsizecod][fscod] * 2
+}
+
+// ac3words is the ac-3 frame size in 16-bit words for each frmsizecod,
+// at 48, 44.1 and 32 kHz
+var ac3words = [...][3]int{
+	{64, 69, 96}, {64, 70, 96}, {80, 87, 120}, {80, 88, 120},
+	{96, 104, 144}, {96, 105, 144}, {112, 121, 168}, {112, 122, 168},
+	{128, 139, 192}, {128, 140, 192}, {160, 174, 240}, {160, 175, 240},
+	{192, 208, 288}, {192, 209, 288}, {224, 243, 336}, {224, 244, 336},
+	{256, 278, 384}, {256, 279, 384}, {320, 348, 480}, {320, 349, 480},
+	{384, 417, 576}, {384, 418, 576}, {448, 487, 672}, {448, 488, 672},
+	{512, 557, 768}, {512, 558, 768}, {640, 696, 960}, {640, 697, 960},
+	{768, 835, 1152}, {768, 836, 1152}, {896, 975, 1344}, {896, 976, 1344},
+	{1024, 1114, 1536}, {1024, 1115, 1536}, {1152, 1253, 1728}, {1152, 1254, 1728},
+	{1280, 1393, 1920}, {1280, 1394, 1920},
+}
+
+// cbcparams returns the cipher and iv for a key and its hex iv, which
+// is zero if empty
+func cbcparams(key, iv string) (cipher.Block, []byte, error) {
+	block, err := aes.NewCipher([]byte(key))
+	if err != nil {
+		return nil, nil, &KeyError{Err: err}
+	}
+	ivb, err := unhex(iv)
+	if err != nil {
+		return nil, nil, &KeyError{Err: err}
+	}
+	if len(ivb) == 0 {
+		ivb = make([]byte, Blocksize)
+	}
+	if len(ivb) != Blocksize {
+		return nil, nil, &KeyError{Err: fmt.Errorf("bad iv length: %d", len(ivb))}
+	}
+	return block, ivb, nil
+}
@@ -0,0 +1,276 @@
+package repack
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"io"
+	"testing"
+
+	"github.com/as/hlscat/av"
+	"github.com/as/hlscat/ts"
+)
+
+// the pids of the sample stream
+const (
+	pmtPID   = 0x1000
+	videoPID = 0x100
+	aacPID   = 0x101
+	ac3PID   = 0x102
+	id3PID   = 0x103
+)
+
+var sampleIV = []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// tsmux writes ts packets, counting continuity per pid
+type tsmux struct {
+	bytes.Buffer
+	cc map[int]byte
+}
+
+// section writes a psi section in one packet
+func (m *tsmux) section(pid int, table byte, body []byte) {
+	n := len(body) + 4
+	sec := append([]byte{table, 0xb0 | byte(n>>8), byte(n)}, body...)
+	c := ts.CRC32(sec)
+	sec = append(sec, byte(c>>24), byte(c>>16), byte(c>>8), byte(c))
+	p := append([]byte{ts.SyncByte, 0x40 | byte(pid>>8), byte(pid), 0x10 | m.cc[pid], 0}, sec...)
+	m.cc[pid] = (m.cc[pid] + 1) & 0xf
+	m.Write(append(p, bytes.Repeat([]byte{0xff}, ts.PacketSize-len(p))...))
+}
+
+// pes writes a pes packet, with the adaptation field in its first ts
+// packet and stuffing in its last
+func (m *tsmux) pes(pid int, af, pes []byte) {
+	for pusi := byte(0x40); len(pes) > 0; pusi = 0 {
+		p := []byte{ts.SyncByte, pusi | byte(pid>>8), byte(pid), 0x10 | m.cc[pid]}
+		m.cc[pid] = (m.cc[pid] + 1) & 0xf
+		if af != nil || len(pes) < ts.PacketSize-4 {
+			if af == nil {
+				af = []byte{0}
+			}
+			for 5+len(af)+len(pes) < ts.PacketSize {
+				af = append(af, 0xff)
+			}
+			p[3] |= 0x20
+			p = append(append(p, byte(len(af))), af...)
+		}
+		n := min(ts.PacketSize-len(p), len(pes))
+		m.Write(append(p, pes[:n]...))
+		pes, af = pes[n:], nil
+	}
+}
+
+// pesPacket returns a pes packet with a pts of zero
+func pesPacket(sid byte, data []byte) []byte {
+	h := []byte{0, 0, 1, sid, 0, 0, 0x80, 0x80, 5, 0x21, 0, 1, 0, 1}
+	n := len(h) - 6 + len(data)
+	h[4], h[5] = byte(n>>8), byte(n)
+	return append(h, data...)
+}
+
+// pattern returns n bytes of filler without any zeros
+func pattern(n, seed int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte((i*7+seed)%255 + 1)
+	}
+	return b
+}
+
+// escape inserts emulation prevention bytes into a nal unit
+func escape(nal []byte) (out []byte) {
+	zeros := 0
+	for _, c := range nal {
+		if zeros >= 2 && c <= 3 {
+			out = append(out, 3)
+			zeros = 0
+		}
+		out = append(out, c)
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return out
+}
+
+// sampleEncrypt encrypts the clear elementary streams per the
+// SAMPLE-AES spec, the inverse of the sampleDecrypter
+type sampleEncrypt struct {
+	block cipher.Block
+}
+
+func (e sampleEncrypt) video(nal [][]byte) []byte {
+	var out []byte
+	for _, nal := range nal {
+		nal = append([]byte{}, nal...)
+		if t := nal[0] & 0x1f; (t == av.H264IDR || t == 1) && len(nal) > 48 {
+			cbc := cipher.NewCBCEncrypter(e.block, sampleIV)
+			for p := nal[32:]; len(p) > 0; {
+				if len(p) > 16 {
+					cbc.CryptBlocks(p[:16], p[:16])
+					p = p[16:]
+				}
+				p = p[min(144, len(p)):]
+			}
+			nal = escape(nal)
+		}
+		out = append(out, av.JoinAnnexB(nal)...)
+	}
+	return out
+}
+
+// frames encrypts each frame after its header and a clear leader of
+// 16 bytes, leaving the last partial block, and frames too short to
+// have any blocks, clear
+func (e sampleEncrypt) frames(hdr int, frames ...[]byte) []byte {
+	var out []byte
+	for _, f := range frames {
+		f = append([]byte{}, f...)
+		if len(f) > hdr+16 {
+			p := f[hdr+16:]
+			p = p[:len(p)/16*16]
+			cipher.NewCBCEncrypter(e.block, sampleIV).CryptBlocks(p, p)
+		}
+		out = append(out, f...)
+	}
+	return out
+}
+
+// adtsFrame returns an aac frame of n bytes of payload
+func adtsFrame(n, seed int) []byte {
+	n += 7
+	h := []byte{0xff, 0xf1, 1<<6 | 3<<2, 2<<6 | byte(n>>11), byte(n >> 3), byte(n<<5 | 0x1f), 0xfc}
+	return append(h, pattern(n-7, seed)...)
+}
+
+// ac3Frame returns a 48kHz ac-3 sync frame of 128 bytes
+func ac3Frame(seed int) []byte {
+	return append([]byte{0x0b, 0x77, 0x12, 0x34, 0, 8 << 3}, pattern(122, seed)...)
+}
+
+func TestSampleAES(t *testing.T) {
+	block, err := aes.NewCipher(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := sampleEncrypt{block}
+
+	// an idr slice with emulation prevention in its clear leader and in a
+	// clear block, an sei that's never encrypted, and a slice too short
+	// to be
+	idr := pattern(400, 1)
+	idr[0] = 0x65
+	copy(idr[8:], []byte{0, 0, 3, 1})
+	copy(idr[32+16+10:], []byte{0, 0, 3, 2})
+	nals := [][]byte{{0x09, 0xf0}, append([]byte{0x06}, pattern(60, 2)...), idr, append([]byte{0x41}, pattern(40, 3)...)}
+	aac := [][]byte{adtsFrame(100, 4), adtsFrame(40, 5), adtsFrame(10, 6)}
+	ac3 := [][]byte{ac3Frame(7), ac3Frame(8)}
+
+	clear := map[int][]byte{
+		videoPID: pesPacket(0xe0, av.JoinAnnexB(nals...)),
+		aacPID:   pesPacket(0xc0, bytes.Join(aac, nil)),
+		ac3PID:   pesPacket(0xbd, bytes.Join(ac3, nil)),
+		id3PID:   pesPacket(0xbd, []byte("ID3 metadata")),
+	}
+	encrypted := map[int][]byte{
+		videoPID: pesPacket(0xe0, e.video(nals)),
+		aacPID:   pesPacket(0xc0, e.frames(7, aac...)),
+		ac3PID:   pesPacket(0xbd, e.frames(0, ac3...)),
+		id3PID:   clear[id3PID],
+	}
+	if bytes.Equal(clear[videoPID], encrypted[videoPID]) || bytes.Equal(clear[aacPID], encrypted[aacPID]) {
+		t.Fatal("nothing encrypted")
+	}
+
+	id3 := []byte{0x26, 0x0d, 0xff, 0xff, 0x49, 0x44, 0x33, 0xff, 0x49, 0x44, 0x33, 0x00, 0x0f}
+	desc := func(s string) []byte { return append([]byte{0x0f, 4}, s...) }
+	stream := func(typ byte, pid int, desc []byte) []byte {
+		return append([]byte{typ, 0xe0 | byte(pid>>8), byte(pid), 0xf0, byte(len(desc))}, desc...)
+	}
+	program := []byte{0, 1, 0xc1, 0, 0, 0xe0 | videoPID>>8, videoPID & 0xff, 0xf0, 0}
+	pmt := bytes.Join([][]byte{
+		program,
+		stream(0xdb, videoPID, desc("zavc")),
+		stream(0xcf, aacPID, desc("aacd")),
+		stream(0xc1, ac3PID, desc("ac3d")),
+		stream(0x15, id3PID, id3),
+	}, nil)
+
+	m := &tsmux{cc: map[int]byte{}}
+	m.section(0, 0, []byte{0, 1, 0xc1, 0, 0, 0, 1, 0xe0 | pmtPID>>8, pmtPID & 0xff})
+	m.section(pmtPID, 2, pmt)
+	pcr := []byte{0x50, 0, 0, 0, 0, 0x7e, 0}
+	m.pes(videoPID, pcr, encrypted[videoPID])
+	m.pes(aacPID, nil, encrypted[aacPID])
+	m.pes(ac3PID, nil, encrypted[ac3PID])
+	m.pes(id3PID, nil, encrypted[id3PID])
+
+	r := New(Options{})
+	rc := r.sampleAES(string(testKey), "0x"+hex.EncodeToString(sampleIV), io.NopCloser(&m.Buffer))
+	out, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out)%ts.PacketSize != 0 {
+		t.Fatalf("%d bytes, not whole packets", len(out))
+	}
+
+	// the pmt has the clear stream types, without the descriptors of the
+	// encrypted ones, and a crc that matches
+	wantPMT := bytes.Join([][]byte{
+		program,
+		stream(0x1b, videoPID, nil),
+		stream(0x0f, aacPID, nil),
+		stream(0x81, ac3PID, nil),
+		stream(0x15, id3PID, id3),
+	}, nil)
+	got := map[int][]byte{}
+	first := map[int][]byte{}
+	cc := map[int]int{}
+	for p := out; len(p) > 0; p = p[ts.PacketSize:] {
+		pkt := p[:ts.PacketSize]
+		if pkt[0] != ts.SyncByte {
+			t.Fatalf("lost sync: %x", pkt[:4])
+		}
+		pid := int(pkt[1]&0x1f)<<8 | int(pkt[2])
+		if last, ok := cc[pid]; ok && int(pkt[3]&0xf) != (last+1)&0xf {
+			t.Errorf("pid %#x: continuity counter %d after %d", pid, pkt[3]&0xf, last)
+		}
+		cc[pid] = int(pkt[3] & 0xf)
+		payload := pkt[4:]
+		var af []byte
+		if pkt[3]&0x20 != 0 {
+			af, payload = payload[1:1+payload[0]], payload[1+payload[0]:]
+		}
+		switch {
+		case pid == pmtPID:
+			sec := payload[1+payload[0]:]
+			n := int(sec[1]&0x0f)<<8 | int(sec[2])
+			sec = sec[:3+n]
+			if body := sec[3 : len(sec)-4]; !bytes.Equal(body, wantPMT) {
+				t.Errorf("pmt:\n%x\nwant:\n%x", body, wantPMT)
+			}
+			c := ts.CRC32(sec[:len(sec)-4])
+			if crc := sec[len(sec)-4:]; !bytes.Equal(crc, []byte{byte(c >> 24), byte(c >> 16), byte(c >> 8), byte(c)}) {
+				t.Errorf("pmt crc %x, want %08x", crc, c)
+			}
+		case pid != 0:
+			if pkt[1]&0x40 != 0 {
+				first[pid] = af
+			}
+			got[pid] = append(got[pid], payload...)
+		}
+	}
+	if !bytes.HasPrefix(first[videoPID], pcr) {
+		t.Errorf("video adaptation field %x, want the pcr %x", first[videoPID], pcr)
+	}
+	for pid, name := range map[int]string{videoPID: "h264", aacPID: "aac", ac3PID: "ac-3", id3PID: "id3"} {
+		if !bytes.Equal(got[pid], clear[pid]) {
+			t.Errorf("%s:\n%x\nwant:\n%x", name, got[pid], clear[pid])
+		}
+	}
+}
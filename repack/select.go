@@ -0,0 +1,89 @@
+package repack
+
+import (
+	"time"
+
+	"github.com/as/hls"
+)
+
+var maxTime = time.Unix(1<<63-62135596801, 999999999)
+var minTime = time.Unix(0, 0)
+
+func quantifyV(s *hls.StreamInfo) (q int) {
+	bw := s.Bandwidth
+	if bw == 0 {
+		bw = s.BandwidthAvg
+	}
+	if bw == 0 {
+		bw = 1
+	}
+	pix := s.Resolution.X * s.Resolution.Y
+	return bw * pix
+}
+
+// best returns the index of the variant in m chosen by Options.Policy,
+// or without a policy, the one with the highest bandwidth times
+// resolution
+func (r *Repackager) best(m *hls.Master) (int, error) {
+	if len(m.Stream) == 0 {
+		return 0, ErrNoStreams
+	}
+	if r.Policy != nil {
+		return r.Policy.choose(m, r.logf)
+	}
+	best, bestq := 0, 0
+	for i := range m.Stream {
+		if q := quantifyV(&m.Stream[i]); q > bestq {
+			best, bestq = i, q
+		}
+	}
+	return best, nil
+}
+
+// Select returns the media playlists for the best variant in m and its
+// audio rendition, chosen by Options.Audio. Both are the same playlist if
+// the audio isn't separate.
+func (r *Repackager) Select(m *hls.Master) (v *hls.Media, a *hls.Media, err error) {
+	b, err := r.best(m)
+	if err != nil {
+		return nil, nil, err
+	}
+	si := &m.Stream[b]
+	parent := m.Path("")
+	v, err = r.Playlist(si.Path(parent))
+	if err != nil {
+		return nil, nil, err
+	}
+	if mi := r.audio(m, si); mi != nil && mi.URI != "" {
+		a, err = r.Playlist(mi.Path(parent))
+		return v, a, err
+	}
+	return v, v, nil
+}
+
+func selectrange(s, e time.Time, m *hls.Media) (p, q int) {
+	p, now := findtime(0, minTime, s, m)
+	q, now = findtime(p, now, e, m)
+	return p, q
+}
+
+func findtime(n int, now, t time.Time, m *hls.Media) (int, time.Time) {
+	for ; n < len(m.File); n++ {
+		now = timeof(now, m, n)
+		if !now.Add(m.File[n].Duration(0) / 2).Before(t) {
+			break
+		}
+	}
+	return n, now
+}
+
+func timeof(prev time.Time, m *hls.Media, i int) (after time.Time) {
+	t := m.File[i].Time
+	if !t.IsZero() {
+		return t
+	}
+	if i > 0 {
+		return prev.Add(m.File[i-1].Duration(0))
+	}
+	return prev
+}
@@ -0,0 +1,230 @@
+package repack
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/as/hls"
+	"github.com/as/hlscat/av"
+	"github.com/as/hlscat/vtt"
+)
+
+// SelectSubtitles returns the media playlist of the subtitle rendition
+// of the best variant in m: the DEFAULT one in its SUBTITLES group, or
+// else the first one in the group. Without a group, any subtitle
+// rendition is taken.
+func (r *Repackager) SelectSubtitles(m *hls.Master) (*hls.Media, error) {
+	b, err := r.best(m)
+	if err != nil {
+		return nil, err
+	}
+	si := &m.Stream[b]
+	var sub *hls.MediaInfo
+	for i := range m.Media {
+		mi := &m.Media[i]
+		if mi.Type != "SUBTITLES" || mi.URI == "" || si.Subtitle != "" && mi.Group != si.Subtitle {
+			continue
+		}
+		if sub == nil || mi.Default && !sub.Default {
+			sub = mi
+		}
+	}
+	if sub == nil {
+		return nil, ErrNoSubtitles
+	}
+	r.logf("hls subtitles: %s %s %s\n", sub.Lang, sub.Name, sub.Path(m.Path("")))
+	return r.Playlist(sub.Path(m.Path("")))
+}
+
+// Subtitles returns the cues of the WebVTT segments in m as one file, in
+// WebVTT or, if format is "srt", SubRip. Cue times follow the
+// X-TIMESTAMP-MAP of the segments and start from zero at the first
+// presentation time of the repackaged video, so they line up with it.
+// Without the video, or if its start can't be found, they start at the
+// MPEG-TS time of the first map instead.
+func (r *Repackager) Subtitles(m, video *hls.Media, format string) io.ReadCloser {
+	if err := resolveRanges(m); err != nil {
+		return failed(err)
+	}
+	origin := r.origin(video)
+	src := r.concat(&r.Proto, r.open(m))
+	pr, pw := io.Pipe()
+	go func() {
+		defer src.Close()
+		in := vtt.NewReader(src)
+		out := vtt.NewWriter(pw)
+		if format == "srt" {
+			out = vtt.NewSRTWriter(pw)
+		}
+		for {
+			c, err := in.ReadCue()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			if origin < 0 {
+				origin = in.Origin()
+			}
+			if c.End <= origin {
+				continue
+			}
+			c.Start -= origin
+			c.End -= origin
+			if err = out.WriteCue(c); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.CloseWithError(out.Close())
+	}()
+	return pr
+}
+
+// writeSubtitles repackages the WebVTT segments in m into dir, like
+// WriteMedia: one segment for each segment in m, holding the cues shown
+// during it, and the media playlist index.m3u8, which is returned. Cue
+// times start from zero, as in Subtitles, and are mapped to the MPEG-TS
+// time where the repackaged video starts. Ready is called once the
+// playlist is first written, and closing stop stops following a live
+// playlist.
+func (r *Repackager) writeSubtitles(dir string, m, video *hls.Media, ready func(), stop <-chan bool) (*hls.Media, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := resolveRanges(m); err != nil {
+		return nil, err
+	}
+	p := r.open(m)
+	p.stop = stop
+	s := r.segmenter(dir, "vtt", p)
+	s.ready = ready
+	if r.Follow {
+		s.update = func() error { return s.playlist(false) }
+	}
+	origin := r.origin(video)
+	src := r.concat(&r.Proto, p)
+	defer src.Close()
+	in := vtt.NewReader(src)
+	var (
+		cues []vtt.Cue // that haven't ended by t
+		t    int64     // where segment s.n starts, in milliseconds
+	)
+	for {
+		c, err := in.ReadCue()
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if origin < 0 {
+			origin = in.Origin()
+		}
+		c.Start -= origin
+		c.End -= origin
+
+		// the segments that end before the cue starts are complete
+		for {
+			f, ok := s.p.segment(s.n)
+			end := t + f.Duration(0).Milliseconds()
+			if !ok || err == nil && c.Start < end {
+				break
+			}
+			if err := s.cues(f, origin, t, end, cues); err != nil {
+				return nil, err
+			}
+			live := cues[:0]
+			for _, c := range cues {
+				if c.End > end {
+					live = append(live, c)
+				}
+			}
+			cues, t = live, end
+		}
+		if err == io.EOF {
+			break
+		}
+		if c.End > 0 {
+			cues = append(cues, c)
+		}
+	}
+	return &s.out, s.playlist(true)
+}
+
+// cues writes the cues shown from t to end, in milliseconds, as the
+// segment cut from f. Origin is the MPEG-TS time of zero, in
+// milliseconds.
+func (s *segmenter) cues(f hls.File, origin, t, end int64, cues []vtt.Cue) error {
+	var b bytes.Buffer
+	w := vtt.NewWriter(&b)
+	w.Header = []string{fmt.Sprintf("X-TIMESTAMP-MAP=MPEGTS:%d,LOCAL:00:00:00.000", max(origin, 0)*90)}
+	for _, c := range cues {
+		if c.Start < end && c.End > t {
+			if err := w.WriteCue(c); err != nil {
+				return err
+			}
+		}
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return s.add(hls.File{Inf: hls.Inf{URL: fmt.Sprintf("seg%d.vtt", s.n), Duration: f.Duration(0)}}, b.Bytes())
+}
+
+// origin returns where the repackaged video of m starts, in
+// milliseconds on the MPEG-TS clock, or -1 if m is nil or its start
+// can't be found
+func (r *Repackager) origin(m *hls.Media) int64 {
+	if m == nil {
+		return -1
+	}
+	t, err := r.start(m)
+	if err != nil {
+		r.logf("subtitles: %v: starting at their own timestamps\n", err)
+		return -1
+	}
+	return t
+}
+
+// start returns the first presentation time of the repackaged video of
+// m, in milliseconds: the earliest of the video track in the first
+// segment kept, or of the first track if there's no video
+func (r *Repackager) start(m *hls.Media) (int64, error) {
+	if err := resolveRanges(m); err != nil {
+		return 0, err
+	}
+	p := r.open(m)
+	p.live = false
+	if len(p.file) == 0 {
+		return 0, ErrNoSegments
+	}
+	p.file = p.file[:1]
+	rc := r.concat(nil, p)
+	defer rc.Close()
+	dmx := r.demuxer(rc)
+	first := map[int]int64{}
+	for {
+		s, err := dmx.ReadSample()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		if t, ok := first[s.Track]; !ok || s.PTS < t {
+			first[s.Track] = s.PTS
+		}
+	}
+	var lead *av.Track
+	for _, t := range dmx.Tracks() {
+		if _, ok := first[t.ID]; ok && (lead == nil || t.Kind == av.Video && lead.Kind != av.Video) {
+			lead = t
+		}
+	}
+	if lead == nil {
+		return 0, av.ErrNoTracks
+	}
+	return av.Rescale(first[lead.ID], int64(lead.Timescale), vtt.Timescale), nil
+}
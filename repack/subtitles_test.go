@@ -0,0 +1,139 @@
+package repack
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/as/hls"
+	"github.com/as/hlscat/av"
+	"github.com/as/hlscat/ts"
+)
+
+// files serves the files in a map by the base of their uri
+type files map[string]string
+
+func (f files) Fetch(ctx context.Context, u string, rng ByteRange) (io.ReadCloser, error) {
+	content, ok := f[u[strings.LastIndex(u, "/")+1:]]
+	if !ok {
+		return nil, &FetchError{URL: u, Status: 404}
+	}
+	return io.NopCloser(strings.NewReader(content)), nil
+}
+
+func TestWriteSubtitles(t *testing.T) {
+	src := files{
+		"a.vtt": "WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:900000,LOCAL:00:00:00.000\n\n00:00:00.500 --> 00:00:01.000\nfirst\n\n00:00:01.500 --> 00:00:02.500\nacross\n",
+		"b.vtt": "WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:900000,LOCAL:00:00:00.000\n\n00:00:01.500 --> 00:00:02.500\nacross\n\n00:00:03.000 --> 00:00:03.500\nlast\n",
+		"c.vtt": "WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:900000,LOCAL:00:00:00.000\n",
+	}
+	m, _ := decodePlaylist(t, "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXTINF:2,\na.vtt\n#EXTINF:2,\nb.vtt\n#EXTINF:2,\nc.vtt\n#EXT-X-ENDLIST\n")
+	dir := t.TempDir()
+	out, err := New(Options{Fetcher: src}).writeSubtitles(dir, m, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// without the video, zero is the time of the first map
+	const header = "WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:900000,LOCAL:00:00:00.000\n\n"
+	want := []string{
+		header + "00:00:00.500 --> 00:00:01.000\nfirst\n\n00:00:01.500 --> 00:00:02.500\nacross\n\n",
+		header + "00:00:01.500 --> 00:00:02.500\nacross\n\n00:00:03.000 --> 00:00:03.500\nlast\n\n",
+		header,
+	}
+	if len(out.File) != len(want) {
+		t.Fatalf("%d segments, want %d", len(out.File), len(want))
+	}
+	for i, f := range out.File {
+		if f.Inf.Duration != m.File[i].Inf.Duration {
+			t.Errorf("%s: duration %s, want %s", f.Inf.URL, f.Inf.Duration, m.File[i].Inf.Duration)
+		}
+		got, err := os.ReadFile(filepath.Join(dir, f.Inf.URL))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want[i] {
+			t.Errorf("%s:\n%s\nwant:\n%s", f.Inf.URL, got, want[i])
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "index.m3u8")); err != nil {
+		t.Error(err)
+	}
+}
+
+// videoAt returns an mpeg ts segment of h264 whose first frame is
+// presented at pts, after one that's decoded before it
+func videoAt(t *testing.T, pts int64) string {
+	t.Helper()
+	cfg, err := av.AVCConfig([][]byte{probeSPS}, [][]byte{probePPS})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	w := ts.NewWriter(&b)
+	if err := w.WriteHeader(&av.Track{ID: 1, Kind: av.Video, Codec: "h264", Timescale: 90000, Config: cfg}); err != nil {
+		t.Fatal(err)
+	}
+	// I P B, in decode order
+	for i, d := range []int64{1, 3, 0} {
+		nal := []byte{0x41, 0x9a, byte(i)}
+		if i == 0 {
+			nal = []byte{0x65, 0x88, 0x84}
+		}
+		s := av.Sample{Track: 1, DTS: pts - 3600 + int64(i)*3600, PTS: pts + d*3600, Dur: 3600, Key: i == 0, Data: av.JoinAVCC(nal)}
+		if err := w.WriteSample(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+func TestSubtitlesVideoStart(t *testing.T) {
+	// the subtitles are mapped to 8s, and the video starts at 9s
+	src := files{
+		"a.vtt": "WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:720000,LOCAL:00:00:00.000\n\n00:00:00.000 --> 00:00:00.900\nbefore\n\n00:00:00.500 --> 00:00:01.500\nacross\n\n00:00:02.000 --> 00:00:03.000\nafter\n",
+		"v.ts":  videoAt(t, 810000),
+	}
+	m, _ := decodePlaylist(t, "#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXTINF:4,\na.vtt\n#EXT-X-ENDLIST\n")
+	video, _ := decodePlaylist(t, "#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXTINF:4,\nv.ts\n#EXT-X-ENDLIST\n")
+	r := New(Options{Fetcher: src})
+
+	for _, tc := range []struct {
+		video *hls.Media
+		want  string
+	}{
+		{video, "1\n00:00:00,000 --> 00:00:00,500\nacross\n\n2\n00:00:01,000 --> 00:00:02,000\nafter\n\n"},
+		// from the first map without the video
+		{nil, "1\n00:00:00,000 --> 00:00:00,900\nbefore\n\n2\n00:00:00,500 --> 00:00:01,500\nacross\n\n3\n00:00:02,000 --> 00:00:03,000\nafter\n\n"},
+	} {
+		rc := r.Subtitles(m, tc.video, "srt")
+		got, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tc.want {
+			t.Errorf("video %v:\n%s\nwant:\n%s", tc.video != nil, got, tc.want)
+		}
+	}
+
+	dir := t.TempDir()
+	out, err := r.writeSubtitles(dir, m, video, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(dir, out.File[0].Inf.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const want = "WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:810000,LOCAL:00:00:00.000\n\n00:00:00.000 --> 00:00:00.500\nacross\n\n00:00:01.000 --> 00:00:02.000\nafter\n\n"
+	if string(got) != want {
+		t.Errorf("segment:\n%s\nwant:\n%s", got, want)
+	}
+}
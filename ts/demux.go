@@ -0,0 +1,479 @@
+// Package ts demultiplexes MPEG transport streams into av samples
+package ts
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+
+	"github.com/as/hlscat/av"
+)
+
+const (
+	PacketSize = 188
+	SyncByte   = 0x47
+	Clock      = 90000
+)
+
+// Elementary stream types carried in the PMT
+const (
+	TypeAAC  = 0x0f
+	TypeH264 = 0x1b
+	TypeH265 = 0x24
+)
+
+var ErrSync = errors.New("ts: lost sync")
+
+// MaxJump is the largest gap between two consecutive timestamps on the
+// same stream that is not treated as a discontinuity. Concatenated
+// segments that restart or skip their clocks are stitched back together
+// so the output remains continuous.
+var MaxJump = int64(2 * Clock)
+
+// Reader is an av.Demuxer for a transport stream, or any number of
+// transport stream segments concatenated together
+type Reader struct {
+	r      *bufio.Reader
+	pkt    [PacketSize]byte
+	pmt    map[int]bool
+	es     map[int]*stream
+	tracks []*av.Track
+	out    []av.Sample
+	offset int64 // added to every timestamp, in Clock units
+	eof    bool
+}
+
+type stream struct {
+	pid, typ int
+	track    *av.Track
+	pes      []byte
+	rai      bool // random access indicator seen in the current pes
+
+	vps, sps, pps [][]byte
+	changed       bool // the parameter sets differ from the track's Config
+
+	held *av.Sample // the last video sample, until its duration is known
+
+	last, dur int64 // last decode time and duration, in Clock units
+	next      int64 // expected next audio time, in track units
+}
+
+// NewReader returns a Reader that demuxes the transport stream in r
+func NewReader(r io.Reader) *Reader {
+	return &Reader{
+		r:   bufio.NewReaderSize(r, 64*PacketSize),
+		pmt: map[int]bool{},
+		es:  map[int]*stream{},
+	}
+}
+
+// Tracks returns the tracks declared in the PMTs read so far
+func (d *Reader) Tracks() []*av.Track {
+	return d.tracks
+}
+
+// ReadSample returns the next sample in the stream
+func (d *Reader) ReadSample() (s av.Sample, err error) {
+	for len(d.out) == 0 {
+		if d.eof {
+			return s, io.EOF
+		}
+		if err = d.packet(); err == io.EOF {
+			d.eof = true
+			for _, st := range d.es {
+				d.flush(st)
+				d.release(st)
+			}
+		} else if err != nil {
+			return s, err
+		}
+	}
+	s, d.out = d.out[0], d.out[1:]
+	return s, nil
+}
+
+func (d *Reader) packet() error {
+	if err := d.sync(); err != nil {
+		return err
+	}
+	p := d.pkt[:]
+	start := p[1]&0x40 != 0
+	pid := int(p[1]&0x1f)<<8 | int(p[2])
+	afc := p[3] >> 4 & 3
+	payload := p[4:]
+	rai := false
+	if afc&2 != 0 {
+		n := int(payload[0])
+		if n > 0 && n < len(payload) {
+			rai = payload[1]&0x40 != 0
+		}
+		if 1+n > len(payload) {
+			return nil
+		}
+		payload = payload[1+n:]
+	}
+	if afc&1 == 0 {
+		return nil
+	}
+	switch {
+	case pid == 0:
+		if start {
+			d.pat(payload)
+		}
+	case d.pmt[pid]:
+		if start {
+			d.pmtable(payload)
+		}
+	default:
+		st := d.es[pid]
+		if st == nil {
+			return nil
+		}
+		if start {
+			d.flush(st)
+			st.rai = false
+		}
+		if start || st.pes != nil {
+			st.pes = append(st.pes, payload...)
+			st.rai = st.rai || rai
+		}
+	}
+	return nil
+}
+
+// sync reads the next packet, skipping garbage between packets
+func (d *Reader) sync() error {
+	for skipped := 0; ; skipped++ {
+		c, err := d.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if c != SyncByte {
+			if skipped > 1<<20 {
+				return ErrSync
+			}
+			continue
+		}
+		d.pkt[0] = c
+		_, err = io.ReadFull(d.r, d.pkt[1:])
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return err
+	}
+}
+
+// section returns the body of the psi section at the start of a payload,
+// after the pointer field and the 3 byte table header, and without the crc
+func section(p []byte) []byte {
+	if len(p) < 1 || int(p[0])+4 > len(p) {
+		return nil
+	}
+	p = p[1+int(p[0]):]
+	n := int(p[1]&0x0f)<<8 | int(p[2])
+	p = p[3:]
+	if n < 4 || n > len(p) {
+		return nil
+	}
+	return p[:n-4]
+}
+
+func (d *Reader) pat(p []byte) {
+	p = section(p)
+	if len(p) < 5 {
+		return
+	}
+	for p = p[5:]; len(p) >= 4; p = p[4:] {
+		program := int(p[0])<<8 | int(p[1])
+		if program != 0 {
+			d.pmt[int(p[2]&0x1f)<<8|int(p[3])] = true
+		}
+	}
+}
+
+// language returns the language in an ISO_639_language_descriptor
+// in the descriptors of an elementary stream, if there is one
+func language(desc []byte) string {
+	for len(desc) >= 2 {
+		tag, n := desc[0], int(desc[1])
+		if 2+n > len(desc) {
+			break
+		}
+		if tag == 0x0a && n >= 3 {
+			return string(desc[2:5])
+		}
+		desc = desc[2+n:]
+	}
+	return ""
+}
+
+func (d *Reader) pmtable(p []byte) {
+	p = section(p)
+	if len(p) < 9 {
+		return
+	}
+	info := int(p[7]&0x0f)<<8 | int(p[8])
+	if 9+info > len(p) {
+		return
+	}
+	used := map[*av.Track]bool{}
+	for p = p[9+info:]; len(p) >= 5; {
+		typ := int(p[0])
+		pid := int(p[1]&0x1f)<<8 | int(p[2])
+		n := int(p[3]&0x0f)<<8 | int(p[4])
+		if 5+n > len(p) {
+			break
+		}
+		desc := p[5 : 5+n]
+		p = p[5+n:]
+		if st := d.es[pid]; st != nil && st.typ == typ {
+			used[st.track] = true
+			continue
+		}
+		kind, codec := streamtype(typ)
+		if kind == 0 {
+			continue
+		}
+		// a new pid for a codec we already have (common across ad
+		// boundaries with different encoders) continues that track
+		var t *av.Track
+		for _, v := range d.tracks {
+			if v.Codec == codec && !used[v] {
+				t = v
+				break
+			}
+		}
+		if t == nil {
+			t = &av.Track{ID: len(d.tracks) + 1, Kind: kind, Codec: codec, Timescale: Clock}
+			d.tracks = append(d.tracks, t)
+		}
+		if lang := language(desc); lang != "" {
+			t.Lang = lang
+		}
+		used[t] = true
+		st := &stream{pid: pid, typ: typ, track: t, last: -1}
+		for _, old := range d.es {
+			if old.track == t {
+				// keep the clock history so the discontinuity
+				// logic sees the new pid as a continuation
+				st.last, st.dur, st.next = old.last, old.dur, old.next
+				st.vps, st.sps, st.pps = old.vps, old.sps, old.pps
+				d.flush(old)
+				st.held, old.held = old.held, nil
+				delete(d.es, old.pid)
+			}
+		}
+		d.es[pid] = st
+	}
+}
+
+func streamtype(typ int) (av.Kind, string) {
+	switch typ {
+	case TypeH264:
+		return av.Video, "h264"
+	case TypeH265:
+		return av.Video, "h265"
+	case TypeAAC:
+		return av.Audio, "aac"
+	}
+	return 0, ""
+}
+
+// flush converts the buffered pes packet into samples
+func (d *Reader) flush(st *stream) {
+	pes := st.pes
+	st.pes = nil
+	if len(pes) < 9 || pes[0] != 0 || pes[1] != 0 || pes[2] != 1 {
+		return
+	}
+	hlen := 9 + int(pes[8])
+	if hlen > len(pes) {
+		return
+	}
+	if n := int(pes[4])<<8 | int(pes[5]); n != 0 && 6+n < len(pes) {
+		pes = pes[:6+n]
+	}
+	pts, dts := int64(-1), int64(-1)
+	if pes[7]&0x80 != 0 && len(pes) >= 14 {
+		pts = timestamp(pes[9:])
+		dts = pts
+	}
+	if pes[7]&0x40 != 0 && len(pes) >= 19 {
+		dts = timestamp(pes[14:])
+	}
+	data := pes[hlen:]
+	if pts < 0 {
+		if st.last < 0 {
+			return
+		}
+		pts, dts = st.last+st.dur-d.offset, st.last+st.dur-d.offset
+	}
+	pts, dts = d.continuous(st, pts, dts)
+	switch st.track.Kind {
+	case av.Video:
+		d.video(st, pts, dts, data)
+	case av.Audio:
+		d.audio(st, pts, data)
+	}
+}
+
+// continuous applies the reader's clock offset to the timestamps and
+// adjusts it when the stream jumps, so every track in the reader moves
+// by the same amount and stays in sync
+func (d *Reader) continuous(st *stream, pts, dts int64) (int64, int64) {
+	pts += d.offset
+	dts += d.offset
+	if st.last >= 0 {
+		if delta := dts - st.last; delta < -MaxJump || delta > MaxJump {
+			fix := st.last + st.dur - dts
+			d.offset += fix
+			pts += fix
+			dts += fix
+		}
+	}
+	if st.last >= 0 && dts > st.last {
+		st.dur = dts - st.last
+	}
+	st.last = dts
+	return pts, dts
+}
+
+func timestamp(p []byte) int64 {
+	return int64(p[0]>>1&7)<<30 | int64(p[1])<<22 | int64(p[2]>>1)<<15 | int64(p[3])<<7 | int64(p[4]>>1)
+}
+
+func (d *Reader) video(st *stream, pts, dts int64, data []byte) {
+	t := st.track
+	key := st.rai
+	var nal [][]byte
+	for _, v := range av.SplitAnnexB(data) {
+		if len(v) == 0 {
+			continue
+		}
+		if t.Codec == "h264" {
+			switch v[0] & 0x1f {
+			case av.H264AUD:
+				continue
+			case av.H264SPS:
+				st.param(&st.sps, v)
+			case av.H264PPS:
+				st.param(&st.pps, v)
+			case av.H264IDR:
+				key = true
+			}
+		} else {
+			switch typ := av.HEVCType(v); {
+			case typ == av.HEVCAUD:
+				continue
+			case typ == av.HEVCVPS:
+				st.param(&st.vps, v)
+			case typ == av.HEVCSPS:
+				st.param(&st.sps, v)
+			case typ == av.HEVCPPS:
+				st.param(&st.pps, v)
+			case typ >= av.HEVCBLA && typ <= av.HEVCCRA:
+				key = true
+			}
+		}
+		nal = append(nal, v)
+	}
+	if len(nal) == 0 {
+		return
+	}
+	if t.Config == nil || key && st.changed {
+		// new parameter sets take effect at the next keyframe
+		if !key || !d.configure(st) && t.Config == nil {
+			return // undecodable until the first keyframe with parameters
+		}
+	}
+	d.release(st)
+	st.held = &av.Sample{
+		Track: t.ID,
+		DTS:   dts,
+		PTS:   pts,
+		Key:   key,
+		Data:  av.JoinAVCC(nal...),
+	}
+}
+
+// param stores a parameter set, noting if it's not the one the stream
+// had
+func (st *stream) param(p *[][]byte, v []byte) {
+	if len(*p) != 1 || !bytes.Equal((*p)[0], v) {
+		st.changed = true
+	}
+	*p = [][]byte{v}
+}
+
+// release outputs the held video sample. Its duration is the time to
+// the sample after it, or the last duration seen if there isn't one yet.
+func (d *Reader) release(st *stream) {
+	s := st.held
+	if s == nil {
+		return
+	}
+	st.held = nil
+	if st.last > s.DTS {
+		s.Dur = st.last - s.DTS
+	} else {
+		s.Dur = st.dur
+	}
+	d.out = append(d.out, *s)
+}
+
+func (d *Reader) configure(st *stream) bool {
+	t := st.track
+	var (
+		s   av.SPS
+		cfg []byte
+		err error
+	)
+	if len(st.sps) == 0 {
+		return false
+	}
+	if t.Codec == "h264" {
+		cfg, err = av.AVCConfig(st.sps, st.pps)
+		s, _ = av.ParseSPS(st.sps[0])
+	} else {
+		cfg, err = av.HEVCConfig(st.vps, st.sps, st.pps)
+		s, _ = av.ParseHEVCSPS(st.sps[0])
+	}
+	if err != nil {
+		return false
+	}
+	t.Config, st.changed = cfg, false
+	t.Width, t.Height = s.Width, s.Height
+	return true
+}
+
+func (d *Reader) audio(st *stream, pts int64, data []byte) {
+	t := st.track
+	for i := 0; len(data) > 0; i++ {
+		h, err := av.ParseADTS(data)
+		if err != nil || h.FrameLen > len(data) {
+			return
+		}
+		if t.Config == nil {
+			t.Config = h.Config()
+			t.SampleRate, t.Channels = h.SampleRate, h.Channels
+			t.Timescale = h.SampleRate
+		}
+		// the pes timestamp applies to the first frame, the rest follow
+		// it; keep to the running count unless the clock moved
+		dts := av.Rescale(pts, Clock, int64(t.Timescale)) + int64(i*av.AACFrameSize)
+		if diff := dts - st.next; st.next != 0 && diff > -av.AACFrameSize/2 && diff < av.AACFrameSize/2 {
+			dts = st.next
+		}
+		st.next = dts + av.AACFrameSize
+		d.out = append(d.out, av.Sample{
+			Track: t.ID,
+			DTS:   dts,
+			PTS:   dts,
+			Dur:   av.AACFrameSize,
+			Key:   true,
+			Data:  append([]byte{}, data[h.HeaderLen:h.FrameLen]...),
+		})
+		data = data[h.FrameLen:]
+	}
+}
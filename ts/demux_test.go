@@ -0,0 +1,147 @@
+package ts
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/as/hlscat/av"
+	"github.com/as/hlscat/mp4"
+)
+
+var (
+	sps640  = []byte{0x67, 0x42, 0x00, 0x1e, 0xf4, 0x05, 0x01, 0x7c, 0x80} // 640x368
+	sps1280 = []byte{0x67, 0x42, 0x00, 0x1e, 0xf4, 0x02, 0x80, 0x2d, 0xc8} // 1280x720
+	pps     = []byte{0x68, 0xce, 0x38, 0x80}
+)
+
+const frame = Clock / 25 // video frame duration
+
+// source returns a transport stream of n frames of h264 at 25fps, with a
+// keyframe every 10, and the aac audio at 48kHz that goes with them, and
+// the samples written to it. Keyframes from the one at change on carry
+// the 1280x720 parameter sets in-band.
+func source(t *testing.T, n, change int) ([]byte, []av.Sample) {
+	t.Helper()
+	cfg, err := av.AVCConfig([][]byte{sps640}, [][]byte{pps})
+	if err != nil {
+		t.Fatal(err)
+	}
+	video := &av.Track{ID: 1, Kind: av.Video, Codec: "h264", Timescale: Clock, Width: 640, Height: 368, Config: cfg}
+	audio := &av.Track{ID: 2, Kind: av.Audio, Codec: "aac", Timescale: 48000, SampleRate: 48000, Channels: 2, Config: av.AACConfig(2, 3, 2)}
+
+	var out bytes.Buffer
+	w := NewWriter(&out)
+	if err := w.WriteHeader(video, audio); err != nil {
+		t.Fatal(err)
+	}
+	var in []av.Sample
+	write := func(s av.Sample) {
+		in = append(in, s)
+		if err := w.WriteSample(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a := int64(0)
+	for i := 0; i < n; i++ {
+		dts := int64(i * frame)
+		for ; av.Rescale(a*av.AACFrameSize, 48000, Clock) < dts+frame; a++ {
+			write(av.Sample{Track: 2, DTS: a * av.AACFrameSize, PTS: a * av.AACFrameSize, Dur: av.AACFrameSize, Key: true, Data: []byte{0x21, byte(a), 0x40, 0x07}})
+		}
+		s := av.Sample{Track: 1, DTS: dts, PTS: dts + 2*frame, Dur: frame, Key: i%10 == 0}
+		nal := [][]byte{{0x41, 0x9a, byte(i)}}
+		if s.Key {
+			nal = [][]byte{{0x65, 0x88, byte(i)}}
+			if change > 0 && i >= change {
+				nal = append([][]byte{sps1280, pps}, nal...)
+			}
+		}
+		s.Data = av.JoinAVCC(nal...)
+		write(s)
+	}
+	return out.Bytes(), in
+}
+
+// samples reads every sample of d by track
+func samples(t *testing.T, d av.Demuxer) map[int][]av.Sample {
+	t.Helper()
+	m := map[int][]av.Sample{}
+	for {
+		s, err := d.ReadSample()
+		if err == io.EOF {
+			return m
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		m[s.Track] = append(m[s.Track], s)
+	}
+}
+
+func TestVideoDuration(t *testing.T) {
+	data, _ := source(t, 30, 0)
+	for i, s := range samples(t, NewReader(bytes.NewReader(data)))[1] {
+		if s.Dur != frame {
+			t.Fatalf("video sample %d: dur %d, want %d", i, s.Dur, frame)
+		}
+	}
+}
+
+func TestParameterChange(t *testing.T) {
+	data, _ := source(t, 30, 10)
+	d := NewReader(bytes.NewReader(data))
+	for {
+		s, err := d.ReadSample()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Track == 1 {
+			break
+		}
+	}
+	v := d.Tracks()[0]
+	if v.Width != 640 || v.Height != 368 {
+		t.Fatalf("first size %dx%d, want 640x368", v.Width, v.Height)
+	}
+	got := samples(t, d)[1]
+	if len(got) != 29 {
+		t.Fatalf("read %d more video samples, want 29", len(got))
+	}
+	if v.Width != 1280 || v.Height != 720 {
+		t.Fatalf("size after the change %dx%d, want 1280x720", v.Width, v.Height)
+	}
+	sps, _, err := av.AVCParams(v.Config)
+	if err != nil || len(sps) != 1 || !bytes.Equal(sps[0], sps1280) {
+		t.Fatalf("config sps %x, %v, want %x", sps, err, sps1280)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	data, in := source(t, 50, 0)
+	var fmp4 bytes.Buffer
+	mw := mp4.NewWriter(&fmp4)
+	mw.FragDur = 0
+	if err := av.Copy(mw, NewReader(bytes.NewReader(data))); err != nil {
+		t.Fatal(err)
+	}
+	want := map[int][]av.Sample{}
+	for _, s := range in {
+		want[s.Track] = append(want[s.Track], s)
+	}
+	got := samples(t, mp4.NewReader(&fmp4))
+	for id, w := range want {
+		g := got[id]
+		if len(g) != len(w) {
+			t.Fatalf("track %d: %d samples, want %d", id, len(g), len(w))
+		}
+		for i := range w {
+			if g[i].DTS != w[i].DTS || g[i].PTS != w[i].PTS || g[i].Key != w[i].Key {
+				t.Fatalf("track %d sample %d: dts=%d pts=%d key=%v, want dts=%d pts=%d key=%v",
+					id, i, g[i].DTS, g[i].PTS, g[i].Key, w[i].DTS, w[i].PTS, w[i].Key)
+			}
+			if !bytes.Equal(g[i].Data, w[i].Data) && id == 2 {
+				t.Fatalf("audio sample %d: data %x, want %x", i, g[i].Data, w[i].Data)
+			}
+		}
+	}
+}
@@ -0,0 +1,332 @@
+package ts
+
+import (
+	"errors"
+	"io"
+
+	"github.com/as/hlscat/av"
+)
+
+var ErrCodec = errors.New("ts: unsupported codec")
+
+const (
+	pmtPID   = 0x1000
+	firstPID = 0x100
+)
+
+// Writer is an av.Muxer that writes an mpeg transport stream. Program
+// tables are repeated before every video keyframe, and video access units
+// carry their parameter sets in-band so each keyframe is a valid entry point.
+type Writer struct {
+	w      io.Writer
+	tracks []*av.Track
+	pid    map[int]int // track id to pid
+	pcr    int         // track id that carries the pcr
+	params map[int][][]byte
+	cc     map[int]byte
+	buf    []byte
+	cut    bool // repeat the tables before the next sample
+}
+
+// NewWriter returns a Writer that writes to w
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{
+		w:      w,
+		pid:    map[int]int{},
+		params: map[int][][]byte{},
+		cc:     map[int]byte{},
+	}
+}
+
+// WriteHeader writes the program tables for the given tracks. Text
+// tracks are dropped, mpeg ts has no place for WebVTT.
+func (w *Writer) WriteHeader(tracks ...*av.Track) error {
+	for _, t := range tracks {
+		if t.Kind == av.Text {
+			continue
+		}
+		if streamid(t) == 0 {
+			return ErrCodec
+		}
+		w.pid[t.ID] = firstPID + len(w.tracks)
+		w.tracks = append(w.tracks, t)
+		w.params[t.ID] = t.Params()
+		if w.pcr == 0 || t.Kind == av.Video && w.kind(w.pcr) != av.Video {
+			w.pcr = t.ID
+		}
+	}
+	w.tables()
+	return w.flush()
+}
+
+func (w *Writer) kind(id int) av.Kind {
+	for _, t := range w.tracks {
+		if t.ID == id {
+			return t.Kind
+		}
+	}
+	return 0
+}
+
+func streamid(t *av.Track) (typ byte) {
+	switch t.Codec {
+	case "h264":
+		return TypeH264
+	case "h265":
+		return TypeH265
+	case "aac":
+		return TypeAAC
+	}
+	return 0
+}
+
+// tables buffers a pat and pmt
+func (w *Writer) tables() {
+	pat := []byte{0, 1, 0xc1, 0, 0, 0, 1, 0xe0 | pmtPID>>8, pmtPID & 0xff}
+	w.psi(0, 0, pat)
+
+	pcr := w.pid[w.pcr]
+	pmt := []byte{0, 1, 0xc1, 0, 0, 0xe0 | byte(pcr>>8), byte(pcr), 0xf0, 0}
+	for _, t := range w.tracks {
+		pid := w.pid[t.ID]
+		var desc []byte
+		if t.Kind == av.Audio && t.Lang != "" {
+			// ISO_639_language_descriptor
+			desc = append([]byte{0x0a, 4}, av.Lang3(t.Lang)...)
+			desc = append(desc, 0)
+		}
+		pmt = append(pmt, streamid(t), 0xe0|byte(pid>>8), byte(pid), 0xf0, byte(len(desc)))
+		pmt = append(pmt, desc...)
+	}
+	w.psi(pmtPID, 2, pmt)
+}
+
+// psi buffers a single packet psi section
+func (w *Writer) psi(pid int, table byte, body []byte) {
+	n := len(body) + 4
+	sec := []byte{table, 0xb0 | byte(n>>8), byte(n)}
+	sec = append(sec, body...)
+	c := CRC32(sec)
+	sec = append(sec, byte(c>>24), byte(c>>16), byte(c>>8), byte(c))
+	p := w.header(pid, true, false)
+	p = append(p, 0) // pointer_field
+	p = append(p, sec...)
+	for len(p) < PacketSize {
+		p = append(p, 0xff)
+	}
+	w.buf = append(w.buf, p...)
+}
+
+func (w *Writer) header(pid int, start, adapt bool) []byte {
+	b := []byte{SyncByte, byte(pid >> 8 & 0x1f), byte(pid), 0x10 | w.cc[pid]}
+	if start {
+		b[1] |= 0x40
+	}
+	if adapt {
+		b[3] |= 0x20
+	}
+	w.cc[pid] = (w.cc[pid] + 1) & 0xf
+	return b
+}
+
+// WriteSample writes one sample as a pes packet
+func (w *Writer) WriteSample(s av.Sample) error {
+	var t *av.Track
+	for _, v := range w.tracks {
+		if v.ID == s.Track {
+			t = v
+		}
+	}
+	if t == nil {
+		return nil
+	}
+	pts := av.Rescale(s.PTS, int64(t.Timescale), Clock)
+	dts := av.Rescale(s.DTS, int64(t.Timescale), Clock)
+	var data []byte
+	if w.cut && !(t.Kind == av.Video && s.Key) {
+		w.tables()
+	}
+	w.cut = false
+	switch t.Kind {
+	case av.Video:
+		if s.Key {
+			w.tables()
+		}
+		data = w.annexb(t, s)
+	case av.Audio:
+		data = adts(t, s.Data)
+	}
+	w.pes(t, s.Key, pts, dts, data)
+	return w.flush()
+}
+
+// annexb converts length-prefixed NAL units to start code delimited ones,
+// adding an access unit delimiter and, for keyframes without them, the
+// track's parameter sets
+func (w *Writer) annexb(t *av.Track, s av.Sample) []byte {
+	nal := av.SplitAVCC(s.Data)
+	aud := []byte{av.H264AUD, 0xf0}
+	if t.Codec == "h265" {
+		aud = []byte{av.HEVCAUD << 1, 1, 0x50}
+	}
+	out := [][]byte{aud}
+	if s.Key && !hasparams(t.Codec, nal) {
+		out = append(out, w.params[t.ID]...)
+	}
+	return av.JoinAnnexB(append(out, nal...)...)
+}
+
+func hasparams(codec string, nal [][]byte) bool {
+	for _, v := range nal {
+		if len(v) == 0 {
+			continue
+		}
+		if codec == "h264" && v[0]&0x1f == av.H264SPS || codec == "h265" && av.HEVCType(v) == av.HEVCSPS {
+			return true
+		}
+	}
+	return false
+}
+
+// adts prefixes a raw aac frame with an adts header
+func adts(t *av.Track, frame []byte) []byte {
+	obj, rate, ch, _ := av.ParseAACConfig(t.Config)
+	ri := 0
+	for i, v := range av.SampleRates {
+		if v == rate {
+			ri = i
+		}
+	}
+	n := len(frame) + 7
+	h := []byte{
+		0xff, 0xf1,
+		byte((obj-1)<<6 | ri<<2 | ch>>2),
+		byte(ch<<6 | n>>11),
+		byte(n >> 3),
+		byte(n<<5 | 0x1f),
+		0xfc,
+	}
+	return append(h, frame...)
+}
+
+func (w *Writer) pes(t *av.Track, key bool, pts, dts int64, data []byte) {
+	sid := byte(0xe0)
+	if t.Kind == av.Audio {
+		sid = 0xc0
+	}
+	h := []byte{0, 0, 1, sid, 0, 0, 0x80, 0x80, 5}
+	h = append(h, stamp(0x20, pts)...)
+	if dts != pts {
+		h[7], h[8] = 0xc0, 10
+		h[9] |= 0x10
+		h = append(h, stamp(0x10, dts)...)
+	}
+	if n := len(h) - 6 + len(data); t.Kind != av.Video && n <= 0xffff {
+		h[4], h[5] = byte(n>>8), byte(n)
+	}
+	payload := append(h, data...)
+	pid := w.pid[t.ID]
+	for first := true; len(payload) > 0; first = false {
+		var af []byte
+		if first && (t.ID == w.pcr || key) {
+			af = []byte{0}
+			if key {
+				af[0] |= 0x40
+			}
+			if t.ID == w.pcr {
+				af[0] |= 0x10
+				af = append(af, pcr(dts)...)
+			}
+		}
+		space := PacketSize - 4
+		if af != nil {
+			space -= 1 + len(af)
+		}
+		if len(payload) < space {
+			// stuff the adaptation field to fill the packet
+			if af == nil {
+				af = []byte{}
+				space--
+			}
+			if pad := space - len(payload); pad > 0 {
+				if len(af) == 0 {
+					af = append(af, 0)
+					pad--
+				}
+				for ; pad > 0; pad-- {
+					af = append(af, 0xff)
+				}
+			}
+		}
+		p := w.header(pid, first, af != nil)
+		if af != nil {
+			p = append(p, byte(len(af)))
+			p = append(p, af...)
+		}
+		n := PacketSize - len(p)
+		if n > len(payload) {
+			n = len(payload)
+		}
+		p = append(p, payload[:n]...)
+		payload = payload[n:]
+		w.buf = append(w.buf, p...)
+	}
+}
+
+func stamp(prefix byte, t int64) []byte {
+	t &= 1<<33 - 1
+	return []byte{
+		prefix | byte(t>>29)&0x0e | 1,
+		byte(t >> 22),
+		byte(t>>14) | 1,
+		byte(t >> 7),
+		byte(t<<1) | 1,
+	}
+}
+
+func pcr(t int64) []byte {
+	t &= 1<<33 - 1
+	return []byte{byte(t >> 25), byte(t >> 17), byte(t >> 9), byte(t >> 1), byte(t<<7) | 0x7e, 0}
+}
+
+func (w *Writer) flush() error {
+	_, err := w.w.Write(w.buf)
+	w.buf = w.buf[:0]
+	return err
+}
+
+// Cut repeats the program tables before the next sample, so the stream
+// can be split there
+func (w *Writer) Cut() error {
+	w.cut = true
+	return nil
+}
+
+// Close does nothing, every sample is written immediately
+func (w *Writer) Close() error {
+	return nil
+}
+
+var crctab = func() (t [256]uint32) {
+	for i := range t {
+		c := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if c&0x80000000 != 0 {
+				c = c<<1 ^ 0x04c11db7
+			} else {
+				c <<= 1
+			}
+		}
+		t[i] = c
+	}
+	return t
+}()
+
+// CRC32 is the mpeg-2 crc used by psi sections
+func CRC32(b []byte) uint32 {
+	c := uint32(0xffffffff)
+	for _, v := range b {
+		c = c<<8 ^ crctab[byte(c>>24)^v]
+	}
+	return c
+}
@@ -0,0 +1,370 @@
+// Package vtt reads WebVTT subtitles, such as the concatenated segments
+// of an hls subtitle rendition, as a text track
+package vtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/as/hlscat/av"
+)
+
+var (
+	ErrTime    = errors.New("vtt: bad timestamp")
+	ErrTimeMap = errors.New("vtt: bad X-TIMESTAMP-MAP")
+)
+
+// Timescale is the timescale of the track, in milliseconds
+const Timescale = 1000
+
+// Cue is one cue of a WebVTT file. Times are in milliseconds.
+type Cue struct {
+	ID         string
+	Start, End int64
+	Settings   string
+	Text       string
+}
+
+// Reader is an av.Demuxer for WebVTT. Cues are turned into samples that
+// cover the timeline from its origin without gaps or overlaps, as in mp4:
+// a sample holds every cue shown for its duration, or is empty. A WEBVTT
+// line begins the next file, and cues repeated from the file before it
+// are only shown once. The samples up to the first new cue of a file
+// are known once it's read.
+//
+// A file with an X-TIMESTAMP-MAP header has its cue times moved to the
+// MPEG-TS clock of the media it belongs to, in milliseconds, and the
+// timeline starts at the MPEG-TS time of the first file's map. Without
+// one, cue times are kept and the timeline starts at zero.
+type Reader struct {
+	br      *bufio.Reader
+	line    string   // a line that was read too far
+	header  []string // the header of the next file
+	track   *av.Track
+	prev    []Cue // the cues of the last file
+	cues    []Cue // of the file being read by ReadCue
+	pending []Cue // cues that haven't ended by t
+	queue   []av.Sample
+	t       int64 // end of the last sample
+	err     error
+
+	mapped bool  // whether a file had a timestamp map
+	shift  int64 // added to cue times, from the map
+	mpeg   int64 // the map's MPEGTS time, unwrapped
+	origin int64
+}
+
+// NewReader returns a Reader that reads from r
+func NewReader(r io.Reader) *Reader {
+	return &Reader{
+		br: bufio.NewReader(r),
+		track: &av.Track{
+			ID:        1,
+			Kind:      av.Text,
+			Codec:     "wvtt",
+			Timescale: Timescale,
+			Config:    []byte("WEBVTT"),
+		},
+	}
+}
+
+func (r *Reader) Tracks() []*av.Track {
+	return []*av.Track{r.track}
+}
+
+// Origin returns where the timeline starts, in milliseconds
+func (r *Reader) Origin() int64 {
+	return r.origin
+}
+
+// ReadCue returns the next cue. Cues are returned in the order of their
+// files, with their times on the timeline. ReadCue and ReadSample each
+// consume the input, so only one of them should be used.
+func (r *Reader) ReadCue() (Cue, error) {
+	for len(r.cues) == 0 {
+		if r.err != nil {
+			return Cue{}, r.err
+		}
+		r.cues, r.err = r.file()
+	}
+	c := r.cues[0]
+	r.cues = r.cues[1:]
+	return c, nil
+}
+
+func (r *Reader) ReadSample() (av.Sample, error) {
+	for len(r.queue) == 0 {
+		if r.err != nil {
+			return av.Sample{}, r.err
+		}
+		var cues []Cue
+		cues, r.err = r.file()
+		first, ok := r.add(cues)
+		if r.err != nil {
+			r.samples(r.end())
+		} else if ok {
+			r.samples(first)
+		}
+	}
+	s := r.queue[0]
+	r.queue = r.queue[1:]
+	return s, nil
+}
+
+// add adds cues to the pending cues, and returns the first start time
+// among them
+func (r *Reader) add(cues []Cue) (first int64, ok bool) {
+	for _, c := range cues {
+		if c.End <= r.t {
+			continue
+		}
+		if !ok || c.Start < first {
+			first, ok = c.Start, true
+		}
+		r.pending = append(r.pending, c)
+	}
+	return first, ok
+}
+
+// end returns the time the last pending cue ends
+func (r *Reader) end() (t int64) {
+	for _, c := range r.pending {
+		t = max(t, c.End)
+	}
+	return t
+}
+
+// file reads the new cues of the next file
+func (r *Reader) file() (cues []Cue, err error) {
+	var all []Cue
+	defer func() {
+		r.prev = all
+	}()
+	for {
+		block, err := r.block()
+		if len(block) > 0 {
+			switch {
+			case strings.HasPrefix(block[0], "WEBVTT"):
+				if len(all) > 0 {
+					// the header of the next file
+					r.header = block
+					return cues, nil
+				}
+				if err := r.timemap(block[1:]); err != nil {
+					return cues, err
+				}
+			case strings.HasPrefix(block[0], "NOTE"), block[0] == "STYLE", block[0] == "REGION":
+			default:
+				c, ok, cerr := parseCue(block)
+				if cerr != nil {
+					return cues, cerr
+				}
+				if !ok {
+					break
+				}
+				c.Start += r.shift
+				c.End += r.shift
+				all = append(all, c)
+				if !slices.Contains(r.prev, c) {
+					cues = append(cues, c)
+				}
+			}
+		}
+		if err != nil {
+			return cues, err
+		}
+	}
+}
+
+// timemap sets the shift of the file's cue times from the
+// X-TIMESTAMP-MAP in its header, if it has one. The first map sets the
+// origin of the timeline.
+func (r *Reader) timemap(header []string) error {
+	for _, line := range header {
+		v, ok := strings.CutPrefix(line, "X-TIMESTAMP-MAP=")
+		if !ok {
+			continue
+		}
+		var local, mpeg int64
+		var err error
+		for _, kv := range strings.Split(v, ",") {
+			k, v, _ := strings.Cut(strings.TrimSpace(kv), ":")
+			switch k {
+			case "LOCAL":
+				local, err = ParseTime(v)
+			case "MPEGTS":
+				mpeg, err = strconv.ParseInt(v, 10, 64)
+			}
+			if err != nil {
+				return ErrTimeMap
+			}
+		}
+		if r.mapped {
+			mpeg = unwrap(mpeg, r.mpeg)
+		}
+		r.mpeg = mpeg
+		r.shift = (mpeg+45)/90 - local
+		if !r.mapped && r.t == 0 {
+			r.origin = (mpeg + 45) / 90
+			r.t = r.origin
+		}
+		r.mapped = true
+	}
+	return nil
+}
+
+// unwrap returns the 33 bit MPEG-TS time t nearest to the time near
+func unwrap(t, near int64) int64 {
+	const wrap = 1 << 33
+	t += near - near%wrap
+	switch {
+	case t-near > wrap/2:
+		t -= wrap
+	case near-t > wrap/2:
+		t += wrap
+	}
+	return t
+}
+
+// block reads the lines up to the next blank line. Segments don't
+// always end with one, so a WEBVTT line also starts a new block.
+func (r *Reader) block() (lines []string, err error) {
+	if r.header != nil {
+		lines, r.header = r.header, nil
+		return lines, nil
+	}
+	if r.line != "" {
+		lines, r.line = []string{r.line}, ""
+	}
+	for {
+		line, err := r.br.ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+		line = strings.TrimPrefix(line, "\ufeff") // byte order mark
+		if strings.HasPrefix(line, "WEBVTT") && len(lines) > 0 {
+			r.line = line
+			return lines, err
+		}
+		if line != "" {
+			lines = append(lines, line)
+		} else if len(lines) > 0 && err == nil {
+			return lines, nil
+		}
+		if err != nil {
+			return lines, err
+		}
+	}
+}
+
+// parseCue parses a cue block. Blocks without a timing line are ignored.
+func parseCue(block []string) (c Cue, ok bool, err error) {
+	if !strings.Contains(block[0], "-->") {
+		if len(block) < 2 || !strings.Contains(block[1], "-->") {
+			return c, false, nil
+		}
+		c.ID, block = block[0], block[1:]
+	}
+	start, rest, _ := strings.Cut(block[0], "-->")
+	rest = strings.TrimSpace(rest)
+	end, settings, _ := strings.Cut(rest, " ")
+	if c.Start, err = ParseTime(strings.TrimSpace(start)); err != nil {
+		return c, false, err
+	}
+	if c.End, err = ParseTime(end); err != nil {
+		return c, false, err
+	}
+	c.Settings = strings.TrimSpace(settings)
+	c.Text = strings.Join(block[1:], "\n")
+	return c, true, nil
+}
+
+// ParseTime parses a WebVTT timestamp, hh:mm:ss.ttt or mm:ss.ttt, into
+// milliseconds
+func ParseTime(s string) (int64, error) {
+	hms, frac, ok := strings.Cut(s, ".")
+	if !ok || len(frac) != 3 {
+		return 0, ErrTime
+	}
+	ms, err := strconv.ParseInt(frac, 10, 64)
+	if err != nil {
+		return 0, ErrTime
+	}
+	f := strings.Split(hms, ":")
+	if len(f) < 2 || len(f) > 3 {
+		return 0, ErrTime
+	}
+	var t int64
+	for _, v := range f {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return 0, ErrTime
+		}
+		t = t*60 + n
+	}
+	return t*1000 + ms, nil
+}
+
+// samples queues the samples of the pending cues up to end
+func (r *Reader) samples(end int64) {
+	at := []int64{end}
+	for _, c := range r.pending {
+		for _, t := range []int64{c.Start, c.End} {
+			if t > r.t && t < end {
+				at = append(at, t)
+			}
+		}
+	}
+	sort.Slice(at, func(i, j int) bool { return at[i] < at[j] })
+	for _, t := range at {
+		if t <= r.t {
+			continue
+		}
+		var data []byte
+		for _, c := range r.pending {
+			if c.Start <= r.t && c.End >= t {
+				data = append(data, cuebox(c)...)
+			}
+		}
+		if data == nil {
+			data = box("vtte", nil)
+		}
+		if n := len(r.queue); n > 0 && string(data) == string(r.queue[n-1].Data) {
+			r.queue[n-1].Dur += t - r.t
+		} else {
+			r.queue = append(r.queue, av.Sample{Track: r.track.ID, DTS: r.t, PTS: r.t, Dur: t - r.t, Key: true, Data: data})
+		}
+		r.t = t
+	}
+	live := r.pending[:0]
+	for _, c := range r.pending {
+		if c.End > r.t {
+			live = append(live, c)
+		}
+	}
+	r.pending = live
+}
+
+// cuebox returns the vttc box for a cue
+func cuebox(c Cue) []byte {
+	var b []byte
+	if c.ID != "" {
+		b = append(b, box("iden", []byte(c.ID))...)
+	}
+	if c.Settings != "" {
+		b = append(b, box("sttg", []byte(c.Settings))...)
+	}
+	b = append(b, box("payl", []byte(c.Text))...)
+	return box("vttc", b)
+}
+
+func box(typ string, body []byte) []byte {
+	b := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(b, uint32(8+len(body)))
+	copy(b[4:], typ)
+	return append(b, body...)
+}
@@ -0,0 +1,118 @@
+package vtt
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+// readCues reads every cue in s
+func readCues(t *testing.T, s string) (*Reader, string) {
+	t.Helper()
+	r := NewReader(strings.NewReader(s))
+	var cues []string
+	for {
+		c, err := r.ReadCue()
+		if err == io.EOF {
+			return r, strings.Join(cues, "; ")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		cues = append(cues, fmt.Sprintf("%d-%d %q", c.Start, c.End, c.Text))
+	}
+}
+
+func TestReadCue(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		in     string
+		origin int64
+		want   string
+	}{
+		{
+			name: "unmapped",
+			in:   "WEBVTT\n\n00:01.000 --> 00:02.500\none\n\n1:00:00.000 --> 1:00:01.000 align:start\ntwo\nlines\n",
+			want: `1000-2500 "one"; 3600000-3601000 "two\nlines"`,
+		},
+		{
+			name:   "mapped",
+			in:     "WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:900000,LOCAL:00:00:01.000\n\n00:00:01.500 --> 00:00:02.000\none\n",
+			origin: 10000,
+			want:   `10500-11000 "one"`,
+		},
+		{
+			// the second segment repeats the cue that spans them, and
+			// starts without a blank line after the first
+			name:   "segments",
+			in:     "\ufeffWEBVTT\r\nX-TIMESTAMP-MAP=LOCAL:00:00:00.000,MPEGTS:180000\r\n\r\nid\r\n00:00:01.000 --> 00:00:03.000\r\nspans\r\nWEBVTT\nX-TIMESTAMP-MAP=MPEGTS:180000,LOCAL:00:00:00.000\n\nNOTE a comment\n\nid\n00:00:01.000 --> 00:00:03.000\nspans\n\n00:00:03.000 --> 00:00:04.000\nnext\n",
+			origin: 2000,
+			want:   `3000-5000 "spans"; 5000-6000 "next"`,
+		},
+		{
+			// the clock wraps between the segments
+			name:   "wrap",
+			in:     "WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:8589844592,LOCAL:00:00:00.000\n\n00:00:00.000 --> 00:00:00.500\nbefore\n\nWEBVTT\nX-TIMESTAMP-MAP=MPEGTS:90000,LOCAL:00:00:00.000\n\n00:00:00.000 --> 00:00:00.500\nafter\n",
+			origin: 95442718,
+			want:   `95442718-95443218 "before"; 95444718-95445218 "after"`,
+		},
+	} {
+		r, got := readCues(t, tc.in)
+		if got != tc.want || r.Origin() != tc.origin {
+			t.Errorf("%s: %s from %d\nwant: %s from %d", tc.name, got, r.Origin(), tc.want, tc.origin)
+		}
+	}
+}
+
+func TestReadCueErrors(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want error
+	}{
+		{"WEBVTT\n\n00:01 --> 00:02.000\nno milliseconds\n", ErrTime},
+		{"WEBVTT\n\n00:00:01.000 --> 1:2:3:4.000\ntoo many fields\n", ErrTime},
+		{"WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:abc,LOCAL:00:00:00.000\n\n00:00:01.000 --> 00:00:02.000\nx\n", ErrTimeMap},
+	} {
+		r := NewReader(strings.NewReader(tc.in))
+		var err error
+		for err == nil {
+			_, err = r.ReadCue()
+		}
+		if !errors.Is(err, tc.want) {
+			t.Errorf("%q: %v, want %v", tc.in, err, tc.want)
+		}
+	}
+}
+
+func TestReadSample(t *testing.T) {
+	// overlapping cues, a gap, and a cue repeated by the next segment
+	in := "WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:90000,LOCAL:00:00:00.000\n\n00:00:00.000 --> 00:00:02.000\na\n\n00:00:01.000 --> 00:00:03.000\nb\n\n" +
+		"WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:90000,LOCAL:00:00:00.000\n\n00:00:01.000 --> 00:00:03.000\nb\n\n00:00:04.000 --> 00:00:05.000\nc\n"
+	r := NewReader(strings.NewReader(in))
+	var got []string
+	for {
+		s, err := r.ReadSample()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		var text []string
+		for _, c := range []string{"a", "b", "c"} {
+			if strings.Contains(string(s.Data), "payl"+c) {
+				text = append(text, c)
+			}
+		}
+		if strings.Contains(string(s.Data), "vtte") {
+			text = append(text, "empty")
+		}
+		got = append(got, fmt.Sprintf("%d+%d %s", s.DTS, s.Dur, strings.Join(text, ",")))
+	}
+	want := "1000+1000 a; 2000+1000 a,b; 3000+1000 b; 4000+1000 empty; 5000+1000 c"
+	if g := strings.Join(got, "; "); g != want {
+		t.Errorf("samples: %s\nwant: %s", g, want)
+	}
+}
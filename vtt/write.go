@@ -0,0 +1,106 @@
+package vtt
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Writer writes cues as a WebVTT file, or as a SubRip (srt) file
+type Writer struct {
+	// Header holds the lines written after the WEBVTT line of a WebVTT
+	// file, such as the X-TIMESTAMP-MAP of an hls segment
+	Header []string
+
+	w   io.Writer
+	srt bool
+	n   int // cues written
+}
+
+// NewWriter returns a Writer that writes WebVTT to w
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// NewSRTWriter returns a Writer that writes SubRip to w. Cue settings
+// are dropped, and so are the tags SubRip doesn't have.
+func NewSRTWriter(w io.Writer) *Writer {
+	return &Writer{w: w, srt: true}
+}
+
+// WriteCue writes the cue. Times before zero are clamped to it.
+func (w *Writer) WriteCue(c Cue) error {
+	c.Start, c.End = max(c.Start, 0), max(c.End, 0)
+	var err error
+	if w.srt {
+		_, err = fmt.Fprintf(w.w, "%d\n%s --> %s\n%s\n\n", w.n+1, FormatTime(c.Start, ','), FormatTime(c.End, ','), srtText(c.Text))
+	} else {
+		if w.n == 0 {
+			if err = w.header(); err != nil {
+				return err
+			}
+		}
+		if c.ID != "" {
+			if _, err = fmt.Fprintf(w.w, "%s\n", c.ID); err != nil {
+				return err
+			}
+		}
+		timing := FormatTime(c.Start, '.') + " --> " + FormatTime(c.End, '.')
+		if c.Settings != "" {
+			timing += " " + c.Settings
+		}
+		_, err = fmt.Fprintf(w.w, "%s\n%s\n\n", timing, c.Text)
+	}
+	w.n++
+	return err
+}
+
+// Close writes the header of a WebVTT file without cues. It doesn't
+// close the underlying writer.
+func (w *Writer) Close() error {
+	if w.srt || w.n > 0 {
+		return nil
+	}
+	return w.header()
+}
+
+func (w *Writer) header() error {
+	h := "WEBVTT\n"
+	for _, line := range w.Header {
+		h += line + "\n"
+	}
+	_, err := io.WriteString(w.w, h+"\n")
+	return err
+}
+
+// FormatTime formats milliseconds as hh:mm:ss.ttt, with sep before the
+// milliseconds: '.' for WebVTT and ',' for SubRip
+func FormatTime(ms int64, sep byte) string {
+	return fmt.Sprintf("%02d:%02d:%02d%c%03d", ms/3600000, ms/60000%60, ms/1000%60, sep, ms%1000)
+}
+
+// srtText returns the cue text with the tags SubRip doesn't have
+// removed and the character references WebVTT needs replaced
+func srtText(s string) string {
+	var b strings.Builder
+	for {
+		i := strings.IndexByte(s, '<')
+		if i < 0 {
+			break
+		}
+		j := strings.IndexByte(s[i:], '>')
+		if j < 0 {
+			break
+		}
+		b.WriteString(s[:i])
+		switch tag := s[i : i+j+1]; tag {
+		case "<i>", "</i>", "<b>", "</b>", "<u>", "</u>":
+			b.WriteString(tag)
+		}
+		s = s[i+j+1:]
+	}
+	b.WriteString(s)
+	return entities.Replace(b.String())
+}
+
+var entities = strings.NewReplacer("&amp;", "&", "&lt;", "<", "&gt;", ">", "&nbsp;", " ", "&lrm;", "‎", "&rlm;", "‏")
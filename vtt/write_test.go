@@ -0,0 +1,57 @@
+package vtt
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWriter(t *testing.T) {
+	cues := []Cue{
+		{Start: -500, End: 1000, Text: "clamped"},
+		{ID: "2", Start: 3723004, End: 3724000, Settings: "line:0 align:start", Text: "<v Bob><i>hi</i> &amp; <c.loud>bye</c>&nbsp;now</v>"},
+	}
+	for _, tc := range []struct {
+		name string
+		w    func(*strings.Builder) *Writer
+		want string
+	}{
+		{
+			"vtt",
+			func(b *strings.Builder) *Writer {
+				w := NewWriter(b)
+				w.Header = []string{"X-TIMESTAMP-MAP=MPEGTS:0,LOCAL:00:00:00.000"}
+				return w
+			},
+			"WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:0,LOCAL:00:00:00.000\n\n" +
+				"00:00:00.000 --> 00:00:01.000\nclamped\n\n" +
+				"2\n01:02:03.004 --> 01:02:04.000 line:0 align:start\n<v Bob><i>hi</i> &amp; <c.loud>bye</c>&nbsp;now</v>\n\n",
+		},
+		{
+			// without the settings, ids, and tags other than i, b and u
+			"srt",
+			func(b *strings.Builder) *Writer { return NewSRTWriter(b) },
+			"1\n00:00:00,000 --> 00:00:01,000\nclamped\n\n" +
+				"2\n01:02:03,004 --> 01:02:04,000\n<i>hi</i> & bye\u00a0now\n\n",
+		},
+	} {
+		var b strings.Builder
+		w := tc.w(&b)
+		for _, c := range cues {
+			if err := w.WriteCue(c); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != tc.want {
+			t.Errorf("%s:\n%s\nwant:\n%s", tc.name, b.String(), tc.want)
+		}
+	}
+
+	// a file without cues still has its header
+	var b strings.Builder
+	if err := NewWriter(&b).Close(); err != nil || b.String() != "WEBVTT\n\n" {
+		t.Errorf("empty: %q, %v", b.String(), err)
+	}
+}